@@ -0,0 +1,321 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/ircv3"
+)
+
+// ChannelState tracks the channels we're in. We learn about them from the IRC
+// messages we see: who is in them, their topics, and their modes.
+type ChannelState struct {
+	mutex sync.Mutex
+
+	// Our nick.
+	nick string
+
+	// Channels we're in, keyed by lowercased name.
+	channels map[string]*Channel
+}
+
+// Channel holds what we know about a channel.
+type Channel struct {
+	Name string
+
+	Topic      string
+	TopicSetBy string
+	TopicSetAt int64
+
+	// Channel modes that are set, e.g. "nt". We don't track modes that apply to
+	// members such as +o, or lists such as +b.
+	Modes string
+
+	// When the channel was created (from RPL_CREATIONTIME). 0 if we don't know.
+	Created int64
+
+	// Nicks in the channel, keyed by lowercased nick.
+	Members map[string]string
+
+	// While the server sends us RPL_NAMREPLY we collect the nicks here. When it
+	// says it's done (RPL_ENDOFNAMES) we replace Members with them.
+	pendingNames map[string]string
+}
+
+// Numerics we use to track channel state.
+const (
+	replyChannelModeIs = "324"
+	replyCreationTime  = "329"
+	replyTopic         = "332"
+	replyTopicWhoTime  = "333"
+	replyNamReply      = "353"
+	replyEndOfNames    = "366"
+)
+
+// Channel modes that apply to members (e.g. +o nick) or lists (e.g. +b mask).
+// We don't track these as modes of the channel.
+const (
+	memberModes = "qaohv"
+	listModes   = "beI"
+)
+
+// nickPrefixChars are the characters that may prefix nicks in RPL_NAMREPLY,
+// e.g. @ for channel operators.
+const nickPrefixChars = "~&@%+"
+
+// NewChannelState creates a ChannelState. nick is our nick.
+func NewChannelState(nick string) *ChannelState {
+	return &ChannelState{
+		nick:     nick,
+		channels: map[string]*Channel{},
+	}
+}
+
+// Update updates our state from a message we read from the server.
+func (c *ChannelState) Update(m ircv3.Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch m.Command {
+	case "JOIN":
+		if len(m.Params) < 1 {
+			return
+		}
+		for _, name := range strings.Split(m.Params[0], ",") {
+			c.join(name, m.SourceNick())
+		}
+	case "PART":
+		if len(m.Params) < 1 {
+			return
+		}
+		for _, name := range strings.Split(m.Params[0], ",") {
+			c.part(name, m.SourceNick())
+		}
+	case "KICK":
+		if len(m.Params) < 2 {
+			return
+		}
+		c.part(m.Params[0], m.Params[1])
+	case "QUIT":
+		for _, channel := range c.channels {
+			delete(channel.Members, strings.ToLower(m.SourceNick()))
+		}
+	case "NICK":
+		if len(m.Params) < 1 {
+			return
+		}
+		c.nickChange(m.SourceNick(), m.Params[0])
+	case "TOPIC":
+		if len(m.Params) < 2 {
+			return
+		}
+		if channel, ok := c.channels[strings.ToLower(m.Params[0])]; ok {
+			channel.Topic = m.Params[1]
+			channel.TopicSetBy = m.SourceNick()
+			channel.TopicSetAt = time.Now().Unix()
+		}
+	case "MODE":
+		if len(m.Params) < 2 {
+			return
+		}
+		if channel, ok := c.channels[strings.ToLower(m.Params[0])]; ok {
+			channel.Modes = applyModes(channel.Modes, m.Params[1])
+		}
+	case replyChannelModeIs:
+		// <me> <channel> <modes> [args]
+		if len(m.Params) < 3 {
+			return
+		}
+		if channel, ok := c.channels[strings.ToLower(m.Params[1])]; ok {
+			channel.Modes = applyModes("", m.Params[2])
+		}
+	case replyCreationTime:
+		// <me> <channel> <time>
+		if len(m.Params) < 3 {
+			return
+		}
+		if channel, ok := c.channels[strings.ToLower(m.Params[1])]; ok {
+			channel.Created, _ = strconv.ParseInt(m.Params[2], 10, 64)
+		}
+	case replyTopic:
+		// <me> <channel> <topic>
+		if len(m.Params) < 3 {
+			return
+		}
+		if channel, ok := c.channels[strings.ToLower(m.Params[1])]; ok {
+			channel.Topic = m.Params[2]
+		}
+	case replyTopicWhoTime:
+		// <me> <channel> <setter> <time>
+		if len(m.Params) < 4 {
+			return
+		}
+		if channel, ok := c.channels[strings.ToLower(m.Params[1])]; ok {
+			channel.TopicSetBy = m.Params[2]
+			if idx := strings.Index(channel.TopicSetBy, "!"); idx != -1 {
+				channel.TopicSetBy = channel.TopicSetBy[:idx]
+			}
+			channel.TopicSetAt, _ = strconv.ParseInt(m.Params[3], 10, 64)
+		}
+	case replyNamReply:
+		// <me> <symbol> <channel> <names>
+		if len(m.Params) < 4 {
+			return
+		}
+		if channel, ok := c.channels[strings.ToLower(m.Params[2])]; ok {
+			if channel.pendingNames == nil {
+				channel.pendingNames = map[string]string{}
+			}
+			for _, name := range strings.Fields(m.Params[3]) {
+				nick := strings.TrimLeft(name, nickPrefixChars)
+				channel.pendingNames[strings.ToLower(nick)] = nick
+			}
+		}
+	case replyEndOfNames:
+		// <me> <channel> <text>
+		if len(m.Params) < 2 {
+			return
+		}
+		if channel, ok := c.channels[strings.ToLower(m.Params[1])]; ok {
+			if channel.pendingNames != nil {
+				channel.Members = channel.pendingNames
+				channel.pendingNames = nil
+			}
+		}
+	}
+}
+
+func (c *ChannelState) join(name, nick string) {
+	key := strings.ToLower(name)
+
+	if strings.EqualFold(nick, c.nick) {
+		c.channels[key] = &Channel{
+			Name:    name,
+			Members: map[string]string{},
+		}
+	}
+
+	if channel, ok := c.channels[key]; ok {
+		channel.Members[strings.ToLower(nick)] = nick
+	}
+}
+
+func (c *ChannelState) part(name, nick string) {
+	key := strings.ToLower(name)
+
+	if strings.EqualFold(nick, c.nick) {
+		delete(c.channels, key)
+		return
+	}
+
+	if channel, ok := c.channels[key]; ok {
+		delete(channel.Members, strings.ToLower(nick))
+	}
+}
+
+func (c *ChannelState) nickChange(oldNick, newNick string) {
+	if strings.EqualFold(oldNick, c.nick) {
+		c.nick = newNick
+	}
+
+	for _, channel := range c.channels {
+		if _, ok := channel.Members[strings.ToLower(oldNick)]; ok {
+			delete(channel.Members, strings.ToLower(oldNick))
+			channel.Members[strings.ToLower(newNick)] = newNick
+		}
+	}
+}
+
+// applyModes applies a mode change such as "+nt-s" to the modes that are set.
+func applyModes(modes, change string) string {
+	set := map[rune]bool{}
+	for _, c := range modes {
+		set[c] = true
+	}
+
+	adding := true
+	for _, c := range change {
+		switch {
+		case c == '+':
+			adding = true
+		case c == '-':
+			adding = false
+		case strings.ContainsRune(memberModes, c) ||
+			strings.ContainsRune(listModes, c):
+			// Not a mode of the channel.
+		case adding:
+			set[c] = true
+		default:
+			delete(set, c)
+		}
+	}
+
+	var result []string
+	for c := range set {
+		result = append(result, string(c))
+	}
+	sort.Strings(result)
+	return strings.Join(result, "")
+}
+
+// Channel returns a copy of what we know about a channel. It returns false if
+// we're not in the channel.
+func (c *ChannelState) Channel(name string) (Channel, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	channel, ok := c.channels[strings.ToLower(name)]
+	if !ok {
+		return Channel{}, false
+	}
+
+	return channel.copy(), true
+}
+
+// Channels returns copies of all the channels we're in, sorted by name.
+func (c *ChannelState) Channels() []Channel {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var channels []Channel
+	for _, channel := range c.channels {
+		channels = append(channels, channel.copy())
+	}
+
+	sort.Slice(channels, func(i, j int) bool {
+		return strings.ToLower(channels[i].Name) <
+			strings.ToLower(channels[j].Name)
+	})
+
+	return channels
+}
+
+func (c *Channel) copy() Channel {
+	channel := *c
+	channel.pendingNames = nil
+	channel.Members = map[string]string{}
+	for k, v := range c.Members {
+		channel.Members[k] = v
+	}
+	return channel
+}
+
+// IsPrivate returns whether the channel is secret or private (+s or +p).
+func (c Channel) IsPrivate() bool {
+	return strings.ContainsAny(c.Modes, "sp")
+}
+
+// SortedMembers returns the nicks in the channel, sorted.
+func (c Channel) SortedMembers() []string {
+	var nicks []string
+	for _, nick := range c.Members {
+		nicks = append(nicks, nick)
+	}
+	sort.Slice(nicks, func(i, j int) bool {
+		return strings.ToLower(nicks[i]) < strings.ToLower(nicks[j])
+	})
+	return nicks
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/andyjack/court/internal/ircv3"
+)
+
+// CTCP (Client-To-Client Protocol) messages are PRIVMSGs and NOTICEs with text
+// wrapped in \x01, e.g. "\x01ACTION waves\x01" for /me waves.
+const ctcpDelim = "\x01"
+
+// ctcpVersion is how we answer CTCP VERSION.
+const ctcpVersion = "horatio (https://github.com/andyjack/court)"
+
+// CTCP is a decoded CTCP message.
+type CTCP struct {
+	// The CTCP command, e.g. ACTION.
+	Command string
+
+	// What follows the command. It may be blank.
+	Params string
+}
+
+// parseCTCP decodes CTCP message text. It returns false if the text is not a
+// CTCP message.
+//
+// Some clients leave off the closing \x01, so we accept that.
+func parseCTCP(text string) (CTCP, bool) {
+	if !strings.HasPrefix(text, ctcpDelim) {
+		return CTCP{}, false
+	}
+
+	text = strings.TrimPrefix(text, ctcpDelim)
+	text = strings.TrimSuffix(text, ctcpDelim)
+	if text == "" {
+		return CTCP{}, false
+	}
+
+	command := text
+	params := ""
+	if idx := strings.Index(text, " "); idx != -1 {
+		command = text[:idx]
+		params = text[idx+1:]
+	}
+
+	return CTCP{
+		Command: strings.ToUpper(command),
+		Params:  params,
+	}, true
+}
+
+// encodeCTCP creates CTCP message text.
+//
+// The params can't contain \x01 or line breaks as they would end the CTCP
+// message or the IRC message early. We replace them with spaces. Send text
+// with several lines as several messages rather than rely on this.
+func encodeCTCP(c CTCP) string {
+	params := strings.NewReplacer(
+		ctcpDelim, " ",
+		"\r", " ",
+		"\n", " ",
+	).Replace(c.Params)
+
+	if params == "" {
+		return ctcpDelim + c.Command + ctcpDelim
+	}
+	return ctcpDelim + c.Command + " " + params + ctcpDelim
+}
+
+// ctcpReply returns the NOTICE answering a CTCP query we received. We answer
+// VERSION, PING, and TIME. It returns false if we don't answer the message.
+func ctcpReply(m ircv3.Message) (ircv3.Message, bool) {
+	if m.Command != "PRIVMSG" || len(m.Params) < 2 {
+		return ircv3.Message{}, false
+	}
+
+	query, ok := parseCTCP(m.Params[1])
+	if !ok {
+		return ircv3.Message{}, false
+	}
+
+	reply := CTCP{Command: query.Command}
+	switch query.Command {
+	case "VERSION":
+		reply.Params = ctcpVersion
+	case "PING":
+		// Echo back what they sent so they can work out the round trip time.
+		reply.Params = query.Params
+	case "TIME":
+		reply.Params = time.Now().Format(time.RFC1123Z)
+	default:
+		return ircv3.Message{}, false
+	}
+
+	return ircv3.Message{
+		Command: "NOTICE",
+		Params:  []string{m.SourceNick(), encodeCTCP(reply)},
+	}, true
+}
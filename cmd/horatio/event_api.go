@@ -1,27 +1,32 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/horgh/irc"
+	"github.com/andyjack/court/internal/ircv3"
+	"github.com/andyjack/court/internal/logging"
 )
 
 // EventAPI represents an Event API. This dispatches events to bots that expect
-// to receive Slack Event API type events via HTTP.
+// to receive Slack Event API type events via HTTP or Socket Mode.
 type EventAPI struct {
+	metrics     *Metrics
 	endpointURL string
+	listener    *Listener
 }
 
 // NewEventAPI creates a new EventAPI.
-func NewEventAPI(endpointURL string) *EventAPI {
+func NewEventAPI(
+	metrics *Metrics,
+	endpointURL string,
+	listener *Listener,
+) *EventAPI {
 	return &EventAPI{
+		metrics:     metrics,
 		endpointURL: endpointURL,
+		listener:    listener,
 	}
 }
 
@@ -29,66 +34,242 @@ func NewEventAPI(endpointURL string) *EventAPI {
 //
 // It's structured to be similar to the Slack Event API event of this type.
 type MessageEvent struct {
-	Type  string `json:"type"`
-	Event Event  `json:"event"`
+	Type      string `json:"type"`
+	EventID   string `json:"event_id"`
+	EventTime int64  `json:"event_time"`
+	Event     Event  `json:"event"`
 }
 
 // Event is part of MessageEvent
 type Event struct {
-	Type    string `json:"type"`
-	Channel string `json:"channel"`
-	User    string `json:"user"`
-	Text    string `json:"text"`
+	Type     string `json:"type"`
+	SubType  string `json:"subtype,omitempty"`
+	Channel  string `json:"channel"`
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	BotID    string `json:"bot_id,omitempty"`
+	Ts       string `json:"ts"`
+	ThreadTs string `json:"thread_ts,omitempty"`
+	EventTs  string `json:"event_ts"`
+
+	UserProfile *UserProfile `json:"user_profile,omitempty"`
+}
+
+// UserProfile is part of a message. Slack includes some of the sender's
+// profile in messages. We include their IRC account.
+type UserProfile struct {
+	// The sender's IRC account.
+	Name string `json:"name"`
+
+	// The sender's nick.
+	DisplayName string `json:"display_name"`
+}
+
+// botIDForNick returns the bot ID we use for messages from the given nick.
+//
+// Slack bot IDs start with B.
+func botIDForNick(nick string) string {
+	return "B" + strings.ToUpper(nick)
 }
 
 var httpClient = &http.Client{
 	Timeout: 10 * time.Second,
 }
 
+// messageFromIRC creates the message we log and dispatch for a PRIVMSG or
+// NOTICE to a channel. nick is our nick.
+//
+// The message must be a regular message or a CTCP ACTION. We don't log other
+// CTCP messages.
+func messageFromIRC(m ircv3.Message, nick string) LoggedMessage {
+	message := LoggedMessage{
+		User:  m.SourceNick(),
+		Text:  m.Params[1],
+		MsgID: m.Tags["msgid"],
+	}
+
+	// With account-tag the server tells us the sender's account if they're
+	// logged in to one.
+	if account := m.Tags["account"]; account != "" && account != "*" {
+		message.UserProfile = &UserProfile{
+			Name:        account,
+			DisplayName: m.SourceNick(),
+		}
+	}
+
+	// If we forward NOTICEs, we mark them so the listener can tell them apart
+	// from regular messages. By convention bots don't reply to NOTICEs.
+	if m.Command == "NOTICE" {
+		message.SubType = "irc_notice"
+	}
+
+	// /me waves arrives as the CTCP ACTION "waves". Slack calls these
+	// me_message.
+	if ctcp, ok := parseCTCP(m.Params[1]); ok && ctcp.Command == "ACTION" {
+		message.SubType = "me_message"
+		message.Text = ctcp.Params
+	}
+
+	// We may see messages we sent ourselves, such as if the server echoes them
+	// back. Tell the listener they're from us so it doesn't reply to itself.
+	if strings.EqualFold(m.SourceNick(), nick) {
+		if message.SubType == "" {
+			message.SubType = "bot_message"
+		}
+		message.BotID = botIDForNick(nick)
+	}
+
+	return message
+}
+
 // DispatchMessageEvent notifies the event listener of a message event.
-func (e *EventAPI) DispatchMessageEvent(m irc.Message) error {
+// logger is for entries about the message.
+//
+// We queue the event to send in the background. See Listener.Queue.
+func (e *EventAPI) DispatchMessageEvent(
+	logger *logging.Logger,
+	channel string,
+	m LoggedMessage,
+) error {
+	eventID, err := newEventID()
+	if err != nil {
+		return err
+	}
+	logger = logger.With("event_id", eventID)
+
 	event := MessageEvent{
-		Type: "event_callback",
+		Type:      "event_callback",
+		EventID:   eventID,
+		EventTime: time.Now().Unix(),
 		Event: Event{
-			Type:    "message",
-			Channel: m.Params[0],
-			User:    m.Prefix,
-			Text:    m.Params[1],
+			Type:     "message",
+			SubType:  m.SubType,
+			Channel:  channel,
+			User:     m.User,
+			Text:     m.Text,
+			BotID:    m.BotID,
+			Ts:       m.Ts,
+			ThreadTs: m.ThreadTs,
+			EventTs:  m.Ts,
+
+			UserProfile: m.UserProfile,
 		},
 	}
 
-	buf, err := json.Marshal(event)
-	if err != nil {
-		return fmt.Errorf("error marshaling: %s", err)
-	}
+	e.listener.Queue(logger, "event", func() {
+		if err := e.dispatch(logger, "message", event); err != nil {
+			logger.Error("Error dispatching message event", "error", err)
+			return
+		}
 
-	req, err := http.NewRequest(
-		http.MethodPost,
-		e.endpointURL,
-		bytes.NewBuffer(buf),
-	)
-	if err != nil {
-		return fmt.Errorf("error creating request: %s", err)
+		logger.Info("Dispatched message event", "destination",
+			e.listener.Destination(e.endpointURL), "channel", channel, "user",
+			m.User, "ts", m.Ts)
+		logger.Debug("Message event", "event", event.Event)
+	})
+	return nil
+}
+
+// ReactionEventPayload represents the payload we send for a reaction_added or
+// reaction_removed event.
+type ReactionEventPayload struct {
+	Type      string        `json:"type"`
+	EventID   string        `json:"event_id"`
+	EventTime int64         `json:"event_time"`
+	Event     ReactionEvent `json:"event"`
+}
+
+// ReactionEvent is part of ReactionEventPayload.
+type ReactionEvent struct {
+	Type     string       `json:"type"`
+	User     string       `json:"user"`
+	Reaction string       `json:"reaction"`
+	ItemUser string       `json:"item_user"`
+	Item     ReactionItem `json:"item"`
+	EventTs  string       `json:"event_ts"`
+}
+
+// ReactionItem is the message a reaction is to.
+type ReactionItem struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	Ts      string `json:"ts"`
+}
+
+// DispatchReactionEvent notifies the event listener that user added (or
+// removed) a reaction to a message. logger is for entries about the reaction.
+//
+// We queue the event to send in the background. See Listener.Queue.
+func (e *EventAPI) DispatchReactionEvent(
+	logger *logging.Logger,
+	channel string,
+	m LoggedMessage,
+	user,
+	reaction string,
+	added bool,
+) error {
+	eventType := "reaction_added"
+	if !added {
+		eventType = "reaction_removed"
 	}
 
-	resp, err := httpClient.Do(req)
+	eventID, err := newEventID()
 	if err != nil {
-		return fmt.Errorf("error performing HTTP request: %s", err)
+		return err
 	}
+	logger = logger.With("event_id", eventID)
 
-	if _, err := ioutil.ReadAll(resp.Body); err != nil {
-		_ = resp.Body.Close()
-		return fmt.Errorf("error reading body: %s", err)
+	event := ReactionEventPayload{
+		Type:      "event_callback",
+		EventID:   eventID,
+		EventTime: time.Now().Unix(),
+		Event: ReactionEvent{
+			Type:     eventType,
+			User:     user,
+			Reaction: reaction,
+			ItemUser: m.User,
+			Item: ReactionItem{
+				Type:    "message",
+				Channel: channel,
+				Ts:      m.Ts,
+			},
+			EventTs: formatTs(time.Now().UnixNano() / int64(time.Microsecond)),
+		},
 	}
 
-	if err := resp.Body.Close(); err != nil {
-		return fmt.Errorf("error closing body: %s", err)
-	}
+	e.listener.Queue(logger, "event", func() {
+		if err := e.dispatch(logger, eventType, event); err != nil {
+			logger.Error("Error dispatching reaction event", "error", err)
+			return
+		}
+
+		logger.Info("Dispatched reaction event", "event_type", eventType,
+			"destination", e.listener.Destination(e.endpointURL), "channel",
+			channel, "user", user, "reaction", reaction)
+	})
+	return nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d from API", resp.StatusCode)
+// dispatch sends an event payload to the event listener.
+func (e *EventAPI) dispatch(
+	logger *logging.Logger,
+	eventType string,
+	payload interface{},
+) error {
+	if err := e.listener.SendEvent(logger, e.endpointURL, payload); err != nil {
+		e.metrics.eventDispatchFailures.Inc(eventType)
+		return err
 	}
 
-	log.Printf("Dispatched message event: POST %s: %+v", e.endpointURL, m)
+	e.metrics.eventsDispatched.Inc(eventType)
 	return nil
 }
+
+// newEventID creates an ID for an event. Like Slack's, it starts with Ev.
+func newEventID() (string, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	return "Ev" + strings.ToUpper(id[:10]), nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// Block is a Slack Block Kit layout block. We understand enough of them to
+// show messages with buttons on IRC.
+//
+// See https://api.slack.com/reference/block-kit/blocks
+type Block struct {
+	Type    string `json:"type"`
+	BlockID string `json:"block_id,omitempty"`
+
+	// Section blocks have text and may have an accessory such as a button.
+	Text      *TextObject   `json:"text,omitempty"`
+	Accessory *BlockElement `json:"accessory,omitempty"`
+
+	// Actions blocks have elements such as buttons.
+	Elements []BlockElement `json:"elements,omitempty"`
+}
+
+// BlockElement is an interactive element in a block, such as a button.
+type BlockElement struct {
+	Type     string      `json:"type"`
+	ActionID string      `json:"action_id,omitempty"`
+	Text     *TextObject `json:"text,omitempty"`
+	Value    string      `json:"value,omitempty"`
+}
+
+// TextObject is text in a block.
+type TextObject struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// textFromBlocks returns the text of the section blocks. We use this as a
+// message's text if it has none.
+func textFromBlocks(blocks []Block) string {
+	var parts []string
+	for _, block := range blocks {
+		if block.Type == "section" && block.Text != nil && block.Text.Text != "" {
+			// IRC messages can't have newlines.
+			parts = append(parts, strings.Join(strings.Fields(block.Text.Text),
+				" "))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Button is a button in a message's blocks.
+type Button struct {
+	BlockID  string
+	ActionID string
+	Text     string
+	Value    string
+}
+
+// buttonsFromBlocks returns the buttons in the blocks, in order.
+func buttonsFromBlocks(blocks []Block) []Button {
+	var buttons []Button
+
+	add := func(blockID string, e BlockElement) {
+		if e.Type != "button" {
+			return
+		}
+		button := Button{
+			BlockID:  blockID,
+			ActionID: e.ActionID,
+			Value:    e.Value,
+		}
+		if e.Text != nil {
+			button.Text = e.Text.Text
+		}
+		buttons = append(buttons, button)
+	}
+
+	for _, block := range blocks {
+		if block.Accessory != nil {
+			add(block.BlockID, *block.Accessory)
+		}
+		for _, e := range block.Elements {
+			add(block.BlockID, e)
+		}
+	}
+
+	return buttons
+}
+
+// ButtonState remembers the buttons in the most recent message with buttons
+// in each channel. People choose one by number, e.g. !1.
+type ButtonState struct {
+	mutex sync.Mutex
+
+	// People choose a button with this followed by its number.
+	prefix string
+
+	// Keyed by lowercased channel.
+	channels map[string]buttonMessage
+}
+
+// buttonMessage is a message with buttons.
+type buttonMessage struct {
+	message LoggedMessage
+	buttons []Button
+}
+
+// NewButtonState creates a ButtonState. People choose a button with the
+// prefix followed by its number.
+func NewButtonState(prefix string) *ButtonState {
+	return &ButtonState{
+		prefix:   prefix,
+		channels: map[string]buttonMessage{},
+	}
+}
+
+// Set records the buttons in a message we sent to a channel. These replace
+// those of any earlier message.
+func (b *ButtonState) Set(channel string, m LoggedMessage, buttons []Button) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.channels[strings.ToLower(channel)] = buttonMessage{
+		message: m,
+		buttons: buttons,
+	}
+}
+
+// Get returns the latest message with buttons in a channel and its buttons.
+func (b *ButtonState) Get(channel string) (LoggedMessage, []Button, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	m, ok := b.channels[strings.ToLower(channel)]
+	return m.message, m.buttons, ok
+}
+
+// SetPrefix changes the prefix people choose a button with.
+func (b *ButtonState) SetPrefix(prefix string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.prefix = prefix
+}
+
+// Prefix returns the prefix people choose a button with.
+func (b *ButtonState) Prefix() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.prefix
+}
+
+// Describe creates the line we send to IRC telling people how to choose a
+// button, e.g. "Reply with !1 (Approve) or !2 (Deny)".
+func (b *ButtonState) Describe(buttons []Button) string {
+	prefix := b.Prefix()
+
+	var options []string
+	for i, button := range buttons {
+		options = append(options, fmt.Sprintf("%s%d (%s)", prefix, i+1,
+			button.Text))
+	}
+
+	if len(options) == 1 {
+		return "Reply with " + options[0]
+	}
+
+	return "Reply with " + strings.Join(options[:len(options)-1], ", ") +
+		" or " + options[len(options)-1]
+}
+
+// Interactions turns people choosing buttons on IRC into Slack block_actions
+// interactions.
+type Interactions struct {
+	// Where we send interactions.
+	interactivityURL string
+
+	listener *Listener
+
+	buttons      *ButtonState
+	responseURLs *ResponseURLs
+	ircClient    *IRCClient
+}
+
+// NewInteractions creates an Interactions.
+func NewInteractions(
+	interactivityURL string,
+	listener *Listener,
+	buttons *ButtonState,
+	responseURLs *ResponseURLs,
+	ircClient *IRCClient,
+) *Interactions {
+	return &Interactions{
+		interactivityURL: interactivityURL,
+		listener:         listener,
+		buttons:          buttons,
+		responseURLs:     responseURLs,
+		ircClient:        ircClient,
+	}
+}
+
+// BlockActionsPayload is the payload of a block_actions interaction. It's
+// structured to be similar to Slack's.
+type BlockActionsPayload struct {
+	Type        string               `json:"type"`
+	User        InteractionUser      `json:"user"`
+	Team        InteractionTeam      `json:"team"`
+	Channel     InteractionChannel   `json:"channel"`
+	Container   InteractionContainer `json:"container"`
+	Message     LoggedMessage        `json:"message"`
+	ResponseURL string               `json:"response_url"`
+	TriggerID   string               `json:"trigger_id"`
+	Actions     []BlockAction        `json:"actions"`
+}
+
+// InteractionUser is who interacted.
+type InteractionUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+// InteractionTeam is the team of who interacted.
+type InteractionTeam struct {
+	ID     string `json:"id"`
+	Domain string `json:"domain"`
+}
+
+// InteractionChannel is where they interacted.
+type InteractionChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// InteractionContainer is the message they interacted with.
+type InteractionContainer struct {
+	Type      string `json:"type"`
+	MessageTs string `json:"message_ts"`
+	ChannelID string `json:"channel_id"`
+}
+
+// BlockAction is the button they chose.
+type BlockAction struct {
+	Type     string     `json:"type"`
+	BlockID  string     `json:"block_id"`
+	ActionID string     `json:"action_id"`
+	Text     TextObject `json:"text"`
+	Value    string     `json:"value,omitempty"`
+	ActionTs string     `json:"action_ts"`
+}
+
+// ParseChoice returns the number of the button chosen if the message chooses
+// one, e.g. !1. It returns false if it doesn't.
+func (b *ButtonState) ParseChoice(text string) (int, bool) {
+	prefix := b.Prefix()
+	if prefix == "" || !strings.HasPrefix(text, prefix) {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(text,
+		prefix)))
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// Dispatch sends a block_actions interaction if the message chooses a button
+// in the channel. It returns false if it doesn't. logger is for entries about
+// the message.
+//
+// We queue the interaction to send in the background. See Listener.Queue.
+func (i *Interactions) Dispatch(
+	logger *logging.Logger,
+	channel,
+	user,
+	text string,
+) bool {
+	n, ok := i.buttons.ParseChoice(text)
+	if !ok {
+		return false
+	}
+
+	message, buttons, ok := i.buttons.Get(channel)
+	if !ok {
+		return false
+	}
+
+	if n < 1 || n > len(buttons) {
+		i.responseURLs.Deliver(logger, channel, user, ResponseMessage{
+			Text: fmt.Sprintf("There's no option %d. %s", n,
+				i.buttons.Describe(buttons)),
+		})
+		return true
+	}
+
+	logger = logger.With("action_id", buttons[n-1].ActionID)
+	button := buttons[n-1]
+	i.listener.Queue(logger, "interaction", func() {
+		if err := i.send(logger, channel, user, message, button); err != nil {
+			logger.Error("Error dispatching interaction", "error", err)
+		}
+	})
+
+	return true
+}
+
+// send sends a block_actions interaction for a button.
+func (i *Interactions) send(
+	logger *logging.Logger,
+	channel,
+	user string,
+	message LoggedMessage,
+	button Button,
+) error {
+	responseURL, err := i.responseURLs.New(channel, user)
+	if err != nil {
+		return err
+	}
+
+	triggerID, err := randomID()
+	if err != nil {
+		return err
+	}
+
+	actionTs := formatTs(time.Now().UnixNano() / int64(time.Microsecond))
+
+	payload := BlockActionsPayload{
+		Type: "block_actions",
+		User: InteractionUser{
+			ID:       user,
+			Username: user,
+			Name:     user,
+		},
+		Team: InteractionTeam{
+			ID:     teamIDForServer(i.ircClient.serverName),
+			Domain: i.ircClient.serverName,
+		},
+		Channel: InteractionChannel{
+			ID:   channel,
+			Name: strings.TrimPrefix(channel, "#"),
+		},
+		Container: InteractionContainer{
+			Type:      "message",
+			MessageTs: message.Ts,
+			ChannelID: channel,
+		},
+		Message:     message,
+		ResponseURL: responseURL,
+		TriggerID:   triggerID,
+		Actions: []BlockAction{
+			{
+				Type:     "button",
+				BlockID:  button.BlockID,
+				ActionID: button.ActionID,
+				Text:     TextObject{Type: "plain_text", Text: button.Text},
+				Value:    button.Value,
+				ActionTs: actionTs,
+			},
+		},
+	}
+
+	if err := i.listener.SendInteraction(logger, i.interactivityURL,
+		payload); err != nil {
+		return err
+	}
+
+	logger.Info("Dispatched block_actions interaction", "destination",
+		i.listener.Destination(i.interactivityURL), "channel", channel, "user",
+		user)
+	logger.Debug("block_actions payload", "payload", payload)
+
+	return nil
+}
@@ -3,22 +3,69 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/andyjack/court/internal/ircv3"
+	"github.com/andyjack/court/internal/logging"
 	"github.com/horgh/irc"
 )
 
 // IRCClient is an IRC client.
 type IRCClient struct {
-	verbose   bool
+	logger    *logging.Logger
+	metrics   *Metrics
 	nick      string
+	host      string
+	port      int
 	conn      net.Conn
 	rw        *bufio.ReadWriter
-	readChan  chan irc.Message
-	writeChan chan irc.Message
+	readChan  chan incomingMessage
+	writeChan chan outgoingMessage
+
+	// The name the server gave in its welcome. Set during init.
+	serverName string
+
+	// Whether we're registered (the server welcomed us) and the connection is
+	// still up. We clear it if we can no longer read or write.
+	connectedMutex sync.Mutex
+	connected      bool
+
+	// IRCv3 capabilities we enabled.
+	capsMutex sync.Mutex
+	caps      map[string]bool
+
+	// Callers waiting for a particular message from the server.
+	waitersMutex sync.Mutex
+	waiters      map[*waiter]struct{}
+}
+
+// incomingMessage is a message we read along with a logger for entries about
+// it. The logger tags entries with a request ID so we can follow what we do
+// because of the message, such as sending events.
+type incomingMessage struct {
+	message ircv3.Message
+	logger  *logging.Logger
+}
+
+// outgoingMessage is a message to write along with a logger for entries about
+// it. The logger is the one for whatever caused us to write the message, such
+// as a Web API request.
+type outgoingMessage struct {
+	message ircv3.Message
+	logger  *logging.Logger
+}
+
+// waiter is waiting for a message from the server.
+type waiter struct {
+	// match decides whether the message is the one we're waiting for.
+	match func(ircv3.Message) bool
+
+	// When we read a matching message we send it here.
+	ch chan ircv3.Message
 }
 
 var dialer = &net.Dialer{
@@ -28,30 +75,36 @@ var dialer = &net.Dialer{
 
 // NewIRCClient creates an IRC client. It connects and joins a channel.
 func NewIRCClient(
-	verbose bool,
+	logger *logging.Logger,
+	metrics *Metrics,
 	nick,
 	channel,
 	host string,
 	port int,
 	wg *sync.WaitGroup,
 ) (*IRCClient, error) {
-	hostAndPort := fmt.Sprintf("%s:%d", host, port)
-	log.Printf("Connecting to IRC server %s...", hostAndPort)
+	hostAndPort := net.JoinHostPort(host, strconv.Itoa(port))
+	logger.Info("Connecting to IRC server", "server", hostAndPort)
 	conn, err := dialer.Dial("tcp", hostAndPort)
 	if err != nil {
 		return nil, fmt.Errorf("error dialing: %s", err)
 	}
 
 	client := &IRCClient{
-		verbose: verbose,
+		logger:  logger,
+		metrics: metrics,
 		nick:    nick,
+		host:    host,
+		port:    port,
 		conn:    conn,
 		rw: bufio.NewReadWriter(
 			bufio.NewReader(conn),
 			bufio.NewWriter(conn),
 		),
-		readChan:  make(chan irc.Message, 1024),
-		writeChan: make(chan irc.Message, 1024),
+		readChan:  make(chan incomingMessage, 1024),
+		writeChan: make(chan outgoingMessage, 1024),
+		caps:      map[string]bool{},
+		waiters:   map[*waiter]struct{}{},
 	}
 
 	wg.Add(1)
@@ -67,38 +120,74 @@ func NewIRCClient(
 	return client, nil
 }
 
+// wantedCaps are the IRCv3 capabilities we request if the server offers them.
+//
+// message-tags lets us send and receive tags such as reactions and message
+// IDs. server-time tells us when the server saw each message. account-tag
+// tells us the account of who sent each message. echo-message has the server
+// send us the messages we send so we learn their IDs.
+var wantedCaps = []string{
+	"message-tags",
+	"server-time",
+	"account-tag",
+	"echo-message",
+}
+
 func (i *IRCClient) init(channel string) error {
-	i.Write(irc.Message{
+	// Ask what capabilities the server has. Servers that don't know about
+	// capabilities ignore this or reply with ERR_UNKNOWNCOMMAND. Servers that
+	// do hold off registering us until we end negotiation.
+	i.Write(i.logger, ircv3.Message{
+		Command: "CAP",
+		Params:  []string{"LS", "302"},
+	})
+
+	i.Write(i.logger, ircv3.Message{
 		Command: "NICK",
 		Params:  []string{i.nick},
 	})
 
-	i.Write(irc.Message{
+	i.Write(i.logger, ircv3.Message{
 		Command: "USER",
 		Params:  []string{i.nick, i.nick, "0", i.nick},
 	})
 
-	i.Write(irc.Message{
-		Command: "JOIN",
-		Params:  []string{channel},
-	})
-
 	timeoutChan := time.After(5 * time.Second)
+	var offered []string
 
 	for {
 		select {
 		case <-timeoutChan:
 			return fmt.Errorf("timeout waiting for connection init")
-		case m, ok := <-i.readChan:
+		case in, ok := <-i.readChan:
 			if !ok {
 				return fmt.Errorf("read channel closed")
 			}
-
-			if m.Command == "001" {
-				log.Printf("Connected to IRC server")
+			m := in.message
+
+			if m.Command == irc.ReplyWelcome {
+				i.serverName = m.Prefix
+				i.setConnected(true)
+				i.logger.Info("Connected to IRC server", "server_name",
+					i.serverName)
+
+				i.Write(i.logger, ircv3.Message{
+					Command: "JOIN",
+					Params:  []string{channel},
+				})
 				return nil
 			}
 
+			if m.Command == "CAP" && len(m.Params) >= 3 {
+				offered = i.negotiateCaps(m, offered)
+				continue
+			}
+
+			// ERR_UNKNOWNCOMMAND in response to CAP.
+			if m.Command == "421" {
+				continue
+			}
+
 			if m.Command == "NOTICE" {
 				continue
 			}
@@ -108,10 +197,96 @@ func (i *IRCClient) init(channel string) error {
 	}
 }
 
-// Read reads an IRC message.
-func (i *IRCClient) Read() (irc.Message, bool) {
-	m, ok := <-i.readChan
-	return m, ok
+// negotiateCaps handles a CAP message during registration. offered holds the
+// capabilities the server offered so far. We return it updated.
+//
+// Once we know all the capabilities the server offers, we request those we
+// want. Once it acknowledges (or rejects) our request, we end negotiation.
+func (i *IRCClient) negotiateCaps(m ircv3.Message, offered []string) []string {
+	switch m.Params[1] {
+	case "LS":
+		// With CAP LS 302 the list may span several messages. All but the last
+		// have * before the list.
+		last := len(m.Params) == 3
+		for _, c := range strings.Fields(m.Params[len(m.Params)-1]) {
+			// Capabilities may have values, e.g. sasl=PLAIN.
+			if idx := strings.Index(c, "="); idx != -1 {
+				c = c[:idx]
+			}
+			offered = append(offered, c)
+		}
+		if !last {
+			return offered
+		}
+
+		var request []string
+		for _, wanted := range wantedCaps {
+			for _, c := range offered {
+				if c == wanted {
+					request = append(request, c)
+				}
+			}
+		}
+
+		if len(request) == 0 {
+			i.Write(i.logger, ircv3.Message{
+				Command: "CAP",
+				Params:  []string{"END"},
+			})
+			return offered
+		}
+
+		i.Write(i.logger, ircv3.Message{
+			Command: "CAP",
+			Params:  []string{"REQ", strings.Join(request, " ")},
+		})
+	case "ACK":
+		i.capsMutex.Lock()
+		for _, c := range strings.Fields(m.Params[2]) {
+			i.caps[c] = true
+		}
+		i.capsMutex.Unlock()
+		i.logger.Info("Enabled capabilities", "caps", m.Params[2])
+		i.Write(i.logger, ircv3.Message{
+			Command: "CAP",
+			Params:  []string{"END"},
+		})
+	case "NAK":
+		i.logger.Warn("Server refused capabilities", "caps", m.Params[2])
+		i.Write(i.logger, ircv3.Message{
+			Command: "CAP",
+			Params:  []string{"END"},
+		})
+	}
+
+	return offered
+}
+
+// messageTime returns when the server saw the message. This comes from the
+// server-time tag. If there's no such tag, it's now.
+func messageTime(logger *logging.Logger, m ircv3.Message) time.Time {
+	if value, ok := m.Tags["time"]; ok {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err == nil {
+			return t
+		}
+		logger.Warn("Invalid time tag", "value", value)
+	}
+	return time.Now()
+}
+
+// HasCap returns whether we enabled the capability.
+func (i *IRCClient) HasCap(c string) bool {
+	i.capsMutex.Lock()
+	defer i.capsMutex.Unlock()
+	return i.caps[c]
+}
+
+// Read reads an IRC message. It also returns a logger for entries about the
+// message and what we do because of it.
+func (i *IRCClient) Read() (ircv3.Message, *logging.Logger, bool) {
+	in, ok := <-i.readChan
+	return in.message, in.logger, ok
 }
 
 func (i *IRCClient) reader(wg *sync.WaitGroup) {
@@ -120,56 +295,122 @@ func (i *IRCClient) reader(wg *sync.WaitGroup) {
 	for {
 		m, err := i.readMessage()
 		if err != nil {
-			log.Printf("error reading: %s", err)
+			i.logger.Error("Error reading from IRC", "error", err)
+			i.setConnected(false)
 			close(i.readChan)
 			return
 		}
 
-		if i.verbose {
-			log.Printf("read message: %s", m)
-		}
-		i.readChan <- m
+		logger := i.logger.With("request_id", logging.NewRequestID())
+		logger.Debug("Read IRC message", "message", m)
+		i.metrics.ircMessagesRead.Inc(m.Command)
+
+		i.notifyWaiters(m)
+		i.readChan <- incomingMessage{message: m, logger: logger}
 	}
 }
 
 var readTimeout = 5 * time.Minute
 
-func (i *IRCClient) readMessage() (irc.Message, error) {
+func (i *IRCClient) readMessage() (ircv3.Message, error) {
 	if err := i.conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
-		return irc.Message{}, fmt.Errorf("error setting read deadline: %s", err)
+		return ircv3.Message{}, fmt.Errorf("error setting read deadline: %s",
+			err)
 	}
 
 	line, err := i.rw.ReadString('\n')
 	if err != nil {
-		return irc.Message{}, err
+		return ircv3.Message{}, err
 	}
 
-	m, err := irc.ParseMessage(line)
+	m, err := ircv3.ParseMessage(line)
 	if err != nil && err != irc.ErrTruncated {
-		return irc.Message{}, fmt.Errorf("unable to parse message: %s: %s", line,
-			err)
+		return ircv3.Message{}, fmt.Errorf("unable to parse message: %s: %s",
+			line, err)
 	}
 
 	return m, nil
 }
 
-// Write writes a message to the connection.
-func (i *IRCClient) Write(m irc.Message) {
-	i.writeChan <- m
+// notifyWaiters hands the message to any waiters that are waiting for it.
+func (i *IRCClient) notifyWaiters(m ircv3.Message) {
+	i.waitersMutex.Lock()
+	defer i.waitersMutex.Unlock()
+
+	for w := range i.waiters {
+		if w.match(m) {
+			w.ch <- m
+			delete(i.waiters, w)
+		}
+	}
+}
+
+// WriteAndWait writes a message to the connection and waits for a reply from
+// the server. match decides which message is the reply. We return the reply.
+//
+// The reply still gets passed to Read as usual.
+func (i *IRCClient) WriteAndWait(
+	logger *logging.Logger,
+	m ircv3.Message,
+	match func(ircv3.Message) bool,
+	timeout time.Duration,
+) (ircv3.Message, error) {
+	w := &waiter{
+		match: match,
+		ch:    make(chan ircv3.Message, 1),
+	}
+
+	// Start waiting before we write so we can't miss the reply.
+	i.waitersMutex.Lock()
+	i.waiters[w] = struct{}{}
+	i.waitersMutex.Unlock()
+
+	i.Write(logger, m)
+
+	select {
+	case reply := <-w.ch:
+		return reply, nil
+	case <-time.After(timeout):
+		i.waitersMutex.Lock()
+		delete(i.waiters, w)
+		i.waitersMutex.Unlock()
+		return ircv3.Message{}, fmt.Errorf("timeout waiting for reply to %s",
+			m.Command)
+	}
+}
+
+// Write writes a message to the connection. logger is for entries about
+// writing it. Pass the logger for whatever caused us to write it, such as a
+// Web API request, so we can tell why we wrote it.
+func (i *IRCClient) Write(logger *logging.Logger, m ircv3.Message) {
+	i.writeChan <- outgoingMessage{message: m, logger: logger}
+	i.metrics.ircWriteQueue.Set(float64(len(i.writeChan)))
 }
 
 func (i *IRCClient) writer(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	for m := range i.writeChan {
-		if err := i.writeMessage(m); err != nil {
-			log.Printf("error writing: %s", err)
-			break
+	for out := range i.writeChan {
+		i.metrics.ircWriteQueue.Set(float64(len(i.writeChan)))
+
+		// A message we can't encode is a problem with that message, not the
+		// connection, so we skip it and carry on.
+		buf, err := encodeMessage(out.message)
+		if err != nil {
+			out.logger.Error("Error encoding IRC message", "message",
+				out.message, "error", err)
+			continue
 		}
 
-		if i.verbose {
-			log.Printf("wrote message: %s", m)
+		if err := i.writeLine(buf); err != nil {
+			out.logger.Error("Error writing to IRC", "error", err)
+			// We can't send anything more, so we're no longer ready.
+			i.setConnected(false)
+			break
 		}
+
+		out.logger.Debug("Wrote IRC message", "message", out.message)
+		i.metrics.ircMessagesWritten.Inc(out.message.Command)
 	}
 
 	for range i.writeChan {
@@ -178,12 +419,25 @@ func (i *IRCClient) writer(wg *sync.WaitGroup) {
 
 var writeTimeout = time.Minute
 
-func (i *IRCClient) writeMessage(m irc.Message) error {
+// encodeMessage encodes a message to write. It's an error if a parameter has
+// a character that would end the line early.
+func encodeMessage(m ircv3.Message) (string, error) {
+	for _, param := range m.Params {
+		if strings.ContainsAny(param, "\r\n\x00") {
+			return "", fmt.Errorf("parameter has CR, LF, or NUL: %q", param)
+		}
+	}
+
 	buf, err := m.Encode()
 	if err != nil && err != irc.ErrTruncated {
-		return fmt.Errorf("error encoding message: %s", err)
+		return "", fmt.Errorf("error encoding message: %s", err)
 	}
 
+	return buf, nil
+}
+
+// writeLine writes an encoded message to the connection.
+func (i *IRCClient) writeLine(buf string) error {
 	if err := i.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
 		return fmt.Errorf("error setting write deadline: %s", err)
 	}
@@ -204,8 +458,28 @@ func (i *IRCClient) writeMessage(m irc.Message) error {
 	return nil
 }
 
+// setConnected records whether we're connected.
+func (i *IRCClient) setConnected(connected bool) {
+	i.connectedMutex.Lock()
+	defer i.connectedMutex.Unlock()
+	i.connected = connected
+}
+
+// Check returns nil if we're registered with the server and the connection is
+// still up, meaning we can both read and write. Otherwise it returns an error
+// saying we're not. It's a readiness check.
+func (i *IRCClient) Check() error {
+	i.connectedMutex.Lock()
+	defer i.connectedMutex.Unlock()
+	if !i.connected {
+		return fmt.Errorf("not connected")
+	}
+	return nil
+}
+
 // Close cleans up the client.
 func (i *IRCClient) Close() {
+	i.setConnected(false)
 	close(i.writeChan)
 	_ = i.conn.Close()
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// Listener sends events, slash commands, and interactions to the listener
+// (the bot). We send them as HTTP requests or, if the listener uses Socket
+// Mode, over its WebSocket.
+type Listener struct {
+	metrics *Metrics
+
+	// If we have a signing secret, we sign the HTTP requests we send with it.
+	signingSecret string
+
+	// If set, we send everything using Socket Mode rather than HTTP.
+	socketMode *SocketModeServer
+
+	// Deliveries waiting to be made. See Queue.
+	queue chan delivery
+
+	// Closed when we stop making deliveries.
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// delivery is something Queue makes in the background.
+type delivery struct {
+	// What it delivers, such as event. For metrics.
+	kind string
+
+	f func()
+}
+
+// listenerQueueSize is how many deliveries may wait to be made. Past this we
+// drop them.
+var listenerQueueSize = 1000
+
+// NewListener creates a Listener. signingSecret may be blank. socketMode may
+// be nil, in which case we send HTTP requests.
+//
+// It makes deliveries in a goroutine until Close is called.
+func NewListener(
+	metrics *Metrics,
+	signingSecret string,
+	socketMode *SocketModeServer,
+) *Listener {
+	l := &Listener{
+		metrics:       metrics,
+		signingSecret: signingSecret,
+		socketMode:    socketMode,
+		queue:         make(chan delivery, listenerQueueSize),
+		stop:          make(chan struct{}),
+	}
+
+	l.wg.Add(1)
+	go l.deliver()
+
+	return l
+}
+
+// Queue calls f in the background. f sends something to the listener, and
+// sending can be slow, such as when the listener takes a while to respond or
+// to acknowledge an envelope. Queueing means whoever has something to send,
+// such as the loop reading from IRC, isn't held up.
+//
+// We call the fs one at a time in the order they were queued. If too many are
+// waiting, or we're closed, we drop f. kind says what f sends, such as event,
+// and is for metrics. logger is for entries about it.
+func (l *Listener) Queue(logger *logging.Logger, kind string, f func()) {
+	select {
+	case <-l.stop:
+		logger.Warn("Dropping delivery to the listener as we're closed", "kind",
+			kind)
+		l.metrics.listenerDropped.Inc(kind)
+		return
+	default:
+	}
+
+	select {
+	case l.queue <- delivery{kind: kind, f: f}:
+		l.metrics.listenerQueue.Set(float64(len(l.queue)))
+	default:
+		logger.Warn("Dropping delivery to the listener as too many are waiting",
+			"kind", kind)
+		l.metrics.listenerDropped.Inc(kind)
+	}
+}
+
+// deliver makes the queued deliveries until we're closed.
+func (l *Listener) deliver() {
+	defer l.wg.Done()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case d := <-l.queue:
+			l.metrics.listenerQueue.Set(float64(len(l.queue)))
+			d.f()
+		}
+	}
+}
+
+// Close stops making deliveries. It waits for the one in progress, if any, and
+// drops the rest.
+func (l *Listener) Close() {
+	close(l.stop)
+	l.wg.Wait()
+}
+
+// Destination describes where we send things we'd otherwise POST to the URL.
+// This is for logging.
+func (l *Listener) Destination(endpointURL string) string {
+	if l.socketMode != nil {
+		return "Socket Mode"
+	}
+	return "POST " + endpointURL
+}
+
+// SendEvent sends an Event API payload, such as an event_callback.
+//
+// Here and below, logger is for entries about what we're sending. If it has a
+// request_id field, we send it in the X-Request-Id header so the listener can
+// log it too.
+func (l *Listener) SendEvent(
+	logger *logging.Logger,
+	endpointURL string,
+	payload interface{},
+) error {
+	if l.socketMode != nil {
+		_, err := l.socketMode.Send(logger, "events_api", payload)
+		return err
+	}
+
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling: %s", err)
+	}
+
+	_, _, err = l.post(logger, endpointURL, "application/json", buf)
+	return err
+}
+
+// SendCommand sends a slash command. form holds the command's fields, such as
+// command and text.
+//
+// It returns the listener's response. If there is none, it returns nil.
+func (l *Listener) SendCommand(
+	logger *logging.Logger,
+	endpointURL string,
+	form url.Values,
+) (*ResponseMessage, error) {
+	if l.socketMode != nil {
+		// Over Socket Mode the fields are JSON rather than a form.
+		payload := map[string]string{}
+		for k := range form {
+			payload[k] = form.Get(k)
+		}
+
+		ackPayload, err := l.socketMode.Send(logger, "slash_commands", payload)
+		if err != nil {
+			return nil, err
+		}
+
+		trimmed := bytes.TrimSpace(ackPayload)
+		if len(trimmed) == 0 || string(trimmed) == "null" {
+			return nil, nil
+		}
+
+		var response ResponseMessage
+		if err := json.Unmarshal(trimmed, &response); err != nil {
+			return nil, fmt.Errorf("invalid JSON response: %s", err)
+		}
+		return &response, nil
+	}
+
+	header, respBody, err := l.post(logger, endpointURL,
+		"application/x-www-form-urlencoded", []byte(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		return nil, nil
+	}
+
+	// The listener may respond with JSON or plain text.
+	var response ResponseMessage
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.Unmarshal(respBody, &response); err != nil {
+			return nil, fmt.Errorf("invalid JSON response: %s", err)
+		}
+	} else {
+		response.Text = string(respBody)
+	}
+
+	return &response, nil
+}
+
+// SendInteraction sends an interaction payload, such as a block_actions one.
+func (l *Listener) SendInteraction(
+	logger *logging.Logger,
+	endpointURL string,
+	payload interface{},
+) error {
+	if l.socketMode != nil {
+		_, err := l.socketMode.Send(logger, "interactive", payload)
+		return err
+	}
+
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling: %s", err)
+	}
+
+	// Slack sends the payload as JSON in a form field.
+	form := url.Values{}
+	form.Set("payload", string(buf))
+
+	_, _, err = l.post(logger, endpointURL,
+		"application/x-www-form-urlencoded", []byte(form.Encode()))
+	return err
+}
+
+// post sends a POST request to the listener. We sign it if we have a signing
+// secret. We return the response's header and body.
+func (l *Listener) post(
+	logger *logging.Logger,
+	endpointURL,
+	contentType string,
+	body []byte,
+) (http.Header, []byte, error) {
+	req, err := http.NewRequest(http.MethodPost, endpointURL,
+		bytes.NewBuffer(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	if l.signingSecret != "" {
+		signRequest(req, body, l.signingSecret)
+	}
+	if requestID := logger.Value("request_id"); requestID != "" {
+		req.Header.Set("X-Request-Id", requestID)
+	}
+
+	logger.Debug("Sending request to listener", "url", endpointURL, "body",
+		body)
+	start := time.Now()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error performing HTTP request: %s", err)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, nil, fmt.Errorf("error reading body: %s", err)
+	}
+
+	if err := resp.Body.Close(); err != nil {
+		return nil, nil, fmt.Errorf("error closing body: %s", err)
+	}
+
+	logger.Debug("Sent request to listener", "url", endpointURL, "status",
+		resp.StatusCode, "duration", time.Since(start), "response", respBody)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("HTTP %d from listener", resp.StatusCode)
+	}
+
+	return resp.Header, respBody, nil
+}
@@ -3,127 +3,480 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
 	"sync"
 
-	"github.com/horgh/irc"
+	"github.com/andyjack/court/internal/config"
+	"github.com/andyjack/court/internal/health"
+	"github.com/andyjack/court/internal/ircv3"
+	"github.com/andyjack/court/internal/logging"
 )
 
 func main() {
-	args, err := getArgs()
+	args, err := getArgs(os.Args[1:], os.Stderr)
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
 
+	logger := newLogger(args.logLevel, args.logFormat)
+	logger.AddSecret(args.signingSecret)
+	for _, token := range args.tokens {
+		logger.AddSecret(token)
+	}
+	for _, token := range args.appTokens {
+		logger.AddSecret(token)
+	}
+	for _, webhook := range args.webhooks {
+		logger.AddSecret(webhook.Secret)
+	}
+
+	metrics := NewMetrics()
+
+	messageLog, err := NewMessageLog(logger, args.historySize,
+		args.historyFile)
+	if err != nil {
+		logger.Fatal("Error opening message log", "error", err)
+	}
+
 	var wg sync.WaitGroup
 
-	ircClient, err := NewIRCClient(args.verbose, args.nick, args.channel,
+	ircClient, err := NewIRCClient(logger, metrics, args.nick, args.channel,
 		args.ircHost, args.ircPort, &wg)
 	if err != nil {
-		log.Fatalf("error connecting: %s", err)
+		logger.Fatal("Error connecting to IRC server", "error", err)
+	}
+
+	for _, channel := range args.channels {
+		ircClient.Write(logger, ircv3.Message{
+			Command: "JOIN",
+			Params:  []string{channel},
+		})
+	}
+
+	channelState := NewChannelState(args.nick)
+
+	buttons := NewButtonState(args.commandPrefix)
+
+	webAPI := NewWebAPI(logger, metrics, ircClient, args.tokens,
+		args.appTokens, messageLog, channelState, buttons)
+
+	// We're ready while we're connected to IRC and in our channel. We start
+	// serving HTTP only once the server welcomed us.
+	checker := health.New()
+	checker.AddCheck("irc", ircClient.Check)
+	checker.AddCheck("channel", func() error {
+		if _, ok := channelState.Channel(args.channel); !ok {
+			return fmt.Errorf("not in %s", args.channel)
+		}
+		return nil
+	})
+	checker.Register(webAPI)
+
+	webhooks := NewWebhooks(logger, metrics, webAPI, channelState,
+		args.webhooks)
+	webAPI.Handle("/services/", webhooks)
+
+	var socketMode *SocketModeServer
+	if args.socketMode {
+		socketMode = NewSocketModeServer(logger, metrics, args.publicURL,
+			webAPI)
 	}
 
-	webAPI := NewWebAPI(args.verbose, ircClient)
+	listener := NewListener(metrics, args.signingSecret, socketMode)
+
+	responseURLs := NewResponseURLs(logger, args.publicURL, webAPI)
+
+	slashCommands := NewSlashCommands(args.commandURL, args.commandPrefix,
+		listener, responseURLs, ircClient)
+
+	interactions := NewInteractions(args.interactivityURL, listener, buttons,
+		responseURLs, ircClient)
+
+	reloadOnSIGHUP(logger, args, ircClient, slashCommands, buttons, webhooks)
+
 	go func() {
 		if err := webAPI.Serve(args.listenPort); err != nil {
-			log.Fatalf("error serving HTTP: %s", err)
+			logger.Fatal("Error serving HTTP", "error", err)
 		}
 	}()
 
-	eventAPI := NewEventAPI(args.url)
+	eventAPI := NewEventAPI(metrics, args.url, listener)
 
+	relay(args, ircClient, channelState, messageLog, eventAPI, slashCommands,
+		interactions)
+
+	// Deliveries may write to IRC, so stop them before closing the client.
+	listener.Close()
+	ircClient.Close()
+	if err := messageLog.Close(); err != nil {
+		logger.Error("Error closing message log", "error", err)
+	}
+	wg.Wait()
+}
+
+// relay reads messages from IRC until the connection closes. We keep our
+// channel state up to date, answer the server and CTCP queries, and dispatch
+// the messages in our channels to the listener.
+func relay(
+	args Args,
+	ircClient *IRCClient,
+	channelState *ChannelState,
+	messageLog *MessageLog,
+	eventAPI *EventAPI,
+	slashCommands *SlashCommands,
+	interactions *Interactions,
+) {
 	for {
-		m, ok := ircClient.Read()
+		m, logger, ok := ircClient.Read()
 		if !ok {
 			break
 		}
 
+		channelState.Update(m)
+
+		// Ask for the modes of channels we join so we know whether they're
+		// private.
+		if m.Command == "JOIN" && strings.EqualFold(m.SourceNick(), args.nick) {
+			ircClient.Write(logger, ircv3.Message{
+				Command: "MODE",
+				Params:  []string{m.Params[0]},
+			})
+		}
+
 		if m.Command == "PING" {
-			ircClient.Write(irc.Message{
+			ircClient.Write(logger, ircv3.Message{
 				Command: "PONG",
 				Params:  []string{m.Params[0]},
 			})
 			continue
 		}
 
-		if m.Command != "PRIVMSG" {
+		if m.Command == "TAGMSG" {
+			handleTagMsg(logger, m, messageLog, eventAPI)
+			continue
+		}
+
+		if m.Command == "NOTICE" && !args.forwardNotices {
 			continue
 		}
 
-		if m.Params[0][0] != '#' {
+		if m.Command != "PRIVMSG" && m.Command != "NOTICE" {
 			continue
 		}
 
-		if err := eventAPI.DispatchMessageEvent(m); err != nil {
-			log.Printf("error dispatching message event: %s", err)
+		if reply, ok := ctcpReply(m); ok {
+			ircClient.Write(logger, reply)
+			continue
+		}
+
+		if len(m.Params) < 2 || len(m.Params[0]) == 0 ||
+			m.Params[0][0] != '#' {
+			continue
+		}
+
+		// Other than ACTION (/me), CTCP messages are not for the channel. CTCP
+		// NOTICEs are replies to queries.
+		if ctcp, ok := parseCTCP(m.Params[1]); ok &&
+			(m.Command == "NOTICE" || ctcp.Command != "ACTION") {
+			continue
+		}
+
+		channel := m.Params[0]
+		message := messageFromIRC(m, args.nick)
+
+		// With echo-message the server sends us the messages we send. We logged
+		// them when we sent them.
+		if ircClient.HasCap("echo-message") &&
+			strings.EqualFold(m.SourceNick(), args.nick) {
+			messageLog.MatchEcho(channel, message.Text, message.MsgID)
+			continue
+		}
+
+		// Commands and choosing buttons aren't messages in the channel as far
+		// as the listener is concerned.
+		if m.Command == "PRIVMSG" && message.SubType == "" {
+			if interactions.Dispatch(logger, channel, message.User,
+				message.Text) {
+				continue
+			}
+			if slashCommands.Dispatch(logger, channel, message.User,
+				message.Text) {
+				continue
+			}
+		}
+
+		message = messageLog.AddAt(channel, message, messageTime(logger, m))
+
+		if err := eventAPI.DispatchMessageEvent(logger, channel,
+			message); err != nil {
+			logger.Error("Error dispatching message event", "error", err)
 			continue
 		}
 	}
+}
 
-	ircClient.Close()
-	wg.Wait()
+// handleTagMsg handles a TAGMSG. If it's a reaction to a message we know
+// about, we record it and dispatch an event. logger is for entries about the
+// TAGMSG.
+func handleTagMsg(
+	logger *logging.Logger,
+	m ircv3.Message,
+	messageLog *MessageLog,
+	eventAPI *EventAPI,
+) {
+	if len(m.Params) < 1 || len(m.Params[0]) == 0 || m.Params[0][0] != '#' {
+		return
+	}
+
+	reaction, ok := reactionFromIRC(m)
+	if !ok {
+		return
+	}
+
+	channel := m.Params[0]
+	user := m.SourceNick()
+
+	message, ok := messageLog.MessageByMsgID(channel, reaction.MsgID)
+	if !ok {
+		return
+	}
+
+	var err error
+	if reaction.Added {
+		message, err = messageLog.AddReaction(channel, message.Ts, reaction.Name,
+			user)
+	} else {
+		message, err = messageLog.RemoveReaction(channel, message.Ts,
+			reaction.Name, user)
+	}
+	if err != nil {
+		// E.g. they already reacted this way.
+		return
+	}
+
+	if err := eventAPI.DispatchReactionEvent(logger, channel, message, user,
+		reaction.Name, reaction.Added); err != nil {
+		logger.Error("Error dispatching reaction event", "error", err)
+	}
 }
 
-// Args are command line arguments.
+// newLogger creates the logger to log with. We send what others log with the
+// standard log package, such as net/http, through it too.
+func newLogger(level logging.Level, format logging.Format) *logging.Logger {
+	logger := logging.New(os.Stderr, level, format)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.LevelInfo))
+	return logger
+}
+
+// Args are our settings. They come from command line arguments, the
+// environment, and a config file.
 type Args struct {
-	verbose    bool
-	listenPort int
-	url        string
-	ircHost    string
-	ircPort    int
-	nick       string
-	channel    string
+	logLevel    logging.Level
+	logFormat   logging.Format
+	listenPort  int
+	url         string
+	ircHost     string
+	ircPort     int
+	nick        string
+	channel     string
+	tokens      []string
+	appTokens   []string
+	historySize int
+	historyFile string
+
+	// Channels to join other than channel.
+	channels []string
+
+	// Incoming webhooks we serve.
+	webhooks []Webhook
+
+	forwardNotices bool
+
+	commandURL       string
+	commandPrefix    string
+	interactivityURL string
+	publicURL        string
+	signingSecret    string
+	socketMode       bool
 }
 
-func getArgs() (Args, error) {
-	verbose := flag.Bool("verbose", false, "Enable verbose output")
-	listenPort := flag.Int("listen-port", 8081, "Port to listen on (HTTP)")
-	url := flag.String("url", "http://localhost:8080/event",
+// envPrefix prefixes the names of environment variables holding settings,
+// e.g. HORATIO_TOKENS.
+const envPrefix = "HORATIO"
+
+// getArgs reads our settings. arguments are the command line arguments. We
+// write usage to output if there's a problem.
+func getArgs(arguments []string, output io.Writer) (Args, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.SetOutput(output)
+
+	fs.String(config.ConfigFlag, "",
+		"Config file to read settings from (optional). Its keys are these "+
+			"flags' names")
+	verbose := fs.Bool("verbose", false,
+		"Enable verbose output. The same as -log-level debug")
+	logLevel := fs.String("log-level", "info",
+		"Log entries at this level and above: debug, info, warn, or error")
+	logFormat := fs.String("log-format", "logfmt",
+		"Log format: logfmt or json")
+	listenPort := fs.Int("listen-port", 8081, "Port to listen on (HTTP)")
+	url := fs.String("url", "http://localhost:8080/event",
 		"Event API listener URL. We send message events here.")
-	ircHost := flag.String("irc-host", "localhost", "IRC server host")
-	ircPort := flag.Int("irc-port", 6667, "IRC server port")
-	nick := flag.String("nick", "Yorick", "Nickname to use")
-	channel := flag.String("channel", "#test", "Channel to join")
+	ircHost := fs.String("irc-host", "localhost", "IRC server host")
+	ircPort := fs.Int("irc-port", 6667, "IRC server port")
+	nick := fs.String("nick", "Yorick", "Nickname to use")
+	channel := fs.String("channel", "#test", "Channel to join")
+	var channels config.List
+	fs.Var(&channels, "channels",
+		"Comma separated list of other channels to join (optional)")
+	var tokens config.List
+	fs.Var(&tokens, "tokens",
+		"Comma separated list of bot tokens to accept in Web API requests")
+	var appTokens config.List
+	fs.Var(&appTokens, "app-tokens",
+		"Comma separated list of app-level tokens to accept. Listeners use "+
+			"these to open Socket Mode connections.")
+	historySize := fs.Int("history-size", 1000,
+		"Number of messages to remember per channel")
+	historyFile := fs.String("history-file", "",
+		"File to save messages in so we remember them across restarts (optional)")
+	forwardNotices := fs.Bool("forward-notices", false,
+		"Send NOTICEs to channels as message events with the irc_notice subtype")
 
-	flag.Parse()
+	commandURL := fs.String("command-url", "http://localhost:8080/command",
+		"Slash command listener URL. We send commands here.")
+	commandPrefix := fs.String("command-prefix", "!",
+		"Messages starting with this are slash commands or choose buttons. "+
+			"Blank to disable.")
+	interactivityURL := fs.String("interactivity-url",
+		"http://localhost:8080/interactivity",
+		"Interactivity listener URL. We send button choices here.")
+	publicURL := fs.String("public-url", "",
+		"URL the listeners can reach us at. We use this for response URLs. "+
+			"Defaults to http://localhost:<listen-port>")
+	signingSecret := fs.String("signing-secret", "",
+		"Secret to sign requests we send with (optional)")
+	socketMode := fs.Bool("socket-mode", false,
+		"Send events, commands, and interactions over Socket Mode connections "+
+			"rather than as HTTP requests. Needs -app-tokens.")
+	var webhookList config.List
+	fs.Var(&webhookList, "webhooks",
+		"Comma separated list of incoming webhooks to serve at /services/, "+
+			"each T.../B.../secret=#channel (optional)")
+
+	if err := config.Parse(fs, arguments, envPrefix); err != nil {
+		return Args{}, err
+	}
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fs.PrintDefaults()
+		return Args{}, err
+	}
+	if *verbose {
+		level = logging.LevelDebug
+	}
+
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		fs.PrintDefaults()
+		return Args{}, err
+	}
 
 	if *listenPort <= 0 {
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		return Args{}, fmt.Errorf("listen port must be > 0")
 	}
 
 	if *url == "" {
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		return Args{}, fmt.Errorf("you must provide a URL")
 	}
 
 	if *ircHost == "" {
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		return Args{}, fmt.Errorf("you must provide an IRC host")
 	}
 
 	if *ircPort <= 0 {
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		return Args{}, fmt.Errorf("you must provide an IRC port")
 	}
 
 	if *nick == "" {
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		return Args{}, fmt.Errorf("you must provide a nick")
 	}
 
 	if *channel == "" {
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		return Args{}, fmt.Errorf("you must provide a channel")
 	}
 
+	for _, c := range channels {
+		if c[0] != '#' {
+			fs.PrintDefaults()
+			return Args{}, fmt.Errorf("channels must start with #: %s", c)
+		}
+	}
+
+	if *publicURL == "" {
+		*publicURL = fmt.Sprintf("http://localhost:%d", *listenPort)
+	}
+
+	if len(tokens) == 0 {
+		fs.PrintDefaults()
+		return Args{}, fmt.Errorf("you must provide at least one token")
+	}
+
+	if *socketMode && len(appTokens) == 0 {
+		fs.PrintDefaults()
+		return Args{}, fmt.Errorf("you must provide an app token to use Socket Mode")
+	}
+
+	if *historySize <= 0 {
+		fs.PrintDefaults()
+		return Args{}, fmt.Errorf("history size must be > 0")
+	}
+
+	var webhooks []Webhook
+	for _, s := range webhookList {
+		webhook, err := ParseWebhook(s)
+		if err != nil {
+			fs.PrintDefaults()
+			return Args{}, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
 	return Args{
-		verbose:    *verbose,
-		listenPort: *listenPort,
-		url:        *url,
-		ircHost:    *ircHost,
-		ircPort:    *ircPort,
-		nick:       *nick,
-		channel:    *channel,
+		logLevel:    level,
+		logFormat:   format,
+		listenPort:  *listenPort,
+		url:         *url,
+		ircHost:     *ircHost,
+		ircPort:     *ircPort,
+		nick:        *nick,
+		channel:     *channel,
+		tokens:      tokens,
+		appTokens:   appTokens,
+		historySize: *historySize,
+		historyFile: *historyFile,
+
+		channels: channels,
+		webhooks: webhooks,
+
+		forwardNotices: *forwardNotices,
+
+		commandURL:       *commandURL,
+		commandPrefix:    *commandPrefix,
+		interactivityURL: *interactivityURL,
+		publicURL:        *publicURL,
+		signingSecret:    *signingSecret,
+		socketMode:       *socketMode,
 	}, nil
 }
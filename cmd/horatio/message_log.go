@@ -0,0 +1,756 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// MessageLog remembers the most recent messages in each channel. This
+// includes messages we see on IRC and messages we send via the Web API.
+//
+// We keep a fixed number of messages per channel. Optionally we write
+// messages to a file so that we remember them across restarts. We append to
+// the file and compact it from time to time so it holds only the messages we
+// keep.
+type MessageLog struct {
+	mutex  sync.Mutex
+	logger *logging.Logger
+
+	// The number of messages to keep per channel.
+	size int
+
+	// Messages keyed by lowercased channel name.
+	channels map[string]*messageRing
+
+	// The timestamp of the last message we logged, in microseconds. Each
+	// message gets a unique timestamp.
+	lastTs int64
+
+	// file may be nil. If it is not, we append each message to it. It's at
+	// path.
+	file *os.File
+	path string
+
+	// How many messages are in the file. Some of them we no longer keep.
+	fileMessages int
+}
+
+// LoggedMessage is a message in a channel's history. It's structured to be
+// similar to a message in a Slack conversations.history response.
+type LoggedMessage struct {
+	Type     string `json:"type"`
+	SubType  string `json:"subtype,omitempty"`
+	User     string `json:"user"`
+	BotID    string `json:"bot_id,omitempty"`
+	Text     string `json:"text"`
+	Ts       string `json:"ts"`
+	ThreadTs string `json:"thread_ts,omitempty"`
+
+	// The IRC message ID (the msgid tag), if the server gave the message one.
+	// Reactions on IRC refer to messages by this ID.
+	MsgID string `json:"irc_msgid,omitempty"`
+
+	// Blocks and attachments in messages we sent.
+	Blocks      []Block      `json:"blocks,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// The sender's IRC account, if the server told us it.
+	UserProfile *UserProfile `json:"user_profile,omitempty"`
+
+	Reactions []Reaction `json:"reactions,omitempty"`
+
+	// Whether we sent the message and expect the server to echo it back to us
+	// (echo-message).
+	awaitingEcho bool
+}
+
+// Reaction is an emoji reaction to a message.
+type Reaction struct {
+	Name  string   `json:"name"`
+	Users []string `json:"users"`
+	Count int      `json:"count"`
+}
+
+// messageLogRecord is a line in the message log file.
+type messageLogRecord struct {
+	Channel string        `json:"channel"`
+	Message LoggedMessage `json:"message"`
+}
+
+// NewMessageLog creates a MessageLog keeping size messages per channel.
+//
+// If path is not blank, we load messages from the file at that path and
+// append new messages to it. We rewrite the file at startup so it holds only
+// the messages we keep, and again whenever it holds twice as many.
+func NewMessageLog(
+	logger *logging.Logger,
+	size int,
+	path string,
+) (*MessageLog, error) {
+	l := &MessageLog{
+		logger:   logger,
+		size:     size,
+		channels: map[string]*messageRing{},
+	}
+
+	if path == "" {
+		return l, nil
+	}
+
+	if err := l.load(path); err != nil {
+		return nil, err
+	}
+
+	l.path = path
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// compact rewrites the file so it holds only the messages we keep and opens
+// it for appending. The caller must hold the mutex or otherwise have
+// exclusive access.
+//
+// If we can't rewrite the file, we carry on appending to the old one.
+func (l *MessageLog) compact() error {
+	if err := l.rewrite(l.path); err != nil {
+		return err
+	}
+
+	// The file we were appending to is gone. The rewritten one replaced it.
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			l.logger.Warn("Error closing message log", "error", err)
+		}
+		l.file = nil
+	}
+
+	fh, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening message log: %s", err)
+	}
+	l.file = fh
+	l.fileMessages = l.kept()
+
+	return nil
+}
+
+// kept returns how many messages we keep across all channels. The caller
+// must hold the mutex or otherwise have exclusive access.
+func (l *MessageLog) kept() int {
+	n := 0
+	for _, ring := range l.channels {
+		n += ring.count
+	}
+	return n
+}
+
+// load reads messages from the file.
+func (l *MessageLog) load(path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error opening message log: %s", err)
+	}
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var record messageLogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			_ = fh.Close()
+			return fmt.Errorf("error parsing message log line: %s: %s",
+				scanner.Text(), err)
+		}
+
+		ts, err := parseTs(record.Message.Ts)
+		if err != nil {
+			_ = fh.Close()
+			return fmt.Errorf("invalid timestamp in message log: %s",
+				record.Message.Ts)
+		}
+		if ts > l.lastTs {
+			l.lastTs = ts
+		}
+
+		l.ring(record.Channel).add(record.Message)
+	}
+
+	if err := scanner.Err(); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("error reading message log: %s", err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("error closing message log: %s", err)
+	}
+
+	return nil
+}
+
+// rewrite writes the messages we hold to the file, replacing it.
+func (l *MessageLog) rewrite(path string) error {
+	tmpPath := path + ".tmp"
+	fh, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening message log: %s", err)
+	}
+
+	w := bufio.NewWriter(fh)
+	for channel, ring := range l.channels {
+		for _, m := range ring.all() {
+			buf, err := json.Marshal(messageLogRecord{Channel: channel, Message: m})
+			if err != nil {
+				_ = fh.Close()
+				return fmt.Errorf("error marshaling message: %s", err)
+			}
+			if _, err := w.Write(append(buf, '\n')); err != nil {
+				_ = fh.Close()
+				return fmt.Errorf("error writing message log: %s", err)
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("error writing message log: %s", err)
+	}
+
+	if err := fh.Sync(); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("error syncing message log: %s", err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("error closing message log: %s", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error renaming message log: %s", err)
+	}
+
+	return nil
+}
+
+// Close closes the log's file if it has one.
+func (l *MessageLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	l.path = ""
+	return err
+}
+
+// Add logs a message in a channel. We give the message its timestamp and
+// return it.
+func (l *MessageLog) Add(channel string, m LoggedMessage) LoggedMessage {
+	return l.AddAt(channel, m, time.Now())
+}
+
+// AddAt logs a message in a channel that was sent at the given time. We give
+// the message its timestamp and return it.
+//
+// The timestamp is based on the time. However, timestamps are unique and
+// increase, so if we already logged a message at or after that time it will
+// be later.
+func (l *MessageLog) AddAt(
+	channel string,
+	m LoggedMessage,
+	t time.Time,
+) LoggedMessage {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	m.Type = "message"
+	m.Ts = l.nextTs(t)
+
+	channel = strings.ToLower(channel)
+	l.ring(channel).add(m)
+
+	if l.path == "" {
+		return m
+	}
+
+	if l.file != nil {
+		buf, err := json.Marshal(messageLogRecord{Channel: channel, Message: m})
+		if err == nil {
+			_, err = l.file.Write(append(buf, '\n'))
+		}
+		if err != nil {
+			// We still have the message in memory.
+			l.logger.Error("Error writing to message log", "channel", channel,
+				"error", err)
+		}
+		l.fileMessages++
+	}
+
+	// Messages we no longer keep are taking up room in the file. If we have
+	// no file, because we failed to reopen it, compacting writes out what we
+	// have and tries again.
+	if l.file == nil || l.fileMessages > 2*l.kept() {
+		if err := l.compact(); err != nil {
+			// We'll try again after the next message. Until then we have the
+			// messages in memory.
+			l.logger.Error("Error compacting message log", "error", err)
+		}
+	}
+
+	return m
+}
+
+// NewTs returns a unique timestamp without logging a message. This is for
+// messages we don't keep, such as ephemeral messages.
+func (l *MessageLog) NewTs() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.nextTs(time.Now())
+}
+
+// nextTs returns a unique timestamp. It is the given time unless we already
+// used that or a later one. The caller must hold the mutex.
+func (l *MessageLog) nextTs(t time.Time) string {
+	ts := t.UnixNano() / int64(time.Microsecond)
+	if ts <= l.lastTs {
+		ts = l.lastTs + 1
+	}
+	l.lastTs = ts
+	return formatTs(ts)
+}
+
+// ring returns the ring holding a channel's messages, creating it if
+// necessary. The caller must hold the mutex or otherwise have exclusive
+// access.
+func (l *MessageLog) ring(channel string) *messageRing {
+	channel = strings.ToLower(channel)
+	ring, ok := l.channels[channel]
+	if !ok {
+		ring = newMessageRing(l.size)
+		l.channels[channel] = ring
+	}
+	return ring
+}
+
+// messages returns a copy of the messages in a channel, oldest first.
+func (l *MessageLog) messages(channel string) []LoggedMessage {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	ring, ok := l.channels[strings.ToLower(channel)]
+	if !ok {
+		return nil
+	}
+	return ring.all()
+}
+
+// MessageByMsgID returns the message in a channel with the given IRC message
+// ID.
+func (l *MessageLog) MessageByMsgID(
+	channel,
+	msgID string,
+) (LoggedMessage, bool) {
+	if msgID == "" {
+		return LoggedMessage{}, false
+	}
+	for _, m := range l.messages(channel) {
+		if m.MsgID == msgID {
+			return m, true
+		}
+	}
+	return LoggedMessage{}, false
+}
+
+// MatchEcho finds the message we sent that the server echoed back to us. The
+// echo has the given text and IRC message ID. We record the ID on the message
+// so people can react to it. We return false if we aren't waiting for an echo
+// of such a message.
+//
+// If we sent the same text more than once, we match the oldest first as that
+// is the order the server echoes them. We send a message with several lines
+// as several IRC messages. We match the first and ignore the others.
+func (l *MessageLog) MatchEcho(channel, text, msgID string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	ring, ok := l.channels[strings.ToLower(channel)]
+	if !ok {
+		return false
+	}
+
+	for i := 0; i < ring.count; i++ {
+		m := ring.at(i)
+		if !m.awaitingEcho {
+			continue
+		}
+		if lines := ircLines(m.Text); len(lines) > 0 && lines[0] == text {
+			m.awaitingEcho = false
+			m.MsgID = msgID
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddReaction records that user reacted to the message in a channel with the
+// given timestamp. We return the message.
+//
+// We only remember reactions in memory. We don't write them to the file.
+func (l *MessageLog) AddReaction(
+	channel,
+	ts,
+	name,
+	user string,
+) (LoggedMessage, error) {
+	return l.updateMessage(channel, ts, func(m *LoggedMessage) error {
+		for i := range m.Reactions {
+			r := &m.Reactions[i]
+			if r.Name != name {
+				continue
+			}
+			for _, u := range r.Users {
+				if strings.EqualFold(u, user) {
+					return apiError("already_reacted")
+				}
+			}
+			r.Users = append(r.Users, user)
+			r.Count++
+			return nil
+		}
+
+		m.Reactions = append(m.Reactions, Reaction{
+			Name:  name,
+			Users: []string{user},
+			Count: 1,
+		})
+		return nil
+	})
+}
+
+// RemoveReaction removes user's reaction to the message in a channel with the
+// given timestamp. We return the message.
+func (l *MessageLog) RemoveReaction(
+	channel,
+	ts,
+	name,
+	user string,
+) (LoggedMessage, error) {
+	return l.updateMessage(channel, ts, func(m *LoggedMessage) error {
+		for i := range m.Reactions {
+			r := &m.Reactions[i]
+			if r.Name != name {
+				continue
+			}
+			for j, u := range r.Users {
+				if !strings.EqualFold(u, user) {
+					continue
+				}
+				r.Users = append(r.Users[:j:j], r.Users[j+1:]...)
+				r.Count--
+				if r.Count == 0 {
+					m.Reactions = append(m.Reactions[:i:i], m.Reactions[i+1:]...)
+				}
+				return nil
+			}
+		}
+		return apiError("no_reaction")
+	})
+}
+
+// updateMessage calls update with the message in a channel with the given
+// timestamp. If update succeeds we keep its changes and return the message.
+func (l *MessageLog) updateMessage(
+	channel,
+	ts string,
+	update func(*LoggedMessage) error,
+) (LoggedMessage, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	ring, ok := l.channels[strings.ToLower(channel)]
+	if !ok {
+		return LoggedMessage{}, apiError("message_not_found")
+	}
+
+	m := ring.find(ts)
+	if m == nil {
+		return LoggedMessage{}, apiError("message_not_found")
+	}
+
+	// Work on a copy so a failed update changes nothing. Copy the reactions
+	// too as messages we returned earlier share them.
+	updated := *m
+	updated.Reactions = nil
+	for _, r := range m.Reactions {
+		r.Users = append([]string(nil), r.Users...)
+		updated.Reactions = append(updated.Reactions, r)
+	}
+
+	if err := update(&updated); err != nil {
+		return LoggedMessage{}, err
+	}
+
+	*m = updated
+	return updated, nil
+}
+
+// HistoryQuery describes which messages to return from History or Replies.
+//
+// It corresponds to the arguments Slack's conversations.history and
+// conversations.replies methods take.
+type HistoryQuery struct {
+	// Only messages after Oldest and before Latest. Either may be blank.
+	Oldest string
+	Latest string
+
+	// Whether to include messages with exactly the Oldest or Latest timestamp.
+	Inclusive bool
+
+	// The maximum number of messages to return.
+	Limit int
+
+	// The cursor from a previous page. Blank for the first page.
+	Cursor string
+}
+
+// HistoryPage is a page of messages.
+type HistoryPage struct {
+	Messages []LoggedMessage
+
+	// If there are more messages, NextCursor is the cursor to get them with.
+	HasMore    bool
+	NextCursor string
+}
+
+// History returns messages in a channel, newest first.
+func (l *MessageLog) History(
+	channel string,
+	q HistoryQuery,
+) (HistoryPage, error) {
+	messages := l.messages(channel)
+
+	// Newest first.
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return paginate(messages, q, true)
+}
+
+// Replies returns a message and the replies in its thread, oldest first.
+func (l *MessageLog) Replies(
+	channel,
+	ts string,
+	q HistoryQuery,
+) (HistoryPage, error) {
+	var thread []LoggedMessage
+	for _, m := range l.messages(channel) {
+		if m.Ts == ts || m.ThreadTs == ts {
+			thread = append(thread, m)
+		}
+	}
+
+	if len(thread) == 0 {
+		return HistoryPage{}, apiError("thread_not_found")
+	}
+
+	return paginate(thread, q, false)
+}
+
+// paginate applies the query to the messages. If newestFirst is true, the
+// messages are ordered newest first and the cursor moves to older messages.
+// Otherwise they are oldest first and the cursor moves to newer messages.
+func paginate(
+	messages []LoggedMessage,
+	q HistoryQuery,
+	newestFirst bool,
+) (HistoryPage, error) {
+	oldest, err := parseOptionalTs(q.Oldest, 0)
+	if err != nil {
+		return HistoryPage{}, apiError("invalid_ts_oldest")
+	}
+
+	latest, err := parseOptionalTs(q.Latest, -1)
+	if err != nil {
+		return HistoryPage{}, apiError("invalid_ts_latest")
+	}
+
+	after := int64(-1)
+	if q.Cursor != "" {
+		after, err = decodeCursor(q.Cursor)
+		if err != nil {
+			return HistoryPage{}, apiError("invalid_cursor")
+		}
+	}
+
+	var page HistoryPage
+	for _, m := range messages {
+		ts, err := parseTs(m.Ts)
+		if err != nil {
+			continue
+		}
+
+		if ts < oldest || (latest != -1 && ts > latest) {
+			continue
+		}
+		if !q.Inclusive && (ts == oldest || ts == latest) {
+			continue
+		}
+
+		if after != -1 {
+			if newestFirst && ts >= after {
+				continue
+			}
+			if !newestFirst && ts <= after {
+				continue
+			}
+		}
+
+		if len(page.Messages) == q.Limit {
+			page.HasMore = true
+			last, _ := parseTs(page.Messages[len(page.Messages)-1].Ts)
+			page.NextCursor = encodeCursor(last)
+			break
+		}
+
+		page.Messages = append(page.Messages, m)
+	}
+
+	return page, nil
+}
+
+// Cursors look like Slack's. They are base64 encoded "next_ts:<ts>" where ts
+// is the timestamp of the last message in the previous page, in
+// microseconds.
+const cursorPrefix = "next_ts:"
+
+func encodeCursor(ts int64) string {
+	return base64.StdEncoding.EncodeToString(
+		[]byte(cursorPrefix + strconv.FormatInt(ts, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	buf, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	s := string(buf)
+	if !strings.HasPrefix(s, cursorPrefix) {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+
+	return strconv.ParseInt(strings.TrimPrefix(s, cursorPrefix), 10, 64)
+}
+
+// formatTs formats a timestamp in microseconds the way Slack does, e.g.
+// 1512085950.000216.
+func formatTs(ts int64) string {
+	return fmt.Sprintf("%d.%06d", ts/1000000, ts%1000000)
+}
+
+// parseTs parses a Slack timestamp to microseconds.
+func parseTs(s string) (int64, error) {
+	parts := strings.SplitN(s, ".", 2)
+
+	secs, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp: %s", s)
+	}
+
+	var micros int64
+	if len(parts) == 2 && parts[1] != "" {
+		frac := parts[1]
+		if len(frac) > 6 {
+			frac = frac[:6]
+		}
+		frac += strings.Repeat("0", 6-len(frac))
+		micros, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp: %s", s)
+		}
+	}
+
+	return secs*1000000 + micros, nil
+}
+
+// parseOptionalTs parses a timestamp that may be blank. If it is blank we
+// return def.
+func parseOptionalTs(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	return parseTs(s)
+}
+
+// messageRing holds up to a fixed number of messages. When it is full, adding
+// a message drops the oldest.
+type messageRing struct {
+	messages []LoggedMessage
+	start    int
+	count    int
+}
+
+func newMessageRing(size int) *messageRing {
+	return &messageRing{
+		messages: make([]LoggedMessage, size),
+	}
+}
+
+func (r *messageRing) add(m LoggedMessage) {
+	if len(r.messages) == 0 {
+		return
+	}
+
+	if r.count < len(r.messages) {
+		r.messages[(r.start+r.count)%len(r.messages)] = m
+		r.count++
+		return
+	}
+
+	r.messages[r.start] = m
+	r.start = (r.start + 1) % len(r.messages)
+}
+
+// find returns the message with the given timestamp, or nil if there isn't
+// one.
+func (r *messageRing) find(ts string) *LoggedMessage {
+	for i := 0; i < r.count; i++ {
+		if m := r.at(i); m.Ts == ts {
+			return m
+		}
+	}
+	return nil
+}
+
+// at returns the ith message, counting from the oldest.
+func (r *messageRing) at(i int) *LoggedMessage {
+	return &r.messages[(r.start+i)%len(r.messages)]
+}
+
+// all returns a copy of the messages, oldest first.
+func (r *messageRing) all() []LoggedMessage {
+	messages := make([]LoggedMessage, 0, r.count)
+	for i := 0; i < r.count; i++ {
+		messages = append(messages, *r.at(i))
+	}
+	return messages
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/andyjack/court/internal/metrics"
+)
+
+// Metrics are what we count and time. We serve them at /metrics in the
+// Prometheus text format.
+type Metrics struct {
+	registry *metrics.Registry
+
+	// IRC messages we read and wrote, by command, and how many messages are
+	// waiting to be written.
+	ircMessagesRead    *metrics.Counter
+	ircMessagesWritten *metrics.Counter
+	ircWriteQueue      *metrics.Gauge
+
+	// Events we sent to the listener and events we failed to send, by type,
+	// such as message.
+	eventsDispatched      *metrics.Counter
+	eventDispatchFailures *metrics.Counter
+
+	// Events, slash commands, and interactions waiting to be sent to the
+	// listener, and those we dropped because too many were waiting, by kind,
+	// such as event.
+	listenerQueue   *metrics.Gauge
+	listenerDropped *metrics.Counter
+
+	// Web API requests we served, by method and error. The error is blank if
+	// the request succeeded. We count requests for methods we don't implement
+	// as the method unknown so people can't make up label values.
+	webAPIRequests        *metrics.Counter
+	webAPIRequestDuration *metrics.Histogram
+
+	// Socket Mode connections listeners opened, and how many are open.
+	socketModeConnectionsOpened *metrics.Counter
+	socketModeConnections       *metrics.Gauge
+
+	// Incoming webhook requests we served, by error. The error is blank if
+	// the request succeeded.
+	webhookRequests *metrics.Counter
+}
+
+// NewMetrics creates our metrics.
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+
+	return &Metrics{
+		registry: r,
+
+		ircMessagesRead: r.NewCounter("horatio_irc_messages_read_total",
+			"IRC messages read, by command", "command"),
+		ircMessagesWritten: r.NewCounter("horatio_irc_messages_written_total",
+			"IRC messages written, by command", "command"),
+		ircWriteQueue: r.NewGauge("horatio_irc_write_queue_length",
+			"IRC messages waiting to be written"),
+
+		eventsDispatched: r.NewCounter("horatio_events_dispatched_total",
+			"Events sent to the listener, by type", "type"),
+		eventDispatchFailures: r.NewCounter(
+			"horatio_event_dispatch_failures_total",
+			"Events we failed to send to the listener, by type", "type"),
+
+		listenerQueue: r.NewGauge("horatio_listener_queue_length",
+			"Events, slash commands, and interactions waiting to be sent to "+
+				"the listener"),
+		listenerDropped: r.NewCounter("horatio_listener_dropped_total",
+			"Events, slash commands, and interactions we dropped because too "+
+				"many were waiting, by kind", "kind"),
+
+		webAPIRequests: r.NewCounter("horatio_web_api_requests_total",
+			"Web API requests, by method and error (blank if the request "+
+				"succeeded)", "method", "error"),
+		webAPIRequestDuration: r.NewHistogram(
+			"horatio_web_api_request_duration_seconds",
+			"How long Web API requests took, by method", nil, "method"),
+
+		socketModeConnectionsOpened: r.NewCounter(
+			"horatio_socket_mode_connections_opened_total",
+			"Socket Mode connections listeners opened"),
+		socketModeConnections: r.NewGauge("horatio_socket_mode_connections",
+			"Socket Mode connections open"),
+
+		webhookRequests: r.NewCounter("horatio_webhook_requests_total",
+			"Incoming webhook requests, by error (blank if the request "+
+				"succeeded)", "error"),
+	}
+}
+
+// Handler returns the HTTP handler serving the metrics.
+func (m *Metrics) Handler() http.Handler {
+	return m.registry
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andyjack/court/internal/irctest"
+	"github.com/andyjack/court/internal/ircv3"
+	"github.com/andyjack/court/internal/logging"
+)
+
+// testTimeout is how long we wait for something to happen.
+const testTimeout = 5 * time.Second
+
+// testToken is the bot token the Web API accepts in tests.
+const testToken = "xoxb-test"
+
+// testHoratio is horatio connected to an irctest server, relaying to an Event
+// API listener.
+type testHoratio struct {
+	ircServer    *irctest.Server
+	ircClient    *IRCClient
+	channelState *ChannelState
+	messageLog   *MessageLog
+	webAPI       *httptest.Server
+
+	// Events the listener received.
+	events chan MessageEvent
+
+	// Closed when relay returns.
+	done chan struct{}
+
+	listener *httptest.Server
+	wg       sync.WaitGroup
+
+	// Sends to listener.
+	sender *Listener
+
+	// While locked for writing, listener doesn't respond.
+	hold sync.RWMutex
+}
+
+// newTestHoratio starts an IRC server and horatio connected to it. horatio
+// joins #test. Call close when done.
+func newTestHoratio(t *testing.T, caps ...string) *testHoratio {
+	ircServer, err := irctest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting IRC server: %s", err)
+	}
+	ircServer.SetCaps(caps...)
+
+	h := &testHoratio{
+		ircServer: ircServer,
+		events:    make(chan MessageEvent, 100),
+		done:      make(chan struct{}),
+	}
+
+	h.listener = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			h.hold.RLock()
+			h.hold.RUnlock()
+
+			var event MessageEvent
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				t.Errorf("error decoding event: %s", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			h.events <- event
+		}))
+
+	args := Args{
+		url:         h.listener.URL,
+		nick:        "horatio",
+		channel:     "#test",
+		tokens:      []string{testToken},
+		historySize: 100,
+	}
+
+	logger := logging.New(ioutil.Discard, logging.LevelDebug,
+		logging.FormatLogfmt)
+	metrics := NewMetrics()
+
+	h.ircClient, err = NewIRCClient(logger, metrics, args.nick, args.channel,
+		ircServer.Host(), ircServer.Port(), &h.wg)
+	if err != nil {
+		t.Fatalf("error connecting to IRC server: %s", err)
+	}
+
+	h.messageLog, err = NewMessageLog(logger, args.historySize, "")
+	if err != nil {
+		t.Fatalf("error creating message log: %s", err)
+	}
+
+	h.channelState = NewChannelState(args.nick)
+	buttons := NewButtonState(args.commandPrefix)
+
+	webAPI := NewWebAPI(logger, metrics, h.ircClient, args.tokens, nil,
+		h.messageLog, h.channelState, buttons)
+	webAPI.Handle("/services/", NewWebhooks(logger, metrics, webAPI,
+		h.channelState, testWebhooks))
+	h.webAPI = httptest.NewServer(webAPI.Handler())
+
+	h.sender = NewListener(metrics, "", nil)
+	responseURLs := NewResponseURLs(logger, h.webAPI.URL, webAPI)
+	slashCommands := NewSlashCommands("", "!", h.sender, responseURLs,
+		h.ircClient)
+	interactions := NewInteractions("", h.sender, buttons, responseURLs,
+		h.ircClient)
+	eventAPI := NewEventAPI(metrics, args.url, h.sender)
+
+	go func() {
+		relay(args, h.ircClient, h.channelState, h.messageLog, eventAPI,
+			slashCommands, interactions)
+		close(h.done)
+	}()
+
+	return h
+}
+
+// close stops horatio and the servers.
+func (h *testHoratio) close() {
+	h.sender.Close()
+	h.ircClient.Close()
+	<-h.done
+	h.wg.Wait()
+	h.webAPI.Close()
+	h.listener.Close()
+	_ = h.ircServer.Close()
+}
+
+// waitForChannel waits until horatio knows it's in the channel.
+func (h *testHoratio) waitForChannel(t *testing.T, name string) {
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if _, ok := h.channelState.Channel(name); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting to join %s", name)
+}
+
+// waitForEvent waits for the listener to receive an event.
+func (h *testHoratio) waitForEvent(t *testing.T) MessageEvent {
+	select {
+	case event := <-h.events:
+		return event
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for event")
+		return MessageEvent{}
+	}
+}
+
+// callWebAPI calls a Web API method and decodes the response into resp.
+func (h *testHoratio) callWebAPI(
+	t *testing.T,
+	method string,
+	values url.Values,
+	resp interface{},
+) {
+	values.Set("token", testToken)
+	httpResp, err := http.PostForm(h.webAPI.URL+"/api/"+method, values)
+	if err != nil {
+		t.Fatalf("error calling %s: %s", method, err)
+	}
+	defer httpResp.Body.Close()
+
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		t.Fatalf("error decoding %s response: %s", method, err)
+	}
+}
+
+// waitForPrivmsg waits for horatio to send a PRIVMSG with the text.
+func (h *testHoratio) waitForPrivmsg(
+	t *testing.T,
+	target,
+	text string,
+) {
+	_, err := h.ircServer.WaitFor(func(m ircv3.Message) bool {
+		return m.Command == "PRIVMSG" && len(m.Params) == 2 &&
+			m.Params[0] == target && m.Params[1] == text
+	}, testTimeout)
+	if err != nil {
+		t.Fatalf("waiting for PRIVMSG %s :%s: %s", target, text, err)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	h := newTestHoratio(t)
+	defer h.close()
+
+	// Registration.
+	if _, err := h.ircServer.WaitForClient("horatio", testTimeout); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := h.ircClient.Check(); err != nil {
+		t.Errorf("Check() = %s after registering, wanted nil", err)
+	}
+
+	// JOIN.
+	h.waitForChannel(t, "#test")
+
+	// Someone else's message fans out to the listener.
+	if err := h.ircServer.Join("alice", "#test"); err != nil {
+		t.Fatalf("error joining: %s", err)
+	}
+	if err := h.ircServer.Say("alice", "#test", "hello there"); err != nil {
+		t.Fatalf("error saying: %s", err)
+	}
+
+	event := h.waitForEvent(t)
+	if event.Type != "event_callback" || event.Event.Type != "message" ||
+		event.Event.Channel != "#test" || event.Event.User != "alice" ||
+		event.Event.Text != "hello there" || event.Event.Ts == "" {
+		t.Errorf("got event %+v, wanted alice's message in #test", event)
+	}
+
+	var history HistoryResponse
+	h.callWebAPI(t, "conversations.history", url.Values{
+		"channel": {"#test"},
+	}, &history)
+	if !history.OK || len(history.Messages) != 1 ||
+		history.Messages[0].Text != "hello there" ||
+		history.Messages[0].Ts != event.Event.Ts {
+		t.Errorf("got history %+v, wanted alice's message", history)
+	}
+
+	// We send messages from the Web API to IRC, a line at a time.
+	var posted PostMessageResponse
+	h.callWebAPI(t, "chat.postMessage", url.Values{
+		"channel": {"#test"},
+		"text":    {"one\ntwo\r\nQUIT :bye"},
+	}, &posted)
+	if !posted.OK {
+		t.Fatalf("chat.postMessage failed: %s", posted.Error)
+	}
+	h.waitForPrivmsg(t, "#test", "one")
+	h.waitForPrivmsg(t, "#test", "two")
+	h.waitForPrivmsg(t, "#test", "QUIT :bye")
+
+	for _, m := range h.ircServer.Received() {
+		if m.Command == "QUIT" {
+			t.Errorf("message text injected a command: %s", m)
+		}
+	}
+}
+
+func TestRelayEchoOfMultipleLines(t *testing.T) {
+	h := newTestHoratio(t, "message-tags", "echo-message")
+	defer h.close()
+
+	h.waitForChannel(t, "#test")
+
+	var posted PostMessageResponse
+	h.callWebAPI(t, "chat.postMessage", url.Values{
+		"channel": {"#test"},
+		"text":    {"first\nsecond"},
+	}, &posted)
+	if !posted.OK {
+		t.Fatalf("chat.postMessage failed: %s", posted.Error)
+	}
+
+	// The echo of the first line gives the message its ID.
+	deadline := time.Now().Add(testTimeout)
+	for {
+		messages := h.messageLog.messages("#test")
+		if len(messages) == 1 && messages[0].MsgID != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got messages %+v, wanted one with a message ID",
+				messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Our own messages aren't events.
+	select {
+	case event := <-h.events:
+		t.Errorf("got event %+v for our own message", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// A listener that's slow to respond doesn't hold up reading from IRC.
+func TestRelayWithSlowListener(t *testing.T) {
+	h := newTestHoratio(t)
+	defer h.close()
+
+	h.waitForChannel(t, "#test")
+	if err := h.ircServer.Join("alice", "#test"); err != nil {
+		t.Fatalf("error joining: %s", err)
+	}
+
+	h.hold.Lock()
+	if err := h.ircServer.Say("alice", "#test", "first"); err != nil {
+		t.Fatalf("error saying: %s", err)
+	}
+
+	// We still answer the server and log messages.
+	if err := h.ircServer.Inject(ircv3.Message{
+		Command: "PING",
+		Params:  []string{"horatio"},
+	}); err != nil {
+		t.Fatalf("error sending PING: %s", err)
+	}
+	if _, err := h.ircServer.WaitFor(func(m ircv3.Message) bool {
+		return m.Command == "PONG"
+	}, testTimeout); err != nil {
+		t.Fatalf("waiting for PONG: %s", err)
+	}
+
+	if err := h.ircServer.Say("alice", "#test", "second"); err != nil {
+		t.Fatalf("error saying: %s", err)
+	}
+	deadline := time.Now().Add(testTimeout)
+	for len(h.messageLog.messages("#test")) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got messages %+v, wanted both",
+				h.messageLog.messages("#test"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The listener gets the events in order once it responds.
+	h.hold.Unlock()
+	for _, text := range []string{"first", "second"} {
+		if event := h.waitForEvent(t); event.Event.Text != text {
+			t.Errorf("got event %+v, wanted %s", event, text)
+		}
+	}
+}
+
+func TestRelayDisconnect(t *testing.T) {
+	h := newTestHoratio(t)
+	defer h.close()
+
+	h.waitForChannel(t, "#test")
+
+	h.ircServer.DisconnectAll()
+
+	select {
+	case <-h.done:
+	case <-time.After(testTimeout):
+		t.Fatalf("relay did not return after the server disconnected us")
+	}
+
+	if err := h.ircClient.Check(); err == nil {
+		t.Errorf("Check() = nil after disconnect, wanted an error")
+	}
+}
+
+func TestMembershipRejectsMalformedTargets(t *testing.T) {
+	h := newTestHoratio(t)
+	defer h.close()
+
+	h.waitForChannel(t, "#test")
+
+	tests := []struct {
+		method string
+		values url.Values
+		error  string
+	}{
+		{"conversations.invite",
+			url.Values{"channel": {"#test"}, "users": {"bad nick"}},
+			"user_not_found"},
+		{"conversations.invite",
+			url.Values{"channel": {"#test"}, "users": {":bad"}},
+			"user_not_found"},
+		{"conversations.kick",
+			url.Values{"channel": {"#test"}, "user": {"bad nick"}},
+			"user_not_found"},
+		{"conversations.kick",
+			url.Values{"channel": {"#te st"}, "user": {"alice"}},
+			"invalid_arguments"},
+		{"conversations.join", url.Values{"channel": {"#a\r\nQUIT"}},
+			"invalid_arguments"},
+
+		// JOIN 0 parts every channel.
+		{"conversations.join", url.Values{"channel": {"0"}},
+			"invalid_arguments"},
+		{"conversations.join", url.Values{"channel": {"#a,#b"}},
+			"invalid_arguments"},
+		{"conversations.leave", url.Values{"channel": {"nick"}},
+			"invalid_arguments"},
+		{"conversations.leave", url.Values{"channel": {"0"}},
+			"invalid_arguments"},
+		{"conversations.invite",
+			url.Values{"channel": {"nick"}, "users": {"alice"}},
+			"invalid_arguments"},
+		{"conversations.kick",
+			url.Values{"channel": {"#a,#b"}, "user": {"alice"}},
+			"invalid_arguments"},
+		{"conversations.kick",
+			url.Values{"channel": {"nick"}, "user": {"alice"}},
+			"invalid_arguments"},
+	}
+
+	for _, test := range tests {
+		var resp APIResponse
+		h.callWebAPI(t, test.method, test.values, &resp)
+		if resp.OK || resp.Error != test.error {
+			t.Errorf("%s %v = %+v, wanted error %s", test.method, test.values,
+				resp, test.error)
+		}
+	}
+
+	// We can still write to IRC.
+	var posted PostMessageResponse
+	h.callWebAPI(t, "chat.postMessage", url.Values{
+		"channel": {"#test"},
+		"text":    {"still here"},
+	}, &posted)
+	h.waitForPrivmsg(t, "#test", "still here")
+
+	for _, m := range h.ircServer.Received() {
+		if m.Command == "INVITE" || m.Command == "KICK" ||
+			m.Command == "QUIT" || m.Command == "PART" ||
+			(m.Command == "JOIN" && m.Params[0] != "#test") {
+			t.Errorf("sent %s for a malformed target", m)
+		}
+	}
+}
+
+func TestPostingNeedsChannel(t *testing.T) {
+	h := newTestHoratio(t)
+	defer h.close()
+
+	h.waitForChannel(t, "#test")
+
+	var posted PostMessageResponse
+	h.callWebAPI(t, "chat.postMessage", url.Values{
+		"channel": {"#test"},
+		"text":    {"first"},
+	}, &posted)
+	h.waitForPrivmsg(t, "#test", "first")
+
+	tests := []struct {
+		method  string
+		channel string
+		error   string
+	}{
+		{"chat.postMessage", "#te st", "channel_not_found"},
+		{"chat.postMessage", "alice", "channel_not_found"},
+		{"chat.postMessage", "#a,#b", "channel_not_found"},
+		{"chat.postMessage", "#other", "not_in_channel"},
+		{"chat.meMessage", "alice", "channel_not_found"},
+		{"chat.meMessage", "#other", "not_in_channel"},
+		{"reactions.add", "alice", "channel_not_found"},
+		{"reactions.add", "#other", "not_in_channel"},
+		{"reactions.remove", "#other", "not_in_channel"},
+	}
+
+	for _, test := range tests {
+		var resp PostMessageResponse
+		h.callWebAPI(t, test.method, url.Values{
+			"channel":   {test.channel},
+			"text":      {"hi"},
+			"name":      {"thumbsup"},
+			"timestamp": {posted.Ts},
+		}, &resp)
+		if resp.OK || resp.Error != test.error {
+			t.Errorf("%s to %s = %+v, wanted error %s", test.method,
+				test.channel, resp, test.error)
+		}
+		if resp.Ts != "" {
+			t.Errorf("%s to %s logged a message", test.method, test.channel)
+		}
+	}
+
+	h.callWebAPI(t, "chat.postMessage", url.Values{
+		"channel": {"#test"},
+		"text":    {"last"},
+	}, &posted)
+	h.waitForPrivmsg(t, "#test", "last")
+
+	for _, m := range h.ircServer.Received() {
+		if (m.Command == "PRIVMSG" || m.Command == "TAGMSG") &&
+			m.Params[0] != "#test" {
+			t.Errorf("sent %s to a channel we can't post to", m)
+		}
+	}
+
+	for _, channel := range []string{"alice", "#other"} {
+		if messages := h.messageLog.messages(channel); len(messages) != 0 {
+			t.Errorf("history of %s = %+v, wanted nothing", channel, messages)
+		}
+	}
+}
+
+// TestWriterSkipsUnencodableMessages checks that a message we can't encode
+// doesn't stop us writing the ones after it.
+func TestWriterSkipsUnencodableMessages(t *testing.T) {
+	h := newTestHoratio(t)
+	defer h.close()
+
+	h.waitForChannel(t, "#test")
+
+	logger := h.ircClient.logger
+	h.ircClient.Write(logger, ircv3.Message{
+		Command: "KICK",
+		Params:  []string{"#test", "bad nick", "reason"},
+	})
+	h.ircClient.Write(logger, ircv3.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"#test", "a\r\nQUIT :bye"},
+	})
+	h.ircClient.Write(logger, ircv3.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"#test", "after"},
+	})
+
+	h.waitForPrivmsg(t, "#test", "after")
+
+	for _, m := range h.ircServer.Received() {
+		if m.Command == "KICK" || m.Command == "QUIT" {
+			t.Errorf("sent %s, wanted it skipped", m)
+		}
+	}
+
+	if err := h.ircClient.Check(); err != nil {
+		t.Errorf("Check() = %s, wanted nil", err)
+	}
+}
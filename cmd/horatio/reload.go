@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/andyjack/court/internal/ircv3"
+	"github.com/andyjack/court/internal/logging"
+)
+
+// reloadOnSIGHUP reloads our settings each time we receive SIGHUP, such as
+// after editing the config file. args are the settings we started with.
+//
+// We apply the settings that are safe to change while running: the log
+// level, the other channels we're in, the command prefix, and the incoming
+// webhooks. We join and part channels to match the new list. Other settings
+// need a restart. We warn if they changed.
+//
+// If the new settings are invalid we log why and keep the old ones.
+func reloadOnSIGHUP(
+	logger *logging.Logger,
+	args Args,
+	ircClient *IRCClient,
+	slashCommands *SlashCommands,
+	buttons *ButtonState,
+	webhooks *Webhooks,
+) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		for range ch {
+			newArgs, err := getArgs(os.Args[1:], ioutil.Discard)
+			if err != nil {
+				logger.Error("Error reloading settings", "error", err)
+				continue
+			}
+
+			logger.SetLevel(newArgs.logLevel)
+
+			for _, channel := range missingChannels(newArgs.channels,
+				args.channels) {
+				ircClient.Write(logger, ircv3.Message{
+					Command: "JOIN",
+					Params:  []string{channel},
+				})
+			}
+			for _, channel := range missingChannels(args.channels,
+				newArgs.channels) {
+				// We never leave our main channel.
+				if strings.EqualFold(channel, args.channel) {
+					continue
+				}
+				ircClient.Write(logger, ircv3.Message{
+					Command: "PART",
+					Params:  []string{channel},
+				})
+			}
+
+			slashCommands.SetPrefix(newArgs.commandPrefix)
+			buttons.SetPrefix(newArgs.commandPrefix)
+
+			for _, webhook := range newArgs.webhooks {
+				logger.AddSecret(webhook.Secret)
+			}
+			webhooks.SetWebhooks(newArgs.webhooks)
+
+			if !reflect.DeepEqual(unreloadable(args), unreloadable(newArgs)) {
+				logger.Warn("Some settings changed that need a restart to apply")
+			}
+
+			args.logLevel = newArgs.logLevel
+			args.channels = newArgs.channels
+			args.commandPrefix = newArgs.commandPrefix
+			args.webhooks = newArgs.webhooks
+
+			logger.Info("Reloaded settings", "log_level", args.logLevel,
+				"channels", strings.Join(args.channels, ","), "command_prefix",
+				args.commandPrefix, "webhooks", len(args.webhooks))
+		}
+	}()
+}
+
+// missingChannels returns the channels in a that aren't in b. Channel names
+// are case insensitive.
+func missingChannels(a, b []string) []string {
+	var missing []string
+	for _, channel := range a {
+		found := false
+		for _, other := range b {
+			if strings.EqualFold(channel, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, channel)
+		}
+	}
+	return missing
+}
+
+// unreloadable returns the settings without those we can change while
+// running.
+func unreloadable(args Args) Args {
+	args.logLevel = 0
+	args.channels = nil
+	args.commandPrefix = ""
+	args.webhooks = nil
+	return args
+}
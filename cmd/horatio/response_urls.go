@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// ResponseURLs hands out response URLs and serves them.
+//
+// Slack gives slash commands and interactions a response URL. The listener
+// can use it to respond later. We serve response URLs alongside the Web API
+// at /responses/.
+type ResponseURLs struct {
+	logger *logging.Logger
+
+	// The URL the listener can reach our Web API at. Response URLs are under
+	// this.
+	baseURL string
+
+	webAPI *WebAPI
+
+	mutex sync.Mutex
+
+	// Who may be responded to, keyed by the ID in the response URL.
+	pending map[string]*pendingResponse
+}
+
+// pendingResponse is something the listener may still respond to.
+type pendingResponse struct {
+	channel string
+	user    string
+	expires time.Time
+
+	// How many more times the listener may respond.
+	uses int
+}
+
+// Like Slack, a response URL works up to 5 times within 30 minutes.
+const (
+	responseURLUses = 5
+	responseURLTTL  = 30 * time.Minute
+)
+
+// ResponseMessage is a response to a slash command or interaction, either
+// right away or sent to its response URL.
+type ResponseMessage struct {
+	// ephemeral (only the user sees it) or in_channel (everyone in the channel
+	// sees it). Blank is ephemeral.
+	ResponseType string `json:"response_type"`
+
+	Text string `json:"text"`
+
+	// Whether to replace the message the user interacted with. We can't
+	// change messages on IRC, so we send a new message to the channel
+	// instead.
+	ReplaceOriginal bool `json:"replace_original"`
+}
+
+// NewResponseURLs creates a ResponseURLs and starts serving response URLs.
+//
+// baseURL is where the listener can reach webAPI.
+func NewResponseURLs(
+	logger *logging.Logger,
+	baseURL string,
+	webAPI *WebAPI,
+) *ResponseURLs {
+	r := &ResponseURLs{
+		logger:  logger,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		webAPI:  webAPI,
+		pending: map[string]*pendingResponse{},
+	}
+
+	webAPI.Handle("/responses/", http.HandlerFunc(r.handler))
+
+	return r
+}
+
+// New creates a response URL for responding to the user in the channel.
+func (r *ResponseURLs) New(channel, user string) (string, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for k, p := range r.pending {
+		if now.After(p.expires) {
+			delete(r.pending, k)
+		}
+	}
+
+	r.pending[id] = &pendingResponse{
+		channel: channel,
+		user:    user,
+		expires: now.Add(responseURLTTL),
+		uses:    responseURLUses,
+	}
+
+	return r.baseURL + "/responses/" + id, nil
+}
+
+// Deliver shows a response in the channel or to the user. logger is for
+// entries about the response. Responses often have several lines. We send
+// each as its own IRC message.
+func (r *ResponseURLs) Deliver(
+	logger *logging.Logger,
+	channel,
+	user string,
+	response ResponseMessage,
+) {
+	if strings.TrimSpace(response.Text) == "" {
+		return
+	}
+
+	if response.ResponseType == "in_channel" || response.ReplaceOriginal {
+		r.webAPI.PostMessage(logger, channel, LoggedMessage{Text: response.Text})
+		return
+	}
+
+	r.webAPI.PostEphemeral(logger, channel, user, response.Text)
+}
+
+// handler handles requests to a response URL.
+func (r *ResponseURLs) handler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "invalid_method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/responses/")
+	logger := httpRequestLogger(r.logger, req)
+
+	r.mutex.Lock()
+	p, ok := r.pending[id]
+	if ok && (time.Now().After(p.expires) || p.uses == 0) {
+		delete(r.pending, id)
+		ok = false
+	}
+	if ok {
+		p.uses--
+	}
+	r.mutex.Unlock()
+
+	if !ok {
+		logger.Warn("Response to unknown or expired response URL")
+		http.Error(w, "expired_url", http.StatusNotFound)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.Error("Error reading response", "error", err)
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+		return
+	}
+
+	var response ResponseMessage
+	if err := json.Unmarshal(buf, &response); err != nil {
+		logger.Warn("Invalid response", "error", err)
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(response.Text) == "" {
+		http.Error(w, "no_text", http.StatusBadRequest)
+		return
+	}
+
+	r.Deliver(logger, p.channel, p.user, response)
+
+	logger.Info("Processed response to response URL", "channel", p.channel,
+		"user", p.user)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// randomID returns a random hex string suitable for an unguessable ID.
+func randomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating ID: %s", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// signRequest signs a request the way Slack does using a signing secret. body
+// is the request's body.
+//
+// See https://api.slack.com/authentication/verifying-requests-from-slack
+func signRequest(req *http.Request, body []byte, secret string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte("v0:" + timestamp + ":"))
+	_, _ = mac.Write(body)
+
+	req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	req.Header.Set("X-Slack-Signature",
+		"v0="+hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// SlashCommands turns IRC messages that look like commands into Slack slash
+// command requests.
+//
+// IRC has no slash commands of its own that reach other clients, so by
+// convention bots respond to messages starting with a prefix such as !. For
+// example, "!deploy web" becomes the slash command /deploy with the text
+// "web".
+type SlashCommands struct {
+	// Where we send commands.
+	commandURL string
+
+	// Messages starting with this are commands.
+	prefixMutex sync.Mutex
+	prefix      string
+
+	listener *Listener
+
+	// Like Slack, we give each command a response URL.
+	responseURLs *ResponseURLs
+
+	ircClient *IRCClient
+}
+
+// NewSlashCommands creates a SlashCommands.
+func NewSlashCommands(
+	commandURL,
+	prefix string,
+	listener *Listener,
+	responseURLs *ResponseURLs,
+	ircClient *IRCClient,
+) *SlashCommands {
+	return &SlashCommands{
+		commandURL:   commandURL,
+		prefix:       prefix,
+		listener:     listener,
+		responseURLs: responseURLs,
+		ircClient:    ircClient,
+	}
+}
+
+// SetPrefix changes the prefix commands start with.
+func (s *SlashCommands) SetPrefix(prefix string) {
+	s.prefixMutex.Lock()
+	defer s.prefixMutex.Unlock()
+	s.prefix = prefix
+}
+
+// parseCommand returns the command and its text if the message is a command.
+// It returns false if it's not.
+//
+// The command must start with a letter so we don't treat messages like "!!!"
+// as commands.
+func (s *SlashCommands) parseCommand(text string) (string, string, bool) {
+	s.prefixMutex.Lock()
+	prefix := s.prefix
+	s.prefixMutex.Unlock()
+
+	if prefix == "" || !strings.HasPrefix(text, prefix) {
+		return "", "", false
+	}
+
+	text = strings.TrimPrefix(text, prefix)
+	command := text
+	args := ""
+	if idx := strings.IndexAny(text, " \t"); idx != -1 {
+		command = text[:idx]
+		args = strings.TrimSpace(text[idx+1:])
+	}
+
+	if command == "" || !unicode.IsLetter([]rune(command)[0]) {
+		return "", "", false
+	}
+
+	return "/" + strings.ToLower(command), args, true
+}
+
+// Dispatch sends a slash command request if the message is a command. It
+// returns false if the message is not a command. logger is for entries about
+// the message.
+//
+// We queue the request to send in the background. See Listener.Queue.
+func (s *SlashCommands) Dispatch(
+	logger *logging.Logger,
+	channel,
+	user,
+	text string,
+) bool {
+	command, args, ok := s.parseCommand(text)
+	if !ok {
+		return false
+	}
+
+	logger = logger.With("command", command)
+	s.listener.Queue(logger, "command", func() {
+		if err := s.send(logger, channel, user, command, args); err != nil {
+			logger.Error("Error dispatching command", "error", err)
+		}
+	})
+
+	return true
+}
+
+// send sends the slash command request and delivers any response we get right
+// away.
+func (s *SlashCommands) send(
+	logger *logging.Logger,
+	channel,
+	user,
+	command,
+	text string,
+) error {
+	responseURL, err := s.responseURLs.New(channel, user)
+	if err != nil {
+		return err
+	}
+
+	triggerID, err := randomID()
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("command", command)
+	form.Set("text", text)
+	form.Set("team_id", teamIDForServer(s.ircClient.serverName))
+	form.Set("team_domain", s.ircClient.serverName)
+	form.Set("channel_id", channel)
+	form.Set("channel_name", strings.TrimPrefix(channel, "#"))
+	form.Set("user_id", user)
+	form.Set("user_name", user)
+	form.Set("response_url", responseURL)
+	form.Set("trigger_id", triggerID)
+
+	response, err := s.listener.SendCommand(logger, s.commandURL, form)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Dispatched command", "destination",
+		s.listener.Destination(s.commandURL), "channel", channel, "user", user)
+
+	if response == nil {
+		return nil
+	}
+
+	logger.Debug("Command response", "response", *response)
+
+	s.responseURLs.Deliver(logger, channel, user, *response)
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+	"github.com/andyjack/court/internal/websocket"
+)
+
+// SocketModeServer acts as Slack's Socket Mode. Rather than us sending
+// listeners HTTP requests, they connect to us with a WebSocket and we send
+// them envelopes holding events, slash commands, and interactions.
+//
+// Listeners find out where to connect by calling apps.connections.open with
+// an app-level token.
+//
+// See https://api.slack.com/apis/connections/socket
+type SocketModeServer struct {
+	logger  *logging.Logger
+	metrics *Metrics
+
+	// URL the listeners can reach us at. We give out WebSocket URLs based on
+	// it.
+	publicURL string
+
+	mutex sync.Mutex
+
+	// URLs we gave out that no one connected with yet. Keyed by the ticket in
+	// the URL. The value is when it expires.
+	tickets map[string]time.Time
+
+	conns map[*socketModeConn]struct{}
+
+	// Envelopes waiting for an acknowledgement, keyed by envelope ID.
+	pending map[string]chan json.RawMessage
+}
+
+// socketModeConn is a listener's connection.
+type socketModeConn struct {
+	conn *websocket.Conn
+
+	// For entries about the connection. It says where the connection is from.
+	logger *logging.Logger
+}
+
+// SocketModeEnvelope is a message we send over a Socket Mode connection.
+type SocketModeEnvelope struct {
+	Type                   string      `json:"type"`
+	EnvelopeID             string      `json:"envelope_id,omitempty"`
+	Payload                interface{} `json:"payload,omitempty"`
+	AcceptsResponsePayload bool        `json:"accepts_response_payload,omitempty"`
+
+	// hello: How many connections are open.
+	NumConnections int `json:"num_connections,omitempty"`
+
+	// disconnect: Why we're disconnecting the listener.
+	Reason string `json:"reason,omitempty"`
+}
+
+// SocketModeAck is what listeners send to acknowledge an envelope.
+type SocketModeAck struct {
+	EnvelopeID string          `json:"envelope_id"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// How long a URL from apps.connections.open is good for. Like Slack's, each
+// is good for one connection.
+var socketModeTicketExpiry = 30 * time.Second
+
+// How long we wait for a listener to acknowledge an envelope. This is the
+// same as Slack.
+var socketModeAckTimeout = 3 * time.Second
+
+// How long we keep a connection before asking the listener to reconnect.
+// Slack does this every few hours.
+var socketModeConnectionLifetime = 4 * time.Hour
+
+// If we hear nothing on a connection for this long, we drop it. Listeners
+// ping us more often than this.
+var socketModeIdleTimeout = 2 * time.Minute
+
+// ConnectionsOpenResponse is the response to an apps.connections.open
+// request.
+type ConnectionsOpenResponse struct {
+	APIResponse
+	URL string `json:"url"`
+}
+
+// NewSocketModeServer creates a SocketModeServer. It implements
+// apps.connections.open and accepts connections alongside the Web API.
+func NewSocketModeServer(
+	logger *logging.Logger,
+	metrics *Metrics,
+	publicURL string,
+	webAPI *WebAPI,
+) *SocketModeServer {
+	s := &SocketModeServer{
+		logger:    logger.With("transport", "socket_mode"),
+		metrics:   metrics,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		tickets:   map[string]time.Time{},
+		conns:     map[*socketModeConn]struct{}{},
+		pending:   map[string]chan json.RawMessage{},
+	}
+
+	webAPI.RegisterAppMethod("apps.connections.open", s.appsConnectionsOpen)
+	webAPI.Handle("/socket-mode/", http.HandlerFunc(s.handler))
+
+	return s
+}
+
+// appsConnectionsOpen implements apps.connections.open. It gives out a URL to
+// connect to.
+func (s *SocketModeServer) appsConnectionsOpen(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	ticket, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	now := time.Now()
+	for t, expires := range s.tickets {
+		if now.After(expires) {
+			delete(s.tickets, t)
+		}
+	}
+	s.tickets[ticket] = now.Add(socketModeTicketExpiry)
+	s.mutex.Unlock()
+
+	// Our public URL is HTTP but WebSocket URLs have their own schemes.
+	wsURL := s.publicURL
+	if strings.HasPrefix(wsURL, "https://") {
+		wsURL = "wss://" + strings.TrimPrefix(wsURL, "https://")
+	} else {
+		wsURL = "ws://" + strings.TrimPrefix(wsURL, "http://")
+	}
+
+	return ConnectionsOpenResponse{
+		APIResponse: APIResponse{OK: true},
+		URL:         wsURL + "/socket-mode/" + ticket,
+	}, nil
+}
+
+// handler accepts a connection to a URL we gave out.
+func (s *SocketModeServer) handler(w http.ResponseWriter, r *http.Request) {
+	ticket := strings.TrimPrefix(r.URL.Path, "/socket-mode/")
+	logger := s.logger.With("remote_addr", r.RemoteAddr)
+
+	s.mutex.Lock()
+	expires, ok := s.tickets[ticket]
+	delete(s.tickets, ticket)
+	s.mutex.Unlock()
+
+	if !ok || time.Now().After(expires) {
+		logger.Warn("Socket Mode connection with invalid or expired URL")
+		http.Error(w, "invalid or expired URL", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		logger.Warn("Error accepting Socket Mode connection", "error", err)
+		return
+	}
+
+	c := &socketModeConn{
+		conn:   conn,
+		logger: logger,
+	}
+
+	s.mutex.Lock()
+	s.conns[c] = struct{}{}
+	numConns := len(s.conns)
+	s.metrics.socketModeConnections.Set(float64(numConns))
+	s.mutex.Unlock()
+
+	s.metrics.socketModeConnectionsOpened.Inc()
+
+	logger.Info("Socket Mode connection opened", "connections", numConns)
+
+	if err := s.write(logger, c, SocketModeEnvelope{
+		Type:           "hello",
+		NumConnections: numConns,
+	}); err != nil {
+		logger.Error("Error sending hello", "error", err)
+	}
+
+	// Ask the listener to reconnect after a while like Slack does.
+	timer := time.AfterFunc(socketModeConnectionLifetime, func() {
+		logger.Info("Asking Socket Mode connection to reconnect")
+		if err := s.write(logger, c, SocketModeEnvelope{
+			Type:   "disconnect",
+			Reason: "refresh_requested",
+		}); err != nil {
+			logger.Error("Error sending disconnect", "error", err)
+		}
+	})
+
+	s.read(c)
+
+	timer.Stop()
+
+	s.mutex.Lock()
+	delete(s.conns, c)
+	s.metrics.socketModeConnections.Set(float64(len(s.conns)))
+	s.mutex.Unlock()
+
+	_ = conn.Close()
+	logger.Info("Socket Mode connection closed")
+}
+
+// read reads acknowledgements from a connection until it closes.
+func (s *SocketModeServer) read(c *socketModeConn) {
+	c.conn.SetIdleTimeout(socketModeIdleTimeout)
+
+	for {
+		_, buf, err := c.conn.ReadMessage()
+		if err != nil {
+			if err != websocket.ErrClosed {
+				c.logger.Warn("Error reading from Socket Mode connection", "error",
+					err)
+			}
+			return
+		}
+
+		c.logger.Debug("Received from Socket Mode connection", "body", buf)
+
+		var ack SocketModeAck
+		if err := json.Unmarshal(buf, &ack); err != nil {
+			c.logger.Warn("Invalid JSON from Socket Mode connection", "error",
+				err)
+			continue
+		}
+
+		s.mutex.Lock()
+		ch, ok := s.pending[ack.EnvelopeID]
+		delete(s.pending, ack.EnvelopeID)
+		s.mutex.Unlock()
+
+		if !ok {
+			c.logger.Warn("Unexpected acknowledgement", "envelope_id",
+				ack.EnvelopeID)
+			continue
+		}
+
+		ch <- ack.Payload
+	}
+}
+
+// write sends an envelope on a connection. logger is for entries about the
+// envelope.
+func (s *SocketModeServer) write(
+	logger *logging.Logger,
+	c *socketModeConn,
+	envelope SocketModeEnvelope,
+) error {
+	buf, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("error marshaling envelope: %s", err)
+	}
+
+	if err := c.conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+		return err
+	}
+
+	logger.Debug("Sent to Socket Mode connection", "remote_addr",
+		c.logger.Value("remote_addr"), "body", buf)
+
+	return nil
+}
+
+// Send sends a payload to a listener in an envelope of the given type, such
+// as events_api, and waits for the listener to acknowledge it. It returns the
+// payload of the acknowledgement, if any.
+//
+// If there is more than one connection we pick one. logger is for entries
+// about what we're sending.
+func (s *SocketModeServer) Send(
+	logger *logging.Logger,
+	envelopeType string,
+	payload interface{},
+) (json.RawMessage, error) {
+	envelopeID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan json.RawMessage, 1)
+
+	s.mutex.Lock()
+	var c *socketModeConn
+	for conn := range s.conns {
+		c = conn
+		break
+	}
+	if c != nil {
+		s.pending[envelopeID] = ch
+	}
+	s.mutex.Unlock()
+
+	if c == nil {
+		return nil, fmt.Errorf("no Socket Mode connections")
+	}
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pending, envelopeID)
+		s.mutex.Unlock()
+	}()
+
+	logger = logger.With("envelope_id", envelopeID)
+
+	// Listeners may respond to slash commands and interactions in their
+	// acknowledgement.
+	if err := s.write(logger, c, SocketModeEnvelope{
+		Type:                   envelopeType,
+		EnvelopeID:             envelopeID,
+		Payload:                payload,
+		AcceptsResponsePayload: envelopeType != "events_api",
+	}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case ackPayload := <-ch:
+		return ackPayload, nil
+	case <-time.After(socketModeAckTimeout):
+		return nil, fmt.Errorf("envelope %s was not acknowledged", envelopeID)
+	}
+}
@@ -3,101 +3,612 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"time"
+	"unicode"
 
-	"github.com/horgh/irc"
+	"github.com/andyjack/court/internal/ircv3"
+	"github.com/andyjack/court/internal/logging"
 )
 
 // WebAPI is an HTTP server acting as Slack's Web API.
 //
-// It receives chat.postMessage requests containing messages to send to IRC.
+// It serves Web API methods at /api/{method}. For example, it receives
+// chat.postMessage requests containing messages to send to IRC.
 type WebAPI struct {
-	verbose   bool
+	logger    *logging.Logger
+	metrics   *Metrics
 	ircClient *IRCClient
+
+	// Bot tokens we accept. Requests must provide one of these.
+	tokens map[string]struct{}
+
+	// App-level tokens we accept. Like Slack, these work only with methods
+	// for apps such as apps.connections.open, and those methods work only
+	// with these.
+	appTokens map[string]struct{}
+
+	// We record messages we send here and serve history from it.
+	messageLog *MessageLog
+
+	// What we know about the channels we're in.
+	channelState *ChannelState
+
+	// Buttons in messages we sent.
+	buttons *ButtonState
+
+	// We serve using our own mux rather than the default one. This means we can
+	// have more than one WebAPI in a process, such as in tests.
+	mux *http.ServeMux
+
+	// Web API methods we implement, keyed by name, e.g. chat.postMessage.
+	methods map[string]webAPIMethod
+
+	// Names of methods that need an app-level token.
+	appMethods map[string]struct{}
 }
 
+// webAPIMethod implements a Web API method.
+//
+// It returns the response to send. To respond with an error, such as
+// channel_not_found, return an apiError. We respond to other errors with
+// internal_error.
+type webAPIMethod func(r *http.Request, p APIParams) (interface{}, error)
+
 // NewWebAPI creates a new WebAPI, an HTTP server acting as Slack's Web API.
-func NewWebAPI(verbose bool, ircClient *IRCClient) *WebAPI {
-	return &WebAPI{
-		verbose:   verbose,
-		ircClient: ircClient,
+func NewWebAPI(
+	logger *logging.Logger,
+	metrics *Metrics,
+	ircClient *IRCClient,
+	tokens,
+	appTokens []string,
+	messageLog *MessageLog,
+	channelState *ChannelState,
+	buttons *ButtonState,
+) *WebAPI {
+	tokenSet := map[string]struct{}{}
+	for _, token := range tokens {
+		tokenSet[token] = struct{}{}
 	}
+
+	appTokenSet := map[string]struct{}{}
+	for _, token := range appTokens {
+		appTokenSet[token] = struct{}{}
+	}
+
+	w := &WebAPI{
+		logger:       logger,
+		metrics:      metrics,
+		ircClient:    ircClient,
+		tokens:       tokenSet,
+		appTokens:    appTokenSet,
+		messageLog:   messageLog,
+		channelState: channelState,
+		buttons:      buttons,
+		mux:          http.NewServeMux(),
+		methods:      map[string]webAPIMethod{},
+		appMethods:   map[string]struct{}{},
+	}
+
+	w.RegisterMethod("auth.test", w.authTest)
+	w.RegisterMethod("chat.meMessage", w.chatMeMessage)
+	w.RegisterMethod("chat.postEphemeral", w.chatPostEphemeral)
+	w.RegisterMethod("chat.postMessage", w.chatPostMessage)
+	w.RegisterMethod("conversations.history", w.conversationsHistory)
+	w.RegisterMethod("conversations.info", w.conversationsInfo)
+	w.RegisterMethod("conversations.invite", w.conversationsInvite)
+	w.RegisterMethod("conversations.join", w.conversationsJoin)
+	w.RegisterMethod("conversations.kick", w.conversationsKick)
+	w.RegisterMethod("conversations.leave", w.conversationsLeave)
+	w.RegisterMethod("conversations.list", w.conversationsList)
+	w.RegisterMethod("conversations.members", w.conversationsMembers)
+	w.RegisterMethod("conversations.replies", w.conversationsReplies)
+	w.RegisterMethod("reactions.add", w.reactionsAdd)
+	w.RegisterMethod("reactions.remove", w.reactionsRemove)
+
+	w.mux.HandleFunc("/api/", w.apiHandler)
+	w.mux.Handle("/metrics", metrics.Handler())
+
+	return w
+}
+
+// RegisterMethod adds a Web API method. If there is already a method with the
+// name, this replaces it.
+func (w *WebAPI) RegisterMethod(name string, method webAPIMethod) {
+	w.methods[name] = method
+	delete(w.appMethods, name)
+}
+
+// RegisterAppMethod adds a Web API method that needs an app-level token
+// rather than a bot token.
+func (w *WebAPI) RegisterAppMethod(name string, method webAPIMethod) {
+	w.methods[name] = method
+	w.appMethods[name] = struct{}{}
+}
+
+// Handle serves requests for the pattern with the handler, alongside the Web
+// API.
+func (w *WebAPI) Handle(pattern string, handler http.Handler) {
+	w.mux.Handle(pattern, handler)
+}
+
+// Handler returns the HTTP handler serving the Web API.
+func (w *WebAPI) Handler() http.Handler {
+	return w.mux
 }
 
 // Serve starts listening for HTTP requests.
 //
 // If it does not return an error then it does not return.
 func (w *WebAPI) Serve(port int) error {
-	http.HandleFunc("/api/chat.postMessage", w.postMessageHandler)
-
-	hostAndPort := fmt.Sprintf(":%d", port)
+	server := &http.Server{
+		Addr:     fmt.Sprintf(":%d", port),
+		Handler:  w.mux,
+		ErrorLog: log.New(w.logger.Writer(logging.LevelWarn), "", 0),
+	}
 
-	log.Printf("Starting to listen on port %d for POST /api/chat.postMessage",
-		port)
-	if err := http.ListenAndServe(hostAndPort, nil); err != nil {
+	w.logger.Info("Starting to listen for Web API requests at /api/, "+
+		"webhooks at /services/, and GET /metrics, /healthz, and /readyz",
+		"port", port)
+	if err := server.ListenAndServe(); err != nil {
 		return fmt.Errorf("error serving: %s", err)
 	}
 
 	return nil
 }
 
-// PostMessagePayload represents the payload sent in a chat.postMessage
-// request.
-type PostMessagePayload struct {
-	Channel string `json:"channel"`
-	Text    string `json:"text"`
-}
-
 // APIResponse is a response that is similar to Slack's Web API's response.
 type APIResponse struct {
-	OK bool `json:"ok"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
 }
 
-func (w *WebAPI) postMessageHandler(hw http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		log.Printf("invalid request method")
-		hw.WriteHeader(http.StatusBadRequest)
+// UnknownMethodResponse is the response to a request for a method we don't
+// implement.
+type UnknownMethodResponse struct {
+	APIResponse
+	ReqMethod string `json:"req_method"`
+}
+
+// apiHandler handles requests to /api/{method}. It dispatches them to the
+// method's implementation.
+func (w *WebAPI) apiHandler(hw http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	name := strings.TrimPrefix(r.URL.Path, "/api/")
+	logger := httpRequestLogger(w.logger, r).With("api_method", name)
+
+	method, ok := w.methods[name]
+	if !ok {
+		logger.Warn("Unknown method")
+		w.writeResponse(logger, hw, UnknownMethodResponse{
+			APIResponse: APIResponse{Error: "unknown_method"},
+			ReqMethod:   name,
+		})
+		w.observeRequest("unknown", "unknown_method", start)
 		return
 	}
 
-	buf, err := ioutil.ReadAll(r.Body)
+	p, parseError, ok := w.parseRequest(logger, hw, r, name)
+	if !ok {
+		w.observeRequest(name, parseError, start)
+		return
+	}
+	p.logger = logger
+
+	logger.Debug("Web API arguments", "arguments", p.values)
+
+	resp, err := method(r, p)
 	if err != nil {
-		log.Printf("error reading request: %s", err)
-		hw.WriteHeader(http.StatusBadRequest)
+		errorCode, ok := err.(apiError)
+		if !ok {
+			logger.Error("Error processing request", "error", err)
+			errorCode = "internal_error"
+		}
+		w.writeResponse(logger, hw, APIResponse{Error: string(errorCode)})
+		logger.Info("Processed request", "result", string(errorCode),
+			"duration", time.Since(start))
+		w.observeRequest(name, string(errorCode), start)
 		return
 	}
 
-	var p PostMessagePayload
-	if err := json.Unmarshal(buf, &p); err != nil {
-		log.Printf("invalid JSON: %s", err)
+	w.writeResponse(logger, hw, resp)
+	logger.Info("Processed request", "result", "ok", "duration",
+		time.Since(start))
+	w.observeRequest(name, "", start)
+}
+
+// observeRequest counts and times a request for the method that started at
+// start. errorCode is the error we responded with, or blank if the request
+// succeeded.
+func (w *WebAPI) observeRequest(method, errorCode string, start time.Time) {
+	w.metrics.webAPIRequests.Inc(method, errorCode)
+	w.metrics.webAPIRequestDuration.Observe(time.Since(start).Seconds(),
+		method)
+}
+
+// httpRequestLogger returns a logger for entries about an HTTP request. It
+// tags them with a request ID. We use the one in the X-Request-Id header if
+// there is one, as yorick sends, so entries in both programs match up.
+func httpRequestLogger(
+	logger *logging.Logger,
+	r *http.Request,
+) *logging.Logger {
+	requestID := r.Header.Get("X-Request-Id")
+	if requestID == "" {
+		requestID = logging.NewRequestID()
+	}
+
+	return logger.With(
+		"request_id", requestID,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote_addr", r.RemoteAddr,
+	)
+}
+
+// parseRequest reads the arguments from a request and checks it has a token
+// we accept.
+//
+// If there is a problem, we write an error response and return false. We
+// also return the error we responded with. If we responded with only an HTTP
+// status, this is invalid_request.
+func (w *WebAPI) parseRequest(
+	logger *logging.Logger,
+	hw http.ResponseWriter,
+	r *http.Request,
+	method string,
+) (APIParams, string, bool) {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		logger.Warn("Invalid request method")
+		hw.WriteHeader(http.StatusMethodNotAllowed)
+		return APIParams{}, "invalid_request", false
+	}
+
+	p, err := parseParams(r)
+	if err != nil {
+		if errorCode, ok := err.(apiError); ok {
+			logger.Warn("Invalid request", "result", string(errorCode))
+			w.writeResponse(logger, hw, APIResponse{Error: string(errorCode)})
+			return APIParams{}, string(errorCode), false
+		}
+		logger.Warn("Invalid request", "error", err)
 		hw.WriteHeader(http.StatusBadRequest)
-		return
+		return APIParams{}, "invalid_request", false
+	}
+
+	if errorCode, ok := w.authenticate(p, method); !ok {
+		logger.Warn("Authentication failed", "result", errorCode)
+		w.writeResponse(logger, hw, APIResponse{Error: errorCode})
+		return APIParams{}, errorCode, false
+	}
+
+	return p, "", true
+}
+
+// authenticate checks the request has a token we accept for the method.
+//
+// If it does not, we return the Slack error code to respond with.
+func (w *WebAPI) authenticate(p APIParams, method string) (string, bool) {
+	if p.token == "" {
+		return "not_authed", false
+	}
+
+	_, isBotToken := w.tokens[p.token]
+	_, isAppToken := w.appTokens[p.token]
+	if !isBotToken && !isAppToken {
+		return "invalid_auth", false
+	}
+
+	// App methods need app tokens and other methods need bot tokens.
+	_, isAppMethod := w.appMethods[method]
+	if isAppMethod != isAppToken {
+		return "not_allowed_token_type", false
+	}
+
+	return "", true
+}
+
+// PostMessagePayload represents the arguments to a chat.postMessage request.
+type PostMessagePayload struct {
+	Channel  string `json:"channel"`
+	Text     string `json:"text"`
+	ThreadTs string `json:"thread_ts"`
+}
+
+// PostMessageResponse is the response to a chat.postMessage request.
+type PostMessageResponse struct {
+	APIResponse
+	Channel string        `json:"channel"`
+	Ts      string        `json:"ts"`
+	Message LoggedMessage `json:"message"`
+}
+
+// chatPostMessage implements chat.postMessage. It sends the message to IRC.
+func (w *WebAPI) chatPostMessage(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	payload := PostMessagePayload{
+		Channel:  p.String("channel"),
+		Text:     p.String("text"),
+		ThreadTs: p.String("thread_ts"),
 	}
 
-	w.ircClient.Write(irc.Message{
-		Command: "PRIVMSG",
-		Params:  []string{p.Channel, p.Text},
+	if err := w.checkPostable(payload.Channel); err != nil {
+		return nil, err
+	}
+
+	var blocks []Block
+	if err := p.JSON("blocks", &blocks); err != nil {
+		return nil, apiError("invalid_blocks")
+	}
+
+	// Like Slack, text is optional if there are blocks.
+	if payload.Text == "" {
+		payload.Text = textFromBlocks(blocks)
+	}
+
+	if strings.TrimSpace(payload.Text) == "" {
+		return nil, apiError("no_text")
+	}
+
+	message := w.PostMessage(p.logger, payload.Channel, LoggedMessage{
+		Text:     payload.Text,
+		ThreadTs: payload.ThreadTs,
+		Blocks:   blocks,
+	})
+
+	return PostMessageResponse{
+		APIResponse: APIResponse{OK: true},
+		Channel:     payload.Channel,
+		Ts:          message.Ts,
+		Message:     message,
+	}, nil
+}
+
+// checkPostable checks we can send messages to the channel. It must be a
+// channel rather than a nick, and we must be in it. Otherwise IRC would drop
+// the message or it would go somewhere else, and we'd log a message no one
+// saw.
+func (w *WebAPI) checkPostable(channel string) error {
+	if !validChannel(channel) {
+		return apiError("channel_not_found")
+	}
+	if _, ok := w.channelState.Channel(channel); !ok {
+		return apiError("not_in_channel")
+	}
+	return nil
+}
+
+// PostMessage sends a message from us to a channel and logs it. We return the
+// message we logged. logger is for entries about sending it.
+//
+// IRC messages can't span lines, so we send a PRIVMSG for each line of the
+// text. If the message's blocks have buttons, we follow it with a line
+// listing them.
+func (w *WebAPI) PostMessage(
+	logger *logging.Logger,
+	channel string,
+	m LoggedMessage,
+) LoggedMessage {
+	m.User = w.ircClient.nick
+	m.BotID = botIDForNick(w.ircClient.nick)
+	m.awaitingEcho = w.ircClient.HasCap("echo-message")
+
+	// Log the message before we send it so that we're ready if the server
+	// echoes it back.
+	message := w.messageLog.Add(channel, m)
+
+	for _, line := range ircLines(m.Text) {
+		w.ircClient.Write(logger, ircv3.Message{
+			Command: "PRIVMSG",
+			Params:  []string{channel, line},
+		})
+	}
+
+	// IRC has no buttons. We list them and people choose one by number.
+	if buttons := buttonsFromBlocks(m.Blocks); len(buttons) > 0 {
+		w.buttons.Set(channel, message, buttons)
+		w.ircClient.Write(logger, ircv3.Message{
+			Command: "PRIVMSG",
+			Params:  []string{channel, w.buttons.Describe(buttons)},
+		})
+	}
+
+	return message
+}
+
+// ircLines splits text into the lines to send as separate IRC messages. We
+// leave out blank lines as IRC has no empty messages.
+func ircLines(text string) []string {
+	text = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(text)
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// MeMessageResponse is the response to a chat.meMessage request.
+type MeMessageResponse struct {
+	APIResponse
+	Channel string `json:"channel"`
+	Ts      string `json:"ts"`
+}
+
+// chatMeMessage implements chat.meMessage. It sends the message to IRC as a
+// CTCP ACTION, the same as /me does. We send an ACTION for each line.
+func (w *WebAPI) chatMeMessage(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channel := p.String("channel")
+	text := p.String("text")
+
+	if err := w.checkPostable(channel); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(text) == "" {
+		return nil, apiError("no_text")
+	}
+
+	message := w.messageLog.Add(channel, LoggedMessage{
+		SubType:      "me_message",
+		User:         w.ircClient.nick,
+		BotID:        botIDForNick(w.ircClient.nick),
+		Text:         text,
+		awaitingEcho: w.ircClient.HasCap("echo-message"),
 	})
 
-	resp := APIResponse{OK: true}
-	buf2, err := json.Marshal(resp)
+	for _, line := range ircLines(text) {
+		action := encodeCTCP(CTCP{Command: "ACTION", Params: line})
+		w.ircClient.Write(p.logger, ircv3.Message{
+			Command: "PRIVMSG",
+			Params:  []string{channel, action},
+		})
+	}
+
+	return MeMessageResponse{
+		APIResponse: APIResponse{OK: true},
+		Channel:     channel,
+		Ts:          message.Ts,
+	}, nil
+}
+
+// PostEphemeralResponse is the response to a chat.postEphemeral request.
+type PostEphemeralResponse struct {
+	APIResponse
+	MessageTs string `json:"message_ts"`
+}
+
+// chatPostEphemeral implements chat.postEphemeral. Only the given user in
+// the channel should see the message.
+//
+// IRC has no such thing, so we send the message to the user as a NOTICE. We
+// say which channel it's about since they won't see it there. We don't log
+// the message as it's not in the channel's history.
+func (w *WebAPI) chatPostEphemeral(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channelName := p.String("channel")
+	user := p.String("user")
+	text := p.String("text")
+
+	if channelName == "" {
+		return nil, apiError("channel_not_found")
+	}
+
+	if user == "" {
+		return nil, apiError("user_not_found")
+	}
+
+	if strings.TrimSpace(text) == "" {
+		return nil, apiError("no_text")
+	}
+
+	channel, ok := w.channelState.Channel(channelName)
+	if !ok {
+		return nil, apiError("channel_not_found")
+	}
+
+	if _, ok := channel.Members[strings.ToLower(user)]; !ok {
+		return nil, apiError("user_not_in_channel")
+	}
+
+	w.PostEphemeral(p.logger, channel.Name, user, text)
+
+	return PostEphemeralResponse{
+		APIResponse: APIResponse{OK: true},
+		MessageTs:   w.messageLog.NewTs(),
+	}, nil
+}
+
+// PostEphemeral sends a message about a channel that only the user should
+// see. We send it as a NOTICE to the user, one for each line of the text.
+// logger is for entries about sending it.
+func (w *WebAPI) PostEphemeral(
+	logger *logging.Logger,
+	channel,
+	user,
+	text string,
+) {
+	for _, line := range ircLines(text) {
+		w.ircClient.Write(logger, ircv3.Message{
+			Command: "NOTICE",
+			Params:  []string{user, fmt.Sprintf("[%s] %s", channel, line)},
+		})
+	}
+}
+
+// AuthTestResponse is the response to an auth.test request.
+type AuthTestResponse struct {
+	APIResponse
+	URL    string `json:"url"`
+	Team   string `json:"team"`
+	User   string `json:"user"`
+	TeamID string `json:"team_id"`
+	UserID string `json:"user_id"`
+	BotID  string `json:"bot_id"`
+}
+
+// authTest implements auth.test. It tells the caller who they are. The caller
+// is always our IRC client. Its user ID is its nick.
+func (w *WebAPI) authTest(r *http.Request, p APIParams) (interface{}, error) {
+	return AuthTestResponse{
+		APIResponse: APIResponse{OK: true},
+		URL: fmt.Sprintf("irc://%s:%d/", w.ircClient.host,
+			w.ircClient.port),
+		Team:   w.ircClient.serverName,
+		User:   w.ircClient.nick,
+		TeamID: teamIDForServer(w.ircClient.serverName),
+		UserID: w.ircClient.nick,
+		BotID:  botIDForNick(w.ircClient.nick),
+	}, nil
+}
+
+// teamIDForServer returns the team ID we use for the IRC server with the given
+// name.
+//
+// Slack team IDs start with T.
+func teamIDForServer(serverName string) string {
+	id := "T"
+	for _, c := range strings.ToUpper(serverName) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			id += string(c)
+		}
+	}
+	return id
+}
+
+// writeResponse writes an API response as JSON.
+func (w *WebAPI) writeResponse(
+	logger *logging.Logger,
+	hw http.ResponseWriter,
+	resp interface{},
+) {
+	buf, err := json.Marshal(resp)
 	if err != nil {
-		log.Printf("error marshaling response: %s", err)
+		logger.Error("Error marshaling response", "error", err)
 		hw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	n, err := hw.Write(buf2)
+	hw.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	n, err := hw.Write(buf)
 	if err != nil {
-		log.Printf("error writing response: %s", err)
+		logger.Error("Error writing response", "error", err)
 		return
 	}
-	if n != len(buf2) {
-		log.Printf("error writing response: short write")
+	if n != len(buf) {
+		logger.Error("Error writing response: short write")
 		return
 	}
-
-	log.Printf("Processed POST /api/chat.postMessage: %+v", p)
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// HistoryResponse is the response to a conversations.history or
+// conversations.replies request.
+type HistoryResponse struct {
+	APIResponse
+	Messages         []LoggedMessage  `json:"messages"`
+	HasMore          bool             `json:"has_more"`
+	ResponseMetadata ResponseMetadata `json:"response_metadata"`
+}
+
+// ResponseMetadata is part of responses to paginated methods.
+type ResponseMetadata struct {
+	NextCursor string `json:"next_cursor"`
+}
+
+// historyQuery reads the arguments conversations.history and
+// conversations.replies have in common.
+func historyQuery(p APIParams) (HistoryQuery, error) {
+	limit, err := pageLimit(p)
+	if err != nil {
+		return HistoryQuery{}, err
+	}
+
+	return HistoryQuery{
+		Oldest:    p.String("oldest"),
+		Latest:    p.String("latest"),
+		Inclusive: p.Bool("inclusive"),
+		Limit:     limit,
+		Cursor:    p.String("cursor"),
+	}, nil
+}
+
+// conversationsHistory implements conversations.history. It returns messages
+// from the channel, newest first.
+func (w *WebAPI) conversationsHistory(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channel := p.String("channel")
+	if channel == "" {
+		return nil, apiError("channel_not_found")
+	}
+
+	q, err := historyQuery(p)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := w.messageLog.History(channel, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHistoryResponse(page), nil
+}
+
+// conversationsReplies implements conversations.replies. It returns a message
+// and the replies in its thread, oldest first.
+func (w *WebAPI) conversationsReplies(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channel := p.String("channel")
+	if channel == "" {
+		return nil, apiError("channel_not_found")
+	}
+
+	ts := p.String("ts")
+	if ts == "" {
+		return nil, apiError("thread_not_found")
+	}
+
+	q, err := historyQuery(p)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := w.messageLog.Replies(channel, ts, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHistoryResponse(page), nil
+}
+
+func newHistoryResponse(page HistoryPage) HistoryResponse {
+	messages := page.Messages
+	if messages == nil {
+		messages = []LoggedMessage{}
+	}
+
+	return HistoryResponse{
+		APIResponse:      APIResponse{OK: true},
+		Messages:         messages,
+		HasMore:          page.HasMore,
+		ResponseMetadata: ResponseMetadata{NextCursor: page.NextCursor},
+	}
+}
+
+// Conversation describes a channel. It's structured to be similar to Slack's
+// conversation object.
+type Conversation struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	IsChannel  bool   `json:"is_channel"`
+	IsPrivate  bool   `json:"is_private"`
+	IsArchived bool   `json:"is_archived"`
+	IsMember   bool   `json:"is_member"`
+	Created    int64  `json:"created"`
+	Topic      Topic  `json:"topic"`
+	Purpose    Topic  `json:"purpose"`
+	NumMembers int    `json:"num_members"`
+}
+
+// Topic is a channel's topic or purpose.
+type Topic struct {
+	Value   string `json:"value"`
+	Creator string `json:"creator"`
+	LastSet int64  `json:"last_set"`
+}
+
+// newConversation describes a channel the way Slack does. Its ID is its IRC
+// name, e.g. #test, and its name is the same without the #.
+func newConversation(channel Channel) Conversation {
+	return Conversation{
+		ID:        channel.Name,
+		Name:      strings.TrimLeft(channel.Name, "#&"),
+		IsChannel: true,
+		IsPrivate: channel.IsPrivate(),
+		IsMember:  true,
+		Created:   channel.Created,
+		Topic: Topic{
+			Value:   channel.Topic,
+			Creator: channel.TopicSetBy,
+			LastSet: channel.TopicSetAt,
+		},
+		NumMembers: len(channel.Members),
+	}
+}
+
+// ConversationsListResponse is the response to a conversations.list request.
+type ConversationsListResponse struct {
+	APIResponse
+	Channels         []Conversation   `json:"channels"`
+	ResponseMetadata ResponseMetadata `json:"response_metadata"`
+}
+
+// conversationsList implements conversations.list. It returns the channels
+// we're in, sorted by name.
+//
+// We only know about channels we're in, so that's all we list.
+func (w *WebAPI) conversationsList(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	types := map[string]bool{"public_channel": true}
+	if p.String("types") != "" {
+		types = map[string]bool{}
+		for _, t := range strings.Split(p.String("types"), ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	limit, err := pageLimit(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	conversations := map[string]Conversation{}
+	for _, channel := range w.channelState.Channels() {
+		conversation := newConversation(channel)
+		if conversation.IsPrivate && !types["private_channel"] {
+			continue
+		}
+		if !conversation.IsPrivate && !types["public_channel"] {
+			continue
+		}
+		ids = append(ids, conversation.ID)
+		conversations[conversation.ID] = conversation
+	}
+
+	page, nextCursor, err := paginateIDs(ids, p.String("cursor"), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := []Conversation{}
+	for _, id := range page {
+		channels = append(channels, conversations[id])
+	}
+
+	return ConversationsListResponse{
+		APIResponse:      APIResponse{OK: true},
+		Channels:         channels,
+		ResponseMetadata: ResponseMetadata{NextCursor: nextCursor},
+	}, nil
+}
+
+// ConversationsInfoResponse is the response to a conversations.info request.
+type ConversationsInfoResponse struct {
+	APIResponse
+	Channel Conversation `json:"channel"`
+}
+
+// conversationsInfo implements conversations.info. It describes a channel
+// we're in.
+func (w *WebAPI) conversationsInfo(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channel, ok := w.channelState.Channel(p.String("channel"))
+	if !ok {
+		return nil, apiError("channel_not_found")
+	}
+
+	return ConversationsInfoResponse{
+		APIResponse: APIResponse{OK: true},
+		Channel:     newConversation(channel),
+	}, nil
+}
+
+// ConversationsMembersResponse is the response to a conversations.members
+// request.
+type ConversationsMembersResponse struct {
+	APIResponse
+	Members          []string         `json:"members"`
+	ResponseMetadata ResponseMetadata `json:"response_metadata"`
+}
+
+// conversationsMembers implements conversations.members. It returns the nicks
+// in a channel we're in, sorted.
+func (w *WebAPI) conversationsMembers(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channel, ok := w.channelState.Channel(p.String("channel"))
+	if !ok {
+		return nil, apiError("channel_not_found")
+	}
+
+	limit, err := pageLimit(p)
+	if err != nil {
+		return nil, err
+	}
+
+	members, nextCursor, err := paginateIDs(channel.SortedMembers(),
+		p.String("cursor"), limit)
+	if err != nil {
+		return nil, err
+	}
+	if members == nil {
+		members = []string{}
+	}
+
+	return ConversationsMembersResponse{
+		APIResponse:      APIResponse{OK: true},
+		Members:          members,
+		ResponseMetadata: ResponseMetadata{NextCursor: nextCursor},
+	}, nil
+}
+
+// pageLimit reads the limit argument of a paginated method.
+func pageLimit(p APIParams) (int, error) {
+	limit, err := p.Int("limit", 100)
+	if err != nil {
+		return 0, err
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 1000
+	}
+	return limit, nil
+}
+
+// Cursors for lists of IDs are base64 encoded "next_id:<id>" where id is the
+// first ID of the next page.
+const idCursorPrefix = "next_id:"
+
+// paginateIDs returns a page of the given IDs. It returns the cursor for the
+// next page, if there is one.
+func paginateIDs(
+	ids []string,
+	cursor string,
+	limit int,
+) ([]string, string, error) {
+	start := 0
+	if cursor != "" {
+		buf, err := base64.StdEncoding.DecodeString(cursor)
+		if err != nil || !strings.HasPrefix(string(buf), idCursorPrefix) {
+			return nil, "", apiError("invalid_cursor")
+		}
+
+		next := strings.TrimPrefix(string(buf), idCursorPrefix)
+		start = len(ids)
+		for i, id := range ids {
+			if strings.ToLower(id) >= strings.ToLower(next) {
+				start = i
+				break
+			}
+		}
+	}
+
+	end := start + limit
+	if end >= len(ids) {
+		return ids[start:], "", nil
+	}
+
+	return ids[start:end], base64.StdEncoding.EncodeToString(
+		[]byte(idCursorPrefix + ids[end])), nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andyjack/court/internal/ircv3"
+	"github.com/andyjack/court/internal/logging"
+)
+
+// How long we wait for the server to reply to a JOIN, PART, INVITE, or KICK.
+var membershipTimeout = 10 * time.Second
+
+// ircErrors maps IRC error numerics to the Slack error codes we respond with.
+var ircErrors = map[string]string{
+	"401": "user_not_found",        // ERR_NOSUCHNICK
+	"403": "channel_not_found",     // ERR_NOSUCHCHANNEL
+	"405": "too_many_channels",     // ERR_TOOMANYCHANNELS
+	"441": "user_not_in_channel",   // ERR_USERNOTINCHANNEL
+	"442": "not_in_channel",        // ERR_NOTONCHANNEL
+	"443": "already_in_channel",    // ERR_USERONCHANNEL
+	"471": "channel_is_full",       // ERR_CHANNELISFULL
+	"473": "invite_only",           // ERR_INVITEONLYCHAN
+	"474": "banned",                // ERR_BANNEDFROMCHAN
+	"475": "bad_channel_key",       // ERR_BADCHANNELKEY
+	"476": "invalid_name",          // ERR_BADCHANMASK
+	"477": "registration_required", // ERR_NEEDREGGEDNICK
+	"482": "restricted_action",     // ERR_CHANOPRIVSNEEDED
+}
+
+// isErrorFor returns whether the message is one of the given error numerics
+// about one of the targets (a channel or nick).
+func isErrorFor(m ircv3.Message, targets []string, numerics ...string) bool {
+	found := false
+	for _, numeric := range numerics {
+		if m.Command == numeric {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	// Error numerics look like <me> <target> [<target>] <text>.
+	if len(m.Params) < 2 {
+		return false
+	}
+	for _, param := range m.Params[1:] {
+		for _, target := range targets {
+			if strings.EqualFold(param, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validNick returns whether s can be a nick in a command we send. It can't be
+// blank, contain a space or comma, or start with a colon. Otherwise it would
+// change the meaning of the command or we couldn't encode it.
+func validNick(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " ,\r\n\x00") && s[0] != ':'
+}
+
+// validChannel returns whether s can be a channel in a command we send. It
+// must start with a channel prefix (# or &) and can't contain a space, comma,
+// or ^G. Otherwise it could be a nick, or a target such as 0 that JOIN treats
+// specially.
+func validChannel(s string) bool {
+	return len(s) > 1 && (s[0] == '#' || s[0] == '&') &&
+		!strings.ContainsAny(s, " ,\a\r\n\x00")
+}
+
+// ircError turns an error numeric into the error we respond with.
+func ircError(m ircv3.Message) error {
+	if errorCode, ok := ircErrors[m.Command]; ok {
+		return apiError(errorCode)
+	}
+	return apiError("internal_error")
+}
+
+// waitForReply writes the message and waits for the server to confirm it or
+// send an error. success decides whether a message confirms it. Any of the
+// numerics about one of the targets (a channel or nick) is an error.
+func (w *WebAPI) waitForReply(
+	logger *logging.Logger,
+	m ircv3.Message,
+	targets []string,
+	success func(ircv3.Message) bool,
+	numerics ...string,
+) error {
+	reply, err := w.ircClient.WriteAndWait(logger, m,
+		func(reply ircv3.Message) bool {
+			return success(reply) || isErrorFor(reply, targets, numerics...)
+		}, membershipTimeout)
+	if err != nil {
+		logger.Warn("No reply from IRC server", "command", m.Command,
+			"targets", targets, "error", err)
+		return apiError("request_timeout")
+	}
+
+	if success(reply) {
+		return nil
+	}
+	return ircError(reply)
+}
+
+// fromUs returns whether the message has our nick as its source.
+func (w *WebAPI) fromUs(m ircv3.Message) bool {
+	return strings.EqualFold(m.SourceNick(), w.ircClient.nick)
+}
+
+// conversationFor describes a channel after a change. We may not have seen
+// the change in our channel state yet, so we fall back to just its name.
+func (w *WebAPI) conversationFor(name string) Conversation {
+	if channel, ok := w.channelState.Channel(name); ok {
+		return newConversation(channel)
+	}
+	return newConversation(Channel{Name: name})
+}
+
+// JoinResponse is the response to a conversations.join request.
+type JoinResponse struct {
+	APIResponse
+	Channel Conversation `json:"channel"`
+	Warning string       `json:"warning,omitempty"`
+}
+
+// conversationsJoin implements conversations.join. It joins the channel.
+func (w *WebAPI) conversationsJoin(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channel := p.String("channel")
+	if channel == "" {
+		return nil, apiError("channel_not_found")
+	}
+	if !validChannel(channel) {
+		return nil, apiError("invalid_arguments")
+	}
+
+	if c, ok := w.channelState.Channel(channel); ok {
+		return JoinResponse{
+			APIResponse: APIResponse{OK: true},
+			Channel:     newConversation(c),
+			Warning:     "already_in_channel",
+		}, nil
+	}
+
+	err := w.waitForReply(
+		p.logger,
+		ircv3.Message{Command: "JOIN", Params: []string{channel}},
+		[]string{channel},
+		func(m ircv3.Message) bool {
+			return m.Command == "JOIN" && w.fromUs(m) && len(m.Params) > 0 &&
+				strings.EqualFold(m.Params[0], channel)
+		},
+		"403", "405", "471", "473", "474", "475", "476", "477",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return JoinResponse{
+		APIResponse: APIResponse{OK: true},
+		Channel:     w.conversationFor(channel),
+	}, nil
+}
+
+// conversationsLeave implements conversations.leave. It parts the channel.
+func (w *WebAPI) conversationsLeave(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channel := p.String("channel")
+	if channel == "" {
+		return nil, apiError("channel_not_found")
+	}
+	if !validChannel(channel) {
+		return nil, apiError("invalid_arguments")
+	}
+
+	if _, ok := w.channelState.Channel(channel); !ok {
+		return nil, apiError("not_in_channel")
+	}
+
+	err := w.waitForReply(
+		p.logger,
+		ircv3.Message{Command: "PART", Params: []string{channel}},
+		[]string{channel},
+		func(m ircv3.Message) bool {
+			return m.Command == "PART" && w.fromUs(m) && len(m.Params) > 0 &&
+				strings.EqualFold(m.Params[0], channel)
+		},
+		"403", "442",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return APIResponse{OK: true}, nil
+}
+
+// InviteResponse is the response to a conversations.invite request.
+type InviteResponse struct {
+	APIResponse
+	Channel Conversation `json:"channel"`
+}
+
+// conversationsInvite implements conversations.invite. It invites each of the
+// users (a comma separated list of nicks) to the channel.
+//
+// If inviting a user fails, we stop and respond with the error.
+func (w *WebAPI) conversationsInvite(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channel := p.String("channel")
+	if channel == "" {
+		return nil, apiError("channel_not_found")
+	}
+	if !validChannel(channel) {
+		return nil, apiError("invalid_arguments")
+	}
+
+	var users []string
+	for _, user := range strings.Split(p.String("users"), ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			users = append(users, user)
+		}
+	}
+	if len(users) == 0 {
+		return nil, apiError("no_user")
+	}
+
+	for _, user := range users {
+		if !validNick(user) {
+			return nil, apiError("user_not_found")
+		}
+	}
+
+	for _, user := range users {
+		if strings.EqualFold(user, w.ircClient.nick) {
+			return nil, apiError("cant_invite_self")
+		}
+
+		// The server replies with RPL_INVITING: <me> <nick> <channel>.
+		err := w.waitForReply(
+			p.logger,
+			ircv3.Message{Command: "INVITE", Params: []string{user, channel}},
+			[]string{user, channel},
+			func(m ircv3.Message) bool {
+				return m.Command == "341" && len(m.Params) > 2 &&
+					strings.EqualFold(m.Params[1], user) &&
+					strings.EqualFold(m.Params[2], channel)
+			},
+			"401", "403", "442", "443", "482",
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return InviteResponse{
+		APIResponse: APIResponse{OK: true},
+		Channel:     w.conversationFor(channel),
+	}, nil
+}
+
+// conversationsKick implements conversations.kick. It kicks the user (a nick)
+// from the channel.
+func (w *WebAPI) conversationsKick(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	channel := p.String("channel")
+	if channel == "" {
+		return nil, apiError("channel_not_found")
+	}
+	if !validChannel(channel) {
+		return nil, apiError("invalid_arguments")
+	}
+
+	user := p.String("user")
+	if !validNick(user) {
+		return nil, apiError("user_not_found")
+	}
+
+	if strings.EqualFold(user, w.ircClient.nick) {
+		return nil, apiError("cant_kick_self")
+	}
+
+	err := w.waitForReply(
+		p.logger,
+		ircv3.Message{Command: "KICK", Params: []string{channel, user}},
+		[]string{channel, user},
+		func(m ircv3.Message) bool {
+			return m.Command == "KICK" && len(m.Params) > 1 &&
+				strings.EqualFold(m.Params[0], channel) &&
+				strings.EqualFold(m.Params[1], user)
+		},
+		"401", "403", "441", "442", "482",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return APIResponse{OK: true}, nil
+}
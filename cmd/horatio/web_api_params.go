@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// APIParams holds the arguments to a Web API method.
+//
+// Like Slack, we accept arguments in a JSON body, a form encoded body, or the
+// query string. If an argument is in both the body and the query string, the
+// body wins.
+//
+// We hold every argument as a string. JSON strings are unquoted. Other JSON
+// values such as numbers, arrays, and objects are held as their JSON text.
+// This matches form encoded requests where structured arguments like blocks
+// are JSON text.
+type APIParams struct {
+	values map[string]string
+
+	// The token the request authenticated with. It is blank if there was none.
+	token string
+
+	// For entries about the request. Pass it to the IRC client when writing
+	// messages because of the request.
+	logger *logging.Logger
+}
+
+// apiError is an error with a Slack error code such as invalid_form_data.
+type apiError string
+
+func (a apiError) Error() string { return string(a) }
+
+// parseParams reads the arguments from the request.
+//
+// The token comes from the Authorization header if there is one. Otherwise
+// it comes from a token argument in a form body or the query string. Like
+// Slack, we don't look for a token in JSON bodies.
+func parseParams(r *http.Request) (APIParams, error) {
+	p := APIParams{values: map[string]string{}}
+
+	for k, v := range r.URL.Query() {
+		p.values[k] = v[0]
+	}
+
+	if r.Method == http.MethodPost {
+		if err := p.parseBody(r); err != nil {
+			return APIParams{}, err
+		}
+	}
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		p.token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	if p.token == "" {
+		p.token = p.values["token"]
+	}
+	delete(p.values, "token")
+
+	return p, nil
+}
+
+// parseBody reads arguments from a POST body.
+func (p APIParams) parseBody(r *http.Request) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		// A body without a content type carries no arguments. We still accept
+		// the request as it may have its arguments in the query string.
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return apiError("invalid_form_data")
+	}
+
+	switch mediaType {
+	case "application/json":
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return fmt.Errorf("error reading request: %s", err)
+		}
+		if len(strings.TrimSpace(string(buf))) == 0 {
+			return nil
+		}
+		return p.parseJSON(buf)
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return apiError("invalid_form_data")
+		}
+		for k, v := range r.PostForm {
+			p.values[k] = v[0]
+		}
+		return nil
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			return apiError("invalid_form_data")
+		}
+		for k, v := range r.MultipartForm.Value {
+			p.values[k] = v[0]
+		}
+		return nil
+	default:
+		return apiError("invalid_form_data")
+	}
+}
+
+// parseJSON reads arguments from a JSON object.
+func (p APIParams) parseJSON(buf []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return apiError("invalid_json")
+	}
+
+	for k, v := range raw {
+		text := strings.TrimSpace(string(v))
+		if text == "null" || k == "token" {
+			continue
+		}
+
+		if strings.HasPrefix(text, `"`) {
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				return apiError("invalid_json")
+			}
+			p.values[k] = s
+			continue
+		}
+
+		p.values[k] = text
+	}
+
+	return nil
+}
+
+// String returns the argument with the given name. It is blank if the
+// argument is not present.
+func (p APIParams) String(name string) string {
+	return p.values[name]
+}
+
+// Has returns whether the argument is present.
+func (p APIParams) Has(name string) bool {
+	_, ok := p.values[name]
+	return ok
+}
+
+// Int returns the argument with the given name as an integer. If the argument
+// is not present, we return the default.
+func (p APIParams) Int(name string, def int) (int, error) {
+	v, ok := p.values[name]
+	if !ok || v == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, apiError("invalid_arguments")
+	}
+	return n, nil
+}
+
+// Bool returns the argument with the given name as a boolean. It is false if
+// the argument is not present.
+func (p APIParams) Bool(name string) bool {
+	v := p.values[name]
+	return v == "true" || v == "1"
+}
+
+// JSON decodes an argument holding JSON text, such as blocks, into v. If the
+// argument is not present, we leave v alone.
+func (p APIParams) JSON(name string, v interface{}) error {
+	s, ok := p.values[name]
+	if !ok || s == "" {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		return apiError("invalid_arguments")
+	}
+	return nil
+}
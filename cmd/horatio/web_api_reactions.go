@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/andyjack/court/internal/ircv3"
+)
+
+// IRC has no reactions of its own. The IRCv3 draft for them sends a TAGMSG
+// with a +draft/react tag holding the reaction and a +draft/reply tag holding
+// the message ID of the message reacted to. We use these when the server
+// supports message tags. Otherwise we send a compact message to the channel
+// describing the reaction.
+//
+// We don't translate between Slack's emoji names and emoji characters. A
+// reaction is whatever name we're given.
+const (
+	tagReact   = "+draft/react"
+	tagUnreact = "+draft/unreact"
+	tagReply   = "+draft/reply"
+)
+
+// reactionQuoteLength is how much of the message we quote when we describe a
+// reaction in a message to the channel.
+const reactionQuoteLength = 40
+
+// reactionsAdd implements reactions.add.
+func (w *WebAPI) reactionsAdd(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	return w.react(p, true)
+}
+
+// reactionsRemove implements reactions.remove.
+func (w *WebAPI) reactionsRemove(
+	r *http.Request,
+	p APIParams,
+) (interface{}, error) {
+	return w.react(p, false)
+}
+
+// react adds or removes one of our reactions to a message.
+func (w *WebAPI) react(p APIParams, add bool) (interface{}, error) {
+	channel := p.String("channel")
+	ts := p.String("timestamp")
+	name := strings.Trim(p.String("name"), ":")
+
+	if channel == "" || ts == "" {
+		return nil, apiError("no_item_specified")
+	}
+
+	if name == "" {
+		return nil, apiError("invalid_name")
+	}
+
+	if err := w.checkPostable(channel); err != nil {
+		return nil, err
+	}
+
+	var message LoggedMessage
+	var err error
+	if add {
+		message, err = w.messageLog.AddReaction(channel, ts, name,
+			w.ircClient.nick)
+	} else {
+		message, err = w.messageLog.RemoveReaction(channel, ts, name,
+			w.ircClient.nick)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w.ircClient.Write(p.logger, reactionMessage(channel, message, name, add,
+		w.ircClient.HasCap("message-tags")))
+
+	return APIResponse{OK: true}, nil
+}
+
+// reactionMessage creates the IRC message telling the channel about a
+// reaction to a message.
+//
+// If useTags is true and the message has an IRC message ID, this is a TAGMSG.
+// Otherwise it's a PRIVMSG such as "+:thumbsup: to nick: some text...".
+func reactionMessage(
+	channel string,
+	m LoggedMessage,
+	name string,
+	add,
+	useTags bool,
+) ircv3.Message {
+	if useTags && m.MsgID != "" {
+		tag := tagReact
+		if !add {
+			tag = tagUnreact
+		}
+		return ircv3.Message{
+			Tags:    map[string]string{tag: name, tagReply: m.MsgID},
+			Command: "TAGMSG",
+			Params:  []string{channel},
+		}
+	}
+
+	sign := "+"
+	if !add {
+		sign = "-"
+	}
+
+	text := []rune(m.Text)
+	quote := string(text)
+	if len(text) > reactionQuoteLength {
+		quote = string(text[:reactionQuoteLength]) + "..."
+	}
+
+	return ircv3.Message{
+		Command: "PRIVMSG",
+		Params: []string{
+			channel,
+			fmt.Sprintf("%s:%s: to %s: %s", sign, name, m.User, quote),
+		},
+	}
+}
+
+// ircReaction is a reaction someone made on IRC.
+type ircReaction struct {
+	// The reaction, e.g. thumbsup.
+	Name string
+
+	// The IRC message ID of the message reacted to.
+	MsgID string
+
+	// False if they removed the reaction.
+	Added bool
+}
+
+// reactionFromIRC returns the reaction in a TAGMSG. It returns false if the
+// TAGMSG is not a reaction.
+func reactionFromIRC(m ircv3.Message) (ircReaction, bool) {
+	msgID := m.Tags[tagReply]
+	if msgID == "" {
+		return ircReaction{}, false
+	}
+
+	if name := strings.Trim(m.Tags[tagReact], ":"); name != "" {
+		return ircReaction{Name: name, MsgID: msgID, Added: true}, true
+	}
+
+	if name := strings.Trim(m.Tags[tagUnreact], ":"); name != "" {
+		return ircReaction{Name: name, MsgID: msgID}, true
+	}
+
+	return ircReaction{}, false
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// Webhooks is an HTTP server acting as Slack's incoming webhooks. Each
+// webhook posts the messages it receives to an IRC channel.
+//
+// Slack's incoming webhook URLs look like
+// https://hooks.slack.com/services/T.../B.../secret. We serve the same paths.
+//
+// See https://api.slack.com/messaging/webhooks
+type Webhooks struct {
+	logger       *logging.Logger
+	metrics      *Metrics
+	webAPI       *WebAPI
+	channelState *ChannelState
+
+	// Webhooks keyed by their team and webhook IDs, e.g. T0001/B0001.
+	mutex    sync.Mutex
+	webhooks map[string]Webhook
+}
+
+// Webhook is an incoming webhook.
+type Webhook struct {
+	// The IDs in its URL. Like Slack's, these start with T and B.
+	TeamID string
+	ID     string
+
+	// The secret at the end of its URL. Requests must have this.
+	Secret string
+
+	// The channel we post to.
+	Channel string
+}
+
+// ParseWebhook parses a webhook setting, e.g. T0001/B0001/secret=#test.
+func ParseWebhook(s string) (Webhook, error) {
+	idx := strings.Index(s, "=")
+	if idx == -1 {
+		return Webhook{}, fmt.Errorf(
+			"invalid webhook, want T.../B.../secret=#channel: %s", s)
+	}
+
+	parts := strings.Split(s[:idx], "/")
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "T") ||
+		!strings.HasPrefix(parts[1], "B") || parts[2] == "" {
+		return Webhook{}, fmt.Errorf(
+			"invalid webhook, want T.../B.../secret=#channel: %s", s)
+	}
+
+	channel := s[idx+1:]
+	if channel == "" || channel[0] != '#' {
+		return Webhook{}, fmt.Errorf("webhook channel must start with #: %s",
+			s)
+	}
+
+	return Webhook{
+		TeamID:  parts[0],
+		ID:      parts[1],
+		Secret:  parts[2],
+		Channel: channel,
+	}, nil
+}
+
+// NewWebhooks creates a Webhooks serving the webhooks.
+func NewWebhooks(
+	logger *logging.Logger,
+	metrics *Metrics,
+	webAPI *WebAPI,
+	channelState *ChannelState,
+	webhooks []Webhook,
+) *Webhooks {
+	h := &Webhooks{
+		logger:       logger,
+		metrics:      metrics,
+		webAPI:       webAPI,
+		channelState: channelState,
+	}
+	h.SetWebhooks(webhooks)
+	return h
+}
+
+// SetWebhooks replaces the webhooks we serve.
+func (h *Webhooks) SetWebhooks(webhooks []Webhook) {
+	m := map[string]Webhook{}
+	for _, webhook := range webhooks {
+		m[webhook.TeamID+"/"+webhook.ID] = webhook
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.webhooks = m
+}
+
+// WebhookPayload is a message sent to an incoming webhook.
+//
+// Slack's legacy webhooks let the payload change the channel, username, and
+// icon. We ignore these as Slack's current ones do.
+type WebhookPayload struct {
+	Text        string       `json:"text"`
+	Blocks      []Block      `json:"blocks"`
+	Attachments []Attachment `json:"attachments"`
+	ThreadTs    string       `json:"thread_ts"`
+}
+
+// Attachment is a legacy secondary attachment in a message.
+//
+// See https://api.slack.com/reference/messaging/attachments
+type Attachment struct {
+	Fallback  string            `json:"fallback,omitempty"`
+	Color     string            `json:"color,omitempty"`
+	Pretext   string            `json:"pretext,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	TitleLink string            `json:"title_link,omitempty"`
+	Text      string            `json:"text,omitempty"`
+	Fields    []AttachmentField `json:"fields,omitempty"`
+	Footer    string            `json:"footer,omitempty"`
+}
+
+// AttachmentField is a field in an attachment, shown as a table.
+type AttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short,omitempty"`
+}
+
+// textFromAttachments creates a message's text from its attachments.
+//
+// Slack shows an attachment's fallback text in clients that can't show
+// attachments. IRC clients can't, so we use it if there is one. Otherwise we
+// put together what the attachment shows.
+func textFromAttachments(attachments []Attachment) string {
+	var parts []string
+	for _, a := range attachments {
+		if a.Fallback != "" {
+			parts = append(parts, oneLine(a.Fallback))
+			continue
+		}
+
+		for _, s := range []string{a.Pretext, a.Title, a.Text} {
+			if s != "" {
+				parts = append(parts, oneLine(s))
+			}
+		}
+		for _, f := range a.Fields {
+			parts = append(parts, oneLine(f.Title+": "+f.Value))
+		}
+		if a.Footer != "" {
+			parts = append(parts, oneLine(a.Footer))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// oneLine joins the lines of s with spaces. We put the attachments' parts on
+// one line, following the last line of the message's text.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// ServeHTTP handles a request to a webhook, /services/T.../B.../secret. We
+// post its message to the webhook's channel.
+//
+// Like Slack, we respond with ok or an error code, such as no_text, as plain
+// text.
+func (h *Webhooks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	logger := httpRequestLogger(h.logger, r)
+
+	errorCode, status := h.handle(logger, r)
+	if errorCode == "" {
+		h.writeResponse(logger, w, http.StatusOK, "ok")
+		logger.Info("Processed webhook request", "result", "ok", "duration",
+			time.Since(start))
+		h.metrics.webhookRequests.Inc("")
+		return
+	}
+
+	h.writeResponse(logger, w, status, errorCode)
+	logger.Info("Processed webhook request", "result", errorCode, "duration",
+		time.Since(start))
+	h.metrics.webhookRequests.Inc(errorCode)
+}
+
+// handle posts a webhook request's message. If there's a problem, we return
+// the error code and HTTP status to respond with.
+func (h *Webhooks) handle(
+	logger *logging.Logger,
+	r *http.Request,
+) (string, int) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/services/"), "/")
+	if len(parts) != 3 {
+		return "no_service", http.StatusNotFound
+	}
+
+	h.mutex.Lock()
+	webhook, ok := h.webhooks[parts[0]+"/"+parts[1]]
+	h.mutex.Unlock()
+	if !ok {
+		return "no_service", http.StatusNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(parts[2]),
+		[]byte(webhook.Secret)) != 1 {
+		return "invalid_token", http.StatusForbidden
+	}
+
+	if r.Method != http.MethodPost {
+		return "invalid_method", http.StatusMethodNotAllowed
+	}
+
+	payload, err := parseWebhookPayload(r)
+	if err != nil {
+		logger.Warn("Invalid webhook payload", "error", err)
+		return "invalid_payload", http.StatusBadRequest
+	}
+
+	if _, ok := h.channelState.Channel(webhook.Channel); !ok {
+		return "channel_not_found", http.StatusNotFound
+	}
+
+	// Like Slack, text is optional if there are blocks or attachments.
+	//
+	// We leave the text's lines as they are. PostMessage sends each as its
+	// own message, as it does for chat.postMessage.
+	text := payload.Text
+	if strings.TrimSpace(text) == "" {
+		text = textFromBlocks(payload.Blocks)
+	}
+	if s := textFromAttachments(payload.Attachments); s != "" {
+		text = strings.TrimSpace(text + " " + s)
+	}
+	if strings.TrimSpace(text) == "" {
+		return "no_text", http.StatusBadRequest
+	}
+
+	h.webAPI.PostMessage(logger, webhook.Channel, LoggedMessage{
+		Text:        text,
+		ThreadTs:    payload.ThreadTs,
+		Blocks:      payload.Blocks,
+		Attachments: payload.Attachments,
+	})
+
+	return "", http.StatusOK
+}
+
+// parseWebhookPayload reads the payload from a webhook request. Like Slack,
+// we accept it as a JSON body or as a form with the JSON in its payload
+// field.
+func parseWebhookPayload(r *http.Request) (WebhookPayload, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return WebhookPayload{}, fmt.Errorf("invalid content type: %s", err)
+	}
+
+	var buf []byte
+	switch mediaType {
+	case "application/json":
+		buf, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return WebhookPayload{}, fmt.Errorf("error reading request: %s", err)
+		}
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return WebhookPayload{}, fmt.Errorf("error parsing form: %s", err)
+		}
+		buf = []byte(r.PostForm.Get("payload"))
+	default:
+		return WebhookPayload{}, fmt.Errorf("unsupported content type: %s",
+			mediaType)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(buf, &payload); err != nil {
+		return WebhookPayload{}, fmt.Errorf("error decoding payload: %s", err)
+	}
+	return payload, nil
+}
+
+// writeResponse writes a plain text response.
+func (h *Webhooks) writeResponse(
+	logger *logging.Logger,
+	w http.ResponseWriter,
+	status int,
+	body string,
+) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(body)); err != nil {
+		logger.Error("Error writing response", "error", err)
+	}
+}
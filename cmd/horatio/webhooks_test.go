@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testWebhooks are the incoming webhooks horatio serves in tests. We're not
+// in #elsewhere.
+var testWebhooks = []Webhook{
+	{TeamID: "T1", ID: "B1", Secret: "s3cret", Channel: "#test"},
+	{TeamID: "T1", ID: "B2", Secret: "s3cret", Channel: "#elsewhere"},
+}
+
+func TestParseWebhook(t *testing.T) {
+	tests := []struct {
+		input   string
+		webhook Webhook
+		ok      bool
+	}{
+		{"T1/B1/s3cret=#test", testWebhooks[0], true},
+		{"T1/B1/s3cret", Webhook{}, false},
+		{"T1/B1=#test", Webhook{}, false},
+		{"T1/B1/=#test", Webhook{}, false},
+		{"X1/B1/s3cret=#test", Webhook{}, false},
+		{"T1/X1/s3cret=#test", Webhook{}, false},
+		{"T1/B1/s3cret=test", Webhook{}, false},
+		{"T1/B1/s3cret=", Webhook{}, false},
+	}
+
+	for _, test := range tests {
+		webhook, err := ParseWebhook(test.input)
+		if test.ok && (err != nil || webhook != test.webhook) {
+			t.Errorf("ParseWebhook(%s) = %+v, %v, wanted %+v", test.input,
+				webhook, err, test.webhook)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("ParseWebhook(%s) succeeded, wanted an error", test.input)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	h := newTestHoratio(t)
+	defer h.close()
+
+	h.waitForChannel(t, "#test")
+
+	form := url.Values{"payload": {`{"text":"from a form"}`}}.Encode()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		response    string
+		privmsgs    []string
+	}{
+		{"json", "POST", "/services/T1/B1/s3cret", "application/json",
+			`{"text":"hello"}`, http.StatusOK, "ok", []string{"hello"}},
+		{"form", "POST", "/services/T1/B1/s3cret",
+			"application/x-www-form-urlencoded", form, http.StatusOK, "ok",
+			[]string{"from a form"}},
+		{"attachments", "POST", "/services/T1/B1/s3cret", "application/json",
+			`{"text":"Deploy","attachments":[{"fallback":"v2 is out"},` +
+				`{"title":"Build","fields":[{"title":"Status",` +
+				`"value":"passed"}]}]}`,
+			http.StatusOK, "ok",
+			[]string{"Deploy v2 is out Build Status: passed"}},
+		{"multiple lines", "POST", "/services/T1/B1/s3cret",
+			"application/json",
+			`{"text":"line one\nline two","attachments":[{"text":"a\nb"}]}`,
+			http.StatusOK, "ok", []string{"line one", "line two a b"}},
+		{"unknown webhook", "POST", "/services/T1/B9/s3cret",
+			"application/json", `{"text":"hi"}`, http.StatusNotFound,
+			"no_service", nil},
+		{"short path", "POST", "/services/T1/B1", "application/json",
+			`{"text":"hi"}`, http.StatusNotFound, "no_service", nil},
+		{"wrong secret", "POST", "/services/T1/B1/guess", "application/json",
+			`{"text":"hi"}`, http.StatusForbidden, "invalid_token", nil},
+		{"GET", "GET", "/services/T1/B1/s3cret", "", "",
+			http.StatusMethodNotAllowed, "invalid_method", nil},
+		{"bad JSON", "POST", "/services/T1/B1/s3cret", "application/json",
+			`{"text":`, http.StatusBadRequest, "invalid_payload", nil},
+		{"bad content type", "POST", "/services/T1/B1/s3cret", "text/plain",
+			`{"text":"hi"}`, http.StatusBadRequest, "invalid_payload", nil},
+		{"no text", "POST", "/services/T1/B1/s3cret", "application/json",
+			`{"text":" "}`, http.StatusBadRequest, "no_text", nil},
+		{"not in channel", "POST", "/services/T1/B2/s3cret",
+			"application/json", `{"text":"hi"}`, http.StatusNotFound,
+			"channel_not_found", nil},
+	}
+
+	var want []string
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, h.webAPI.URL+test.path,
+			strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("error creating request: %s", err)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: error sending request: %s", test.name, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: error reading response: %s", test.name, err)
+		}
+
+		if resp.StatusCode != test.status || string(body) != test.response {
+			t.Errorf("%s: got %d %s, wanted %d %s", test.name, resp.StatusCode,
+				body, test.status, test.response)
+		}
+
+		for _, privmsg := range test.privmsgs {
+			h.waitForPrivmsg(t, "#test", privmsg)
+			want = append(want, privmsg)
+		}
+	}
+
+	// Failed requests send nothing. Wait for a last message so we know IRC
+	// has seen everything we sent.
+	h.callWebAPI(t, "chat.postMessage", url.Values{
+		"channel": {"#test"},
+		"text":    {"done"},
+	}, &PostMessageResponse{})
+	h.waitForPrivmsg(t, "#test", "done")
+	want = append(want, "done")
+
+	var got []string
+	for _, m := range h.ircServer.Received() {
+		if m.Command == "PRIVMSG" {
+			got = append(got, m.Params[1])
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("sent %q, wanted %q", got, want)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+// Block is a Slack Block Kit layout block. We define the parts we use.
+//
+// See https://api.slack.com/reference/block-kit/blocks
+type Block struct {
+	Type    string `json:"type"`
+	BlockID string `json:"block_id,omitempty"`
+
+	// Section blocks have text and may have an accessory such as a button.
+	Text      *TextObject   `json:"text,omitempty"`
+	Accessory *BlockElement `json:"accessory,omitempty"`
+
+	// Actions blocks have elements such as buttons.
+	Elements []BlockElement `json:"elements,omitempty"`
+}
+
+// BlockElement is an interactive element in a block, such as a button.
+type BlockElement struct {
+	Type     string      `json:"type"`
+	ActionID string      `json:"action_id,omitempty"`
+	Text     *TextObject `json:"text,omitempty"`
+	Value    string      `json:"value,omitempty"`
+
+	// Buttons may be primary or danger.
+	Style string `json:"style,omitempty"`
+}
+
+// TextObject is text in a block.
+type TextObject struct {
+	// plain_text or mrkdwn.
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// SectionBlock creates a section block with markdown text.
+func SectionBlock(text string) Block {
+	return Block{
+		Type: "section",
+		Text: &TextObject{Type: "mrkdwn", Text: text},
+	}
+}
+
+// ActionsBlock creates an actions block holding the elements.
+func ActionsBlock(blockID string, elements ...BlockElement) Block {
+	return Block{
+		Type:     "actions",
+		BlockID:  blockID,
+		Elements: elements,
+	}
+}
+
+// Button creates a button. When someone clicks it we receive a block_actions
+// interaction with its action ID and value.
+func Button(actionID, text, value string) BlockElement {
+	return BlockElement{
+		Type:     "button",
+		ActionID: actionID,
+		Text:     &TextObject{Type: "plain_text", Text: text},
+		Value:    value,
+	}
+}
@@ -1,33 +1,269 @@
 package main
 
-import "log"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
-// messageEvent gets called when we see a message in a channel.
+	"github.com/andyjack/court/internal/store"
+)
+
+// registerPlugins adds the plugins compiled into yorick. Enable them with
+// -plugins.
+func registerPlugins(r *PluginRegistry) {
+	r.Register(&helloPlugin{})
+	r.Register(&greeterPlugin{})
+	r.Register(&karmaPlugin{})
+}
+
+// helloPlugin replies to hello, and to mentions by repeating what they said.
+type helloPlugin struct {
+	BasePlugin
+}
+
+// Name returns the plugin's name.
+func (p *helloPlugin) Name() string {
+	return "hello"
+}
+
+// OnMessage gets called when we see a message in a channel.
 //
 // We can use the WebAPIClient to reply in the channel if we like.
-func messageEvent(
+func (p *helloPlugin) OnMessage(client *WebAPIClient, event MessageEvent) {
+	reply := "huh?"
+	if event.Text == "hello" {
+		reply = "hi there"
+	}
+
+	err := client.ChatPostMessage(event.Channel, reply)
+	if err != nil {
+		client.Logger().Error("Error posting message to channel", "channel",
+			event.Channel, "error", err)
+		return
+	}
+}
+
+// OnMention gets called when someone mentions us in a message.
+//
+// The text has the leading mention of us removed.
+func (p *helloPlugin) OnMention(client *WebAPIClient, event MessageEvent) {
+	reply := fmt.Sprintf("<@%s> you said: %s", event.User, event.Text)
+	if event.Text == "" {
+		reply = fmt.Sprintf("<@%s> yes?", event.User)
+	}
+
+	err := client.ChatPostMessage(event.Channel, reply)
+	if err != nil {
+		client.Logger().Error("Error posting message to channel", "channel",
+			event.Channel, "error", err)
+		return
+	}
+}
+
+// greeterPlugin welcomes people who join a channel. Its greeting setting
+// changes what it says.
+type greeterPlugin struct {
+	BasePlugin
+
+	greeting string
+}
+
+// Name returns the plugin's name.
+func (p *greeterPlugin) Name() string {
+	return "greeter"
+}
+
+// Init reads the plugin's settings.
+func (p *greeterPlugin) Init(client *WebAPIClient, config PluginConfig) error {
+	p.greeting = "Welcome!"
+	if greeting, ok := config.Settings["greeting"]; ok {
+		if greeting == "" {
+			return fmt.Errorf("greeting must not be blank")
+		}
+		p.greeting = greeting
+	}
+	return nil
+}
+
+// OnMember gets called when someone joins or leaves a channel. We greet them
+// if they joined.
+func (p *greeterPlugin) OnMember(client *WebAPIClient, event MemberEvent) {
+	if !event.Joined {
+		return
+	}
+
+	err := client.ChatPostMessage(event.Channel, fmt.Sprintf("<@%s> %s",
+		event.User, p.greeting))
+	if err != nil {
+		client.Logger().Error("Error posting message to channel", "channel",
+			event.Channel, "error", err)
+		return
+	}
+}
+
+// karmaPlugin counts karma. Saying thing++ gives thing a point and thing--
+// takes one away. We remember the counts in the store.
+type karmaPlugin struct {
+	BasePlugin
+
+	store store.Store
+}
+
+// karmaRE matches giving or taking karma, e.g. coffee++ or <@U0123>--.
+var karmaRE = regexp.MustCompile(`(\S+?)(\+\+|--)(?:\s|$)`)
+
+// Name returns the plugin's name. It's also its namespace in the store.
+func (p *karmaPlugin) Name() string {
+	return "karma"
+}
+
+// Init remembers the store.
+func (p *karmaPlugin) Init(client *WebAPIClient, config PluginConfig) error {
+	p.store = config.Store
+	return nil
+}
+
+// OnMessage gets called when we see a message in a channel. We change the
+// karma of each thing it gives or takes karma from and say its new count.
+func (p *karmaPlugin) OnMessage(client *WebAPIClient, event MessageEvent) {
+	for _, match := range karmaRE.FindAllStringSubmatch(event.Text, -1) {
+		thing := strings.ToLower(match[1])
+
+		// No giving yourself karma.
+		if thing == strings.ToLower(fmt.Sprintf("<@%s>", event.User)) {
+			continue
+		}
+
+		delta := int64(1)
+		if match[2] == "--" {
+			delta = -1
+		}
+
+		karma, err := p.store.Increment(p.Name(), thing, delta)
+		if err != nil {
+			client.Logger().Error("Error changing karma", "thing", thing,
+				"error", err)
+			continue
+		}
+
+		err = client.ChatPostMessage(event.Channel, fmt.Sprintf(
+			"%s has %d karma", match[1], karma))
+		if err != nil {
+			client.Logger().Error("Error posting message to channel", "channel",
+				event.Channel, "error", err)
+			return
+		}
+	}
+}
+
+// registerCommands sets up the slash commands we know.
+func registerCommands(e *EventListener) {
+	e.RegisterCommand("/echo", echoCommand)
+	e.RegisterCommand("/deploy", deployCommand)
+	e.RegisterCommand("/approve", approveCommand)
+	e.RegisterAction("approve", approvalAction)
+	e.RegisterAction("deny", approvalAction)
+}
+
+// echoCommand gets called when someone runs /echo. We say what they said in
+// the channel.
+func echoCommand(
 	client *WebAPIClient,
-	channel string,
-	user string,
-	text string,
-) {
-	if text == "hello" {
-		reply := "hi there"
+	command SlashCommand,
+) *SlashCommandResponse {
+	if command.Text == "" {
+		return &SlashCommandResponse{Text: "Usage: /echo <text>"}
+	}
+
+	return &SlashCommandResponse{
+		ResponseType: "in_channel",
+		Text:         command.Text,
+	}
+}
+
+// deployCommand gets called when someone runs /deploy. It shows responding
+// to a command that takes a while: We tell the user we're starting right
+// away, and tell the channel when we're done using the response URL.
+func deployCommand(
+	client *WebAPIClient,
+	command SlashCommand,
+) *SlashCommandResponse {
+	if command.Text == "" {
+		return &SlashCommandResponse{Text: "Usage: /deploy <what>"}
+	}
+
+	go func() {
+		// Pretend to do some work.
+		time.Sleep(5 * time.Second)
 
-		err := client.ChatPostMessage(channel, reply)
+		err := command.Respond(SlashCommandResponse{
+			ResponseType: "in_channel",
+			Text: fmt.Sprintf("<@%s> deployed %s", command.UserID,
+				command.Text),
+		})
 		if err != nil {
-			log.Printf("Error posting message to channel: %s", err)
+			client.Logger().Error("Error responding to command", "error", err)
 			return
 		}
+	}()
 
-		return
+	return &SlashCommandResponse{
+		Text: fmt.Sprintf("Deploying %s...", command.Text),
 	}
+}
 
-	reply := "huh?"
+// approveCommand gets called when someone runs /approve. We ask the channel
+// to approve or deny what they asked for using buttons.
+func approveCommand(
+	client *WebAPIClient,
+	command SlashCommand,
+) *SlashCommandResponse {
+	if command.Text == "" {
+		return &SlashCommandResponse{Text: "Usage: /approve <what>"}
+	}
+
+	text := fmt.Sprintf("<@%s> wants approval for: %s", command.UserID,
+		command.Text)
+	blocks := []Block{
+		SectionBlock(text),
+		ActionsBlock("approval",
+			Button("approve", "Approve", command.Text),
+			Button("deny", "Deny", command.Text),
+		),
+	}
+
+	go func() {
+		if err := client.ChatPostMessageBlocks(command.ChannelID, text,
+			blocks); err != nil {
+			client.Logger().Error("Error posting message to channel", "channel",
+				command.ChannelID, "error", err)
+			return
+		}
+	}()
+
+	return nil
+}
+
+// approvalAction gets called when someone clicks Approve or Deny on a message
+// from approveCommand. We replace the message with the decision.
+func approvalAction(
+	client *WebAPIClient,
+	payload InteractionPayload,
+	action BlockAction,
+) {
+	decision := "approved"
+	if action.ActionID == "deny" {
+		decision = "denied"
+	}
 
-	err := client.ChatPostMessage(channel, reply)
+	err := payload.Respond(ActionResponse{
+		ReplaceOriginal: true,
+		Text: fmt.Sprintf("<@%s> %s: %s", payload.User.ID, decision,
+			action.Value),
+	})
 	if err != nil {
-		log.Printf("Error posting message to channel: %s", err)
+		client.Logger().Error("Error responding to action", "error", err)
 		return
 	}
 }
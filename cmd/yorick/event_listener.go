@@ -4,28 +4,85 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
 )
 
 // EventListener is an HTTP server that receives Slack Event API HTTP events.
 // It can use Slack's Web API to do things in response.
 type EventListener struct {
-	verbose      bool
+	logger       *logging.Logger
+	metrics      *Metrics
+	handlers     *HandlerPool
+	plugins      *PluginRegistry
 	port         int
 	webAPIClient *WebAPIClient
+	mentions     *mentionTracker
+
+	// Our own user ID. It may be blank if we don't know it.
+	userID string
+
+	// If we have a signing secret, we only accept requests signed with it.
+	signingSecret string
+
+	// recorder may be nil. If it is not, we record Event API requests with it.
+	recorder *Recorder
+
+	// Channels we respond to messages in, keyed by ID. If there are none we
+	// respond in all channels.
+	channelsMutex sync.Mutex
+	channels      map[string]struct{}
+
+	// Slash command handlers, keyed by lowercased command, e.g. /deploy.
+	commandsMutex sync.Mutex
+	commands      map[string]SlashCommandHandler
+
+	// Interaction handlers. Actions are keyed by action ID. View submissions
+	// and shortcuts are keyed by callback ID.
+	interactionsMutex sync.Mutex
+	actions           map[string]ActionHandler
+	viewSubmissions   map[string]ViewSubmissionHandler
+	shortcuts         map[string]ShortcutHandler
 }
 
 // NewEventListener creates an EventListener.
+//
+// signingSecret may be blank. If it's not, we check requests are signed with
+// it.
+//
+// recorder may be nil. If it's not, we record the Event API requests we
+// receive.
 func NewEventListener(
-	verbose bool,
+	logger *logging.Logger,
+	metrics *Metrics,
+	handlers *HandlerPool,
+	plugins *PluginRegistry,
 	port int,
 	webAPIClient *WebAPIClient,
+	userID,
+	signingSecret string,
+	recorder *Recorder,
 ) *EventListener {
 	return &EventListener{
-		verbose:      verbose,
-		port:         port,
-		webAPIClient: webAPIClient,
+		logger:        logger,
+		metrics:       metrics,
+		handlers:      handlers,
+		plugins:       plugins,
+		port:          port,
+		webAPIClient:  webAPIClient,
+		mentions:      newMentionTracker(),
+		userID:        userID,
+		signingSecret: signingSecret,
+		recorder:      recorder,
+		commands:      map[string]SlashCommandHandler{},
+
+		actions:         map[string]ActionHandler{},
+		viewSubmissions: map[string]ViewSubmissionHandler{},
+		shortcuts:       map[string]ShortcutHandler{},
 	}
 }
 
@@ -34,10 +91,13 @@ func NewEventListener(
 // It does not return unless there is an error.
 func (e *EventListener) Serve() error {
 	http.HandleFunc("/event", e.eventHandler)
+	http.HandleFunc("/command", e.commandHandler)
+	http.HandleFunc("/interactivity", e.interactivityHandler)
 
 	hostAndPort := fmt.Sprintf(":%d", e.port)
 
-	log.Printf("Starting to listen on port %d for POST /event", e.port)
+	e.logger.Info("Starting to listen for POST /event, /command, and "+
+		"/interactivity", "port", e.port)
 	if err := http.ListenAndServe(hostAndPort, nil); err != nil {
 		return fmt.Errorf("error serving: %s", err)
 	}
@@ -53,49 +113,119 @@ type EventPayload struct {
 	// url_verification events include a challenge field.
 	Challenge string `json:"challenge"`
 
+	// The rest are set in event_callback events.
+	TeamID    string `json:"team_id"`
+	EventID   string `json:"event_id"`
+	EventTime int64  `json:"event_time"`
+
+	// AuthedUsers and Authorizations identify the installation the event is
+	// for. We use them to recognize mentions of ourself.
+	AuthedUsers    []string        `json:"authed_users"`
+	Authorizations []Authorization `json:"authorizations"`
+
 	Event Event `json:"event"`
 }
 
+// Authorization describes an installation an event is visible to. It's part of
+// an Event API payload.
+type Authorization struct {
+	TeamID string `json:"team_id"`
+	UserID string `json:"user_id"`
+	IsBot  bool   `json:"is_bot"`
+}
+
 // Event represents the actual event. It's part of an Event API payload.
 type Event struct {
-	Type    string `json:"type"`
-	SubType string `json:"subtype"`
-	Channel string `json:"channel"`
-	User    string `json:"user"`
-	Text    string `json:"text"`
+	Type     string `json:"type"`
+	SubType  string `json:"subtype"`
+	Channel  string `json:"channel"`
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	BotID    string `json:"bot_id"`
+	Ts       string `json:"ts"`
+	ThreadTs string `json:"thread_ts"`
+	EventTs  string `json:"event_ts"`
 }
 
 // eventHandler handles an HTTP request sent to the /event endpoint.
 func (e *EventListener) eventHandler(w http.ResponseWriter, r *http.Request) {
+	logger := e.requestLogger(r)
+
 	if r.Method != http.MethodPost {
-		e.log(r, "invalid request method")
+		logger.Warn("Invalid request method")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	buf, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		e.log(r, "error reading request: %s", err)
+		logger.Error("Error reading request", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if e.verbose {
-		e.log(r, "Received event with body: %s", buf)
+	logger.Debug("Received event", "body", buf)
+
+	// Record before checking the signature so we can reproduce requests we
+	// rejected too.
+	if e.recorder != nil {
+		if err := e.recorder.Record(r, buf); err != nil {
+			logger.Error("Error recording request", "error", err)
+		}
+	}
+
+	if !e.verifyRequest(logger, w, r, buf) {
+		return
 	}
 
 	var p EventPayload
 	if err := json.Unmarshal(buf, &p); err != nil {
-		e.log(r, "invalid JSON: %s", err)
+		logger.Warn("Invalid JSON", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	e.log(r, "Received event: %+v", p)
+	resp := e.dispatchEvent(logger, p)
+	if resp == nil {
+		return
+	}
+
+	buf, err = json.Marshal(resp)
+	if err != nil {
+		logger.Error("Error marshaling event response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(buf); err != nil {
+		logger.Error("Error writing event response", "error", err)
+		return
+	}
+}
+
+// dispatchEvent passes an event to the function that handles its type. This
+// is the same whether the event arrived over HTTP or Socket Mode. logger
+// describes where it came from.
+//
+// It returns what to respond with, or nil to respond with nothing.
+func (e *EventListener) dispatchEvent(
+	logger *logging.Logger,
+	p EventPayload,
+) interface{} {
+	if p.EventID != "" {
+		logger = logger.With("event_id", p.EventID)
+	}
+
+	logger.Info("Received event", "type", p.Type, "event_type", p.Event.Type,
+		"channel", p.Event.Channel, "user", p.Event.User)
+	logger.Debug("Event payload", "payload", p)
+
+	e.metrics.eventsReceived.Inc(eventMetricType(p))
 
 	switch p.Type {
 	case "url_verification":
-		e.eventURLVerification(w, r, p)
+		return e.eventURLVerification(logger, p)
 	case "event_callback":
 		// eventEventCallback is the event that happens when we receive a regular
 		// authorized user event. It holds an event object inside it which can be
@@ -103,20 +233,73 @@ func (e *EventListener) eventHandler(w http.ResponseWriter, r *http.Request) {
 		// that event.
 		switch p.Event.Type {
 		case "message":
-			e.eventMessage(w, r, p.Event)
+			e.eventMessage(logger, p)
+		case "app_mention":
+			e.eventAppMention(logger, p)
+		case "member_joined_channel", "member_left_channel":
+			e.eventMember(logger, p)
 		default:
-			e.log(r, "event_callback event type not recognized")
+			logger.Warn("event_callback event type not recognized",
+				"event_type", p.Event.Type)
 		}
 	default:
-		e.log(r, "unexpected event type: %s: %s", p.Type)
+		logger.Warn("Unexpected event type", "type", p.Type)
+	}
+
+	return nil
+}
+
+// eventMetricType returns the type to count an event as in metrics. We count
+// types we don't handle as unknown so people can't make up label values.
+func eventMetricType(p EventPayload) string {
+	switch p.Type {
+	case "url_verification":
+		return p.Type
+	case "event_callback":
+		switch p.Event.Type {
+		case "message", "app_mention", "member_joined_channel",
+			"member_left_channel":
+			return p.Event.Type
+		}
+	}
+	return "unknown"
+}
+
+// verifyRequest checks the request's signature if we have a signing secret.
+// If it's not valid, we respond with an error and return false.
+func (e *EventListener) verifyRequest(
+	logger *logging.Logger,
+	w http.ResponseWriter,
+	r *http.Request,
+	body []byte,
+) bool {
+	if e.signingSecret == "" {
+		return true
 	}
+
+	if err := verifySignature(e.signingSecret, r, body); err != nil {
+		logger.Warn("Invalid signature", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	return true
 }
 
-// log logs a message associated with the given request.
-func (e *EventListener) log(r *http.Request, f string, args ...interface{}) {
-	log.Print(
-		fmt.Sprintf("HTTP %s %s from %s: ", r.Method, r.URL.Path, r.RemoteAddr) +
-			fmt.Sprintf(f, args...),
+// requestLogger returns a logger for entries about an HTTP request. It tags
+// them with a request ID. We use the one in the X-Request-Id header if there
+// is one, as horatio sends, so entries in both programs match up.
+func (e *EventListener) requestLogger(r *http.Request) *logging.Logger {
+	requestID := r.Header.Get("X-Request-Id")
+	if requestID == "" {
+		requestID = logging.NewRequestID()
+	}
+
+	return e.logger.With(
+		"request_id", requestID,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote_addr", r.RemoteAddr,
 	)
 }
 
@@ -131,55 +314,285 @@ type URLVerificationResponse struct {
 //
 // We echo the challenge back.
 func (e *EventListener) eventURLVerification(
-	w http.ResponseWriter,
-	r *http.Request,
+	logger *logging.Logger,
 	p EventPayload,
-) {
-	resp := URLVerificationResponse{
+) URLVerificationResponse {
+	logger.Info("Processed url_verification event")
+	return URLVerificationResponse{
 		Challenge: p.Challenge,
 	}
+}
 
-	buf, err := json.Marshal(resp)
-	if err != nil {
-		e.log(r, "error marshaling url_verification response: %s")
-		w.WriteHeader(http.StatusInternalServerError)
+// eventMessage is the event that we receive when a message is posted to a
+// channel.
+//
+// See https://api.slack.com/events/message
+func (e *EventListener) eventMessage(logger *logging.Logger, p EventPayload) {
+	event := p.Event
+
+	if e.ignoreEvent(logger, event) {
 		return
 	}
 
-	n, err := w.Write(buf)
-	if err != nil {
-		e.log(r, "error writing url_verification response: %s", err)
+	// subtypes can include our own messages (bot_message). To simplify things,
+	// only deal with regular channel messages which have no subtype.
+	if event.SubType != "" {
+		logger.Info("Ignoring message event with subtype", "subtype",
+			event.SubType)
 		return
 	}
-	if n != len(buf) {
-		e.log(r, "error writing url_verification response: short write")
+
+	// If the message mentions us then it is an app_mention too. Slack sends us
+	// both events if we subscribe to both. Treat it as a mention regardless of
+	// which event we see first so the mention handler sees it exactly once.
+	if mentionsAny(event.Text, e.ourUserIDs(p)) {
+		e.dispatchMention(logger, event)
 		return
 	}
 
-	e.log(r, "Processed url_verification event")
+	message := MessageEvent{
+		Channel:  event.Channel,
+		User:     event.User,
+		Text:     event.Text,
+		Ts:       event.Ts,
+		ThreadTs: event.ThreadTs,
+	}
+	e.dispatchToPlugins(logger, "message", event.Channel,
+		func(plugin Plugin, client *WebAPIClient) {
+			plugin.OnMessage(client, message)
+		})
+
+	logger.Info("Processed message event")
 }
 
-// eventMessage is the event that we receive when a message is posted to a
-// channel.
+// eventAppMention is the event that we receive when a message mentions us.
 //
-// See https://api.slack.com/events/message
-func (e *EventListener) eventMessage(
-	w http.ResponseWriter,
-	r *http.Request,
+// See https://api.slack.com/events/app_mention
+func (e *EventListener) eventAppMention(
+	logger *logging.Logger,
+	p EventPayload,
+) {
+	if e.ignoreEvent(logger, p.Event) {
+		return
+	}
+
+	e.dispatchMention(logger, p.Event)
+}
+
+// SetChannels sets the channels we respond to messages in, by ID. If there
+// are none we respond in all channels.
+func (e *EventListener) SetChannels(channels []string) {
+	m := map[string]struct{}{}
+	for _, channel := range channels {
+		m[channel] = struct{}{}
+	}
+
+	e.channelsMutex.Lock()
+	defer e.channelsMutex.Unlock()
+	e.channels = m
+}
+
+// respondsIn returns whether we respond to messages in the channel.
+func (e *EventListener) respondsIn(channel string) bool {
+	e.channelsMutex.Lock()
+	defer e.channelsMutex.Unlock()
+
+	if len(e.channels) == 0 {
+		return true
+	}
+	_, ok := e.channels[channel]
+	return ok
+}
+
+// ignoreEvent decides whether to ignore an event because it came from us or
+// from another bot, or because it's in a channel we don't respond in.
+// Replying to bots risks us talking to ourself in a loop.
+func (e *EventListener) ignoreEvent(
+	logger *logging.Logger,
+	event Event,
+) bool {
+	if !e.respondsIn(event.Channel) {
+		logger.Info("Ignoring event in channel we don't respond in",
+			"event_type", event.Type)
+		return true
+	}
+
+	if event.BotID != "" {
+		logger.Info("Ignoring event from bot", "event_type", event.Type,
+			"bot_id", event.BotID)
+		return true
+	}
+
+	if e.userID != "" && event.User == e.userID {
+		logger.Info("Ignoring event from ourself", "event_type", event.Type)
+		return true
+	}
+
+	return false
+}
+
+// dispatchMention passes a message that mentions us to the mention handler.
+//
+// The same message may arrive as both a message and an app_mention event. We
+// hand it to the handler only the first time.
+func (e *EventListener) dispatchMention(
+	logger *logging.Logger,
 	event Event,
 ) {
-	// subtypes can include our own messages (bot_message). To simplify things,
-	// only deal with regular channel messages which have no subtype.
-	if event.SubType != "" {
-		e.log(r, "Received message event with subtype %s, ignoring it",
-			event.SubType)
+	if !e.mentions.add(event.Channel, event.Ts) {
+		logger.Info("Ignoring mention we already handled", "channel",
+			event.Channel, "ts", event.Ts)
 		return
 	}
 
-	// Respond in a goroutine so we reply to the Event API request ASAP.
-	go func() {
-		messageEvent(e.webAPIClient, event.Channel, event.User, event.Text)
-	}()
+	message := MessageEvent{
+		Channel:  event.Channel,
+		User:     event.User,
+		Text:     stripLeadingMention(event.Text),
+		Ts:       event.Ts,
+		ThreadTs: event.ThreadTs,
+	}
+	e.dispatchToPlugins(logger, "mention", event.Channel,
+		func(plugin Plugin, client *WebAPIClient) {
+			plugin.OnMention(client, message)
+		})
+
+	logger.Info("Processed app_mention event")
+}
+
+// eventMember is the event that we receive when someone joins or leaves a
+// channel.
+//
+// See https://api.slack.com/events/member_joined_channel and
+// https://api.slack.com/events/member_left_channel
+func (e *EventListener) eventMember(logger *logging.Logger, p EventPayload) {
+	if e.ignoreEvent(logger, p.Event) {
+		return
+	}
+
+	member := MemberEvent{
+		Channel: p.Event.Channel,
+		User:    p.Event.User,
+		Joined:  p.Event.Type == "member_joined_channel",
+	}
+	e.dispatchToPlugins(logger, "member", p.Event.Channel,
+		func(plugin Plugin, client *WebAPIClient) {
+			plugin.OnMember(client, member)
+		})
 
-	e.log(r, "Processed message event")
+	logger.Info("Processed member event")
+}
+
+// dispatchToPlugins calls f for each plugin enabled in the channel. Each runs
+// in a goroutine so we reply to the Event API request ASAP. kind is the kind
+// of handler, such as message, for metrics.
+//
+// f gets a WebAPIClient whose logger says which plugin it's for.
+func (e *EventListener) dispatchToPlugins(
+	logger *logging.Logger,
+	kind,
+	channel string,
+	f func(plugin Plugin, client *WebAPIClient),
+) {
+	for _, plugin := range e.plugins.Enabled(channel) {
+		plugin := plugin
+		pluginLogger := logger.With("plugin", plugin.Name())
+		client := e.webAPIClient.WithLogger(pluginLogger)
+
+		if !e.handlers.Go(kind, func() {
+			f(plugin, client)
+		}) {
+			pluginLogger.Warn("Dropping event as too many handlers are running")
+		}
+	}
+}
+
+// ourUserIDs returns the user IDs that are us. This is the user ID we learned
+// from auth.test along with the users the event was delivered for.
+func (e *EventListener) ourUserIDs(p EventPayload) []string {
+	var ids []string
+	if e.userID != "" {
+		ids = append(ids, e.userID)
+	}
+	ids = append(ids, p.AuthedUsers...)
+	for _, a := range p.Authorizations {
+		if a.UserID != "" {
+			ids = append(ids, a.UserID)
+		}
+	}
+	return ids
+}
+
+// mentionsAny returns whether the text contains a mention of any of the users.
+//
+// Mentions look like <@U123> or <@U123|name>.
+func mentionsAny(text string, userIDs []string) bool {
+	for _, id := range userIDs {
+		if strings.Contains(text, "<@"+id+">") ||
+			strings.Contains(text, "<@"+id+"|") {
+			return true
+		}
+	}
+	return false
+}
+
+// stripLeadingMention removes a mention from the start of the text. For example
+// "<@U123>: hi" becomes "hi".
+func stripLeadingMention(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if !strings.HasPrefix(trimmed, "<@") {
+		return trimmed
+	}
+
+	idx := strings.Index(trimmed, ">")
+	if idx == -1 {
+		return trimmed
+	}
+
+	trimmed = strings.TrimLeft(trimmed[idx+1:], ":,")
+	return strings.TrimSpace(trimmed)
+}
+
+// mentionTracker remembers which messages we handled as mentions recently.
+type mentionTracker struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+// Slack sends the message and app_mention events for a message close together.
+// We only need to remember mentions for a little while.
+var mentionExpiry = 10 * time.Minute
+
+func newMentionTracker() *mentionTracker {
+	return &mentionTracker{
+		seen: map[string]time.Time{},
+	}
+}
+
+// add records that we handled the message with the given channel and
+// timestamp. It returns false if we already did.
+//
+// If we don't have a timestamp we can't tell messages apart, so we say we've
+// not seen it.
+func (m *mentionTracker) add(channel, ts string) bool {
+	if ts == "" {
+		return true
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	for k, t := range m.seen {
+		if now.Sub(t) > mentionExpiry {
+			delete(m.seen, k)
+		}
+	}
+
+	key := channel + " " + ts
+	if _, ok := m.seen[key]; ok {
+		return false
+	}
+	m.seen[key] = now
+	return true
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/andyjack/court/internal/logging"
+	"github.com/andyjack/court/internal/store"
+)
+
+// newTestEventListener creates an EventListener that responds in C1.
+func newTestEventListener() *EventListener {
+	logger := logging.New(ioutil.Discard, logging.LevelDebug,
+		logging.FormatLogfmt)
+	metrics := NewMetrics()
+	client := NewWebAPIClient(logger, metrics, "http://127.0.0.1:1",
+		"xoxb-test")
+	e := NewEventListener(logger, metrics, NewHandlerPool(metrics, 10),
+		NewPluginRegistry(logger, store.NewMemory()), 8080, client, "UTEST",
+		"", nil)
+	e.SetChannels([]string{"C1"})
+	return e
+}
+
+// We count event and interaction types we don't handle as unknown.
+func TestReceivedMetrics(t *testing.T) {
+	e := newTestEventListener()
+	logger := e.logger
+
+	events := []EventPayload{
+		{Type: "url_verification", Challenge: "x"},
+		{Type: "event_callback", Event: Event{Type: "member_joined_channel",
+			Channel: "C2"}},
+		{Type: "event_callback", Event: Event{Type: "made_up"}},
+		{Type: "event_callback", Event: Event{Type: "also_made_up"}},
+		{Type: "made_up"},
+	}
+	for _, p := range events {
+		e.dispatchEvent(logger, p)
+	}
+
+	interactions := []InteractionPayload{
+		{Type: "shortcut"},
+		{Type: "made_up"},
+	}
+	for _, p := range interactions {
+		e.dispatchInteraction(logger, p)
+	}
+
+	text := metricsText(t, e.metrics)
+	for _, want := range []string{
+		`yorick_events_received_total{type="url_verification"} 1`,
+		`yorick_events_received_total{type="member_joined_channel"} 1`,
+		`yorick_events_received_total{type="unknown"} 3`,
+		`yorick_interactions_received_total{type="shortcut"} 1`,
+		`yorick_interactions_received_total{type="unknown"} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+
+	if strings.Contains(text, "made_up") {
+		t.Errorf("metrics have a made up type:\n%s", text)
+	}
+}
+
+func TestIgnoreEvent(t *testing.T) {
+	e := newTestEventListener()
+
+	tests := []struct {
+		event  Event
+		ignore bool
+	}{
+		{Event{Type: "message", Channel: "C1", User: "U1"}, false},
+
+		// A channel we don't respond in.
+		{Event{Type: "message", Channel: "C2", User: "U1"}, true},
+
+		// Another bot.
+		{Event{Type: "message", SubType: "bot_message", Channel: "C1",
+			BotID: "B1"}, true},
+
+		// Ourself, with or without a subtype.
+		{Event{Type: "message", Channel: "C1", User: "UTEST"}, true},
+		{Event{Type: "message", SubType: "bot_message", Channel: "C1",
+			User: "UTEST"}, true},
+	}
+
+	for _, test := range tests {
+		if got := e.ignoreEvent(e.logger, test.event); got != test.ignore {
+			t.Errorf("ignoreEvent(%+v) = %t, wanted %t", test.event, got,
+				test.ignore)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// HandlerPool runs handlers in goroutines, up to a limit at once. This stops
+// a flood of events from starting an unbounded number of goroutines.
+//
+// When the limit is reached the pool is saturated. We reject handlers until
+// some finish, and we're not ready.
+type HandlerPool struct {
+	metrics *Metrics
+
+	// A slot per handler that may run. Running handlers hold one.
+	slots chan struct{}
+}
+
+// NewHandlerPool creates a HandlerPool running up to size handlers at once.
+func NewHandlerPool(metrics *Metrics, size int) *HandlerPool {
+	return &HandlerPool{
+		metrics: metrics,
+		slots:   make(chan struct{}, size),
+	}
+}
+
+// Go runs the handler f in a goroutine. kind says what kind of handler it is,
+// such as message, and is for metrics.
+//
+// If the pool is saturated, we don't run f and return false.
+func (p *HandlerPool) Go(kind string, f func()) bool {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.metrics.handlersRejected.Inc(kind)
+		return false
+	}
+
+	p.metrics.handlersRunning.Inc()
+
+	go func() {
+		defer func() {
+			p.metrics.handlersRunning.Dec()
+			<-p.slots
+		}()
+
+		start := time.Now()
+		f()
+		p.metrics.handlerDuration.Observe(time.Since(start).Seconds(), kind)
+	}()
+
+	return true
+}
+
+// Check returns nil if the pool has room for another handler. Otherwise it
+// returns an error saying it's saturated. It's a readiness check.
+func (p *HandlerPool) Check() error {
+	if len(p.slots) >= cap(p.slots) {
+		return fmt.Errorf("all %d handlers busy", cap(p.slots))
+	}
+	return nil
+}
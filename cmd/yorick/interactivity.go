@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// InteractionPayload is what Slack sends us when someone interacts with our
+// app, such as clicking a button, submitting a modal, or using a shortcut.
+// Slack sends these to our /interactivity endpoint.
+//
+// Which fields are set depends on the type.
+//
+// See https://api.slack.com/reference/interaction-payloads
+type InteractionPayload struct {
+	// block_actions, view_submission, shortcut, or message_action.
+	Type string `json:"type"`
+
+	User    InteractionUser    `json:"user"`
+	Team    InteractionTeam    `json:"team"`
+	Channel InteractionChannel `json:"channel"`
+
+	// block_actions: The message with the blocks that were interacted with.
+	Container InteractionContainer `json:"container"`
+	Message   InteractionMessage   `json:"message"`
+	Actions   []BlockAction        `json:"actions"`
+
+	// view_submission: The modal that was submitted.
+	View View `json:"view"`
+
+	// shortcut and message_action: The shortcut's callback ID.
+	CallbackID string `json:"callback_id"`
+
+	// We can respond later by sending to this URL. Not all types have one.
+	ResponseURL string `json:"response_url"`
+
+	TriggerID string `json:"trigger_id"`
+}
+
+// InteractionUser is who interacted.
+type InteractionUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+// InteractionTeam is the team of who interacted.
+type InteractionTeam struct {
+	ID     string `json:"id"`
+	Domain string `json:"domain"`
+}
+
+// InteractionChannel is where they interacted.
+type InteractionChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// InteractionContainer is what they interacted with, such as a message.
+type InteractionContainer struct {
+	Type      string `json:"type"`
+	MessageTs string `json:"message_ts"`
+	ChannelID string `json:"channel_id"`
+}
+
+// InteractionMessage is the message they interacted with.
+type InteractionMessage struct {
+	Ts     string  `json:"ts"`
+	Text   string  `json:"text"`
+	User   string  `json:"user"`
+	BotID  string  `json:"bot_id"`
+	Blocks []Block `json:"blocks"`
+}
+
+// BlockAction is an element they interacted with, such as a button.
+type BlockAction struct {
+	Type     string     `json:"type"`
+	BlockID  string     `json:"block_id"`
+	ActionID string     `json:"action_id"`
+	Text     TextObject `json:"text"`
+	Value    string     `json:"value"`
+	ActionTs string     `json:"action_ts"`
+}
+
+// View is a modal.
+type View struct {
+	ID              string `json:"id"`
+	CallbackID      string `json:"callback_id"`
+	PrivateMetadata string `json:"private_metadata"`
+
+	// The values of the modal's inputs. Keyed by block ID and then action ID.
+	State ViewState `json:"state"`
+}
+
+// ViewState holds the values of a modal's inputs.
+type ViewState struct {
+	Values map[string]map[string]ViewValue `json:"values"`
+}
+
+// ViewValue is the value of an input. Which field is set depends on the
+// input's type.
+type ViewValue struct {
+	Type           string          `json:"type"`
+	Value          string          `json:"value"`
+	SelectedOption *SelectedOption `json:"selected_option"`
+}
+
+// SelectedOption is the option chosen in a select input.
+type SelectedOption struct {
+	Value string `json:"value"`
+}
+
+// ViewSubmissionResponse tells Slack what to do with a modal after it's
+// submitted. To show errors next to inputs, set ResponseAction to errors and
+// Errors to the errors keyed by block ID.
+type ViewSubmissionResponse struct {
+	ResponseAction string            `json:"response_action"`
+	Errors         map[string]string `json:"errors,omitempty"`
+}
+
+// ActionResponse is a response to a block action, sent to its response URL.
+type ActionResponse struct {
+	// ephemeral (only the user sees it) or in_channel (everyone in the channel
+	// sees it).
+	ResponseType string `json:"response_type,omitempty"`
+
+	Text string `json:"text"`
+
+	// Whether to replace the message that had the blocks.
+	ReplaceOriginal bool `json:"replace_original"`
+}
+
+// ActionHandler handles someone interacting with an element such as a button.
+// It's called for each such action.
+//
+// Slack expects us to acknowledge the interaction within 3 seconds. We call
+// the handler in a goroutine after we acknowledge it.
+type ActionHandler func(
+	client *WebAPIClient,
+	payload InteractionPayload,
+	action BlockAction,
+)
+
+// ViewSubmissionHandler handles someone submitting a modal.
+//
+// It returns what to do with the modal. If it returns nil, Slack closes it.
+// It must return within 3 seconds.
+type ViewSubmissionHandler func(
+	client *WebAPIClient,
+	payload InteractionPayload,
+) *ViewSubmissionResponse
+
+// ShortcutHandler handles someone using a global or message shortcut.
+//
+// Like ActionHandler, we call it in a goroutine after we acknowledge the
+// interaction.
+type ShortcutHandler func(client *WebAPIClient, payload InteractionPayload)
+
+// RegisterAction sets the handler for interactions with elements with the
+// given action ID.
+func (e *EventListener) RegisterAction(actionID string, handler ActionHandler) {
+	e.interactionsMutex.Lock()
+	defer e.interactionsMutex.Unlock()
+	e.actions[actionID] = handler
+}
+
+// RegisterViewSubmission sets the handler for submissions of modals with the
+// given callback ID.
+func (e *EventListener) RegisterViewSubmission(
+	callbackID string,
+	handler ViewSubmissionHandler,
+) {
+	e.interactionsMutex.Lock()
+	defer e.interactionsMutex.Unlock()
+	e.viewSubmissions[callbackID] = handler
+}
+
+// RegisterShortcut sets the handler for the shortcut with the given callback
+// ID.
+func (e *EventListener) RegisterShortcut(
+	callbackID string,
+	handler ShortcutHandler,
+) {
+	e.interactionsMutex.Lock()
+	defer e.interactionsMutex.Unlock()
+	e.shortcuts[callbackID] = handler
+}
+
+// Respond sends a response to the interaction using its response URL.
+func (p InteractionPayload) Respond(resp ActionResponse) error {
+	return postResponse(p.ResponseURL, resp)
+}
+
+// interactivityHandler handles an HTTP request sent to the /interactivity
+// endpoint.
+func (e *EventListener) interactivityHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	logger := e.requestLogger(r)
+
+	if r.Method != http.MethodPost {
+		logger.Warn("Invalid request method")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("Error reading request", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("Received interaction", "body", buf)
+
+	if !e.verifyRequest(logger, w, r, buf) {
+		return
+	}
+
+	// The payload is JSON in a form field.
+	form, err := url.ParseQuery(string(buf))
+	if err != nil {
+		logger.Warn("Invalid form", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var p InteractionPayload
+	if err := json.Unmarshal([]byte(form.Get("payload")), &p); err != nil {
+		logger.Warn("Invalid payload JSON", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp := e.dispatchInteraction(logger, p)
+	if resp == nil {
+		return
+	}
+
+	buf, err = json.Marshal(resp)
+	if err != nil {
+		logger.Error("Error marshaling view submission response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(buf); err != nil {
+		logger.Error("Error writing view submission response", "error", err)
+		return
+	}
+}
+
+// dispatchInteraction passes an interaction to the function that handles its
+// type. logger describes where the interaction came from.
+//
+// It returns what to respond with, or nil to respond with nothing. Only view
+// submissions have a response.
+func (e *EventListener) dispatchInteraction(
+	logger *logging.Logger,
+	p InteractionPayload,
+) *ViewSubmissionResponse {
+	logger = logger.With("interaction_type", p.Type)
+	logger.Info("Received interaction", "user", p.User.ID)
+	logger.Debug("Interaction payload", "payload", p)
+
+	e.metrics.interactionsReceived.Inc(interactionMetricType(p))
+
+	switch p.Type {
+	case "block_actions":
+		e.interactionBlockActions(logger, p)
+	case "view_submission":
+		return e.interactionViewSubmission(logger, p)
+	case "shortcut", "message_action":
+		e.interactionShortcut(logger, p)
+	default:
+		logger.Warn("Interaction type not recognized")
+	}
+
+	return nil
+}
+
+// interactionMetricType returns the type to count an interaction as in
+// metrics. We count types we don't handle as unknown so people can't make up
+// label values.
+func interactionMetricType(p InteractionPayload) string {
+	switch p.Type {
+	case "block_actions", "view_submission", "shortcut", "message_action":
+		return p.Type
+	}
+	return "unknown"
+}
+
+// interactionBlockActions handles someone interacting with elements in a
+// message, such as clicking a button.
+func (e *EventListener) interactionBlockActions(
+	logger *logging.Logger,
+	p InteractionPayload,
+) {
+	for _, action := range p.Actions {
+		e.interactionsMutex.Lock()
+		handler, ok := e.actions[action.ActionID]
+		e.interactionsMutex.Unlock()
+
+		if !ok {
+			logger.Warn("No handler for action", "action_id", action.ActionID)
+			continue
+		}
+
+		// Respond in a goroutine so we acknowledge the interaction ASAP.
+		client := e.webAPIClient.WithLogger(logger)
+		action := action
+		if !e.handlers.Go("action", func() {
+			handler(client, p, action)
+		}) {
+			logger.Warn("Dropping action as too many handlers are running",
+				"action_id", action.ActionID)
+			continue
+		}
+
+		logger.Info("Processed action", "action_id", action.ActionID)
+	}
+}
+
+// interactionViewSubmission handles someone submitting a modal.
+func (e *EventListener) interactionViewSubmission(
+	logger *logging.Logger,
+	p InteractionPayload,
+) *ViewSubmissionResponse {
+	e.interactionsMutex.Lock()
+	handler, ok := e.viewSubmissions[p.View.CallbackID]
+	e.interactionsMutex.Unlock()
+
+	if !ok {
+		logger.Warn("No handler for view", "callback_id", p.View.CallbackID)
+		return nil
+	}
+
+	start := time.Now()
+	resp := handler(e.webAPIClient.WithLogger(logger), p)
+	e.metrics.handlerDuration.Observe(time.Since(start).Seconds(),
+		"view_submission")
+
+	logger.Info("Processed view submission", "callback_id",
+		p.View.CallbackID)
+	return resp
+}
+
+// interactionShortcut handles someone using a shortcut.
+func (e *EventListener) interactionShortcut(
+	logger *logging.Logger,
+	p InteractionPayload,
+) {
+	e.interactionsMutex.Lock()
+	handler, ok := e.shortcuts[p.CallbackID]
+	e.interactionsMutex.Unlock()
+
+	if !ok {
+		logger.Warn("No handler for shortcut", "callback_id", p.CallbackID)
+		return
+	}
+
+	client := e.webAPIClient.WithLogger(logger)
+	if !e.handlers.Go("shortcut", func() {
+		handler(client, p)
+	}) {
+		logger.Warn("Dropping shortcut as too many handlers are running",
+			"callback_id", p.CallbackID)
+		return
+	}
+
+	logger.Info("Processed shortcut", "callback_id", p.CallbackID)
+}
@@ -3,57 +3,306 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/andyjack/court/internal/config"
+	"github.com/andyjack/court/internal/health"
+	"github.com/andyjack/court/internal/logging"
+	"github.com/andyjack/court/internal/store"
 )
 
 func main() {
-	args, err := getArgs()
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replay(os.Args[2:]); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	}
+
+	args, err := getArgs(os.Args[1:], os.Stderr)
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
 
-	webAPIClient := NewWebAPIClient(args.url, args.token)
+	logger := newLogger(args.logLevel, args.logFormat)
+	logger.AddSecret(args.token)
+	logger.AddSecret(args.signingSecret)
+	logger.AddSecret(args.appToken)
+
+	metrics := NewMetrics()
+
+	webAPIClient := NewWebAPIClient(logger, metrics, args.url, args.token)
+
+	// Find out who we are so we can ignore our own messages. This also checks
+	// our token is good so we find out about a bad one right away.
+	self, err := webAPIClient.AuthTest()
+	if err != nil {
+		logger.Fatal("Error checking our token (auth.test)", "error", err)
+	}
+	logger.Info("Checked our token", "user_id", self.UserID, "bot_id",
+		self.BotID, "team", self.Team)
 
-	eventListener := NewEventListener(args.verbose, args.port, webAPIClient)
+	var recorder *Recorder
+	if args.recordFile != "" {
+		recorder, err = NewRecorder(args.recordFile)
+		if err != nil {
+			logger.Fatal("Error opening recording", "error", err)
+		}
+	}
+
+	handlers := NewHandlerPool(metrics, args.maxHandlers)
+
+	store, err := openStore(args.storeFile)
+	if err != nil {
+		logger.Fatal("Error opening store", "error", err)
+	}
+
+	plugins := NewPluginRegistry(logger, store)
+	registerPlugins(plugins)
+	if err := plugins.Init(webAPIClient, args.plugins); err != nil {
+		logger.Fatal("Error enabling plugins", "error", err)
+	}
+	shutdownOnSignal(logger, plugins, store)
+
+	eventListener := NewEventListener(logger, metrics, handlers, plugins,
+		args.port, webAPIClient, self.UserID, args.signingSecret, recorder)
+	eventListener.SetChannels(args.channels)
+	registerCommands(eventListener)
+
+	reloadOnSIGHUP(logger, args, eventListener, plugins)
+
+	// We serve metrics and health checks alongside anything else we serve.
+	// We're ready while the handler pool has room. We serve nothing until
+	// auth.test succeeds, so we're only ready after it does.
+	checker := health.New()
+	checker.AddCheck("handler_pool", handlers.Check)
+	http.Handle("/metrics", metrics.Handler())
+	checker.Register(http.DefaultServeMux)
+
+	// With an app-level token we receive everything over Socket Mode and don't
+	// need to listen for HTTP requests other than for metrics and health
+	// checks. We're ready only while we're connected.
+	if args.appToken != "" {
+		appClient := NewWebAPIClient(logger, metrics, args.url, args.appToken)
+		socketModeClient := NewSocketModeClient(logger, metrics, appClient,
+			eventListener)
+		checker.AddCheck("socket_mode", socketModeClient.Check)
+
+		go func() {
+			if err := serveStatus(logger, args.port); err != nil {
+				logger.Fatal("Error serving", "error", err)
+			}
+		}()
+
+		socketModeClient.Run()
+		return
+	}
 
 	if err := eventListener.Serve(); err != nil {
-		log.Fatalf("error serving: %s", err)
+		logger.Fatal("Error serving", "error", err)
+	}
+}
+
+// openStore opens the store plugins remember things in. If path is blank, we
+// keep it in memory and forget everything when we exit. Otherwise we save it
+// to the file at path.
+func openStore(path string) (store.Store, error) {
+	if path == "" {
+		return store.NewMemory(), nil
+	}
+	return store.OpenFile(path)
+}
+
+// shutdownOnSignal shuts down the plugins, closes the store, and exits when
+// we receive SIGINT or SIGTERM.
+func shutdownOnSignal(
+	logger *logging.Logger,
+	plugins *PluginRegistry,
+	store store.Store,
+) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-ch
+		logger.Info("Shutting down", "signal", sig.String())
+		plugins.Shutdown()
+		if err := store.Close(); err != nil {
+			logger.Error("Error closing store", "error", err)
+		}
+		os.Exit(0)
+	}()
+}
+
+// serveStatus listens for HTTP requests for metrics and health checks only. We
+// use it when we receive everything over Socket Mode.
+//
+// If it does not return an error then it does not return.
+func serveStatus(logger *logging.Logger, port int) error {
+	logger.Info("Starting to listen for GET /metrics, /healthz, and /readyz",
+		"port", port)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+		return fmt.Errorf("error serving: %s", err)
 	}
+	return nil
+}
+
+// newLogger creates the logger to log with. We send what others log with the
+// standard log package, such as net/http, through it too.
+func newLogger(level logging.Level, format logging.Format) *logging.Logger {
+	logger := logging.New(os.Stderr, level, format)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.LevelInfo))
+	return logger
 }
 
-// Args are command line arguments.
+// Args are our settings. They come from command line arguments, the
+// environment, and a config file.
 type Args struct {
-	verbose bool
-	port    int
-	url     string
-	token   string
+	logLevel  logging.Level
+	logFormat logging.Format
+	port      int
+	url       string
+	token     string
+
+	// The most handlers we run at once.
+	maxHandlers int
+
+	// Channels we respond to messages in. If there are none we respond in all
+	// channels.
+	channels []string
+
+	// Plugins to enable, keyed by name.
+	plugins map[string]PluginConfig
+
+	// File plugins' store is saved in. If it's blank, we keep the store in
+	// memory.
+	storeFile string
+
+	signingSecret string
+	appToken      string
+	recordFile    string
 }
 
-func getArgs() (Args, error) {
-	verbose := flag.Bool("verbose", false, "Enable verbose output")
-	port := flag.Int("port", 8080, "Port to listen on")
-	url := flag.String("url", "http://127.0.0.1:8081/api",
+// envPrefix prefixes the names of environment variables holding settings,
+// e.g. YORICK_TOKEN.
+const envPrefix = "YORICK"
+
+// getArgs reads our settings. arguments are the command line arguments. We
+// write usage to output if there's a problem.
+func getArgs(arguments []string, output io.Writer) (Args, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.SetOutput(output)
+
+	fs.String(config.ConfigFlag, "",
+		"Config file to read settings from (optional). Its keys are these "+
+			"flags' names")
+	verbose := fs.Bool("verbose", false,
+		"Enable verbose output. The same as -log-level debug")
+	logLevel := fs.String("log-level", "info",
+		"Log entries at this level and above: debug, info, warn, or error")
+	logFormat := fs.String("log-format", "logfmt",
+		"Log format: logfmt or json")
+	port := fs.Int("port", 8080,
+		"Port to listen on. With -app-token, we serve only /metrics, "+
+			"/healthz, and /readyz here")
+	url := fs.String("url", "http://127.0.0.1:8081/api",
 		"Slack API endpoint base URL. Typically https://slack.com/api")
-	token := flag.String("token", "", "OAuth token to use with the Web API")
+	token := fs.String("token", "", "OAuth token to use with the Web API")
+	signingSecret := fs.String("signing-secret", "",
+		"Signing secret to verify requests with (optional)")
+	appToken := fs.String("app-token", "",
+		"App-level token. If set, we use Socket Mode rather than listening for "+
+			"HTTP requests")
+	recordFile := fs.String("record-file", "",
+		"File to record the Event API requests we receive to. Replay them with "+
+			"yorick replay")
+	maxHandlers := fs.Int("max-handlers", 100,
+		"Most handlers to run at once. While this many are running we drop "+
+			"new events and aren't ready")
+	var channels config.List
+	fs.Var(&channels, "channels",
+		"Comma separated list of IDs of channels to respond to messages in. "+
+			"Blank for all channels")
+	var plugins config.List
+	_ = plugins.Set("hello")
+	fs.Var(&plugins, "plugins",
+		"Comma separated list of plugins to enable. Each is a name to enable "+
+			"it in all channels, or name@channel to enable it in a channel")
+	var pluginSettings config.List
+	fs.Var(&pluginSettings, "plugin-settings",
+		"Comma separated list of plugin settings, each plugin.key=value "+
+			"(optional)")
+	storeFile := fs.String("store-file", "",
+		"File to save what plugins remember in so they remember it across "+
+			"restarts (optional)")
 
-	flag.Parse()
+	if err := config.Parse(fs, arguments, envPrefix); err != nil {
+		return Args{}, err
+	}
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fs.PrintDefaults()
+		return Args{}, err
+	}
+	if *verbose {
+		level = logging.LevelDebug
+	}
+
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		fs.PrintDefaults()
+		return Args{}, err
+	}
 
 	if *port <= 0 {
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		return Args{}, fmt.Errorf("port must be > 0")
 	}
 
 	if *url == "" {
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		return Args{}, fmt.Errorf("you must specify a URL")
 	}
 
-	// Allow token to be optional as it's not needed when running with horatio.
+	if *token == "" {
+		fs.PrintDefaults()
+		return Args{}, fmt.Errorf("you must specify a token")
+	}
+
+	if *maxHandlers <= 0 {
+		fs.PrintDefaults()
+		return Args{}, fmt.Errorf("max handlers must be > 0")
+	}
+
+	pluginConfigs, err := parsePluginConfigs(plugins, pluginSettings)
+	if err != nil {
+		fs.PrintDefaults()
+		return Args{}, err
+	}
 
 	return Args{
-		verbose: *verbose,
-		port:    *port,
-		url:     *url,
-		token:   *token,
+		logLevel:  level,
+		logFormat: format,
+		port:      *port,
+		url:       *url,
+		token:     *token,
+
+		maxHandlers: *maxHandlers,
+
+		channels: channels,
+		plugins:  pluginConfigs,
+
+		storeFile: *storeFile,
+
+		signingSecret: *signingSecret,
+		appToken:      *appToken,
+		recordFile:    *recordFile,
 	}, nil
 }
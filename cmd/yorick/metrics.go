@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/andyjack/court/internal/metrics"
+)
+
+// Metrics are what we count and time. We serve them at /metrics in the
+// Prometheus text format.
+type Metrics struct {
+	registry *metrics.Registry
+
+	// Events, slash commands, and interactions we received. Events are by
+	// their type. For event_callback events, this is the type of the event
+	// inside, such as message. Commands are by command. We count commands we
+	// have no handler for, and event and interaction types we don't handle, as
+	// unknown so people can't make up label values.
+	eventsReceived       *metrics.Counter
+	commandsReceived     *metrics.Counter
+	interactionsReceived *metrics.Counter
+
+	// How long handlers took, by the kind of handler, such as message or
+	// command.
+	handlerDuration *metrics.Histogram
+
+	// Handlers running in the handler pool, and handlers we didn't run
+	// because the pool was saturated, by kind of handler.
+	handlersRunning  *metrics.Gauge
+	handlersRejected *metrics.Counter
+
+	// Web API calls we made, by method and error. The error is blank if the
+	// call succeeded. Otherwise it's the error code the API gave, or one of
+	// the webAPIError codes below if we didn't get that far.
+	webAPICalls        *metrics.Counter
+	webAPICallDuration *metrics.Histogram
+
+	// Socket Mode connections we opened and times we reconnected, by why we
+	// reconnected: refresh_requested if the server asked us to, and error if
+	// the connection failed.
+	socketModeConnections *metrics.Counter
+	socketModeReconnects  *metrics.Counter
+}
+
+// Errors we count Web API calls as having when the API didn't tell us an
+// error code.
+const (
+	webAPIErrorRequest  = "request_failed"
+	webAPIErrorHTTP     = "http_error"
+	webAPIErrorResponse = "invalid_response"
+)
+
+// NewMetrics creates our metrics.
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+
+	return &Metrics{
+		registry: r,
+
+		eventsReceived: r.NewCounter("yorick_events_received_total",
+			"Event API events received, by type", "type"),
+		commandsReceived: r.NewCounter("yorick_commands_received_total",
+			"Slash commands received, by command", "command"),
+		interactionsReceived: r.NewCounter(
+			"yorick_interactions_received_total",
+			"Interactions received, by type", "type"),
+
+		handlerDuration: r.NewHistogram("yorick_handler_duration_seconds",
+			"How long handlers took, by kind of handler", nil, "handler"),
+		handlersRunning: r.NewGauge("yorick_handlers_running",
+			"Handlers running in the handler pool"),
+		handlersRejected: r.NewCounter("yorick_handlers_rejected_total",
+			"Handlers we didn't run because the handler pool was saturated, "+
+				"by kind of handler", "handler"),
+
+		webAPICalls: r.NewCounter("yorick_web_api_calls_total",
+			"Web API calls, by method and error (blank if the call succeeded)",
+			"method", "error"),
+		webAPICallDuration: r.NewHistogram(
+			"yorick_web_api_call_duration_seconds",
+			"How long Web API calls took, by method", nil, "method"),
+
+		socketModeConnections: r.NewCounter(
+			"yorick_socket_mode_connections_total",
+			"Socket Mode connections opened"),
+		socketModeReconnects: r.NewCounter(
+			"yorick_socket_mode_reconnects_total",
+			"Times we reconnected to Socket Mode, by reason", "reason"),
+	}
+}
+
+// Handler returns the HTTP handler serving the metrics.
+func (m *Metrics) Handler() http.Handler {
+	return m.registry
+}
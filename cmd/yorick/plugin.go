@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/andyjack/court/internal/logging"
+	"github.com/andyjack/court/internal/store"
+)
+
+// Plugin is a bot behaviour, such as replying to hello. Several plugins can
+// be compiled into yorick. Each is enabled in all channels or only in some,
+// and receives the events in the channels it's enabled in.
+//
+// Handlers get a WebAPIClient whose logger is for entries about the event.
+// Each handler runs in its own goroutine, so handlers may take their time,
+// but they must be safe to run concurrently.
+//
+// Embed BasePlugin to implement only the methods you need.
+type Plugin interface {
+	// Name returns the plugin's name, e.g. hello. We enable plugins by name.
+	Name() string
+
+	// Init prepares the plugin. We call it once at startup if the plugin is
+	// enabled, before any handlers. The client is for use outside of handlers,
+	// such as to post messages on a schedule.
+	Init(client *WebAPIClient, config PluginConfig) error
+
+	// OnMessage is called when someone posts a message.
+	OnMessage(client *WebAPIClient, event MessageEvent)
+
+	// OnMention is called when someone mentions us in a message. We call it
+	// rather than OnMessage for such messages.
+	OnMention(client *WebAPIClient, event MessageEvent)
+
+	// OnMember is called when someone joins or leaves a channel.
+	OnMember(client *WebAPIClient, event MemberEvent)
+
+	// Shutdown cleans up when we exit.
+	Shutdown() error
+}
+
+// PluginConfig configures a plugin.
+type PluginConfig struct {
+	// Channels the plugin is enabled in, by ID. If there are none, it's
+	// enabled in all channels.
+	Channels []string
+
+	// Settings for the plugin, from -plugin-settings.
+	Settings map[string]string
+
+	// Where the plugin can remember things. It's shared by all plugins. By
+	// convention each uses namespaces named after itself.
+	Store store.Store
+}
+
+// MessageEvent is a message in a channel.
+type MessageEvent struct {
+	Channel string
+	User    string
+
+	// For mentions, the leading mention of us is removed.
+	Text string
+
+	Ts       string
+	ThreadTs string
+}
+
+// MemberEvent says someone joined or left a channel.
+type MemberEvent struct {
+	Channel string
+	User    string
+
+	// Whether they joined. If not, they left.
+	Joined bool
+}
+
+// BasePlugin implements Plugin's methods other than Name by doing nothing.
+// Embed it in plugins.
+type BasePlugin struct{}
+
+// Init does nothing.
+func (BasePlugin) Init(client *WebAPIClient, config PluginConfig) error {
+	return nil
+}
+
+// OnMessage does nothing.
+func (BasePlugin) OnMessage(client *WebAPIClient, event MessageEvent) {}
+
+// OnMention does nothing.
+func (BasePlugin) OnMention(client *WebAPIClient, event MessageEvent) {}
+
+// OnMember does nothing.
+func (BasePlugin) OnMember(client *WebAPIClient, event MemberEvent) {}
+
+// Shutdown does nothing.
+func (BasePlugin) Shutdown() error {
+	return nil
+}
+
+// PluginRegistry holds the plugins compiled into yorick and tracks which are
+// enabled and where.
+type PluginRegistry struct {
+	logger *logging.Logger
+	store  store.Store
+
+	mutex sync.Mutex
+
+	// Plugins compiled in, keyed by name.
+	plugins map[string]Plugin
+
+	// Enabled plugins, keyed by name. Each has the channels it's enabled in,
+	// keyed by ID. If there are none, it's enabled in all channels.
+	enabled map[string]map[string]struct{}
+}
+
+// NewPluginRegistry creates a PluginRegistry with no plugins. We give the
+// plugins we enable the store.
+func NewPluginRegistry(
+	logger *logging.Logger,
+	store store.Store,
+) *PluginRegistry {
+	return &PluginRegistry{
+		logger:  logger,
+		store:   store,
+		plugins: map[string]Plugin{},
+		enabled: map[string]map[string]struct{}{},
+	}
+}
+
+// Register adds a plugin. If there is already a plugin with its name, this
+// replaces it.
+func (r *PluginRegistry) Register(plugin Plugin) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.plugins[plugin.Name()] = plugin
+}
+
+// Init enables and initializes the configured plugins. configs are keyed by
+// plugin name.
+//
+// If any plugin is unknown or fails to initialize, we return an error. We
+// shut down the plugins we initialized already.
+func (r *PluginRegistry) Init(
+	client *WebAPIClient,
+	configs map[string]PluginConfig,
+) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var names []string
+	for name := range configs {
+		if _, ok := r.plugins[name]; !ok {
+			return fmt.Errorf("unknown plugin: %s", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		config := configs[name]
+		config.Store = r.store
+		logger := r.logger.With("plugin", name)
+
+		if err := r.plugins[name].Init(client.WithLogger(logger),
+			config); err != nil {
+			r.shutdown()
+			return fmt.Errorf("error initializing plugin %s: %s", name, err)
+		}
+
+		r.enabled[name] = channelSet(config.Channels)
+		logger.Info("Enabled plugin", "channels",
+			strings.Join(config.Channels, ","))
+	}
+
+	return nil
+}
+
+// SetChannels changes the channels enabled plugins are enabled in. configs
+// are keyed by plugin name. We ignore plugins that aren't enabled.
+func (r *PluginRegistry) SetChannels(configs map[string]PluginConfig) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, config := range configs {
+		if _, ok := r.enabled[name]; ok {
+			r.enabled[name] = channelSet(config.Channels)
+		}
+	}
+}
+
+// Enabled returns the plugins enabled in the channel, ordered by name.
+func (r *PluginRegistry) Enabled(channel string) []Plugin {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var plugins []Plugin
+	for _, name := range r.enabledNames() {
+		channels := r.enabled[name]
+		if _, ok := channels[channel]; ok || len(channels) == 0 {
+			plugins = append(plugins, r.plugins[name])
+		}
+	}
+	return plugins
+}
+
+// Shutdown shuts down the enabled plugins. We log errors rather than return
+// them as we're exiting anyway.
+func (r *PluginRegistry) Shutdown() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.shutdown()
+}
+
+// shutdown shuts down the enabled plugins and disables them. The caller must
+// hold the lock.
+func (r *PluginRegistry) shutdown() {
+	for _, name := range r.enabledNames() {
+		if err := r.plugins[name].Shutdown(); err != nil {
+			r.logger.Error("Error shutting down plugin", "plugin", name, "error",
+				err)
+		}
+	}
+	r.enabled = map[string]map[string]struct{}{}
+}
+
+// channelSet turns a list of channels into a set.
+func channelSet(channels []string) map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, channel := range channels {
+		set[channel] = struct{}{}
+	}
+	return set
+}
+
+// enabledNames returns the names of the enabled plugins, sorted. The caller
+// must hold the lock.
+func (r *PluginRegistry) enabledNames() []string {
+	var names []string
+	for name := range r.enabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parsePluginConfigs parses the -plugins and -plugin-settings settings into
+// each enabled plugin's config, keyed by name.
+//
+// Each entry in plugins enables a plugin, either in all channels (hello) or
+// in one (hello@C0123). Each entry in settings is a setting for an enabled
+// plugin (greeter.greeting=Welcome).
+func parsePluginConfigs(
+	plugins,
+	settings []string,
+) (map[string]PluginConfig, error) {
+	configs := map[string]PluginConfig{}
+
+	for _, s := range plugins {
+		name, channel := s, ""
+		if idx := strings.Index(s, "@"); idx != -1 {
+			name, channel = s[:idx], s[idx+1:]
+			if channel == "" {
+				return nil, fmt.Errorf("invalid plugin, want name@channel: %s", s)
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid plugin, want name@channel: %s", s)
+		}
+
+		config, ok := configs[name]
+		if !ok {
+			config = PluginConfig{Settings: map[string]string{}}
+		}
+
+		// Enabling a plugin in all channels wins over enabling it in some.
+		if channel == "" {
+			config.Channels = nil
+		} else if !ok || len(config.Channels) > 0 {
+			config.Channels = append(config.Channels, channel)
+		}
+
+		configs[name] = config
+	}
+
+	for _, s := range settings {
+		idx := strings.Index(s, "=")
+		dot := strings.Index(s, ".")
+		if idx == -1 || dot == -1 || dot > idx || dot == 0 || dot == idx-1 {
+			return nil, fmt.Errorf(
+				"invalid plugin setting, want plugin.key=value: %s", s)
+		}
+
+		name, key, value := s[:dot], s[dot+1:idx], s[idx+1:]
+		config, ok := configs[name]
+		if !ok {
+			return nil, fmt.Errorf("setting for plugin that isn't enabled: %s",
+				s)
+		}
+		config.Settings[key] = value
+	}
+
+	return configs, nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andyjack/court/internal/logging"
+	"github.com/andyjack/court/internal/slacktest"
+	"github.com/andyjack/court/internal/store"
+)
+
+// testPlugin is a plugin that records when we initialize and shut it down.
+type testPlugin struct {
+	BasePlugin
+
+	name string
+
+	// If set, Init fails.
+	initErr error
+
+	// Where we record calls, shared by the plugins in a test.
+	calls *[]string
+}
+
+// Name returns the plugin's name.
+func (p *testPlugin) Name() string {
+	return p.name
+}
+
+// Init records the call.
+func (p *testPlugin) Init(client *WebAPIClient, config PluginConfig) error {
+	*p.calls = append(*p.calls, "init "+p.name)
+	return p.initErr
+}
+
+// Shutdown records the call.
+func (p *testPlugin) Shutdown() error {
+	*p.calls = append(*p.calls, "shutdown "+p.name)
+	return nil
+}
+
+// newTestRegistry creates a PluginRegistry using the store.
+func newTestRegistry(s store.Store) *PluginRegistry {
+	logger := logging.New(ioutil.Discard, logging.LevelDebug,
+		logging.FormatLogfmt)
+	return NewPluginRegistry(logger, s)
+}
+
+func TestParsePluginConfigs(t *testing.T) {
+	tests := []struct {
+		name     string
+		plugins  []string
+		settings []string
+		output   map[string]PluginConfig
+	}{
+		{
+			"none",
+			nil,
+			nil,
+			map[string]PluginConfig{},
+		},
+		{
+			"all channels",
+			[]string{"hello"},
+			nil,
+			map[string]PluginConfig{
+				"hello": {Settings: map[string]string{}},
+			},
+		},
+		{
+			"channels are merged",
+			[]string{"hello@C1", "karma", "hello@C2"},
+			nil,
+			map[string]PluginConfig{
+				"hello": {
+					Channels: []string{"C1", "C2"},
+					Settings: map[string]string{},
+				},
+				"karma": {Settings: map[string]string{}},
+			},
+		},
+		{
+			"all channels wins after some",
+			[]string{"hello@C1", "hello"},
+			nil,
+			map[string]PluginConfig{
+				"hello": {Settings: map[string]string{}},
+			},
+		},
+		{
+			"all channels wins before some",
+			[]string{"hello", "hello@C1"},
+			nil,
+			map[string]PluginConfig{
+				"hello": {Settings: map[string]string{}},
+			},
+		},
+		{
+			"settings",
+			[]string{"greeter@C1"},
+			[]string{
+				"greeter.greeting=Hi=there",
+				"greeter.name=",
+				"greeter.a.b=c",
+			},
+			map[string]PluginConfig{
+				"greeter": {
+					Channels: []string{"C1"},
+					Settings: map[string]string{
+						"greeting": "Hi=there",
+						"name":     "",
+						"a.b":      "c",
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		configs, err := parsePluginConfigs(test.plugins, test.settings)
+		if err != nil {
+			t.Errorf("%s: parsePluginConfigs() error: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(configs, test.output) {
+			t.Errorf("%s: parsePluginConfigs() = %+v, wanted %+v", test.name,
+				configs, test.output)
+		}
+	}
+}
+
+func TestParsePluginConfigsErrors(t *testing.T) {
+	tests := []struct {
+		plugins  []string
+		settings []string
+		error    string
+	}{
+		{[]string{""}, nil, "invalid plugin"},
+		{[]string{"@C1"}, nil, "invalid plugin"},
+		{[]string{"hello@"}, nil, "invalid plugin"},
+		{[]string{"hello"}, []string{"hello.greeting"},
+			"invalid plugin setting"},
+		{[]string{"hello"}, []string{"hello=hi"}, "invalid plugin setting"},
+		{[]string{"hello"}, []string{"greeting=hello.hi"},
+			"invalid plugin setting"},
+		{[]string{"hello"}, []string{".greeting=hi"}, "invalid plugin setting"},
+		{[]string{"hello"}, []string{"hello.=hi"}, "invalid plugin setting"},
+		{[]string{"hello"}, []string{"karma.limit=3"}, "isn't enabled"},
+	}
+
+	for _, test := range tests {
+		_, err := parsePluginConfigs(test.plugins, test.settings)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("parsePluginConfigs(%q, %q) error = %v, wanted %s",
+				test.plugins, test.settings, err, test.error)
+		}
+	}
+}
+
+func TestPluginRegistryInit(t *testing.T) {
+	server := slacktest.NewServer()
+	defer server.Close()
+	client := newTestClient(server, "xoxb-test")
+
+	tests := []struct {
+		name    string
+		enable  []string
+		failing string
+		error   string
+		calls   []string
+	}{
+		{
+			"success",
+			[]string{"a", "b"},
+			"",
+			"",
+			[]string{"init a", "init b"},
+		},
+		{
+			"unknown plugin",
+			[]string{"a", "nope"},
+			"",
+			"unknown plugin: nope",
+			nil,
+		},
+		{
+			"failing plugin shuts down earlier ones",
+			[]string{"a", "b", "c"},
+			"b",
+			"error initializing plugin b",
+			[]string{"init a", "init b", "shutdown a"},
+		},
+	}
+
+	for _, test := range tests {
+		var calls []string
+		r := newTestRegistry(store.NewMemory())
+		for _, name := range []string{"a", "b", "c"} {
+			plugin := &testPlugin{name: name, calls: &calls}
+			if name == test.failing {
+				plugin.initErr = fmt.Errorf("failed")
+			}
+			r.Register(plugin)
+		}
+
+		configs := map[string]PluginConfig{}
+		for _, name := range test.enable {
+			configs[name] = PluginConfig{}
+		}
+
+		err := r.Init(client, configs)
+		if test.error == "" && err != nil {
+			t.Errorf("%s: Init() error: %s", test.name, err)
+		}
+		if test.error != "" &&
+			(err == nil || !strings.Contains(err.Error(), test.error)) {
+			t.Errorf("%s: Init() error = %v, wanted %s", test.name, err,
+				test.error)
+		}
+
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%s: calls = %q, wanted %q", test.name, calls, test.calls)
+		}
+
+		// After a failure nothing is enabled.
+		if test.error != "" && len(r.Enabled("C1")) != 0 {
+			t.Errorf("%s: plugins enabled after Init() failed", test.name)
+		}
+	}
+}
+
+func TestPluginRegistryEnabled(t *testing.T) {
+	server := slacktest.NewServer()
+	defer server.Close()
+	client := newTestClient(server, "xoxb-test")
+
+	var calls []string
+	r := newTestRegistry(store.NewMemory())
+	for _, name := range []string{"all", "one", "two", "off"} {
+		r.Register(&testPlugin{name: name, calls: &calls})
+	}
+
+	configs, err := parsePluginConfigs(
+		[]string{"two@C1", "one@C1", "two@C2", "all"}, nil)
+	if err != nil {
+		t.Fatalf("parsePluginConfigs() error: %s", err)
+	}
+	if err := r.Init(client, configs); err != nil {
+		t.Fatalf("Init() error: %s", err)
+	}
+
+	tests := []struct {
+		channel string
+		output  []string
+	}{
+		{"C1", []string{"all", "one", "two"}},
+		{"C2", []string{"all", "two"}},
+		{"C3", []string{"all"}},
+	}
+
+	for _, test := range tests {
+		var names []string
+		for _, plugin := range r.Enabled(test.channel) {
+			names = append(names, plugin.Name())
+		}
+		if !reflect.DeepEqual(names, test.output) {
+			t.Errorf("Enabled(%s) = %q, wanted %q", test.channel, names,
+				test.output)
+		}
+	}
+
+	// Changing channels takes effect, and doesn't enable plugins.
+	r.SetChannels(map[string]PluginConfig{
+		"one": {Channels: []string{"C3"}},
+		"off": {},
+	})
+	var names []string
+	for _, plugin := range r.Enabled("C3") {
+		names = append(names, plugin.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"all", "one"}) {
+		t.Errorf("Enabled(C3) after SetChannels() = %q, wanted [all one]",
+			names)
+	}
+
+	r.Shutdown()
+	if len(r.Enabled("C1")) != 0 {
+		t.Errorf("plugins enabled after Shutdown()")
+	}
+}
+
+func TestKarmaPlugin(t *testing.T) {
+	server := slacktest.NewServer()
+	defer server.Close()
+	client := newTestClient(server, "xoxb-test")
+
+	s := store.NewMemory()
+	if err := s.Put("karma", "broken", "lots"); err != nil {
+		t.Fatalf("error putting: %s", err)
+	}
+
+	r := newTestRegistry(s)
+	r.Register(&karmaPlugin{})
+	if err := r.Init(client, map[string]PluginConfig{"karma": {}}); err != nil {
+		t.Fatalf("Init() error: %s", err)
+	}
+
+	plugins := r.Enabled("C1")
+	if len(plugins) != 1 {
+		t.Fatalf("got %d plugins, wanted karma", len(plugins))
+	}
+	karma := plugins[0]
+
+	tests := []struct {
+		user  string
+		text  string
+		posts []string
+	}{
+		{"U1", "coffee++", []string{"coffee has 1 karma"}},
+		{"U1", "Coffee++ and tea-- please",
+			[]string{"Coffee has 2 karma", "tea has -1 karma"}},
+		{"U1", "c++ is a language", []string{"c has 1 karma"}},
+		{"U1", "<@U1>++", nil},
+		{"U2", "<@U1>++", []string{"<@U1> has 1 karma"}},
+		{"U1", "nothing to see here", nil},
+		{"U1", "b-+ ++ --", nil},
+
+		// We can't count karma on a value that isn't a number.
+		{"U1", "broken++ coffee--", []string{"coffee has 1 karma"}},
+	}
+
+	for _, test := range tests {
+		server.Reset()
+		karma.OnMessage(client, MessageEvent{
+			Channel: "C1",
+			User:    test.user,
+			Text:    test.text,
+		})
+
+		var posts []string
+		for _, call := range server.CallsTo("chat.postMessage") {
+			if call.Arg("channel") != "C1" {
+				t.Errorf("%q: posted to %s, wanted C1", test.text,
+					call.Arg("channel"))
+			}
+			posts = append(posts, call.Arg("text"))
+		}
+		if !reflect.DeepEqual(posts, test.posts) {
+			t.Errorf("%q: posted %q, wanted %q", test.text, posts, test.posts)
+		}
+	}
+
+	// Counts are in the store under the plugin's namespace.
+	value, ok, err := s.Get("karma", "coffee")
+	if err != nil || !ok || value != "1" {
+		t.Errorf("Get(karma, coffee) = %q, %v, %v, wanted 1", value, ok, err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Recorder writes the Event API requests we receive to a file, one JSON
+// object per line. We can replay them later with the replay subcommand to
+// reproduce how we handled them.
+type Recorder struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// RecordedRequest is a line in a recording.
+type RecordedRequest struct {
+	// When we received the request.
+	Time time.Time `json:"time"`
+
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Header http.Header `json:"header"`
+
+	// The body exactly as we received it.
+	Body string `json:"body"`
+}
+
+// NewRecorder creates a Recorder appending to the file at path.
+func NewRecorder(path string) (*Recorder, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening recording: %s", err)
+	}
+	return &Recorder{file: fh}, nil
+}
+
+// Record writes a request to the file. body is the request's body.
+func (r *Recorder) Record(req *http.Request, body []byte) error {
+	buf, err := json.Marshal(RecordedRequest{
+		Time:   time.Now(),
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Header: req.Header,
+		Body:   string(body),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling request: %s", err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.file.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("error writing recording: %s", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("error closing recording: %s", err)
+	}
+	return nil
+}
+
+// readRecording reads the requests in a recording.
+func readRecording(path string) ([]RecordedRequest, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening recording: %s", err)
+	}
+
+	var requests []RecordedRequest
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var req RecordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			_ = fh.Close()
+			return nil, fmt.Errorf("error parsing recording line: %s: %s",
+				scanner.Text(), err)
+		}
+		requests = append(requests, req)
+	}
+
+	if err := scanner.Err(); err != nil {
+		_ = fh.Close()
+		return nil, fmt.Errorf("error reading recording: %s", err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return nil, fmt.Errorf("error closing recording: %s", err)
+	}
+
+	return requests, nil
+}
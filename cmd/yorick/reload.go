@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// reloadOnSIGHUP reloads our settings each time we receive SIGHUP, such as
+// after editing the config file. args are the settings we started with.
+//
+// We apply the settings that are safe to change while running: the log
+// level, the channels we respond in, and the channels plugins are enabled in.
+// Others, including which plugins are enabled, need a restart. We warn if
+// they changed.
+//
+// If the new settings are invalid we log why and keep the old ones.
+func reloadOnSIGHUP(
+	logger *logging.Logger,
+	args Args,
+	eventListener *EventListener,
+	plugins *PluginRegistry,
+) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		for range ch {
+			err := reload(logger, &args, os.Args[1:], eventListener, plugins)
+			if err != nil {
+				logger.Error("Error reloading settings", "error", err)
+			}
+		}
+	}()
+}
+
+// reload reads our settings again from the command line arguments, the
+// environment, and the config file, and applies those we can change while
+// running. args are the settings we're running with. We update them.
+//
+// If the new settings are invalid we return why and change nothing.
+func reload(
+	logger *logging.Logger,
+	args *Args,
+	arguments []string,
+	eventListener *EventListener,
+	plugins *PluginRegistry,
+) error {
+	newArgs, err := getArgs(arguments, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+
+	logger.SetLevel(newArgs.logLevel)
+	eventListener.SetChannels(newArgs.channels)
+	plugins.SetChannels(newArgs.plugins)
+
+	if !reflect.DeepEqual(unreloadable(*args), unreloadable(newArgs)) {
+		logger.Warn("Some settings changed that need a restart to apply")
+	}
+
+	args.logLevel = newArgs.logLevel
+	args.channels = newArgs.channels
+
+	// Only the plugins we enabled at startup are running.
+	for name, config := range args.plugins {
+		if newConfig, ok := newArgs.plugins[name]; ok {
+			config.Channels = newConfig.Channels
+			args.plugins[name] = config
+		}
+	}
+
+	logger.Info("Reloaded settings", "log_level", args.logLevel,
+		"channels", strings.Join(args.channels, ","))
+	return nil
+}
+
+// unreloadable returns the settings without those we can change while
+// running.
+func unreloadable(args Args) Args {
+	args.logLevel = 0
+	args.channels = nil
+
+	plugins := map[string]PluginConfig{}
+	for name, config := range args.plugins {
+		config.Channels = nil
+		plugins[name] = config
+	}
+	args.plugins = plugins
+
+	return args
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/andyjack/court/internal/logging"
+	"github.com/andyjack/court/internal/slacktest"
+	"github.com/andyjack/court/internal/store"
+)
+
+// reloadState is what a reload may change.
+type reloadState struct {
+	debug    bool
+	channels []string
+	plugins  map[string]PluginConfig
+
+	// Whether we respond in each channel, and the plugins enabled in each.
+	respondsIn map[string]bool
+	enabled    map[string][]string
+}
+
+// getReloadState gathers what a reload may change.
+func getReloadState(
+	logger *logging.Logger,
+	args Args,
+	eventListener *EventListener,
+	plugins *PluginRegistry,
+) reloadState {
+	state := reloadState{
+		debug:      logger.Enabled(logging.LevelDebug),
+		channels:   args.channels,
+		plugins:    map[string]PluginConfig{},
+		respondsIn: map[string]bool{},
+		enabled:    map[string][]string{},
+	}
+	for name, config := range args.plugins {
+		state.plugins[name] = config
+	}
+	for _, channel := range []string{"C1", "C2"} {
+		state.respondsIn[channel] = eventListener.respondsIn(channel)
+		for _, plugin := range plugins.Enabled(channel) {
+			state.enabled[channel] = append(state.enabled[channel],
+				plugin.Name())
+		}
+	}
+	return state
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "yorick.toml")
+	writeConfig := func(contents string) {
+		contents = "token = \"xoxb-test\"\n" + contents
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatalf("error writing config file: %s", err)
+		}
+	}
+	arguments := []string{"-config", path}
+
+	writeConfig(`
+log-level = "info"
+channels = ["C1"]
+plugins = ["hello@C1"]
+`)
+
+	args, err := getArgs(arguments, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("getArgs() error: %s", err)
+	}
+
+	server := slacktest.NewServer()
+	defer server.Close()
+
+	logger := logging.New(ioutil.Discard, args.logLevel, logging.FormatLogfmt)
+	client := NewWebAPIClient(logger, NewMetrics(), server.URL(), args.token)
+
+	plugins := NewPluginRegistry(logger, store.NewMemory())
+	registerPlugins(plugins)
+	if err := plugins.Init(client, args.plugins); err != nil {
+		t.Fatalf("Init() error: %s", err)
+	}
+
+	eventListener := NewEventListener(logger, NewMetrics(),
+		NewHandlerPool(NewMetrics(), 1), plugins, args.port, client, "UTEST",
+		"", nil)
+	eventListener.SetChannels(args.channels)
+
+	before := getReloadState(logger, args, eventListener, plugins)
+
+	// Settings that fail validation change nothing, even the valid settings
+	// alongside them.
+	invalid := []string{
+		"log-level = \"loud\"\nchannels = [\"C2\"]",
+		"port = 0\nchannels = [\"C2\"]",
+		"channels = [\"C2\"]\nnope = 1",
+		"channels = [\"C2\"]\nplugins = [\"hello@\"]",
+		"channels = [\"C2\"]\nplugin-settings = [\"greeter.greeting=hi\"]",
+		"channels = \"C2\"",
+	}
+
+	for _, contents := range invalid {
+		writeConfig(contents)
+
+		err := reload(logger, &args, arguments, eventListener, plugins)
+		if err == nil {
+			t.Errorf("reload() of %q succeeded, wanted an error", contents)
+		}
+
+		after := getReloadState(logger, args, eventListener, plugins)
+		if !reflect.DeepEqual(after, before) {
+			t.Errorf("reload() of %q changed %+v to %+v", contents, before,
+				after)
+		}
+	}
+
+	// Valid settings apply, other than enabling plugins which needs a
+	// restart.
+	writeConfig(`
+log-level = "debug"
+channels = ["C2"]
+plugins = ["hello@C2", "greeter"]
+`)
+	if err := reload(logger, &args, arguments, eventListener,
+		plugins); err != nil {
+		t.Fatalf("reload() error: %s", err)
+	}
+
+	after := getReloadState(logger, args, eventListener, plugins)
+	want := reloadState{
+		debug:    true,
+		channels: []string{"C2"},
+		plugins: map[string]PluginConfig{
+			"hello": {
+				Channels: []string{"C2"},
+				Settings: map[string]string{},
+			},
+		},
+		respondsIn: map[string]bool{"C1": false, "C2": true},
+		enabled:    map[string][]string{"C2": {"hello"}},
+	}
+	if !reflect.DeepEqual(after, want) {
+		t.Errorf("after reload() got %+v, wanted %+v", after, want)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// ReplayArgs are the replay subcommand's command line arguments.
+type ReplayArgs struct {
+	logLevel       logging.Level
+	logFormat      logging.Format
+	url            string
+	signingSecret  string
+	preserveTiming bool
+	files          []string
+}
+
+// replay is the replay subcommand. It sends the requests in recordings made
+// with -record-file to a yorick's event endpoint, as if Slack were sending
+// them again.
+//
+// Since yorick rejects requests with old timestamps, we sign each request
+// afresh rather than sending the recorded signature.
+func replay(argv []string) error {
+	args, err := getReplayArgs(argv)
+	if err != nil {
+		return err
+	}
+
+	logger := newLogger(args.logLevel, args.logFormat)
+	logger.AddSecret(args.signingSecret)
+
+	for _, file := range args.files {
+		requests, err := readRecording(file)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("Replaying recording", "file", file, "requests",
+			len(requests))
+
+		for i, req := range requests {
+			if args.preserveTiming && i > 0 {
+				time.Sleep(req.Time.Sub(requests[i-1].Time))
+			}
+
+			if err := replayRequest(logger, args, req); err != nil {
+				return fmt.Errorf("error replaying request %d from %s: %s", i+1,
+					file, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Headers we don't copy from recorded requests. Go sets the first few itself
+// and we set the signature headers ourselves.
+var unreplayedHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Accept-Encoding",
+	"X-Slack-Request-Timestamp",
+	"X-Slack-Signature",
+}
+
+// replayRequest sends a recorded request and logs the response.
+func replayRequest(
+	logger *logging.Logger,
+	args ReplayArgs,
+	rec RecordedRequest,
+) error {
+	body := []byte(rec.Body)
+
+	req, err := http.NewRequest(http.MethodPost, args.url,
+		bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %s", err)
+	}
+
+	for k, v := range rec.Header {
+		req.Header[k] = v
+	}
+	for _, k := range unreplayedHeaders {
+		req.Header.Del(k)
+	}
+
+	if args.signingSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+		req.Header.Set("X-Slack-Signature",
+			computeSignature(args.signingSecret, timestamp, body))
+	}
+
+	logger = logger.With("recorded_at", rec.Time)
+	logger.Debug("Sending request", "body", body)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error performing HTTP request: %s", err)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		_ = resp.Body.Close()
+		return fmt.Errorf("error reading body: %s", err)
+	}
+
+	if err := resp.Body.Close(); err != nil {
+		return fmt.Errorf("error closing body: %s", err)
+	}
+
+	logger.Info("Replayed request", "status", resp.StatusCode, "response",
+		respBody)
+	return nil
+}
+
+// getReplayArgs parses the replay subcommand's arguments. argv holds the
+// arguments after "replay".
+func getReplayArgs(argv []string) (ReplayArgs, error) {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+
+	verbose := fs.Bool("verbose", false,
+		"Enable verbose output. The same as -log-level debug")
+	logLevel := fs.String("log-level", "info",
+		"Log entries at this level and above: debug, info, warn, or error")
+	logFormat := fs.String("log-format", "logfmt",
+		"Log format: logfmt or json")
+	url := fs.String("url", "http://127.0.0.1:8080/event",
+		"URL of the yorick event endpoint to send requests to")
+	signingSecret := fs.String("signing-secret", "",
+		"Signing secret to sign requests with. Use the one yorick has, if any")
+	preserveTiming := fs.Bool("preserve-timing", false,
+		"Wait between requests as long as there was between them when they "+
+			"were recorded")
+
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(),
+			"Usage: yorick replay [flags] <recording> [recording...]\n")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(argv); err != nil {
+		return ReplayArgs{}, fmt.Errorf("invalid arguments: %s", err)
+	}
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fs.Usage()
+		return ReplayArgs{}, err
+	}
+	if *verbose {
+		level = logging.LevelDebug
+	}
+
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		fs.Usage()
+		return ReplayArgs{}, err
+	}
+
+	if *url == "" {
+		fs.Usage()
+		return ReplayArgs{}, fmt.Errorf("you must specify a URL")
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return ReplayArgs{}, fmt.Errorf("you must specify a recording")
+	}
+
+	return ReplayArgs{
+		logLevel:       level,
+		logFormat:      format,
+		url:            *url,
+		signingSecret:  *signingSecret,
+		preserveTiming: *preserveTiming,
+		files:          fs.Args(),
+	}, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Slack signs the requests it sends us using our app's signing secret. This
+// lets us check requests really came from Slack.
+//
+// See https://api.slack.com/authentication/verifying-requests-from-slack
+
+// signatureVersion is the only version of signature Slack uses.
+const signatureVersion = "v0"
+
+// maxRequestAge is how old a request's timestamp may be. Rejecting old
+// requests protects against someone replaying a request they captured.
+var maxRequestAge = 5 * time.Minute
+
+// verifySignature checks the request's signature. body is the request's body.
+func verifySignature(secret string, r *http.Request, body []byte) error {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	if timestamp == "" {
+		return fmt.Errorf("no timestamp header")
+	}
+
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %s", timestamp)
+	}
+
+	age := time.Since(time.Unix(secs, 0))
+	if math.Abs(float64(age)) > float64(maxRequestAge) {
+		return fmt.Errorf("timestamp is too old: %s", timestamp)
+	}
+
+	signature := r.Header.Get("X-Slack-Signature")
+	if signature == "" {
+		return fmt.Errorf("no signature header")
+	}
+
+	wanted := computeSignature(secret, timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(wanted)) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return nil
+}
+
+// computeSignature computes the signature of a request body sent at the given
+// time (in Unix seconds).
+func computeSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(signatureVersion + ":" + timestamp + ":"))
+	_, _ = mac.Write(body)
+	return signatureVersion + "=" + hex.EncodeToString(mac.Sum(nil))
+}
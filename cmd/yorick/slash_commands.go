@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+)
+
+// SlashCommand is a slash command someone ran, such as /deploy. Slack sends
+// these to our /command endpoint as a form, or over Socket Mode as JSON.
+//
+// See https://api.slack.com/interactivity/slash-commands
+type SlashCommand struct {
+	// The command including its /, e.g. /deploy.
+	Command string `json:"command"`
+
+	// What follows the command.
+	Text string `json:"text"`
+
+	UserID      string `json:"user_id"`
+	UserName    string `json:"user_name"`
+	ChannelID   string `json:"channel_id"`
+	ChannelName string `json:"channel_name"`
+	TeamID      string `json:"team_id"`
+
+	// We can respond to the command later by sending to this URL.
+	ResponseURL string `json:"response_url"`
+
+	TriggerID string `json:"trigger_id"`
+}
+
+// SlashCommandResponse is a response to a slash command.
+type SlashCommandResponse struct {
+	// ephemeral (only the user who ran the command sees it) or in_channel
+	// (everyone in the channel sees it). Slack treats blank as ephemeral.
+	ResponseType string `json:"response_type,omitempty"`
+
+	Text string `json:"text"`
+}
+
+// SlashCommandHandler handles a slash command.
+//
+// It returns what to respond with right away. If it returns nil we respond
+// with nothing. Slack expects a response within 3 seconds. To do something
+// that takes longer, start doing it in a goroutine and respond later with
+// SlashCommand.Respond.
+type SlashCommandHandler func(
+	client *WebAPIClient,
+	command SlashCommand,
+) *SlashCommandResponse
+
+// RegisterCommand sets the handler for a slash command. name is the command
+// including its /, e.g. /deploy.
+func (e *EventListener) RegisterCommand(
+	name string,
+	handler SlashCommandHandler,
+) {
+	e.commandsMutex.Lock()
+	defer e.commandsMutex.Unlock()
+	e.commands[strings.ToLower(name)] = handler
+}
+
+// commandHandler handles an HTTP request sent to the /command endpoint.
+func (e *EventListener) commandHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	logger := e.requestLogger(r)
+
+	if r.Method != http.MethodPost {
+		logger.Warn("Invalid request method")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("Error reading request", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("Received command", "body", buf)
+
+	if !e.verifyRequest(logger, w, r, buf) {
+		return
+	}
+
+	form, err := url.ParseQuery(string(buf))
+	if err != nil {
+		logger.Warn("Invalid form", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	command := SlashCommand{
+		Command:     form.Get("command"),
+		Text:        form.Get("text"),
+		UserID:      form.Get("user_id"),
+		UserName:    form.Get("user_name"),
+		ChannelID:   form.Get("channel_id"),
+		ChannelName: form.Get("channel_name"),
+		TeamID:      form.Get("team_id"),
+		ResponseURL: form.Get("response_url"),
+		TriggerID:   form.Get("trigger_id"),
+	}
+
+	resp := e.dispatchCommand(logger, command)
+	if resp == nil {
+		return
+	}
+
+	buf, err = json.Marshal(resp)
+	if err != nil {
+		logger.Error("Error marshaling command response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(buf); err != nil {
+		logger.Error("Error writing command response", "error", err)
+		return
+	}
+}
+
+// dispatchCommand passes a slash command to its handler. logger describes
+// where the command came from.
+//
+// It returns what to respond with right away, or nil to respond with nothing.
+func (e *EventListener) dispatchCommand(
+	logger *logging.Logger,
+	command SlashCommand,
+) *SlashCommandResponse {
+	logger = logger.With("command", command.Command)
+	logger.Info("Received command", "channel", command.ChannelID, "user",
+		command.UserID)
+	logger.Debug("Command payload", "payload", command)
+
+	e.commandsMutex.Lock()
+	handler, ok := e.commands[strings.ToLower(command.Command)]
+	e.commandsMutex.Unlock()
+
+	var resp *SlashCommandResponse
+	if ok {
+		e.metrics.commandsReceived.Inc(strings.ToLower(command.Command))
+		start := time.Now()
+		resp = handler(e.webAPIClient.WithLogger(logger), command)
+		e.metrics.handlerDuration.Observe(time.Since(start).Seconds(),
+			"command")
+	} else {
+		e.metrics.commandsReceived.Inc("unknown")
+		resp = &SlashCommandResponse{
+			Text: fmt.Sprintf("Sorry, I don't know the command %s.",
+				command.Command),
+		}
+	}
+
+	logger.Info("Processed command")
+	return resp
+}
+
+// Respond sends a response to the command using its response URL. Use this
+// to respond after the handler returns.
+func (c SlashCommand) Respond(resp SlashCommandResponse) error {
+	return postResponse(c.ResponseURL, resp)
+}
+
+// postResponse sends a response to a response URL.
+func postResponse(responseURL string, resp interface{}) error {
+	if responseURL == "" {
+		return fmt.Errorf("no response URL")
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("error marshaling response: %s", err)
+	}
+
+	httpResp, err := httpClient.Post(responseURL, "application/json",
+		bytes.NewBuffer(buf))
+	if err != nil {
+		return fmt.Errorf("error performing HTTP request: %s", err)
+	}
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		_ = httpResp.Body.Close()
+		return fmt.Errorf("error reading response body: %s", err)
+	}
+
+	if err := httpResp.Body.Close(); err != nil {
+		return fmt.Errorf("error closing response body: %s", err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d from response URL: %s", httpResp.StatusCode,
+			body)
+	}
+
+	return nil
+}
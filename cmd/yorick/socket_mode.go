@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+	"github.com/andyjack/court/internal/websocket"
+)
+
+// SocketModeClient receives events, slash commands, and interactions over a
+// WebSocket instead of as HTTP requests. This means we don't need a public
+// HTTP endpoint.
+//
+// We pass what we receive to the EventListener's handlers, so handlers work
+// the same whichever way we receive things.
+//
+// See https://api.slack.com/apis/connections/socket
+type SocketModeClient struct {
+	logger  *logging.Logger
+	metrics *Metrics
+
+	// Whether we have a connection the server said hello on.
+	connectedMutex sync.Mutex
+	connected      bool
+
+	// A Web API client using an app-level token. We need one to open
+	// connections.
+	appClient *WebAPIClient
+
+	listener *EventListener
+}
+
+// SocketModeEnvelope is a message we receive over a Socket Mode connection.
+//
+// Which fields are set depends on the type.
+type SocketModeEnvelope struct {
+	// hello, events_api, slash_commands, interactive, or disconnect.
+	Type string `json:"type"`
+
+	// We acknowledge events_api, slash_commands, and interactive envelopes by
+	// sending back their ID.
+	EnvelopeID string          `json:"envelope_id"`
+	Payload    json.RawMessage `json:"payload"`
+
+	// Whether we may include a payload in our acknowledgement, such as a
+	// response to a slash command.
+	AcceptsResponsePayload bool `json:"accepts_response_payload"`
+
+	RetryAttempt int    `json:"retry_attempt"`
+	RetryReason  string `json:"retry_reason"`
+
+	// hello: How many connections the app has open.
+	NumConnections int `json:"num_connections"`
+
+	// disconnect: Why we're being disconnected, e.g. refresh_requested.
+	Reason string `json:"reason"`
+}
+
+// SocketModeAck acknowledges an envelope.
+type SocketModeAck struct {
+	EnvelopeID string      `json:"envelope_id"`
+	Payload    interface{} `json:"payload,omitempty"`
+}
+
+// How long we wait between attempts to connect. We wait longer after each
+// failure up to the maximum.
+var (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// If a connection lasts this long before failing, we consider it was healthy
+// and reconnect without waiting long.
+var healthyConnectionTime = time.Minute
+
+// How often we ping the server, and how long we wait to hear anything from it
+// before we decide the connection is dead.
+var (
+	socketModePingInterval = 30 * time.Second
+	socketModeIdleTimeout  = 2 * time.Minute
+)
+
+// NewSocketModeClient creates a SocketModeClient.
+func NewSocketModeClient(
+	logger *logging.Logger,
+	metrics *Metrics,
+	appClient *WebAPIClient,
+	listener *EventListener,
+) *SocketModeClient {
+	return &SocketModeClient{
+		logger:    logger.With("transport", "socket_mode"),
+		metrics:   metrics,
+		appClient: appClient,
+		listener:  listener,
+	}
+}
+
+// Run connects and receives envelopes. If we're disconnected, we connect
+// again.
+//
+// It does not return.
+func (s *SocketModeClient) Run() {
+	delay := minReconnectDelay
+
+	for {
+		start := time.Now()
+		err := s.connect()
+
+		// If we were told to reconnect, do so right away. Otherwise wait a bit
+		// so we don't hammer the server if something is wrong.
+		if err == nil {
+			s.metrics.socketModeReconnects.Inc("refresh_requested")
+			delay = minReconnectDelay
+			continue
+		}
+		s.logger.Error("Socket Mode connection failed", "error", err)
+		s.metrics.socketModeReconnects.Inc("error")
+
+		// If the connection was good for a while, start waiting from the
+		// beginning again.
+		if time.Since(start) > healthyConnectionTime {
+			delay = minReconnectDelay
+		}
+
+		s.logger.Info("Reconnecting to Socket Mode", "delay", delay)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// connect opens a connection and receives envelopes until we're disconnected.
+//
+// If we were disconnected because the server asked us to reconnect, it
+// returns nil.
+func (s *SocketModeClient) connect() error {
+	url, err := s.appClient.AppsConnectionsOpen()
+	if err != nil {
+		return fmt.Errorf("error opening connection: %s", err)
+	}
+
+	conn, err := websocket.Dial(url, nil)
+	if err != nil {
+		return fmt.Errorf("error connecting: %s", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	conn.SetIdleTimeout(socketModeIdleTimeout)
+
+	s.logger.Info("Connected to Socket Mode")
+	s.metrics.socketModeConnections.Inc()
+
+	defer s.setConnected(false)
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.ping(conn, done)
+
+	for {
+		_, buf, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("error reading: %s", err)
+		}
+
+		s.logger.Debug("Received Socket Mode envelope", "body", buf)
+
+		var env SocketModeEnvelope
+		if err := json.Unmarshal(buf, &env); err != nil {
+			s.logger.Warn("Invalid envelope JSON", "error", err)
+			continue
+		}
+
+		switch env.Type {
+		case "hello":
+			s.logger.Info("Socket Mode ready", "connections",
+				env.NumConnections)
+			s.setConnected(true)
+		case "disconnect":
+			s.logger.Info("Socket Mode server asked us to reconnect", "reason",
+				env.Reason)
+			_ = conn.WriteClose(websocket.CloseNormal, "")
+			return nil
+		case "events_api", "slash_commands", "interactive":
+			// Handle envelopes in the handler pool so a slow handler doesn't
+			// hold up the others, and so a flood of them can't start unbounded
+			// goroutines. If the pool is saturated we don't acknowledge the
+			// envelope. Slack sends it again later.
+			if !s.listener.handlers.Go("envelope", func() {
+				s.handle(conn, env)
+			}) {
+				s.logger.Warn(
+					"Dropping envelope as too many handlers are running",
+					"envelope_type", env.Type, "envelope_id", env.EnvelopeID)
+			}
+		default:
+			s.logger.Warn("Unexpected envelope type", "type", env.Type)
+		}
+	}
+}
+
+// setConnected records whether we're connected.
+func (s *SocketModeClient) setConnected(connected bool) {
+	s.connectedMutex.Lock()
+	defer s.connectedMutex.Unlock()
+	s.connected = connected
+}
+
+// Check returns nil if we're connected. Otherwise it returns an error saying
+// we're not. It's a readiness check.
+func (s *SocketModeClient) Check() error {
+	s.connectedMutex.Lock()
+	defer s.connectedMutex.Unlock()
+	if !s.connected {
+		return fmt.Errorf("not connected")
+	}
+	return nil
+}
+
+// ping pings the server periodically until done is closed. The server's
+// pongs keep the connection from timing out while it's quiet.
+func (s *SocketModeClient) ping(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(socketModePingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WritePing(nil); err != nil {
+				s.logger.Error("Error pinging", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// handle passes the envelope's payload to its handler and acknowledges it.
+func (s *SocketModeClient) handle(
+	conn *websocket.Conn,
+	env SocketModeEnvelope,
+) {
+	logger := s.logger.With(
+		"request_id", logging.NewRequestID(),
+		"envelope_type", env.Type,
+		"envelope_id", env.EnvelopeID,
+	)
+	if env.RetryAttempt > 0 {
+		logger = logger.With("retry_attempt", env.RetryAttempt, "retry_reason",
+			env.RetryReason)
+	}
+
+	ack := SocketModeAck{EnvelopeID: env.EnvelopeID}
+
+	switch env.Type {
+	case "events_api":
+		var p EventPayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			logger.Warn("Invalid payload JSON", "error", err)
+			break
+		}
+		if resp := s.listener.dispatchEvent(logger, p); resp != nil {
+			ack.Payload = resp
+		}
+	case "slash_commands":
+		var command SlashCommand
+		if err := json.Unmarshal(env.Payload, &command); err != nil {
+			logger.Warn("Invalid payload JSON", "error", err)
+			break
+		}
+		if resp := s.listener.dispatchCommand(logger, command); resp != nil {
+			ack.Payload = resp
+		}
+	case "interactive":
+		var p InteractionPayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			logger.Warn("Invalid payload JSON", "error", err)
+			break
+		}
+		if resp := s.listener.dispatchInteraction(logger, p); resp != nil {
+			ack.Payload = resp
+		}
+	}
+
+	if !env.AcceptsResponsePayload {
+		ack.Payload = nil
+	}
+
+	buf, err := json.Marshal(ack)
+	if err != nil {
+		logger.Error("Error marshaling acknowledgement", "error", err)
+		return
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+		logger.Error("Error sending acknowledgement", "error", err)
+		return
+	}
+}
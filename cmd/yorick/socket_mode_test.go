@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+	"github.com/andyjack/court/internal/slacktest"
+	"github.com/andyjack/court/internal/store"
+	"github.com/andyjack/court/internal/websocket"
+)
+
+// testTimeout is how long we wait for something to happen.
+const testTimeout = 5 * time.Second
+
+// Envelopes run in the handler pool. When it's saturated, we don't
+// acknowledge envelopes so Slack sends them again.
+func TestSocketModeHandlerPool(t *testing.T) {
+	conns := make(chan *websocket.Conn)
+	wsServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Upgrade(w, r)
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}))
+	defer wsServer.Close()
+
+	server := slacktest.NewServer()
+	defer server.Close()
+	server.Respond("apps.connections.open", slacktest.OK(
+		map[string]interface{}{
+			"url": "ws" + strings.TrimPrefix(wsServer.URL, "http"),
+		}))
+
+	logger := logging.New(ioutil.Discard, logging.LevelDebug,
+		logging.FormatLogfmt)
+	metrics := NewMetrics()
+	client := NewWebAPIClient(logger, metrics, server.URL(), "xapp-test")
+	listener := NewEventListener(logger, metrics, NewHandlerPool(metrics, 1),
+		NewPluginRegistry(logger, store.NewMemory()), 8080, client, "UTEST",
+		"", nil)
+
+	release := make(chan struct{})
+	listener.RegisterCommand("/slow", func(
+		client *WebAPIClient,
+		command SlashCommand,
+	) *SlashCommandResponse {
+		<-release
+		return &SlashCommandResponse{Text: "done"}
+	})
+
+	socketMode := NewSocketModeClient(logger, metrics, client, listener)
+	connectErr := make(chan error, 1)
+	go func() {
+		connectErr <- socketMode.connect()
+	}()
+
+	var conn *websocket.Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for connection")
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	send := func(env map[string]interface{}) {
+		buf, err := json.Marshal(env)
+		if err != nil {
+			t.Fatalf("error marshaling envelope: %s", err)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+			t.Fatalf("error sending envelope: %s", err)
+		}
+	}
+
+	command := map[string]interface{}{"type": "slash_commands",
+		"accepts_response_payload": true,
+		"payload":                  map[string]string{"command": "/slow"}}
+
+	send(map[string]interface{}{"type": "hello"})
+
+	// The first takes the only slot. The second finds the pool saturated.
+	command["envelope_id"] = "E1"
+	send(command)
+	waitFor(t, func() bool { return listener.handlers.Check() != nil })
+
+	command["envelope_id"] = "E2"
+	send(command)
+	waitFor(t, func() bool {
+		return strings.Contains(metricsText(t, metrics),
+			`yorick_handlers_rejected_total{handler="envelope"} 1`)
+	})
+
+	close(release)
+
+	command["envelope_id"] = "E3"
+	waitFor(t, func() bool { return listener.handlers.Check() == nil })
+	send(command)
+
+	// We acknowledge E1 and E3, and not E2.
+	var acks []string
+	for len(acks) < 2 {
+		_, buf, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("error reading acknowledgement: %s", err)
+		}
+		var ack struct {
+			EnvelopeID string               `json:"envelope_id"`
+			Payload    SlashCommandResponse `json:"payload"`
+		}
+		if err := json.Unmarshal(buf, &ack); err != nil {
+			t.Fatalf("invalid acknowledgement: %s", err)
+		}
+		if ack.Payload.Text != "done" {
+			t.Errorf("acknowledgement %s has payload %+v, wanted done",
+				ack.EnvelopeID, ack.Payload)
+		}
+		acks = append(acks, ack.EnvelopeID)
+	}
+	if strings.Join(acks, ",") != "E1,E3" {
+		t.Errorf("acknowledged %q, wanted E1 and E3", acks)
+	}
+
+	send(map[string]interface{}{"type": "disconnect", "reason": "test"})
+	select {
+	case err := <-connectErr:
+		if err != nil {
+			t.Errorf("connect() = %s", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for disconnect")
+	}
+}
+
+// waitFor waits for f to return true.
+func waitFor(t *testing.T, f func() bool) {
+	deadline := time.Now().Add(testTimeout)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// metricsText returns the metrics in the Prometheus text format.
+func metricsText(t *testing.T, metrics *Metrics) string {
+	var buf bytes.Buffer
+	if err := metrics.registry.Write(&buf); err != nil {
+		t.Fatalf("error writing metrics: %s", err)
+	}
+	return buf.String()
+}
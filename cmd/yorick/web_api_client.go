@@ -7,35 +7,65 @@ import (
 	"io/ioutil"
 	"net/http"
 	"time"
+
+	"github.com/andyjack/court/internal/logging"
 )
 
 // WebAPIClient is a Slack Web API client.
 type WebAPIClient struct {
+	logger      *logging.Logger
+	metrics     *Metrics
 	endpointURL string
 	token       string
 }
 
 // NewWebAPIClient creates a WebAPIClient.
-func NewWebAPIClient(endpointURL, token string) *WebAPIClient {
+func NewWebAPIClient(
+	logger *logging.Logger,
+	metrics *Metrics,
+	endpointURL,
+	token string,
+) *WebAPIClient {
 	return &WebAPIClient{
+		logger:      logger,
+		metrics:     metrics,
 		endpointURL: endpointURL,
 		token:       token,
 	}
 }
 
+// WithLogger returns a copy of the client that logs with the logger. We use
+// this to tie the calls we make while handling a request to the request.
+//
+// If the logger has a request_id field, we send it in the X-Request-Id header
+// so the server can log it too.
+func (w *WebAPIClient) WithLogger(logger *logging.Logger) *WebAPIClient {
+	c := *w
+	c.logger = logger
+	return &c
+}
+
+// Logger returns the client's logger. Handlers can use it to log about the
+// request they're handling.
+func (w *WebAPIClient) Logger() *logging.Logger {
+	return w.logger
+}
+
 var httpClient = &http.Client{
 	Timeout: 10 * time.Second,
 }
 
 // PostMessagePayload represents a chat.postMessage payload.
 type PostMessagePayload struct {
-	Channel string `json:"channel"`
-	Text    string `json:"text"`
+	Channel string  `json:"channel"`
+	Text    string  `json:"text"`
+	Blocks  []Block `json:"blocks,omitempty"`
 }
 
 // APIResponse represents an API response.
 type APIResponse struct {
-	OK bool `json:"ok"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
 }
 
 // ChatPostMessage sends a message to a channel (chat.postMessage).
@@ -45,50 +75,250 @@ func (w *WebAPIClient) ChatPostMessage(channel, text string) error {
 		Text:    text,
 	}
 
+	var resp APIResponse
+	return w.call("chat.postMessage", payload, &resp)
+}
+
+// ChatPostMessageBlocks sends a message with blocks to a channel
+// (chat.postMessage). The text is what notifications show.
+func (w *WebAPIClient) ChatPostMessageBlocks(
+	channel,
+	text string,
+	blocks []Block,
+) error {
+	payload := PostMessagePayload{
+		Channel: channel,
+		Text:    text,
+		Blocks:  blocks,
+	}
+
+	var resp APIResponse
+	return w.call("chat.postMessage", payload, &resp)
+}
+
+// ChatMeMessage sends a /me message to a channel (chat.meMessage).
+func (w *WebAPIClient) ChatMeMessage(channel, text string) error {
+	payload := PostMessagePayload{
+		Channel: channel,
+		Text:    text,
+	}
+
+	var resp APIResponse
+	return w.call("chat.meMessage", payload, &resp)
+}
+
+// PostEphemeralPayload represents a chat.postEphemeral payload.
+type PostEphemeralPayload struct {
+	Channel string `json:"channel"`
+	User    string `json:"user"`
+	Text    string `json:"text"`
+}
+
+// ChatPostEphemeral sends a message to a channel that only the given user
+// sees (chat.postEphemeral).
+func (w *WebAPIClient) ChatPostEphemeral(channel, user, text string) error {
+	payload := PostEphemeralPayload{
+		Channel: channel,
+		User:    user,
+		Text:    text,
+	}
+
+	var resp APIResponse
+	return w.call("chat.postEphemeral", payload, &resp)
+}
+
+// AuthTestResponse represents an auth.test response. It tells us who we are.
+type AuthTestResponse struct {
+	APIResponse
+	URL    string `json:"url"`
+	Team   string `json:"team"`
+	User   string `json:"user"`
+	TeamID string `json:"team_id"`
+	UserID string `json:"user_id"`
+	BotID  string `json:"bot_id"`
+}
+
+// AuthTest checks our token and finds out who we are (auth.test).
+func (w *WebAPIClient) AuthTest() (AuthTestResponse, error) {
+	var resp AuthTestResponse
+	if err := w.call("auth.test", struct{}{}, &resp); err != nil {
+		return AuthTestResponse{}, err
+	}
+	return resp, nil
+}
+
+// ConnectionsOpenResponse represents an apps.connections.open response.
+type ConnectionsOpenResponse struct {
+	APIResponse
+	URL string `json:"url"`
+}
+
+// AppsConnectionsOpen asks for a Socket Mode WebSocket URL
+// (apps.connections.open). The client must use an app-level token.
+func (w *WebAPIClient) AppsConnectionsOpen() (string, error) {
+	var resp ConnectionsOpenResponse
+	if err := w.call("apps.connections.open", struct{}{}, &resp); err != nil {
+		return "", err
+	}
+	if resp.URL == "" {
+		return "", fmt.Errorf("no URL in apps.connections.open response")
+	}
+	return resp.URL, nil
+}
+
+// apiResponse is implemented by all API responses. It lets us check whether
+// the API said the request succeeded.
+type apiResponse interface {
+	response() APIResponse
+}
+
+func (a APIResponse) response() APIResponse { return a }
+
+// call calls a Web API method. It sends the payload as JSON and decodes the
+// response into the given response.
+func (w *WebAPIClient) call(
+	method string,
+	payload interface{},
+	response apiResponse,
+) error {
+	start := time.Now()
+	errorCode, err := w.doCall(method, payload, response)
+	w.metrics.webAPICalls.Inc(method, errorCode)
+	w.metrics.webAPICallDuration.Observe(time.Since(start).Seconds(), method)
+	return err
+}
+
+// doCall does the work of call. If the call fails, it also returns the error
+// to count the call as having. This is the error code the API gave if it
+// gave one.
+func (w *WebAPIClient) doCall(
+	method string,
+	payload interface{},
+	response apiResponse,
+) (string, error) {
 	buf, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("error marshaling payload: %s", err)
+		return webAPIErrorRequest, fmt.Errorf("error marshaling payload: %s",
+			err)
 	}
 
 	req, err := http.NewRequest(
 		http.MethodPost,
-		fmt.Sprintf("%s/chat.postMessage", w.endpointURL),
+		fmt.Sprintf("%s/%s", w.endpointURL, method),
 		bytes.NewBuffer(buf),
 	)
 	if err != nil {
-		return fmt.Errorf("error creating request: %s", err)
+		return webAPIErrorRequest, fmt.Errorf("error creating request: %s", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", w.token))
+	if requestID := w.logger.Value("request_id"); requestID != "" {
+		req.Header.Set("X-Request-Id", requestID)
+	}
+
+	logger := w.logger.With("api_method", method)
+	logger.Debug("Calling Web API method", "payload", buf)
+	start := time.Now()
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("error performing HTTP request: %s", err)
+		return webAPIErrorRequest, fmt.Errorf(
+			"error performing HTTP request: %s", err)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		_ = resp.Body.Close()
-		return fmt.Errorf("error reading body: %s", err)
+		return webAPIErrorResponse, fmt.Errorf("error reading body: %s", err)
 	}
 
 	if err := resp.Body.Close(); err != nil {
-		return fmt.Errorf("error closing body: %s", err)
+		return webAPIErrorResponse, fmt.Errorf("error closing body: %s", err)
 	}
 
+	logger.Debug("Called Web API method", "status", resp.StatusCode,
+		"duration", time.Since(start), "response", body)
+
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d from API", resp.StatusCode)
+		return webAPIErrorHTTP, fmt.Errorf("HTTP %d from API", resp.StatusCode)
+	}
+
+	if err := json.Unmarshal(body, response); err != nil {
+		return webAPIErrorResponse, fmt.Errorf("error unmarshaling body: %s",
+			err)
+	}
+
+	if r := response.response(); !r.OK {
+		errorCode := r.Error
+		if errorCode == "" {
+			errorCode = webAPIErrorResponse
+		}
+		return errorCode, fmt.Errorf("API said !ok: %s (I sent %s)", body, buf)
+	}
+
+	return "", nil
+}
+
+// paginatedResponse holds the parts of a response from a paginated method
+// that tell us whether there are more pages.
+type paginatedResponse struct {
+	APIResponse
+	HasMore          bool `json:"has_more"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+func (p paginatedResponse) cursor() string {
+	return p.ResponseMetadata.NextCursor
+}
+
+// pagedResponse is implemented by responses from paginated methods.
+type pagedResponse interface {
+	apiResponse
+	cursor() string
+}
+
+// pager fetches the pages of a paginated method one at a time.
+type pager struct {
+	client  *WebAPIClient
+	method  string
+	args    map[string]interface{}
+	started bool
+	cursor  string
+	err     error
+}
+
+func newPager(
+	client *WebAPIClient,
+	method string,
+	args map[string]interface{},
+) *pager {
+	return &pager{
+		client: client,
+		method: method,
+		args:   args,
+	}
+}
+
+// next fetches the next page into response. It returns false if there are no
+// more pages or there was an error.
+func (p *pager) next(response pagedResponse) bool {
+	if p.err != nil || (p.started && p.cursor == "") {
+		return false
 	}
 
-	var apiResponse APIResponse
-	if err := json.Unmarshal(body, &apiResponse); err != nil {
-		return fmt.Errorf("error unmarshaling body: %s", err)
+	if p.cursor != "" {
+		p.args["cursor"] = p.cursor
 	}
 
-	if !apiResponse.OK {
-		return fmt.Errorf("API said !ok: %s (I sent %s)", body, buf)
+	if err := p.client.call(p.method, p.args, response); err != nil {
+		p.err = err
+		return false
 	}
 
-	return nil
+	p.started = true
+	p.cursor = response.cursor()
+	return true
 }
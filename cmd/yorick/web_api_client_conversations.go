@@ -0,0 +1,350 @@
+package main
+
+import "strings"
+
+// Message is a message in a conversation, such as from conversations.history.
+type Message struct {
+	Type     string `json:"type"`
+	SubType  string `json:"subtype"`
+	User     string `json:"user"`
+	BotID    string `json:"bot_id"`
+	Text     string `json:"text"`
+	Ts       string `json:"ts"`
+	ThreadTs string `json:"thread_ts"`
+}
+
+// HistoryOptions limits the messages ConversationsHistory and
+// ConversationsReplies return. The zero value means no limits.
+type HistoryOptions struct {
+	// Only messages after Oldest and before Latest. Either may be blank.
+	Oldest string
+	Latest string
+
+	// Whether to include messages with exactly the Oldest or Latest timestamp.
+	Inclusive bool
+
+	// How many messages to fetch per request. If it is zero, the API decides.
+	Limit int
+}
+
+// ConversationsHistory returns an iterator over the messages in a channel,
+// newest first (conversations.history).
+//
+// It fetches more messages as needed.
+func (w *WebAPIClient) ConversationsHistory(
+	channel string,
+	opts HistoryOptions,
+) *MessageIterator {
+	args := opts.args()
+	args["channel"] = channel
+	return &MessageIterator{pager: newPager(w, "conversations.history", args)}
+}
+
+// ConversationsReplies returns an iterator over a message and the replies in
+// its thread, oldest first (conversations.replies).
+//
+// It fetches more messages as needed.
+func (w *WebAPIClient) ConversationsReplies(
+	channel,
+	ts string,
+	opts HistoryOptions,
+) *MessageIterator {
+	args := opts.args()
+	args["channel"] = channel
+	args["ts"] = ts
+	return &MessageIterator{pager: newPager(w, "conversations.replies", args)}
+}
+
+func (h HistoryOptions) args() map[string]interface{} {
+	args := map[string]interface{}{}
+	if h.Oldest != "" {
+		args["oldest"] = h.Oldest
+	}
+	if h.Latest != "" {
+		args["latest"] = h.Latest
+	}
+	if h.Inclusive {
+		args["inclusive"] = true
+	}
+	if h.Limit > 0 {
+		args["limit"] = h.Limit
+	}
+	return args
+}
+
+// MessageIterator iterates over messages from a paginated method. Use it like
+// a bufio.Scanner:
+//
+//	iter := client.ConversationsHistory(channel, HistoryOptions{})
+//	for iter.Next() {
+//		m := iter.Message()
+//	}
+//	if err := iter.Err(); err != nil {
+//	}
+type MessageIterator struct {
+	pager    *pager
+	messages []Message
+	current  Message
+}
+
+// messagesResponse is a page of messages.
+type messagesResponse struct {
+	paginatedResponse
+	Messages []Message `json:"messages"`
+}
+
+// Next advances to the next message. It returns false when there are no more
+// messages or there was an error.
+func (m *MessageIterator) Next() bool {
+	for len(m.messages) == 0 {
+		var resp messagesResponse
+		if !m.pager.next(&resp) {
+			return false
+		}
+		m.messages = resp.Messages
+	}
+
+	m.current = m.messages[0]
+	m.messages = m.messages[1:]
+	return true
+}
+
+// Message returns the current message.
+func (m *MessageIterator) Message() Message {
+	return m.current
+}
+
+// Err returns the error that stopped iteration, if any.
+func (m *MessageIterator) Err() error {
+	return m.pager.err
+}
+
+// Conversation describes a channel.
+type Conversation struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	IsChannel  bool   `json:"is_channel"`
+	IsPrivate  bool   `json:"is_private"`
+	IsArchived bool   `json:"is_archived"`
+	IsMember   bool   `json:"is_member"`
+	Created    int64  `json:"created"`
+	Topic      Topic  `json:"topic"`
+	Purpose    Topic  `json:"purpose"`
+	NumMembers int    `json:"num_members"`
+}
+
+// Topic is a channel's topic or purpose.
+type Topic struct {
+	Value   string `json:"value"`
+	Creator string `json:"creator"`
+	LastSet int64  `json:"last_set"`
+}
+
+// ListOptions limits the conversations ConversationsList returns.
+type ListOptions struct {
+	// Comma separated conversation types, e.g. public_channel,private_channel.
+	// If it is blank, the API decides.
+	Types string
+
+	// Whether to leave out archived channels.
+	ExcludeArchived bool
+
+	// How many conversations to fetch per request. If it is zero, the API
+	// decides.
+	Limit int
+}
+
+// ConversationsList returns an iterator over the conversations in the
+// workspace (conversations.list).
+//
+// It fetches more conversations as needed.
+func (w *WebAPIClient) ConversationsList(
+	opts ListOptions,
+) *ConversationIterator {
+	args := map[string]interface{}{}
+	if opts.Types != "" {
+		args["types"] = opts.Types
+	}
+	if opts.ExcludeArchived {
+		args["exclude_archived"] = true
+	}
+	if opts.Limit > 0 {
+		args["limit"] = opts.Limit
+	}
+	return &ConversationIterator{
+		pager: newPager(w, "conversations.list", args),
+	}
+}
+
+// ConversationIterator iterates over conversations. Use it the same way as a
+// MessageIterator.
+type ConversationIterator struct {
+	pager         *pager
+	conversations []Conversation
+	current       Conversation
+}
+
+// conversationsResponse is a page of conversations.
+type conversationsResponse struct {
+	paginatedResponse
+	Channels []Conversation `json:"channels"`
+}
+
+// Next advances to the next conversation. It returns false when there are no
+// more conversations or there was an error.
+func (c *ConversationIterator) Next() bool {
+	for len(c.conversations) == 0 {
+		var resp conversationsResponse
+		if !c.pager.next(&resp) {
+			return false
+		}
+		c.conversations = resp.Channels
+	}
+
+	c.current = c.conversations[0]
+	c.conversations = c.conversations[1:]
+	return true
+}
+
+// Conversation returns the current conversation.
+func (c *ConversationIterator) Conversation() Conversation {
+	return c.current
+}
+
+// Err returns the error that stopped iteration, if any.
+func (c *ConversationIterator) Err() error {
+	return c.pager.err
+}
+
+// conversationInfoResponse is the response to conversations.info.
+type conversationInfoResponse struct {
+	APIResponse
+	Channel Conversation `json:"channel"`
+}
+
+// ConversationsInfo describes a channel (conversations.info).
+func (w *WebAPIClient) ConversationsInfo(
+	channel string,
+) (Conversation, error) {
+	args := map[string]interface{}{
+		"channel":             channel,
+		"include_num_members": true,
+	}
+
+	var resp conversationInfoResponse
+	if err := w.call("conversations.info", args, &resp); err != nil {
+		return Conversation{}, err
+	}
+	return resp.Channel, nil
+}
+
+// ConversationsMembers returns an iterator over the user IDs of the members
+// of a channel (conversations.members).
+//
+// It fetches more members as needed. limit is how many to fetch per request.
+// If it is zero, the API decides.
+func (w *WebAPIClient) ConversationsMembers(
+	channel string,
+	limit int,
+) *MemberIterator {
+	args := map[string]interface{}{
+		"channel": channel,
+	}
+	if limit > 0 {
+		args["limit"] = limit
+	}
+	return &MemberIterator{
+		pager: newPager(w, "conversations.members", args),
+	}
+}
+
+// MemberIterator iterates over user IDs. Use it the same way as a
+// MessageIterator.
+type MemberIterator struct {
+	pager   *pager
+	members []string
+	current string
+}
+
+// membersResponse is a page of members.
+type membersResponse struct {
+	paginatedResponse
+	Members []string `json:"members"`
+}
+
+// Next advances to the next member. It returns false when there are no more
+// members or there was an error.
+func (m *MemberIterator) Next() bool {
+	for len(m.members) == 0 {
+		var resp membersResponse
+		if !m.pager.next(&resp) {
+			return false
+		}
+		m.members = resp.Members
+	}
+
+	m.current = m.members[0]
+	m.members = m.members[1:]
+	return true
+}
+
+// Member returns the current member's user ID.
+func (m *MemberIterator) Member() string {
+	return m.current
+}
+
+// Err returns the error that stopped iteration, if any.
+func (m *MemberIterator) Err() error {
+	return m.pager.err
+}
+
+// ConversationsJoin joins a channel (conversations.join).
+func (w *WebAPIClient) ConversationsJoin(channel string) (Conversation, error) {
+	args := map[string]interface{}{
+		"channel": channel,
+	}
+
+	var resp conversationInfoResponse
+	if err := w.call("conversations.join", args, &resp); err != nil {
+		return Conversation{}, err
+	}
+	return resp.Channel, nil
+}
+
+// ConversationsLeave leaves a channel (conversations.leave).
+func (w *WebAPIClient) ConversationsLeave(channel string) error {
+	args := map[string]interface{}{
+		"channel": channel,
+	}
+
+	var resp APIResponse
+	return w.call("conversations.leave", args, &resp)
+}
+
+// ConversationsInvite invites users to a channel (conversations.invite).
+func (w *WebAPIClient) ConversationsInvite(
+	channel string,
+	users ...string,
+) (Conversation, error) {
+	args := map[string]interface{}{
+		"channel": channel,
+		"users":   strings.Join(users, ","),
+	}
+
+	var resp conversationInfoResponse
+	if err := w.call("conversations.invite", args, &resp); err != nil {
+		return Conversation{}, err
+	}
+	return resp.Channel, nil
+}
+
+// ConversationsKick removes a user from a channel (conversations.kick).
+func (w *WebAPIClient) ConversationsKick(channel, user string) error {
+	args := map[string]interface{}{
+		"channel": channel,
+		"user":    user,
+	}
+
+	var resp APIResponse
+	return w.call("conversations.kick", args, &resp)
+}
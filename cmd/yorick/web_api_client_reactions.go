@@ -0,0 +1,23 @@
+package main
+
+// ReactionsAdd adds a reaction to a message (reactions.add). name is the
+// emoji's name, e.g. thumbsup. timestamp is the message's ts.
+func (w *WebAPIClient) ReactionsAdd(channel, timestamp, name string) error {
+	return w.react("reactions.add", channel, timestamp, name)
+}
+
+// ReactionsRemove removes a reaction from a message (reactions.remove).
+func (w *WebAPIClient) ReactionsRemove(channel, timestamp, name string) error {
+	return w.react("reactions.remove", channel, timestamp, name)
+}
+
+func (w *WebAPIClient) react(method, channel, timestamp, name string) error {
+	args := map[string]interface{}{
+		"channel":   channel,
+		"timestamp": timestamp,
+		"name":      name,
+	}
+
+	var resp APIResponse
+	return w.call(method, args, &resp)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andyjack/court/internal/logging"
+	"github.com/andyjack/court/internal/slacktest"
+)
+
+// newTestClient creates a WebAPIClient using the token and talking to the
+// server.
+func newTestClient(server *slacktest.Server, token string) *WebAPIClient {
+	logger := logging.New(ioutil.Discard, logging.LevelDebug,
+		logging.FormatLogfmt)
+	return NewWebAPIClient(logger, NewMetrics(), server.URL(), token)
+}
+
+func TestWebAPIClientCalls(t *testing.T) {
+	server := slacktest.NewServer()
+	defer server.Close()
+	server.SetTokens("xoxb-test")
+
+	client := newTestClient(server, "xoxb-test")
+
+	self, err := client.AuthTest()
+	if err != nil {
+		t.Fatalf("AuthTest() error: %s", err)
+	}
+	if self.UserID != "UTEST" || self.BotID != "BTEST" {
+		t.Errorf("AuthTest() = %+v, wanted UTEST and BTEST", self)
+	}
+
+	if err := client.ChatPostMessage("C1", "hello"); err != nil {
+		t.Fatalf("ChatPostMessage() error: %s", err)
+	}
+
+	if err := client.ChatPostEphemeral("C1", "U1", "psst"); err != nil {
+		t.Fatalf("ChatPostEphemeral() error: %s", err)
+	}
+
+	if err := server.CheckCalls("auth.test", "chat.postMessage",
+		"chat.postEphemeral"); err != nil {
+		t.Errorf("%s", err)
+	}
+
+	calls := server.Calls()
+	for _, call := range calls {
+		if call.Token != "xoxb-test" {
+			t.Errorf("%s sent token %q, wanted xoxb-test", call.Method,
+				call.Token)
+		}
+	}
+
+	post := calls[1]
+	if post.Arg("channel") != "C1" || post.Arg("text") != "hello" {
+		t.Errorf("chat.postMessage args = %v, wanted channel C1 and text "+
+			"hello", post.Args)
+	}
+
+	ephemeral := calls[2]
+	if ephemeral.Arg("channel") != "C1" || ephemeral.Arg("user") != "U1" ||
+		ephemeral.Arg("text") != "psst" {
+		t.Errorf("chat.postEphemeral args = %v, wanted channel C1, user U1, "+
+			"and text psst", ephemeral.Args)
+	}
+}
+
+func TestWebAPIClientErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*slacktest.Server)
+		token string
+		error string
+	}{
+		{
+			"error code",
+			func(s *slacktest.Server) {
+				s.Respond("chat.postMessage",
+					slacktest.Error("channel_not_found"))
+			},
+			"xoxb-test",
+			"channel_not_found",
+		},
+		{
+			"bad token",
+			func(s *slacktest.Server) { s.SetTokens("xoxb-other") },
+			"xoxb-test",
+			"invalid_auth",
+		},
+		{
+			"no token",
+			func(s *slacktest.Server) { s.SetTokens("xoxb-other") },
+			"",
+			"not_authed",
+		},
+		{
+			"HTTP error",
+			func(s *slacktest.Server) {
+				s.Respond("chat.postMessage", slacktest.Response{
+					Status: http.StatusInternalServerError,
+				})
+			},
+			"xoxb-test",
+			"HTTP 500",
+		},
+		{
+			"invalid response",
+			func(s *slacktest.Server) {
+				s.Respond("chat.postMessage", slacktest.Response{Body: "{"})
+			},
+			"xoxb-test",
+			"error unmarshaling body",
+		},
+	}
+
+	for _, test := range tests {
+		server := slacktest.NewServer()
+		test.setup(server)
+
+		client := newTestClient(server, test.token)
+		err := client.ChatPostMessage("C1", "hello")
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%s: ChatPostMessage() error = %v, wanted %s", test.name,
+				err, test.error)
+		}
+
+		if len(server.CallsTo("chat.postMessage")) != 1 {
+			t.Errorf("%s: got %d calls, wanted 1", test.name,
+				len(server.CallsTo("chat.postMessage")))
+		}
+
+		server.Close()
+	}
+}
+
+func TestWebAPIClientRateLimited(t *testing.T) {
+	server := slacktest.NewServer()
+	defer server.Close()
+
+	server.Queue("chat.postMessage", slacktest.RateLimited(2*time.Second))
+
+	client := newTestClient(server, "xoxb-test")
+
+	// We don't retry by ourselves. The caller sees the 429.
+	err := client.ChatPostMessage("C1", "hello")
+	if err == nil || !strings.Contains(err.Error(), "HTTP 429") {
+		t.Fatalf("ChatPostMessage() error = %v, wanted HTTP 429", err)
+	}
+	if n := len(server.CallsTo("chat.postMessage")); n != 1 {
+		t.Fatalf("got %d calls after a 429, wanted 1", n)
+	}
+
+	// The queued response is used up, so trying again succeeds.
+	if err := client.ChatPostMessage("C1", "hello"); err != nil {
+		t.Fatalf("ChatPostMessage() error after 429: %s", err)
+	}
+
+	// The 429 tells clients when to try again.
+	server.Queue("chat.postMessage", slacktest.RateLimited(2*time.Second))
+	resp, err := http.Post(server.URL()+"/chat.postMessage",
+		"application/json", strings.NewReader(`{"channel":"C1","text":"x"}`))
+	if err != nil {
+		t.Fatalf("error posting: %s", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests ||
+		resp.Header.Get("Retry-After") != "2" {
+		t.Errorf("got status %d and Retry-After %q, wanted 429 and 2",
+			resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestWebAPIClientPagination(t *testing.T) {
+	server := slacktest.NewServer()
+	defer server.Close()
+
+	// Three pages of history, linked by cursors.
+	pages := map[string]slacktest.Response{
+		"": slacktest.OK(map[string]interface{}{
+			"messages": []map[string]interface{}{
+				{"text": "c", "ts": "3.0"},
+				{"text": "b", "ts": "2.0"},
+			},
+			"has_more":          true,
+			"response_metadata": map[string]string{"next_cursor": "page2"},
+		}),
+		"page2": slacktest.OK(map[string]interface{}{
+			"messages":          []map[string]interface{}{},
+			"has_more":          true,
+			"response_metadata": map[string]string{"next_cursor": "page3"},
+		}),
+		"page3": slacktest.OK(map[string]interface{}{
+			"messages": []map[string]interface{}{
+				{"text": "a", "ts": "1.0"},
+			},
+		}),
+	}
+	server.Handle("conversations.history",
+		func(call slacktest.Call) slacktest.Response {
+			resp, ok := pages[call.Arg("cursor")]
+			if !ok {
+				return slacktest.Error("invalid_cursor")
+			}
+			return resp
+		})
+
+	client := newTestClient(server, "xoxb-test")
+
+	iter := client.ConversationsHistory("C1", HistoryOptions{Limit: 2})
+	var texts []string
+	for iter.Next() {
+		texts = append(texts, iter.Message().Text)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("iterating: %s", err)
+	}
+	if !reflect.DeepEqual(texts, []string{"c", "b", "a"}) {
+		t.Errorf("got messages %v, wanted [c b a]", texts)
+	}
+
+	calls := server.CallsTo("conversations.history")
+	var cursors []string
+	for _, call := range calls {
+		cursors = append(cursors, call.Arg("cursor"))
+		if call.Arg("channel") != "C1" || call.Arg("limit") != "2" {
+			t.Errorf("call args = %v, wanted channel C1 and limit 2",
+				call.Args)
+		}
+	}
+	if !reflect.DeepEqual(cursors, []string{"", "page2", "page3"}) {
+		t.Errorf("got cursors %q, wanted none, page2, then page3", cursors)
+	}
+
+	// Iterating is lazy. We don't fetch more than we need.
+	server.Reset()
+	iter = client.ConversationsHistory("C1", HistoryOptions{})
+	if !iter.Next() || iter.Message().Text != "c" {
+		t.Fatalf("first message = %+v, wanted c", iter.Message())
+	}
+	if err := server.CheckCalls("conversations.history"); err != nil {
+		t.Errorf("%s", err)
+	}
+}
+
+func TestWebAPIClientPaginationError(t *testing.T) {
+	server := slacktest.NewServer()
+	defer server.Close()
+
+	server.Queue("conversations.members",
+		slacktest.OK(map[string]interface{}{
+			"members":           []string{"U1", "U2"},
+			"response_metadata": map[string]string{"next_cursor": "next"},
+		}),
+		slacktest.Error("channel_not_found"),
+	)
+
+	client := newTestClient(server, "xoxb-test")
+
+	iter := client.ConversationsMembers("C1", 0)
+	var members []string
+	for iter.Next() {
+		members = append(members, iter.Member())
+	}
+
+	if !reflect.DeepEqual(members, []string{"U1", "U2"}) {
+		t.Errorf("got members %v, wanted the first page's", members)
+	}
+	if err := iter.Err(); err == nil ||
+		!strings.Contains(err.Error(), "channel_not_found") {
+		t.Errorf("Err() = %v, wanted channel_not_found", err)
+	}
+
+	if iter.Next() {
+		t.Errorf("Next() = true after an error")
+	}
+	if n := len(server.CallsTo("conversations.members")); n != 2 {
+		t.Errorf("got %d calls, wanted 2", n)
+	}
+}
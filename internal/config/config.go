@@ -0,0 +1,202 @@
+// Package config fills in command line flags from the environment and from a
+// config file. This lets us keep secrets such as tokens out of process
+// listings.
+//
+// Each flag is a setting. Its value comes from the first of these that has
+// it:
+//
+//  1. The command line, e.g. -log-level debug.
+//  2. An environment variable named for the flag with a prefix, in upper case
+//     and with - replaced by _, e.g. YORICK_LOG_LEVEL=debug.
+//  3. The config file, e.g. log-level = "debug".
+//  4. The flag's default.
+//
+// The config file is in a subset of TOML: key = value pairs, one per line,
+// where keys are flag names. Values are strings, integers, booleans, or
+// arrays of strings. Arrays are for List flags. Comments start with #. For
+// example:
+//
+//	# yorick.toml
+//	token = "xoxb-..."
+//	port = 8080
+//	verbose = true
+//	channels = ["C0123", "C0456"]
+//
+// The config file's path comes from the -config flag, or the environment if
+// it's not on the command line. We don't use a config file if neither says
+// to.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ConfigFlag is the name of the flag holding the config file's path.
+const ConfigFlag = "config"
+
+// Parse parses the command line arguments with the flag set. It then sets
+// flags not on the command line from the environment and then from the
+// config file. Environment variables are named prefix_FLAG_NAME.
+//
+// If the flag set has a ConfigFlag flag, its value is the config file's path.
+//
+// It is an error if the config file has settings that aren't flags or that
+// have the wrong type.
+func Parse(fs *flag.FlagSet, arguments []string, prefix string) error {
+	if err := fs.Parse(arguments); err != nil {
+		return err
+	}
+
+	onCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || onCommandLine[f.Name] {
+			return
+		}
+		name := EnvName(prefix, f.Name)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, s); setErr != nil {
+			err = fmt.Errorf("invalid value for %s in the environment: %s",
+				name, setErr)
+			return
+		}
+		onCommandLine[f.Name] = true
+	})
+	if err != nil {
+		return err
+	}
+
+	configFlag := fs.Lookup(ConfigFlag)
+	if configFlag == nil || configFlag.Value.String() == "" {
+		return nil
+	}
+
+	return apply(fs, configFlag.Value.String(), onCommandLine)
+}
+
+// EnvName returns the name of the environment variable for a flag.
+func EnvName(prefix, name string) string {
+	return prefix + "_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// apply sets flags from the config file at path. It skips flags in skip as
+// they were set already.
+func apply(fs *flag.FlagSet, path string, skip map[string]bool) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %s", err)
+	}
+
+	values, err := parse(string(buf))
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	// Go through the settings in order so we report the first problem.
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return values[names[i]].line < values[names[j]].line
+	})
+
+	for _, name := range names {
+		v := values[name]
+
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s: line %d: unknown setting: %s", path, v.line,
+				name)
+		}
+		if name == ConfigFlag {
+			return fmt.Errorf("%s: line %d: %s can't be set in the config file",
+				path, v.line, name)
+		}
+
+		if want := kindOf(f); v.kind != want {
+			return fmt.Errorf("%s: line %d: %s must be %s", path, v.line, name,
+				want)
+		}
+
+		if skip[name] {
+			continue
+		}
+
+		if list, ok := f.Value.(*List); ok {
+			*list = append(List(nil), v.items...)
+			continue
+		}
+
+		if err := fs.Set(name, v.text); err != nil {
+			return fmt.Errorf("%s: line %d: invalid value for %s: %s", path,
+				v.line, name, err)
+		}
+	}
+
+	return nil
+}
+
+// kindOf returns the kind of value a flag takes in a config file.
+func kindOf(f *flag.Flag) kind {
+	if _, ok := f.Value.(*List); ok {
+		return kindArray
+	}
+
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return kindString
+	}
+
+	switch getter.Get().(type) {
+	case bool:
+		return kindBoolean
+	case int, int64, uint, uint64:
+		return kindInteger
+	default:
+		return kindString
+	}
+}
+
+// List is a flag holding a list of strings. On the command line and in the
+// environment it's comma separated. In the config file it's an array.
+type List []string
+
+// String returns the list comma separated.
+func (l *List) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+// Set sets the list from a comma separated string. We trim whitespace and
+// drop blank items.
+func (l *List) Set(s string) error {
+	var items List
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	*l = items
+	return nil
+}
+
+// Get returns the list.
+func (l *List) Get() interface{} {
+	return []string(*l)
+}
@@ -0,0 +1,313 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPrefix prefixes the environment variables in tests.
+const testPrefix = "CONFIGTEST"
+
+// testFlags are the flags we parse in tests.
+type testFlags struct {
+	fs      *flag.FlagSet
+	name    *string
+	port    *int
+	verbose *bool
+	list    List
+}
+
+// newTestFlags creates a flag set with a flag of each kind.
+func newTestFlags() *testFlags {
+	f := &testFlags{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.fs.SetOutput(ioutil.Discard)
+	f.fs.String(ConfigFlag, "", "Config file")
+	f.name = f.fs.String("name", "default", "Name")
+	f.port = f.fs.Int("port", 1, "Port")
+	f.verbose = f.fs.Bool("verbose", false, "Verbose")
+	f.list = List{"d"}
+	f.fs.Var(&f.list, "list", "List")
+	return f
+}
+
+// writeConfig writes a config file into the directory and returns its path.
+func writeConfig(t *testing.T, dir, contents string) string {
+	path := filepath.Join(dir, "test.toml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("error writing config file: %s", err)
+	}
+	return path
+}
+
+// setEnv sets the environment variables and returns a function that unsets
+// them.
+func setEnv(t *testing.T, env map[string]string) func() {
+	for name, value := range env {
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatalf("error setting %s: %s", name, err)
+		}
+	}
+	return func() {
+		for name := range env {
+			_ = os.Unsetenv(name)
+		}
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		want string
+	}{
+		{"default", nil, nil, "", "default"},
+		{"file", nil, nil, `name = "file"`, "file"},
+		{
+			"environment over file",
+			nil,
+			map[string]string{"CONFIGTEST_NAME": "env"},
+			`name = "file"`,
+			"env",
+		},
+		{
+			"command line over environment",
+			[]string{"-name", "cmd"},
+			map[string]string{"CONFIGTEST_NAME": "env"},
+			`name = "file"`,
+			"cmd",
+		},
+		{
+			"command line over file",
+			[]string{"-name", "cmd"},
+			nil,
+			`name = "file"`,
+			"cmd",
+		},
+		{
+			"blank in environment is set",
+			nil,
+			map[string]string{"CONFIGTEST_NAME": ""},
+			`name = "file"`,
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		f := newTestFlags()
+		path := writeConfig(t, dir, test.file)
+		unset := setEnv(t, test.env)
+
+		args := append([]string{"-config", path}, test.args...)
+		err := Parse(f.fs, args, testPrefix)
+		unset()
+		if err != nil {
+			t.Errorf("%s: Parse() error: %s", test.name, err)
+			continue
+		}
+
+		if *f.name != test.want {
+			t.Errorf("%s: name = %q, wanted %q", test.name, *f.name, test.want)
+		}
+	}
+}
+
+func TestParseKinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := writeConfig(t, dir, `
+name = "bot"
+port = 8_080
+verbose = true
+list = ["a", "b"]
+`)
+
+	f := newTestFlags()
+	if err := Parse(f.fs, []string{"-config", path}, testPrefix); err != nil {
+		t.Fatalf("Parse() error: %s", err)
+	}
+
+	if *f.name != "bot" || *f.port != 8080 || !*f.verbose ||
+		!reflect.DeepEqual(f.list, List{"a", "b"}) {
+		t.Errorf("got name %q, port %d, verbose %v, list %q", *f.name, *f.port,
+			*f.verbose, f.list)
+	}
+}
+
+func TestParseList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		want List
+	}{
+		{"default", nil, nil, "", List{"d"}},
+		{
+			"command line",
+			[]string{"-list", " a, b,,c "},
+			nil,
+			`list = ["x"]`,
+			List{"a", "b", "c"},
+		},
+		{
+			"environment",
+			nil,
+			map[string]string{"CONFIGTEST_LIST": "x,y"},
+			`list = ["z"]`,
+			List{"x", "y"},
+		},
+		{"file", nil, nil, `list = ["p", "q, r"]`, List{"p", "q, r"}},
+		{"empty in file", nil, nil, `list = []`, nil},
+		{"blank on command line", []string{"-list", ""}, nil, "", nil},
+	}
+
+	for _, test := range tests {
+		f := newTestFlags()
+		path := writeConfig(t, dir, test.file)
+		unset := setEnv(t, test.env)
+
+		args := append([]string{"-config", path}, test.args...)
+		err := Parse(f.fs, args, testPrefix)
+		unset()
+		if err != nil {
+			t.Errorf("%s: Parse() error: %s", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(f.list, test.want) {
+			t.Errorf("%s: list = %#v, wanted %#v", test.name, f.list, test.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		file  string
+		error string
+	}{
+		{
+			"unknown setting",
+			nil,
+			"name = \"x\"\nnope = 1",
+			"line 2: unknown setting: nope",
+		},
+		{
+			"config file in config file",
+			nil,
+			`config = "other.toml"`,
+			"config can't be set in the config file",
+		},
+		{"string for integer", nil, `port = "80"`, "port must be an integer"},
+		{"integer for string", nil, "name = 1", "name must be a string"},
+		{"string for boolean", nil, `verbose = "yes"`,
+			"verbose must be a boolean"},
+		{"string for list", nil, `list = "a,b"`, "list must be an array"},
+		{"invalid TOML", nil, "[table]", "tables are not supported"},
+		{
+			"invalid environment variable",
+			map[string]string{"CONFIGTEST_PORT": "eighty"},
+			"",
+			"invalid value for CONFIGTEST_PORT",
+		},
+
+		// We check settings' types even if the command line or environment
+		// overrides them.
+		{
+			"overridden setting of the wrong type",
+			map[string]string{"CONFIGTEST_PORT": "80"},
+			`port = "80"`,
+			"port must be an integer",
+		},
+	}
+
+	for _, test := range tests {
+		f := newTestFlags()
+		path := writeConfig(t, dir, test.file)
+		unset := setEnv(t, test.env)
+
+		err := Parse(f.fs, []string{"-config", path}, testPrefix)
+		unset()
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%s: Parse() error = %v, wanted %s", test.name, err,
+				test.error)
+		}
+	}
+
+	f := newTestFlags()
+	err = Parse(f.fs, []string{"-config", filepath.Join(dir, "missing")},
+		testPrefix)
+	if err == nil || !strings.Contains(err.Error(), "error reading config") {
+		t.Errorf("Parse() of missing file error = %v, wanted error reading "+
+			"config", err)
+	}
+}
+
+func TestParseConfigFromEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := writeConfig(t, dir, `name = "file"`)
+	unset := setEnv(t, map[string]string{"CONFIGTEST_CONFIG": path})
+	defer unset()
+
+	f := newTestFlags()
+	if err := Parse(f.fs, nil, testPrefix); err != nil {
+		t.Fatalf("Parse() error: %s", err)
+	}
+	if *f.name != "file" {
+		t.Errorf("name = %q, wanted file", *f.name)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   string
+		output string
+	}{
+		{"YORICK", "token", "YORICK_TOKEN"},
+		{"HORATIO", "log-level", "HORATIO_LOG_LEVEL"},
+		{"YORICK", "plugin-settings", "YORICK_PLUGIN_SETTINGS"},
+	}
+
+	for _, test := range tests {
+		if got := EnvName(test.prefix, test.name); got != test.output {
+			t.Errorf("EnvName(%s, %s) = %s, wanted %s", test.prefix, test.name,
+				got, test.output)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// kind is the type of a value in a config file.
+type kind int
+
+const (
+	kindString kind = iota
+	kindInteger
+	kindBoolean
+	kindArray
+)
+
+// String returns the kind's name for use in errors.
+func (k kind) String() string {
+	switch k {
+	case kindString:
+		return "a string"
+	case kindInteger:
+		return "an integer"
+	case kindBoolean:
+		return "a boolean"
+	case kindArray:
+		return "an array"
+	default:
+		return fmt.Sprintf("kind(%d)", int(k))
+	}
+}
+
+// value is a setting's value from a config file.
+type value struct {
+	kind kind
+
+	// The value as text. For strings it's unquoted. For integers and booleans
+	// it's as written.
+	text string
+
+	// Arrays only. Arrays hold strings.
+	items []string
+
+	// Line the setting is on, for errors.
+	line int
+}
+
+// parser parses the subset of TOML we support: key = value pairs with string,
+// integer, boolean, and string array values, and comments. There are no
+// tables.
+//
+// See https://toml.io/en/v1.0.0
+type parser struct {
+	input string
+	pos   int
+	line  int
+}
+
+// parse parses a config file's contents. It returns the settings keyed by
+// name.
+func parse(input string) (map[string]value, error) {
+	p := &parser{input: input, line: 1}
+	values := map[string]value{}
+
+	for {
+		p.skipSpaceAndComments(true)
+		if p.done() {
+			return values, nil
+		}
+
+		line := p.line
+
+		if p.peek() == '[' {
+			return nil, fmt.Errorf("line %d: tables are not supported", line)
+		}
+
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		p.skipSpaceAndComments(false)
+		if p.done() || p.peek() != '=' {
+			return nil, fmt.Errorf("line %d: expected = after %s", line, key)
+		}
+		p.pos++
+		p.skipSpaceAndComments(false)
+
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %s", line, key, err)
+		}
+		v.line = line
+
+		if err := p.endLine(); err != nil {
+			return nil, fmt.Errorf("line %d: %s", p.line, err)
+		}
+
+		if prev, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: %s is already set on line %d", line,
+				key, prev.line)
+		}
+		values[key] = v
+	}
+}
+
+// done returns whether we parsed all of the input.
+func (p *parser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+// peek returns the next byte without consuming it. The caller must check we're
+// not done.
+func (p *parser) peek() byte {
+	return p.input[p.pos]
+}
+
+// skipSpaceAndComments skips spaces, tabs, and comments. If newlines is true
+// it skips newlines too.
+func (p *parser) skipSpaceAndComments(newlines bool) {
+	for !p.done() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.done() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// endLine consumes the rest of the line after a value. Only a comment may
+// follow it.
+func (p *parser) endLine() error {
+	p.skipSpaceAndComments(false)
+	if p.done() {
+		return nil
+	}
+	if p.peek() != '\n' {
+		return fmt.Errorf("unexpected %q after value", p.peek())
+	}
+	p.pos++
+	p.line++
+	return nil
+}
+
+// parseKey parses a bare key such as log-level.
+func (p *parser) parseKey() (string, error) {
+	start := p.pos
+	for !p.done() && isKeyByte(p.peek()) {
+		p.pos++
+	}
+	if p.pos == start {
+		if p.peek() == '"' || p.peek() == '\'' {
+			return "", fmt.Errorf("quoted keys are not supported")
+		}
+		return "", fmt.Errorf("expected a key but found %q", p.peek())
+	}
+	if !p.done() && p.peek() == '.' {
+		return "", fmt.Errorf("dotted keys are not supported")
+	}
+	return p.input[start:p.pos], nil
+}
+
+// isKeyByte returns whether c may be in a bare key.
+func isKeyByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '_'
+}
+
+// parseValue parses a value.
+func (p *parser) parseValue() (value, error) {
+	if p.done() || p.peek() == '\n' {
+		return value{}, fmt.Errorf("missing value")
+	}
+
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		s, err := p.parseString()
+		if err != nil {
+			return value{}, err
+		}
+		return value{kind: kindString, text: s}, nil
+	case c == '[':
+		items, err := p.parseArray()
+		if err != nil {
+			return value{}, err
+		}
+		return value{kind: kindArray, items: items}, nil
+	}
+
+	start := p.pos
+	for !p.done() && isKeyByte(p.peek()) || !p.done() && p.peek() == '+' {
+		p.pos++
+	}
+	text := p.input[start:p.pos]
+
+	if text == "true" || text == "false" {
+		return value{kind: kindBoolean, text: text}, nil
+	}
+
+	n, err := strconv.ParseInt(strings.Replace(text, "_", "", -1), 10, 64)
+	if err != nil || strings.HasPrefix(text, "_") ||
+		strings.HasSuffix(text, "_") {
+		if text == "" {
+			return value{}, fmt.Errorf("invalid value starting with %q",
+				p.peek())
+		}
+		return value{}, fmt.Errorf("invalid value: %s", text)
+	}
+	return value{kind: kindInteger, text: strconv.FormatInt(n, 10)}, nil
+}
+
+// parseString parses a basic ("...") or literal ('...') string on one line.
+func (p *parser) parseString() (string, error) {
+	quote := p.peek()
+	start := p.pos
+	p.pos++
+
+	for {
+		if p.done() || p.peek() == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		if c == '\\' && quote == '"' {
+			if p.done() {
+				return "", fmt.Errorf("unterminated string")
+			}
+			p.pos++
+			continue
+		}
+		if c == quote {
+			break
+		}
+	}
+
+	raw := p.input[start:p.pos]
+	if quote == '\'' {
+		return raw[1 : len(raw)-1], nil
+	}
+
+	// TOML's escapes are a subset of Go's, other than \e and \UXXXXXXXX
+	// which work the same.
+	s, err := strconv.Unquote(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid string: %s", raw)
+	}
+	return s, nil
+}
+
+// parseArray parses an array of strings. It may span lines and have a
+// trailing comma.
+func (p *parser) parseArray() ([]string, error) {
+	p.pos++
+	items := []string{}
+
+	for {
+		p.skipSpaceAndComments(true)
+		if p.done() {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return items, nil
+		}
+
+		if c := p.peek(); c != '"' && c != '\'' {
+			return nil, fmt.Errorf("arrays may only hold strings")
+		}
+		s, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+
+		p.skipSpaceAndComments(true)
+		if p.done() {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, fmt.Errorf("expected , or ] in array but found %q",
+				p.peek())
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input  string
+		output map[string]value
+	}{
+		{"", map[string]value{}},
+		{"# Just a comment\n\n", map[string]value{}},
+
+		// Strings.
+		{`token = "xoxb-1"`, map[string]value{
+			"token": {kind: kindString, text: "xoxb-1", line: 1},
+		}},
+		{`a = "tab\there \"quoted\" \u00e9"`, map[string]value{
+			"a": {kind: kindString, text: "tab\there \"quoted\" é", line: 1},
+		}},
+		{`a = 'C:\path # not a comment'`, map[string]value{
+			"a": {kind: kindString, text: `C:\path # not a comment`, line: 1},
+		}},
+		{`a = ""`, map[string]value{
+			"a": {kind: kindString, text: "", line: 1},
+		}},
+
+		// Integers.
+		{"port = 8080", map[string]value{
+			"port": {kind: kindInteger, text: "8080", line: 1},
+		}},
+		{"a = 1_000\nb = +5\nc = -3", map[string]value{
+			"a": {kind: kindInteger, text: "1000", line: 1},
+			"b": {kind: kindInteger, text: "5", line: 2},
+			"c": {kind: kindInteger, text: "-3", line: 3},
+		}},
+
+		// Booleans.
+		{"a = true\nb = false", map[string]value{
+			"a": {kind: kindBoolean, text: "true", line: 1},
+			"b": {kind: kindBoolean, text: "false", line: 2},
+		}},
+
+		// Arrays.
+		{`a = []`, map[string]value{
+			"a": {kind: kindArray, items: []string{}, line: 1},
+		}},
+		{`a = ["x", 'y']`, map[string]value{
+			"a": {kind: kindArray, items: []string{"x", "y"}, line: 1},
+		}},
+		{"a = [\n  \"x\", # first\n  \"y\",\n]\nb = 1", map[string]value{
+			"a": {kind: kindArray, items: []string{"x", "y"}, line: 1},
+			"b": {kind: kindInteger, text: "1", line: 5},
+		}},
+
+		// Spacing, comments, and CRLF.
+		{"\n  log-level=\"debug\"   # why\r\nlog_format = 'json'\r\n",
+			map[string]value{
+				"log-level":  {kind: kindString, text: "debug", line: 2},
+				"log_format": {kind: kindString, text: "json", line: 3},
+			}},
+	}
+
+	for _, test := range tests {
+		values, err := parse(test.input)
+		if err != nil {
+			t.Errorf("parse(%q) error: %s", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.output) {
+			t.Errorf("parse(%q) = %+v, wanted %+v", test.input, values,
+				test.output)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		error string
+	}{
+		{"[server]\nport = 1", "line 1: tables are not supported"},
+		{"a = 1\n[[servers]]", "line 2: tables are not supported"},
+		{"server.port = 1", "line 1: dotted keys are not supported"},
+		{`"port" = 1`, "line 1: quoted keys are not supported"},
+		{"a = 1\nb = 2\na = 3", "line 3: a is already set on line 1"},
+		{"a 1", "line 1: expected = after a"},
+		{"a =", "line 1: a: missing value"},
+		{"a = \nb = 1", "line 1: a: missing value"},
+		{`a = "x`, "line 1: a: unterminated string"},
+		{"a = \"x\ny\"", "line 1: a: unterminated string"},
+		{`a = "\q"`, "line 1: a: invalid string"},
+		{"a = yes", "line 1: a: invalid value: yes"},
+		{"a = 1.5", "line 1: unexpected '.' after value"},
+		{"a = _1", "line 1: a: invalid value: _1"},
+		{"a = 1 2", "line 1: unexpected '2' after value"},
+		{"a = = 1", `line 1: a: invalid value starting with '='`},
+		{"a = [1]", "line 1: a: arrays may only hold strings"},
+		{`a = ["x" "y"]`, "line 1: a: expected , or ] in array"},
+		{"a = [\"x\",\n", "line 1: a: unterminated array"},
+		{"= 1", "line 1: expected a key"},
+	}
+
+	for _, test := range tests {
+		_, err := parse(test.input)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("parse(%q) error = %v, wanted %s", test.input, err,
+				test.error)
+		}
+	}
+}
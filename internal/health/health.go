@@ -0,0 +1,97 @@
+// Package health serves liveness and readiness endpoints, typically at
+// /healthz and /readyz, for orchestrators such as Kubernetes.
+//
+// /healthz says whether the process is up. It succeeds as long as we can
+// serve it. /readyz says whether the process can do its job, such as whether
+// it's connected to the services it needs. It runs checks and succeeds only
+// if all of them pass.
+//
+// Both respond with 200 OK on success and 503 Service Unavailable otherwise.
+// The body is plain text. For /readyz it has a line per check.
+package health
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Checker runs readiness checks and serves the endpoints.
+type Checker struct {
+	mutex  sync.Mutex
+	checks []check
+}
+
+// check is a readiness check.
+type check struct {
+	name string
+
+	// f returns nil if the check passes. Otherwise it returns why it didn't.
+	f func() error
+}
+
+// New creates a Checker with no checks. With no checks we're always ready.
+func New() *Checker {
+	return &Checker{}
+}
+
+// AddCheck adds a readiness check. f returns nil if the check passes, or an
+// error saying why not. We call f on each request to /readyz, so it must be
+// quick and safe to call concurrently.
+func (c *Checker) AddCheck(name string, f func() error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.checks = append(c.checks, check{name: name, f: f})
+}
+
+// run runs the checks and describes their outcomes, a line per check in the
+// order they were added. It also returns whether they all passed.
+func (c *Checker) run() ([]byte, bool) {
+	c.mutex.Lock()
+	checks := append([]check(nil), c.checks...)
+	c.mutex.Unlock()
+
+	var buf bytes.Buffer
+	ready := true
+
+	for _, ch := range checks {
+		if err := ch.f(); err != nil {
+			ready = false
+			_, _ = fmt.Fprintf(&buf, "%s: %s\n", ch.name, err)
+			continue
+		}
+		_, _ = fmt.Fprintf(&buf, "%s: ok\n", ch.name)
+	}
+
+	return buf.Bytes(), ready
+}
+
+// ServeHealthz serves the liveness endpoint.
+func (c *Checker) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// ServeReadyz serves the readiness endpoint.
+func (c *Checker) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	body, ready := c.run()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(body)
+}
+
+// Mux is something we can serve the endpoints with, such as an
+// *http.ServeMux.
+type Mux interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// Register serves the endpoints at /healthz and /readyz with the mux.
+func (c *Checker) Register(mux Mux) {
+	mux.Handle("/healthz", http.HandlerFunc(c.ServeHealthz))
+	mux.Handle("/readyz", http.HandlerFunc(c.ServeReadyz))
+}
@@ -0,0 +1,69 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// get requests the path from the mux.
+func get(mux *http.ServeMux, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestEndpoints(t *testing.T) {
+	c := New()
+	mux := http.NewServeMux()
+	c.Register(mux)
+
+	// With no checks we're ready.
+	if w := get(mux, "/readyz"); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("/readyz with no checks = %d %q, wanted 200 and no body",
+			w.Code, w.Body.String())
+	}
+
+	var mutex sync.Mutex
+	connected := false
+	c.AddCheck("database", func() error { return nil })
+	c.AddCheck("irc", func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !connected {
+			return fmt.Errorf("not connected")
+		}
+		return nil
+	})
+
+	tests := []struct {
+		connected bool
+		path      string
+		status    int
+		body      string
+	}{
+		{false, "/readyz", http.StatusServiceUnavailable,
+			"database: ok\nirc: not connected\n"},
+		{false, "/healthz", http.StatusOK, "ok\n"},
+		{true, "/readyz", http.StatusOK, "database: ok\nirc: ok\n"},
+		{true, "/healthz", http.StatusOK, "ok\n"},
+	}
+
+	for _, test := range tests {
+		mutex.Lock()
+		connected = test.connected
+		mutex.Unlock()
+
+		w := get(mux, test.path)
+		if w.Code != test.status || w.Body.String() != test.body {
+			t.Errorf("%s with connected %t = %d %q, wanted %d %q", test.path,
+				test.connected, w.Code, w.Body.String(), test.status, test.body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct !=
+			"text/plain; charset=utf-8" {
+			t.Errorf("%s Content-Type = %s, wanted text/plain", test.path, ct)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package irctest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/ircv3"
+)
+
+// Client is a client connected to the server.
+type Client struct {
+	server *Server
+	conn   net.Conn
+
+	writeMutex sync.Mutex
+
+	// The rest are guarded by the server's mutex.
+
+	nick       string
+	user       string
+	registered bool
+
+	// Whether the client started capability negotiation and has not ended it
+	// yet. We hold off on welcoming it until it ends.
+	negotiating bool
+
+	// Capabilities the client enabled.
+	caps map[string]bool
+
+	closed bool
+}
+
+// Nick returns the client's nick. It's blank if the client has not sent one.
+func (c *Client) Nick() string {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	return c.nick
+}
+
+// HasCap returns whether the client enabled the capability.
+func (c *Client) HasCap(name string) bool {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	return c.caps[name]
+}
+
+// Send sends a message to the client. If the message has no prefix, it's
+// from the server.
+func (c *Client) Send(m ircv3.Message) error {
+	if m.Prefix == "" {
+		m.Prefix = c.server.name
+	}
+
+	buf, err := m.Encode()
+	if err != nil {
+		return fmt.Errorf("error encoding message: %s", err)
+	}
+
+	return c.write(buf)
+}
+
+// SendRaw sends a line to the client as is. It need not be valid IRC. We add
+// CRLF if it's missing.
+func (c *Client) SendRaw(line string) error {
+	if !strings.HasSuffix(line, "\n") {
+		line += "\r\n"
+	}
+	return c.write(line)
+}
+
+// write writes to the client's connection.
+func (c *Client) write(s string) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return fmt.Errorf("error setting deadline: %s", err)
+	}
+
+	if _, err := c.conn.Write([]byte(s)); err != nil {
+		return fmt.Errorf("error writing: %s", err)
+	}
+
+	return nil
+}
+
+// Disconnect closes the client's connection without warning.
+func (c *Client) Disconnect() error {
+	c.server.mutex.Lock()
+	c.closed = true
+	c.server.mutex.Unlock()
+
+	if err := c.conn.Close(); err != nil {
+		return fmt.Errorf("error closing connection: %s", err)
+	}
+	return nil
+}
+
+// isClosed returns whether we closed the client's connection.
+func (c *Client) isClosed() bool {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	return c.closed
+}
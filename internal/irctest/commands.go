@@ -0,0 +1,721 @@
+package irctest
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andyjack/court/internal/ircv3"
+)
+
+// Numerics we send.
+const (
+	replyWelcome        = "001"
+	replyYourHost       = "002"
+	replyCreated        = "003"
+	replyMyInfo         = "004"
+	replyUModeIs        = "221"
+	replyChannelModeIs  = "324"
+	replyCreationTime   = "329"
+	replyNoTopic        = "331"
+	replyTopic          = "332"
+	replyInviting       = "341"
+	replyNameReply      = "353"
+	replyEndOfNames     = "366"
+	errNoSuchNick       = "401"
+	errNoSuchChannel    = "403"
+	errCannotSendToChan = "404"
+	errUnknownCommand   = "421"
+	errNoMOTD           = "422"
+	errNoNicknameGiven  = "431"
+	errErroneusNickname = "432"
+	errNicknameInUse    = "433"
+	errUserNotInChannel = "441"
+	errNotOnChannel     = "442"
+	errUserOnChannel    = "443"
+	errNotRegistered    = "451"
+	errNeedMoreParams   = "461"
+	errChanOPrivsNeeded = "482"
+)
+
+// handleCommand is the default handling of a message from a client. The
+// caller must hold the lock.
+func (s *Server) handleCommand(c *Client, m ircv3.Message) {
+	switch m.Command {
+	case "CAP":
+		s.cap(c, m)
+		return
+	case "NICK":
+		s.nick(c, m)
+		return
+	case "USER":
+		s.user(c, m)
+		return
+	case "PING":
+		s.reply(c, "PONG", s.name, param(m, 0))
+		return
+	case "PONG":
+		return
+	case "QUIT":
+		s.quit(c, param(m, 0))
+		c.closed = true
+		_ = c.Send(ircv3.Message{
+			Command: "ERROR",
+			Params:  []string{"Closing link"},
+		})
+		_ = c.conn.Close()
+		return
+	}
+
+	if !c.registered {
+		s.numeric(c, errNotRegistered, "You have not registered")
+		return
+	}
+
+	switch m.Command {
+	case "JOIN":
+		s.joinCommand(c, m)
+	case "PART":
+		s.partCommand(c, m)
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		s.message(c, m)
+	case "MODE":
+		s.mode(c, m)
+	case "TOPIC":
+		s.topic(c, m)
+	case "INVITE":
+		s.invite(c, m)
+	case "KICK":
+		s.kick(c, m)
+	case "NAMES":
+		if len(m.Params) > 0 {
+			if ch, ok := s.channels[strings.ToLower(m.Params[0])]; ok {
+				s.names(c, ch)
+			}
+		}
+	default:
+		s.numeric(c, errUnknownCommand, m.Command, "Unknown command")
+	}
+}
+
+// cap handles capability negotiation.
+//
+// See https://ircv3.net/specs/extensions/capability-negotiation
+func (s *Server) cap(c *Client, m ircv3.Message) {
+	target := c.nick
+	if target == "" {
+		target = "*"
+	}
+
+	switch strings.ToUpper(param(m, 0)) {
+	case "LS":
+		c.negotiating = true
+		var caps []string
+		for name := range s.caps {
+			caps = append(caps, name)
+		}
+		sort.Strings(caps)
+		s.reply(c, "CAP", target, "LS", strings.Join(caps, " "))
+	case "LIST":
+		var caps []string
+		for name := range c.caps {
+			caps = append(caps, name)
+		}
+		sort.Strings(caps)
+		s.reply(c, "CAP", target, "LIST", strings.Join(caps, " "))
+	case "REQ":
+		c.negotiating = true
+		requested := strings.Fields(param(m, 1))
+		for _, name := range requested {
+			if !s.caps[strings.TrimPrefix(name, "-")] {
+				s.reply(c, "CAP", target, "NAK", param(m, 1))
+				return
+			}
+		}
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(c.caps, name[1:])
+				continue
+			}
+			c.caps[name] = true
+		}
+		s.reply(c, "CAP", target, "ACK", param(m, 1))
+	case "END":
+		c.negotiating = false
+		s.maybeWelcome(c)
+	}
+}
+
+// nick handles a client setting or changing its nick.
+func (s *Server) nick(c *Client, m ircv3.Message) {
+	nick := param(m, 0)
+	if nick == "" {
+		s.numeric(c, errNoNicknameGiven, "No nickname given")
+		return
+	}
+
+	if isChannel(nick) || strings.ContainsAny(nick, " ,*?!@") {
+		s.numeric(c, errErroneusNickname, nick, "Erroneous nickname")
+		return
+	}
+
+	if other := s.findClient(nick); other != nil && other != c {
+		s.numeric(c, errNicknameInUse, nick, "Nickname is already in use")
+		return
+	}
+	for _, ch := range s.channels {
+		mem, ok := ch.members[strings.ToLower(nick)]
+		if ok && mem.client == nil {
+			s.numeric(c, errNicknameInUse, nick, "Nickname is already in use")
+			return
+		}
+	}
+
+	if !c.registered {
+		c.nick = nick
+		s.maybeWelcome(c)
+		return
+	}
+
+	// Tell the client and everyone who shares a channel with it.
+	change := ircv3.Message{
+		Prefix:  userMask(c.nick, c.user),
+		Command: "NICK",
+		Params:  []string{nick},
+	}
+	told := map[*Client]bool{c: true}
+	s.deliver(c, change, "")
+	for _, ch := range s.channels {
+		mem, ok := ch.members[strings.ToLower(c.nick)]
+		if !ok {
+			continue
+		}
+		delete(ch.members, strings.ToLower(c.nick))
+		mem.nick = nick
+		ch.members[strings.ToLower(nick)] = mem
+		for _, other := range ch.members {
+			if other.client != nil && !told[other.client] {
+				told[other.client] = true
+				s.deliver(other.client, change, "")
+			}
+		}
+	}
+	c.nick = nick
+}
+
+// user handles the USER command.
+func (s *Server) user(c *Client, m ircv3.Message) {
+	if len(m.Params) < 4 {
+		s.numeric(c, errNeedMoreParams, "USER", "Not enough parameters")
+		return
+	}
+	if c.registered {
+		return
+	}
+	c.user = m.Params[0]
+	s.maybeWelcome(c)
+}
+
+// maybeWelcome completes registration if the client has sent everything we
+// need.
+func (s *Server) maybeWelcome(c *Client) {
+	if c.registered || c.nick == "" || c.user == "" || c.negotiating {
+		return
+	}
+
+	c.registered = true
+
+	s.numeric(c, replyWelcome, "Welcome to the test IRC network "+c.nick)
+	s.numeric(c, replyYourHost, "Your host is "+s.name)
+	s.numeric(c, replyCreated, "This server was created for a test")
+	s.numeric(c, replyMyInfo, s.name, "irctest", "i", "bhiklmnopstv")
+	s.numeric(c, errNoMOTD, "MOTD File is missing")
+}
+
+// joinCommand handles a client joining channels.
+func (s *Server) joinCommand(c *Client, m ircv3.Message) {
+	if len(m.Params) < 1 {
+		s.numeric(c, errNeedMoreParams, "JOIN", "Not enough parameters")
+		return
+	}
+
+	for _, name := range strings.Split(m.Params[0], ",") {
+		if !isChannel(name) {
+			s.numeric(c, errNoSuchChannel, name, "No such channel")
+			continue
+		}
+		s.join(&member{nick: c.nick, client: c}, name)
+	}
+}
+
+// join adds a member to a channel. We create the channel if it doesn't exist.
+// The caller must hold the lock.
+func (s *Server) join(mem *member, name string) {
+	ch, ok := s.channels[strings.ToLower(name)]
+	if !ok {
+		ch = &channel{
+			name:    name,
+			modes:   "+nt",
+			created: time.Now(),
+			members: map[string]*member{},
+		}
+		s.channels[strings.ToLower(name)] = ch
+
+		// Whoever creates a channel is its operator.
+		mem.op = true
+	}
+
+	if _, ok := ch.members[strings.ToLower(mem.nick)]; ok {
+		return
+	}
+	ch.members[strings.ToLower(mem.nick)] = mem
+
+	user := ""
+	if mem.client != nil {
+		user = mem.client.user
+	}
+	s.deliverToChannel(ch, ircv3.Message{
+		Prefix:  userMask(mem.nick, user),
+		Command: "JOIN",
+		Params:  []string{ch.name},
+	}, nil, "")
+
+	if mem.client == nil {
+		return
+	}
+
+	if ch.topic != "" {
+		s.numeric(mem.client, replyTopic, ch.name, ch.topic)
+	}
+	s.names(mem.client, ch)
+}
+
+// names sends a client the members of a channel.
+func (s *Server) names(c *Client, ch *channel) {
+	var nicks []string
+	for _, mem := range ch.members {
+		if mem.op {
+			nicks = append(nicks, "@"+mem.nick)
+			continue
+		}
+		nicks = append(nicks, mem.nick)
+	}
+	sort.Strings(nicks)
+
+	s.numeric(c, replyNameReply, "=", ch.name, strings.Join(nicks, " "))
+	s.numeric(c, replyEndOfNames, ch.name, "End of /NAMES list")
+}
+
+// partCommand handles a client leaving channels.
+func (s *Server) partCommand(c *Client, m ircv3.Message) {
+	if len(m.Params) < 1 {
+		s.numeric(c, errNeedMoreParams, "PART", "Not enough parameters")
+		return
+	}
+
+	for _, name := range strings.Split(m.Params[0], ",") {
+		ch, ok := s.channels[strings.ToLower(name)]
+		if !ok {
+			s.numeric(c, errNoSuchChannel, name, "No such channel")
+			continue
+		}
+		mem, ok := ch.members[strings.ToLower(c.nick)]
+		if !ok {
+			s.numeric(c, errNotOnChannel, name, "You're not on that channel")
+			continue
+		}
+		s.part(mem, ch, param(m, 1))
+	}
+}
+
+// part removes a member from a channel and tells the channel. The caller must
+// hold the lock.
+func (s *Server) part(mem *member, ch *channel, reason string) {
+	params := []string{ch.name}
+	if reason != "" {
+		params = append(params, reason)
+	}
+
+	user := ""
+	if mem.client != nil {
+		user = mem.client.user
+	}
+	s.deliverToChannel(ch, ircv3.Message{
+		Prefix:  userMask(mem.nick, user),
+		Command: "PART",
+		Params:  params,
+	}, nil, "")
+
+	s.removeMember(ch, mem.nick)
+}
+
+// removeMember removes a member from a channel. When a channel is empty, it
+// stops existing.
+func (s *Server) removeMember(ch *channel, nick string) {
+	delete(ch.members, strings.ToLower(nick))
+	if len(ch.members) == 0 {
+		delete(s.channels, strings.ToLower(ch.name))
+	}
+}
+
+// quit removes a client from its channels and tells those who shared them.
+// The caller must hold the lock.
+func (s *Server) quit(c *Client, reason string) {
+	if c.nick == "" {
+		return
+	}
+
+	m := ircv3.Message{
+		Prefix:  userMask(c.nick, c.user),
+		Command: "QUIT",
+		Params:  []string{reason},
+	}
+
+	told := map[*Client]bool{c: true}
+	for _, ch := range s.channels {
+		if _, ok := ch.members[strings.ToLower(c.nick)]; !ok {
+			continue
+		}
+		s.removeMember(ch, c.nick)
+		for _, mem := range ch.members {
+			if mem.client != nil && !told[mem.client] {
+				told[mem.client] = true
+				s.deliver(mem.client, m, "")
+			}
+		}
+	}
+}
+
+// message handles PRIVMSG, NOTICE, and TAGMSG. We send the message to the
+// members of the channel or to the nick.
+func (s *Server) message(c *Client, m ircv3.Message) {
+	if len(m.Params) < 1 || (m.Command != "TAGMSG" && len(m.Params) < 2) {
+		s.numeric(c, errNeedMoreParams, m.Command, "Not enough parameters")
+		return
+	}
+
+	// Only client-only tags pass through the server.
+	tags := map[string]string{}
+	for k, v := range m.Tags {
+		if strings.HasPrefix(k, "+") {
+			tags[k] = v
+		}
+	}
+
+	out := ircv3.Message{
+		Tags:    tags,
+		Prefix:  userMask(c.nick, c.user),
+		Command: m.Command,
+		Params:  m.Params,
+	}
+
+	target := m.Params[0]
+
+	if isChannel(target) {
+		ch, ok := s.channels[strings.ToLower(target)]
+		if !ok {
+			if m.Command != "NOTICE" {
+				s.numeric(c, errNoSuchChannel, target, "No such channel")
+			}
+			return
+		}
+		if _, ok := ch.members[strings.ToLower(c.nick)]; !ok {
+			if m.Command != "NOTICE" {
+				s.numeric(c, errCannotSendToChan, target, "Cannot send to channel")
+			}
+			return
+		}
+
+		msgID := s.newMsgID()
+		s.deliverToChannel(ch, out, c, msgID)
+		if c.caps["echo-message"] {
+			s.deliver(c, out, msgID)
+		}
+		return
+	}
+
+	msgID := s.newMsgID()
+	if other := s.findClient(target); other != nil {
+		s.deliver(other, out, msgID)
+		if c.caps["echo-message"] {
+			s.deliver(c, out, msgID)
+		}
+		return
+	}
+
+	// Messages to users the test is acting as go nowhere, but the test can
+	// see them with Received.
+	for _, ch := range s.channels {
+		if _, ok := ch.members[strings.ToLower(target)]; ok {
+			if c.caps["echo-message"] {
+				s.deliver(c, out, msgID)
+			}
+			return
+		}
+	}
+
+	if m.Command != "NOTICE" {
+		s.numeric(c, errNoSuchNick, target, "No such nick/channel")
+	}
+}
+
+// deliverToChannel sends a message to the connected members of a channel
+// other than except, which may be nil. msgID may be blank. The caller must
+// hold the lock.
+func (s *Server) deliverToChannel(
+	ch *channel,
+	m ircv3.Message,
+	except *Client,
+	msgID string,
+) {
+	for _, mem := range ch.members {
+		if mem.client == nil || mem.client == except {
+			continue
+		}
+		s.deliver(mem.client, m, msgID)
+	}
+}
+
+// deliver sends a message to a client. We add the tags the client enabled.
+// The caller must hold the lock.
+func (s *Server) deliver(c *Client, m ircv3.Message, msgID string) {
+	if m.Command == "TAGMSG" && !c.caps["message-tags"] {
+		return
+	}
+
+	tags := map[string]string{}
+	if c.caps["message-tags"] {
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+		if msgID != "" {
+			tags["msgid"] = msgID
+		}
+	}
+	if c.caps["server-time"] {
+		tags["time"] = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	m.Tags = tags
+	_ = c.Send(m)
+}
+
+// mode handles MODE. We answer queries about channel modes and let operators
+// set flag modes.
+func (s *Server) mode(c *Client, m ircv3.Message) {
+	if len(m.Params) < 1 {
+		s.numeric(c, errNeedMoreParams, "MODE", "Not enough parameters")
+		return
+	}
+
+	target := m.Params[0]
+	if !isChannel(target) {
+		s.numeric(c, replyUModeIs, "+i")
+		return
+	}
+
+	ch, ok := s.channels[strings.ToLower(target)]
+	if !ok {
+		s.numeric(c, errNoSuchChannel, target, "No such channel")
+		return
+	}
+
+	if len(m.Params) == 1 {
+		s.numeric(c, replyChannelModeIs, ch.name, ch.modes)
+		s.numeric(c, replyCreationTime, ch.name,
+			strconv.FormatInt(ch.created.Unix(), 10))
+		return
+	}
+
+	mem, ok := ch.members[strings.ToLower(c.nick)]
+	if !ok || !mem.op {
+		s.numeric(c, errChanOPrivsNeeded, ch.name,
+			"You're not channel operator")
+		return
+	}
+
+	ch.modes = applyModes(ch.modes, m.Params[1])
+	s.deliverToChannel(ch, ircv3.Message{
+		Prefix:  userMask(c.nick, c.user),
+		Command: "MODE",
+		Params:  m.Params,
+	}, nil, "")
+}
+
+// applyModes applies changes such as +s-n to modes such as +nt. We only track
+// flag modes. We ignore modes that take arguments.
+func applyModes(modes, changes string) string {
+	set := map[rune]bool{}
+	for _, r := range strings.TrimPrefix(modes, "+") {
+		set[r] = true
+	}
+
+	adding := true
+	for _, r := range changes {
+		switch r {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		case 'b', 'k', 'l', 'o', 'v':
+		default:
+			if adding {
+				set[r] = true
+			} else {
+				delete(set, r)
+			}
+		}
+	}
+
+	var flags []string
+	for r := range set {
+		flags = append(flags, string(r))
+	}
+	sort.Strings(flags)
+	return "+" + strings.Join(flags, "")
+}
+
+// topic handles TOPIC. Members can see and set the topic.
+func (s *Server) topic(c *Client, m ircv3.Message) {
+	if len(m.Params) < 1 {
+		s.numeric(c, errNeedMoreParams, "TOPIC", "Not enough parameters")
+		return
+	}
+
+	ch, ok := s.channels[strings.ToLower(m.Params[0])]
+	if !ok {
+		s.numeric(c, errNoSuchChannel, m.Params[0], "No such channel")
+		return
+	}
+
+	if _, ok := ch.members[strings.ToLower(c.nick)]; !ok {
+		s.numeric(c, errNotOnChannel, ch.name, "You're not on that channel")
+		return
+	}
+
+	if len(m.Params) == 1 {
+		if ch.topic == "" {
+			s.numeric(c, replyNoTopic, ch.name, "No topic is set")
+			return
+		}
+		s.numeric(c, replyTopic, ch.name, ch.topic)
+		return
+	}
+
+	ch.topic = m.Params[1]
+	s.deliverToChannel(ch, ircv3.Message{
+		Prefix:  userMask(c.nick, c.user),
+		Command: "TOPIC",
+		Params:  []string{ch.name, ch.topic},
+	}, nil, "")
+}
+
+// invite handles INVITE.
+func (s *Server) invite(c *Client, m ircv3.Message) {
+	if len(m.Params) < 2 {
+		s.numeric(c, errNeedMoreParams, "INVITE", "Not enough parameters")
+		return
+	}
+	nick, name := m.Params[0], m.Params[1]
+
+	other := s.findClient(nick)
+	if other == nil {
+		s.numeric(c, errNoSuchNick, nick, "No such nick/channel")
+		return
+	}
+
+	if ch, ok := s.channels[strings.ToLower(name)]; ok {
+		if _, ok := ch.members[strings.ToLower(c.nick)]; !ok {
+			s.numeric(c, errNotOnChannel, ch.name, "You're not on that channel")
+			return
+		}
+		if _, ok := ch.members[strings.ToLower(nick)]; ok {
+			s.numeric(c, errUserOnChannel, nick, ch.name,
+				"is already on channel")
+			return
+		}
+	}
+
+	s.numeric(c, replyInviting, other.nick, name)
+	_ = other.Send(ircv3.Message{
+		Prefix:  userMask(c.nick, c.user),
+		Command: "INVITE",
+		Params:  []string{other.nick, name},
+	})
+}
+
+// kick handles KICK. Only operators may kick.
+func (s *Server) kick(c *Client, m ircv3.Message) {
+	if len(m.Params) < 2 {
+		s.numeric(c, errNeedMoreParams, "KICK", "Not enough parameters")
+		return
+	}
+	name, nick := m.Params[0], m.Params[1]
+
+	ch, ok := s.channels[strings.ToLower(name)]
+	if !ok {
+		s.numeric(c, errNoSuchChannel, name, "No such channel")
+		return
+	}
+
+	mem, ok := ch.members[strings.ToLower(c.nick)]
+	if !ok {
+		s.numeric(c, errNotOnChannel, ch.name, "You're not on that channel")
+		return
+	}
+	if !mem.op {
+		s.numeric(c, errChanOPrivsNeeded, ch.name,
+			"You're not channel operator")
+		return
+	}
+
+	victim, ok := ch.members[strings.ToLower(nick)]
+	if !ok {
+		s.numeric(c, errUserNotInChannel, nick, ch.name,
+			"They aren't on that channel")
+		return
+	}
+
+	reason := param(m, 2)
+	if reason == "" {
+		reason = c.nick
+	}
+	s.deliverToChannel(ch, ircv3.Message{
+		Prefix:  userMask(c.nick, c.user),
+		Command: "KICK",
+		Params:  []string{ch.name, victim.nick, reason},
+	}, nil, "")
+	s.removeMember(ch, victim.nick)
+}
+
+// numeric sends a numeric reply to a client. The client's nick is the first
+// parameter.
+func (s *Server) numeric(c *Client, numeric string, params ...string) {
+	target := c.nick
+	if target == "" {
+		target = "*"
+	}
+	s.reply(c, numeric, append([]string{target}, params...)...)
+}
+
+// reply sends a message from the server to a client.
+func (s *Server) reply(c *Client, command string, params ...string) {
+	_ = c.Send(ircv3.Message{
+		Prefix:  s.name,
+		Command: command,
+		Params:  params,
+	})
+}
+
+// param returns the message's parameter at the index. It's blank if there is
+// none.
+func param(m ircv3.Message, i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
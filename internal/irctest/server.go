@@ -0,0 +1,529 @@
+// Package irctest provides an IRC server to use in tests. It runs in the
+// test's process and listens on a random local port, so tests need no real
+// IRC server.
+//
+// It implements enough of IRC for our programs: registration, capability
+// negotiation, JOIN, PART, PRIVMSG, NOTICE, TAGMSG, PING, MODE, TOPIC,
+// INVITE, KICK, NAMES, and QUIT.
+//
+// Tests can change how it behaves. They can replace how it handles a command,
+// for example to reply with an error numeric, and they can inject faults
+// such as disconnects and slow reads. Tests can also act as users who are not
+// connected: such users can join channels and send messages.
+package irctest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyjack/court/internal/ircv3"
+)
+
+// Server is an IRC server for tests.
+type Server struct {
+	name     string
+	listener net.Listener
+
+	// We process one message at a time while holding the mutex. This keeps the
+	// server simple.
+	mutex sync.Mutex
+
+	clients  map[*Client]struct{}
+	channels map[string]*channel
+
+	// Capabilities we offer.
+	caps map[string]bool
+
+	// Handlers that replace the default handling of commands, keyed by command.
+	handlers map[string]HandlerFunc
+
+	// How long to wait before processing each message a client sends.
+	readDelay time.Duration
+
+	// Every message clients sent us, in order.
+	received []ircv3.Message
+
+	// Closed and replaced whenever we receive a message. Waiters use it to
+	// find out there is something new.
+	receivedChan chan struct{}
+
+	// Used to create message IDs.
+	msgIDCounter int
+
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// HandlerFunc handles a message from a client instead of the server's default
+// handling. It returns false to have the server handle the message as usual
+// after all.
+//
+// The message's prefix is the client's nick!user@host.
+type HandlerFunc func(c *Client, m ircv3.Message) bool
+
+// channel is a channel on the server.
+type channel struct {
+	name    string
+	topic   string
+	modes   string
+	created time.Time
+
+	// Keyed by lowercased nick.
+	members map[string]*member
+}
+
+// member is a user in a channel. It's a connected client or a user the test
+// is acting as.
+type member struct {
+	nick   string
+	client *Client
+	op     bool
+}
+
+// serverName is the name the server uses for itself.
+const serverName = "irc.test"
+
+// How long we wait for a write to a client before giving up. A client that
+// does not read should not hang the test.
+var writeTimeout = 10 * time.Second
+
+// NewServer starts a server listening on a random port on the loopback
+// interface. Close it when you are done with it.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("error listening: %s", err)
+	}
+
+	s := &Server{
+		name:         serverName,
+		listener:     ln,
+		clients:      map[*Client]struct{}{},
+		channels:     map[string]*channel{},
+		caps:         map[string]bool{},
+		handlers:     map[string]HandlerFunc{},
+		receivedChan: make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// Name returns the server's name. It's the prefix of messages from the
+// server.
+func (s *Server) Name() string {
+	return s.name
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Host returns the host the server listens on.
+func (s *Server) Host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the server. It disconnects all clients.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for c := range s.clients {
+		_ = c.conn.Close()
+	}
+	s.mutex.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	if err != nil {
+		return fmt.Errorf("error closing listener: %s", err)
+	}
+	return nil
+}
+
+// SetCaps sets the IRCv3 capabilities the server offers, such as
+// message-tags. It offers none by default.
+//
+// The server sends server-time, msgid, and echo-message tags and echoes to
+// clients that enable the matching capabilities.
+func (s *Server) SetCaps(caps ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.caps = map[string]bool{}
+	for _, c := range caps {
+		s.caps[c] = true
+	}
+}
+
+// Handle replaces the handling of a command, such as JOIN. Set a nil handler
+// to go back to the default handling.
+func (s *Server) Handle(command string, handler HandlerFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	command = strings.ToUpper(command)
+	if handler == nil {
+		delete(s.handlers, command)
+		return
+	}
+	s.handlers[command] = handler
+}
+
+// Script makes the server reply to a command with the given lines instead of
+// handling it. In the lines, $nick is the client's nick, $server is the
+// server's name, and $1 through $9 are the command's parameters.
+//
+// For example, to refuse all joins:
+//
+//	s.Script("JOIN", ":$server 474 $nick $1 :Cannot join channel (+b)")
+func (s *Server) Script(command string, lines ...string) {
+	s.Handle(command, func(c *Client, m ircv3.Message) bool {
+		for _, line := range lines {
+			line = expandScript(line, s.name, c.Nick(), m.Params)
+			if err := c.SendRaw(line); err != nil {
+				return true
+			}
+		}
+		return true
+	})
+}
+
+// expandScript replaces the variables in a scripted line.
+func expandScript(line, server, nick string, params []string) string {
+	for i := 9; i >= 1; i-- {
+		value := ""
+		if i <= len(params) {
+			value = params[i-1]
+		}
+		line = strings.Replace(line, "$"+strconv.Itoa(i), value, -1)
+	}
+	line = strings.Replace(line, "$nick", nick, -1)
+	line = strings.Replace(line, "$server", server, -1)
+	return line
+}
+
+// SetReadDelay makes the server wait this long before processing each message
+// a client sends. This simulates a slow or lagged server.
+func (s *Server) SetReadDelay(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.readDelay = d
+}
+
+// Client returns the connected client with the nick, if there is one.
+func (s *Server) Client(nick string) (*Client, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := s.findClient(nick)
+	return c, c != nil
+}
+
+// WaitForClient waits until a client registers with the nick.
+func (s *Server) WaitForClient(
+	nick string,
+	timeout time.Duration,
+) (*Client, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mutex.Lock()
+		c := s.findClient(nick)
+		registered := c != nil && c.registered
+		ch := s.receivedChan
+		s.mutex.Unlock()
+
+		if registered {
+			return c, nil
+		}
+
+		select {
+		case <-ch:
+		case <-time.After(time.Until(deadline)):
+			return nil, fmt.Errorf("timed out waiting for %s to register", nick)
+		}
+	}
+}
+
+// DisconnectAll closes the connections of all clients without warning.
+func (s *Server) DisconnectAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.clients {
+		_ = c.conn.Close()
+	}
+}
+
+// Received returns every message clients sent, in order. Each message's prefix
+// is its sender's nick!user@host.
+func (s *Server) Received() []ircv3.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]ircv3.Message(nil), s.received...)
+}
+
+// WaitFor waits for a client to send a message that matches. It looks at
+// messages we received before it was called too.
+func (s *Server) WaitFor(
+	match func(ircv3.Message) bool,
+	timeout time.Duration,
+) (ircv3.Message, error) {
+	deadline := time.Now().Add(timeout)
+	next := 0
+	for {
+		s.mutex.Lock()
+		received := s.received[next:]
+		next = len(s.received)
+		ch := s.receivedChan
+		s.mutex.Unlock()
+
+		for _, m := range received {
+			if match(m) {
+				return m, nil
+			}
+		}
+
+		select {
+		case <-ch:
+		case <-time.After(time.Until(deadline)):
+			return ircv3.Message{}, fmt.Errorf("timed out waiting for message")
+		}
+	}
+}
+
+// Join makes a user the test is acting as join a channel. We tell the
+// channel's members.
+func (s *Server) Join(nick, channelName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if c := s.findClient(nick); c != nil {
+		return fmt.Errorf("%s is a connected client", nick)
+	}
+
+	if !isChannel(channelName) {
+		return fmt.Errorf("invalid channel name: %s", channelName)
+	}
+
+	s.join(&member{nick: nick}, channelName)
+	return nil
+}
+
+// Part makes a user the test is acting as leave a channel. We tell the
+// channel's members.
+func (s *Server) Part(nick, channelName, reason string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ch, ok := s.channels[strings.ToLower(channelName)]
+	if !ok {
+		return fmt.Errorf("no such channel: %s", channelName)
+	}
+
+	m, ok := ch.members[strings.ToLower(nick)]
+	if !ok {
+		return fmt.Errorf("%s is not in %s", nick, channelName)
+	}
+
+	s.part(m, ch, reason)
+	return nil
+}
+
+// Say sends a PRIVMSG from a user the test is acting as. The target is a
+// channel or a nick.
+func (s *Server) Say(nick, target, text string) error {
+	return s.Inject(ircv3.Message{
+		Prefix:  nick,
+		Command: "PRIVMSG",
+		Params:  []string{target, text},
+	})
+}
+
+// Inject delivers a message as if the server or a user the test is acting as
+// sent it. The first parameter is the target: a channel or a nick. If the
+// prefix is a nick, we expand it to nick!user@host. If it's blank, the
+// message is from the server.
+//
+// Messages to a channel go to all of its connected members. They get tags
+// such as server-time if they enabled them.
+func (s *Server) Inject(m ircv3.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if m.Prefix == "" {
+		m.Prefix = s.name
+	} else if !strings.Contains(m.Prefix, "!") && m.Prefix != s.name {
+		m.Prefix = userMask(m.Prefix, m.Prefix)
+	}
+
+	if len(m.Params) == 0 {
+		return fmt.Errorf("message has no target")
+	}
+	target := m.Params[0]
+
+	if isChannel(target) {
+		ch, ok := s.channels[strings.ToLower(target)]
+		if !ok {
+			return fmt.Errorf("no such channel: %s", target)
+		}
+		s.deliverToChannel(ch, m, nil, s.newMsgID())
+		return nil
+	}
+
+	c := s.findClient(target)
+	if c == nil {
+		return fmt.Errorf("no such client: %s", target)
+	}
+	s.deliver(c, m, s.newMsgID())
+	return nil
+}
+
+// accept accepts connections until the listener closes.
+func (s *Server) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &Client{
+			server: s,
+			conn:   conn,
+			caps:   map[string]bool{},
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.clients[c] = struct{}{}
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go s.read(c)
+	}
+}
+
+// read reads and handles messages from a client until it disconnects.
+func (s *Server) read(c *Client) {
+	defer s.wg.Done()
+	defer s.removeClient(c)
+
+	br := bufio.NewReader(c.conn)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		delay := s.readDelay
+		s.mutex.Unlock()
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		m, err := ircv3.ParseMessage(line)
+		if err != nil {
+			// Real servers ignore lines they can't parse.
+			continue
+		}
+
+		s.handle(c, m)
+
+		if c.isClosed() {
+			return
+		}
+	}
+}
+
+// handle handles a message from a client.
+func (s *Server) handle(c *Client, m ircv3.Message) {
+	m.Command = strings.ToUpper(m.Command)
+
+	s.mutex.Lock()
+	m.Prefix = ""
+	if c.nick != "" {
+		m.Prefix = userMask(c.nick, c.user)
+	}
+	s.received = append(s.received, m)
+	close(s.receivedChan)
+	s.receivedChan = make(chan struct{})
+	handler, ok := s.handlers[m.Command]
+	s.mutex.Unlock()
+
+	// Call handlers without the lock so they can use the server.
+	if ok && handler(c, m) {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handleCommand(c, m)
+}
+
+// removeClient forgets a client that disconnected. We tell those in its
+// channels it quit unless it already told us.
+func (s *Server) removeClient(c *Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_ = c.conn.Close()
+
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+	delete(s.clients, c)
+
+	s.quit(c, "Connection closed")
+
+	// Let waiters see the client is gone.
+	close(s.receivedChan)
+	s.receivedChan = make(chan struct{})
+}
+
+// findClient finds the registered client with the nick. The caller must hold
+// the lock.
+func (s *Server) findClient(nick string) *Client {
+	for c := range s.clients {
+		if c.nick != "" && strings.EqualFold(c.nick, nick) {
+			return c
+		}
+	}
+	return nil
+}
+
+// newMsgID creates a message ID. The caller must hold the lock.
+func (s *Server) newMsgID() string {
+	s.msgIDCounter++
+	return fmt.Sprintf("msg%d", s.msgIDCounter)
+}
+
+// userMask creates a nick!user@host prefix.
+func userMask(nick, user string) string {
+	if user == "" {
+		user = nick
+	}
+	return nick + "!" + user + "@localhost"
+}
+
+// isChannel returns whether the name is a channel name.
+func isChannel(name string) bool {
+	return len(name) > 1 && (name[0] == '#' || name[0] == '&')
+}
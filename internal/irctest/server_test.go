@@ -0,0 +1,140 @@
+package irctest
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andyjack/court/internal/ircv3"
+)
+
+// testTimeout is how long we wait for something to happen.
+const testTimeout = 5 * time.Second
+
+// testConn is a raw connection to the server.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dial connects to the server and registers with the nick.
+func dial(t *testing.T, s *Server, nick string) *testConn {
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("error dialing: %s", err)
+	}
+
+	c := &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.send("NICK " + nick)
+	c.send("USER " + nick + " 0 * :" + nick)
+	c.expect(func(m ircv3.Message) bool { return m.Command == "001" })
+	return c
+}
+
+// send sends a raw line.
+func (c *testConn) send(line string) {
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatalf("error writing: %s", err)
+	}
+}
+
+// expect reads until a message matches and returns it.
+func (c *testConn) expect(match func(ircv3.Message) bool) ircv3.Message {
+	if err := c.conn.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+		c.t.Fatalf("error setting deadline: %s", err)
+	}
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("error reading: %s", err)
+		}
+
+		m, err := ircv3.ParseMessage(line)
+		if err != nil {
+			c.t.Fatalf("error parsing %q: %s", line, err)
+		}
+		if match(m) {
+			return m
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	c := dial(t, s, "bot")
+
+	if _, err := s.WaitForClient("bot", testTimeout); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	c.send("JOIN #test")
+	c.expect(func(m ircv3.Message) bool {
+		return m.Command == "JOIN" && m.SourceNick() == "bot" &&
+			len(m.Params) > 0 && m.Params[0] == "#test"
+	})
+
+	// Users the test acts as join and talk.
+	if err := s.Join("alice", "#test"); err != nil {
+		t.Fatalf("error joining: %s", err)
+	}
+	if err := s.Say("alice", "#test", "hi bot"); err != nil {
+		t.Fatalf("error saying: %s", err)
+	}
+	c.expect(func(m ircv3.Message) bool {
+		return m.Command == "PRIVMSG" && m.SourceNick() == "alice" &&
+			len(m.Params) == 2 && m.Params[1] == "hi bot"
+	})
+
+	// We record what clients send.
+	c.send("PRIVMSG #test :hi alice")
+	m, err := s.WaitFor(func(m ircv3.Message) bool {
+		return m.Command == "PRIVMSG"
+	}, testTimeout)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if m.SourceNick() != "bot" || m.Params[0] != "#test" ||
+		m.Params[1] != "hi alice" {
+		t.Errorf("received %s, wanted bot's PRIVMSG", m)
+	}
+
+	// Scripted replies replace the default handling.
+	s.Script("JOIN", ":$server 474 $nick $1 :Cannot join channel (+b)")
+	c.send("JOIN #banned")
+	c.expect(func(m ircv3.Message) bool {
+		return m.Command == "474" && len(m.Params) > 1 &&
+			m.Params[0] == "bot" && m.Params[1] == "#banned"
+	})
+}
+
+func TestServerDisconnect(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	c := dial(t, s, "bot")
+
+	s.DisconnectAll()
+
+	if err := c.conn.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+		t.Fatalf("error setting deadline: %s", err)
+	}
+	for {
+		if _, err := c.r.ReadString('\n'); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatalf("still connected after DisconnectAll")
+			}
+			break
+		}
+	}
+}
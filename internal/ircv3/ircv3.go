@@ -0,0 +1,286 @@
+// Package ircv3 provides IRC protocol messages with IRCv3 message tags.
+//
+// github.com/horgh/irc handles the rest of the message. We parse and encode
+// the tags section here and leave the prefix, command and parameters to it.
+//
+// See https://ircv3.net/specs/extensions/message-tags
+package ircv3
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// MaxTagLength is the maximum length of the tags section of a message. It
+// includes the leading @ and the trailing space. Tags do not count towards
+// irc.MaxLineLength.
+//
+// This is the limit on what servers send. Clients are limited to 4094 bytes
+// of client-only tags, but we don't distinguish.
+const MaxTagLength = 8191
+
+// Message holds a protocol message with its tags.
+type Message struct {
+	// Tags are IRCv3 message tags. They are optional. The key is the tag's name
+	// including any client-only prefix (+) and vendor (e.g. +draft/react). The
+	// value is unescaped. It is blank for tags without a value.
+	Tags map[string]string
+
+	// Prefix may be blank. It's optional.
+	Prefix string
+
+	// Command is the IRC command. For example, PRIVMSG. It may be a numeric.
+	Command string
+
+	// There are at most 15 parameters.
+	Params []string
+}
+
+func (m Message) String() string {
+	return fmt.Sprintf("Tags%q %s", m.Tags, m.withoutTags())
+}
+
+// SourceNick retrieves the nickname portion of the prefix. It is valid for
+// this to be blank as not all messages have prefixes.
+func (m Message) SourceNick() string {
+	return m.withoutTags().SourceNick()
+}
+
+// withoutTags returns the message as github.com/horgh/irc knows it.
+func (m Message) withoutTags() irc.Message {
+	return irc.Message{Prefix: m.Prefix, Command: m.Command, Params: m.Params}
+}
+
+// ParseMessage parses a protocol message from the client/server. The message
+// should include the trailing CRLF.
+//
+// Tags do not count towards irc.MaxLineLength. As with irc.ParseMessage, if
+// the rest of the line is too long we return the truncated message along with
+// irc.ErrTruncated.
+func ParseMessage(line string) (Message, error) {
+	var tags map[string]string
+
+	if line != "" && line[0] == '@' {
+		var err error
+		tags, line, err = parseTags(line)
+		if err != nil {
+			return Message{}, fmt.Errorf("problem parsing tags: %s", err)
+		}
+	}
+
+	m, err := irc.ParseMessage(line)
+	if err != nil && err != irc.ErrTruncated {
+		return Message{}, err
+	}
+
+	return Message{
+		Tags:    tags,
+		Prefix:  m.Prefix,
+		Command: m.Command,
+		Params:  m.Params,
+	}, err
+}
+
+// parseTags parses out the tags portion of a line.
+//
+// line begins with @. We return the tags and the rest of the line following
+// the space after the tags.
+//
+// We are parsing this:
+// message    =  [ "@" tags SPACE ] [ ":" prefix SPACE ] command [ params ] crlf
+// tags       =  tag *[ ";" tag ]
+// tag        =  key [ "=" escaped_value ]
+//
+// We are lenient about the characters in keys. We only reject those that can't
+// appear anywhere in a message.
+func parseTags(line string) (map[string]string, string, error) {
+	idx := strings.IndexByte(line, ' ')
+	if idx == -1 {
+		return nil, "", fmt.Errorf("no space found")
+	}
+
+	// The limit includes the space.
+	if idx+1 > MaxTagLength {
+		return nil, "", fmt.Errorf("tags are too long: %d bytes", idx+1)
+	}
+
+	tags := map[string]string{}
+	for _, tag := range strings.Split(line[1:idx], ";") {
+		// Permit empty tags. e.g. a trailing ;.
+		if tag == "" {
+			continue
+		}
+
+		key := tag
+		value := ""
+		if eq := strings.IndexByte(tag, '='); eq != -1 {
+			key = tag[:eq]
+			value = unescapeTagValue(tag[eq+1:])
+		}
+
+		if key == "" || key == "+" {
+			return nil, "", fmt.Errorf("tag with zero length key")
+		}
+
+		if strings.ContainsAny(key, "\x00\r\n") {
+			return nil, "", fmt.Errorf("invalid character in tag key: %q", key)
+		}
+
+		tags[key] = value
+	}
+
+	// Be lenient and allow more than one space after the tags.
+	rest := strings.TrimLeft(line[idx:], " ")
+	if rest == "" || rest == "\r\n" || rest == "\n" {
+		return nil, "", fmt.Errorf("malformed message. Tags only")
+	}
+
+	return tags, rest, nil
+}
+
+// unescapeTagValue reverses the escaping of a tag value.
+//
+// A \ followed by a character other than those with escape meanings is the
+// character itself. A trailing \ is dropped.
+func unescapeTagValue(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		if i == len(value) {
+			break
+		}
+
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+
+	return b.String()
+}
+
+// Encode encodes the Message into a raw protocol message string with a
+// trailing CRLF.
+//
+// Tags do not count towards irc.MaxLineLength. As with irc.Message's Encode,
+// if the rest of the message is too long we return as much as we can along
+// with irc.ErrTruncated.
+func (m Message) Encode() (string, error) {
+	s, err := m.withoutTags().Encode()
+	if len(m.Tags) == 0 || (err != nil && err != irc.ErrTruncated) {
+		return s, err
+	}
+
+	tags, tagsErr := encodeTags(m.Tags)
+	if tagsErr != nil {
+		return "", tagsErr
+	}
+
+	return tags + s, err
+}
+
+// encodeTags encodes tags including the leading @ and trailing space. We
+// encode them sorted by key so the result is predictable.
+//
+// The tags must have valid keys and fit in MaxTagLength bytes.
+func encodeTags(tags map[string]string) (string, error) {
+	var keys []string
+	for k := range tags {
+		if !isValidTagKey(k) {
+			return "", fmt.Errorf("invalid tag key: %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := "@"
+	for i, k := range keys {
+		if i > 0 {
+			s += ";"
+		}
+		s += k
+		if tags[k] != "" {
+			s += "=" + escapeTagValue(tags[k])
+		}
+	}
+
+	s += " "
+
+	if len(s) > MaxTagLength {
+		return "", fmt.Errorf("tags are too long: %d bytes", len(s))
+	}
+
+	return s, nil
+}
+
+// isValidTagKey checks a tag key is well formed:
+//
+// key        =  [ client_prefix ] [ vendor '/' ] key_name
+// client_prefix = '+'
+// key_name   =  1*( ALPHA / DIGIT / "-" )
+// vendor     =  host
+func isValidTagKey(key string) bool {
+	key = strings.TrimPrefix(key, "+")
+
+	if idx := strings.LastIndex(key, "/"); idx != -1 {
+		vendor := key[:idx]
+		if vendor == "" {
+			return false
+		}
+		for _, c := range vendor {
+			if !isTagKeyChar(c) && c != '.' {
+				return false
+			}
+		}
+		key = key[idx+1:]
+	}
+
+	if key == "" {
+		return false
+	}
+
+	for _, c := range key {
+		if !isTagKeyChar(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isTagKeyChar says whether c may appear in a tag's key name.
+func isTagKeyChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') || c == '-'
+}
+
+// escapeTagValue escapes characters that may not appear in a tag value.
+func escapeTagValue(value string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		";", "\\:",
+		" ", "\\s",
+		"\r", "\\r",
+		"\n", "\\n",
+	).Replace(value)
+}
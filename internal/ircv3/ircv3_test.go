@@ -0,0 +1,251 @@
+package ircv3
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		input   string
+		tags    map[string]string
+		prefix  string
+		command string
+		params  []string
+		success bool
+	}{
+		{"@id=123 :irc PRIVMSG #test :hi\r\n", map[string]string{"id": "123"},
+			"irc", "PRIVMSG", []string{"#test", "hi"}, true},
+
+		// No tags.
+		{":irc PRIVMSG #test :hi\r\n", nil, "irc", "PRIVMSG",
+			[]string{"#test", "hi"}, true},
+
+		// Tag without a value and a client-only tag.
+		{"@a;+draft/react=x PRIVMSG\r\n",
+			map[string]string{"a": "", "+draft/react": "x"}, "", "PRIVMSG", nil,
+			true},
+
+		// Escaped value.
+		{`@k=a\:b\sc\\d\re\nf PRIVMSG` + "\r\n",
+			map[string]string{"k": "a;b c\\d\re\nf"}, "", "PRIVMSG", nil, true},
+
+		// Unknown escape is the character. Trailing \ is dropped.
+		{`@k=a\bc\ PRIVMSG` + "\r\n", map[string]string{"k": "abc"}, "",
+			"PRIVMSG", nil, true},
+
+		// Trailing ; is permitted, as is more than one space.
+		{"@a=1;  PRIVMSG\r\n", map[string]string{"a": "1"}, "", "PRIVMSG", nil,
+			true},
+
+		// Tags only.
+		{"@a=1\r\n", nil, "", "", nil, false},
+		{"@a=1 \r\n", nil, "", "", nil, false},
+
+		// Zero length key.
+		{"@=1 PRIVMSG\r\n", nil, "", "", nil, false},
+		{"@+=1 PRIVMSG\r\n", nil, "", "", nil, false},
+
+		// The tags section may be up to MaxTagLength bytes including the @ and
+		// the space.
+		{"@a=" + strings.Repeat("x", MaxTagLength-4) + " PRIVMSG\r\n",
+			map[string]string{"a": strings.Repeat("x", MaxTagLength-4)}, "",
+			"PRIVMSG", nil, true},
+		{"@a=" + strings.Repeat("x", MaxTagLength-3) + " PRIVMSG\r\n", nil, "",
+			"", nil, false},
+
+		// The rest of the message must be valid.
+		{"@a=1 :irc\r\n", nil, "", "", nil, false},
+		{"", nil, "", "", nil, false},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMessage(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("ParseMessage(%q) = %s", test.input, err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("ParseMessage(%q) = %s, wanted an error", test.input, m)
+			continue
+		}
+
+		if !tagsEqual(m.Tags, test.tags) || m.Prefix != test.prefix ||
+			m.Command != test.command || !paramsEqual(m.Params, test.params) {
+			t.Errorf("ParseMessage(%q) = %s, wanted tags %q prefix %s "+
+				"command %s params %q", test.input, m, test.tags, test.prefix,
+				test.command, test.params)
+		}
+	}
+}
+
+// Tags don't count towards the line length.
+func TestParseMessageLength(t *testing.T) {
+	text := strings.Repeat("a", 470)
+	m, err := ParseMessage("@account=bob;time=2011-10-19T16:40:51.620Z " +
+		":bob!u@h PRIVMSG #test :" + text + "\r\n")
+	if err != nil {
+		t.Fatalf("ParseMessage() = %s", err)
+	}
+	if m.Tags["account"] != "bob" || m.SourceNick() != "bob" ||
+		m.Params[1] != text {
+		t.Errorf("ParseMessage() = %s", m)
+	}
+
+	m, err = ParseMessage("@a=1 PRIVMSG #test :" + strings.Repeat("a", 600) +
+		"\r\n")
+	if err != irc.ErrTruncated {
+		t.Fatalf("ParseMessage() = %v, wanted %s", err, irc.ErrTruncated)
+	}
+	if m.Tags["a"] != "1" || m.Command != "PRIVMSG" {
+		t.Errorf("ParseMessage() = %s", m)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		input  Message
+		output string
+	}{
+		{
+			Message{
+				Tags:    map[string]string{"b": "2", "a": ""},
+				Command: "PRIVMSG",
+				Params:  []string{"#test", "hi"},
+			},
+			"@a;b=2 PRIVMSG #test hi\r\n",
+		},
+		{
+			Message{
+				Tags:    map[string]string{"+draft/react": "a;b c\\d\r\n"},
+				Command: "TAGMSG",
+				Params:  []string{"#test"},
+			},
+			`@+draft/react=a\:b\sc\\d\r\n TAGMSG #test` + "\r\n",
+		},
+		{
+			Message{
+				Prefix:  "nick!user@host",
+				Command: "PRIVMSG",
+				Params:  []string{"#test", "hi there"},
+			},
+			":nick!user@host PRIVMSG #test :hi there\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		buf, err := test.input.Encode()
+		if err != nil {
+			t.Errorf("Encode(%s) = %s", test.input, err)
+			continue
+		}
+
+		if buf != test.output {
+			t.Errorf("Encode(%s) = %q, wanted %q", test.input, buf, test.output)
+			continue
+		}
+
+		m, err := ParseMessage(buf)
+		if err != nil {
+			t.Errorf("ParseMessage(%q) = %s", buf, err)
+			continue
+		}
+
+		if !tagsEqual(m.Tags, test.input.Tags) {
+			t.Errorf("ParseMessage(%q) got tags %q, wanted %q", buf, m.Tags,
+				test.input.Tags)
+		}
+	}
+}
+
+// Tags don't count towards the line length.
+func TestEncodeLength(t *testing.T) {
+	m := Message{
+		Tags:    map[string]string{"a": strings.Repeat("x", 600)},
+		Command: "PRIVMSG",
+		Params:  []string{"#test", "hi"},
+	}
+	buf, err := m.Encode()
+	if err != nil || !strings.HasSuffix(buf, " PRIVMSG #test hi\r\n") {
+		t.Errorf("Encode(%s) = %q, %v", m, buf, err)
+	}
+
+	m = Message{
+		Tags:    map[string]string{"a": "1"},
+		Command: "PRIVMSG",
+		Params:  []string{"#test", strings.Repeat("x", 600)},
+	}
+	buf, err = m.Encode()
+	if err != irc.ErrTruncated || !strings.HasPrefix(buf, "@a=1 PRIVMSG") ||
+		len(buf) != len("@a=1 ")+irc.MaxLineLength {
+		t.Errorf("Encode(%s) = %q, %v", m, buf, err)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []map[string]string{
+		{"": "1"},
+		{"+": "1"},
+		{"a b": "1"},
+		{"a;b": "1"},
+		{"a=b": "1"},
+		{"/key": "1"},
+		{"example.com/": "1"},
+		{"exa_mple.com/key": "1"},
+		{"a": strings.Repeat("x", MaxTagLength-3)},
+	}
+
+	for _, tags := range tests {
+		m := Message{Tags: tags, Command: "TAGMSG", Params: []string{"#test"}}
+		if buf, err := m.Encode(); err == nil {
+			t.Errorf("Encode(%q) = %q, wanted an error", tags, buf)
+		}
+	}
+
+	// Valid keys, and tags right at the limit.
+	tests = []map[string]string{
+		{"+example.com/some-key": "1"},
+		{"draft/react": "1", "Key2": ""},
+		{"a": strings.Repeat("x", MaxTagLength-4)},
+	}
+
+	for _, tags := range tests {
+		m := Message{Tags: tags, Command: "TAGMSG", Params: []string{"#test"}}
+		if _, err := m.Encode(); err != nil {
+			t.Errorf("Encode(%q) = %s", tags, err)
+		}
+	}
+}
+
+func tagsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if v2, ok := b[k]; !ok || v2 != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func paramsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
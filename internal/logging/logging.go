@@ -0,0 +1,412 @@
+// Package logging provides structured, levelled logging.
+//
+// Each log entry has a time, a level, a message, and fields (key/value
+// pairs). We write entries either in logfmt:
+//
+//	time=2020-01-02T03:04:05.678Z level=info msg="Posted message" channel=C1
+//
+// or as JSON objects, one per line:
+//
+//	{"time":"2020-01-02T03:04:05.678Z","level":"info","msg":"Posted message","channel":"C1"}
+//
+// Loggers can carry fields, such as a request ID, that they add to every
+// entry. We redact secrets from entries so tokens don't end up in logs.
+package logging
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is how important an entry is.
+type Level int
+
+// The levels, from least to most important.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the level's name.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// ParseLevel parses a level's name.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid log level: %s", s)
+	}
+}
+
+// Format is how we write entries.
+type Format int
+
+// The formats.
+const (
+	FormatLogfmt Format = iota
+	FormatJSON
+)
+
+// ParseFormat parses a format's name: logfmt or json.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "logfmt":
+		return FormatLogfmt, nil
+	case "json":
+		return FormatJSON, nil
+	default:
+		return 0, fmt.Errorf("invalid log format: %s", s)
+	}
+}
+
+// Logger writes log entries.
+//
+// Loggers created with With share their parent's output, level, and secrets.
+type Logger struct {
+	out *output
+
+	// Fields to add to every entry, as alternating keys and values.
+	fields []interface{}
+}
+
+// output is where a Logger and the Loggers derived from it write.
+type output struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+
+	// Strings we replace with redacted wherever they appear.
+	secrets []string
+}
+
+// redacted is what we replace secrets with.
+const redacted = "[REDACTED]"
+
+// tokenRE matches Slack tokens, such as xoxb-... and xapp-...
+var tokenRE = regexp.MustCompile(`\bx(?:ox[a-z]|app)-[A-Za-z0-9-]+`)
+
+// secretKeys are substrings of field keys whose values we always redact.
+var secretKeys = []string{"token", "secret", "password", "authorization"}
+
+// New creates a Logger writing entries at the level or above to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		out: &output{
+			w:      w,
+			level:  level,
+			format: format,
+		},
+	}
+}
+
+// With returns a Logger that adds the fields to every entry. keyvals are
+// alternating keys and values.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	if len(keyvals)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Value returns the value of a field the Logger adds to every entry, as a
+// string. It's blank if there is no such field. If there are several, it
+// returns the last.
+func (l *Logger) Value(key string) string {
+	for i := len(l.fields) - 2; i >= 0; i -= 2 {
+		if fmt.Sprint(l.fields[i]) == key {
+			return fmt.Sprint(l.fields[i+1])
+		}
+	}
+	return ""
+}
+
+// AddSecret makes the Logger, its parents, and the Loggers derived from them
+// redact s wherever it appears. Blank strings are ignored.
+func (l *Logger) AddSecret(s string) {
+	if s == "" {
+		return
+	}
+
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	l.out.secrets = append(l.out.secrets, s)
+}
+
+// SetLevel changes the level the Logger, its parents, and the Loggers derived
+// from them write entries at.
+func (l *Logger) SetLevel(level Level) {
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	l.out.level = level
+}
+
+// Enabled returns whether we write entries at the level. It's useful to avoid
+// building fields we would throw away.
+func (l *Logger) Enabled(level Level) bool {
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	return level >= l.out.level
+}
+
+// Debug logs detail that is useful when tracking down a problem.
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.Log(LevelDebug, msg, keyvals...)
+}
+
+// Info logs something happening as usual.
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.Log(LevelInfo, msg, keyvals...)
+}
+
+// Warn logs something unusual that we can carry on from.
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.Log(LevelWarn, msg, keyvals...)
+}
+
+// Error logs a failure.
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.Log(LevelError, msg, keyvals...)
+}
+
+// Fatal logs a failure at the error level and exits.
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.Log(LevelError, msg, keyvals...)
+	os.Exit(1)
+}
+
+// Log logs an entry at the level. keyvals are alternating keys and values.
+// They follow the Logger's own fields.
+func (l *Logger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	fields = append(fields,
+		"time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"level", level.String(),
+		"msg", msg,
+	)
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+
+	var buf bytes.Buffer
+	switch l.out.format {
+	case FormatJSON:
+		l.out.encodeJSON(&buf, fields)
+	default:
+		l.out.encodeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	_, _ = l.out.w.Write(buf.Bytes())
+}
+
+// encodeLogfmt writes fields as logfmt. The caller must hold the lock.
+func (o *output) encodeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		key := o.redact(fmt.Sprint(fields[i]))
+		buf.WriteString(logfmtKey(key))
+		buf.WriteByte('=')
+
+		value := o.valueString(key, fields[i+1])
+		if needsQuoting(value) {
+			buf.WriteString(strconv.Quote(value))
+		} else {
+			buf.WriteString(value)
+		}
+	}
+}
+
+// encodeJSON writes fields as a JSON object. The caller must hold the lock.
+func (o *output) encodeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key := o.redact(fmt.Sprint(fields[i]))
+		writeJSON(buf, key)
+		buf.WriteByte(':')
+
+		switch v := fields[i+1].(type) {
+		case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32,
+			uint64, float32, float64:
+			if isSecretKey(key) {
+				writeJSON(buf, redacted)
+				continue
+			}
+			writeJSON(buf, v)
+		default:
+			writeJSON(buf, o.valueString(key, v))
+		}
+	}
+	buf.WriteByte('}')
+}
+
+// writeJSON writes a value as JSON.
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// valueString turns a field's value into a string and redacts it. The caller
+// must hold the lock.
+func (o *output) valueString(key string, v interface{}) string {
+	if isSecretKey(key) {
+		return redacted
+	}
+
+	var s string
+	switch v := v.(type) {
+	case nil:
+		s = "<nil>"
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprintf("%+v", v)
+	}
+
+	return o.redact(s)
+}
+
+// redact replaces secrets and things that look like tokens in s. The caller
+// must hold the lock.
+func (o *output) redact(s string) string {
+	for _, secret := range o.secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return tokenRE.ReplaceAllString(s, redacted)
+}
+
+// isSecretKey returns whether we always redact the values of fields with the
+// key.
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range secretKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// logfmtKey makes a key safe to use in logfmt.
+func logfmtKey(key string) string {
+	if key == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// needsQuoting returns whether a logfmt value must be quoted.
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' ||
+			!unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writer returns a writer that logs each line written to it as an entry at
+// the level. It's useful to send the output of the standard log package, or
+// of libraries using it, through the Logger:
+//
+//	log.SetFlags(0)
+//	log.SetOutput(logger.Writer(logging.LevelInfo))
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: l, level: level}
+}
+
+// lineWriter is the io.Writer from Logger.Writer.
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+// Write logs each line in p.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"),
+		"\n") {
+		w.logger.Log(w.level, line)
+	}
+	return len(p), nil
+}
+
+// NewRequestID creates a random ID to tie together the log entries about a
+// request.
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,421 @@
+// Package metrics provides counters, gauges, and histograms that we expose in
+// the Prometheus text format, typically at /metrics.
+//
+// Create metrics with a Registry and serve the Registry over HTTP:
+//
+//	registry := metrics.NewRegistry()
+//	requests := registry.NewCounter("app_requests_total",
+//		"Requests received", "method")
+//	http.Handle("/metrics", registry)
+//	...
+//	requests.Inc("GET")
+//
+// Metrics may have labels. Pass a value for each of a metric's labels, in the
+// order the labels were given, when updating it.
+//
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics and writes them out.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]*metric
+}
+
+// metric is a metric with all of its series (one per combination of label
+// values).
+type metric struct {
+	mutex sync.Mutex
+
+	name       string
+	help       string
+	metricType string
+	labels     []string
+
+	// Histograms only. Upper bounds of the buckets, in increasing order. There
+	// is always a +Inf bucket in addition to these.
+	buckets []float64
+
+	// Series keyed by their label values joined with seriesSep.
+	series map[string]*series
+
+	// If set, the metric has no series of its own. We call this when writing
+	// to find its value.
+	valueFunc func() float64
+}
+
+// series is a metric's value for one combination of label values.
+type series struct {
+	labelValues []string
+
+	// Counters and gauges.
+	value float64
+
+	// Histograms. Counts per bucket (not cumulative), including the +Inf
+	// bucket last.
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// seriesSep separates label values in series keys. It won't be in a label
+// value that is valid UTF-8.
+const seriesSep = "\xff"
+
+// DefaultBuckets are histogram buckets suitable for timing things such as
+// HTTP requests, in seconds.
+var DefaultBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+var (
+	nameRE  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// NewRegistry creates a Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: map[string]*metric{},
+	}
+}
+
+// register adds a metric.
+//
+// Registering metrics happens at startup, so mistakes such as an invalid name
+// are bugs. We panic rather than return an error.
+func (r *Registry) register(m *metric) {
+	if !nameRE.MatchString(m.name) {
+		panic(fmt.Sprintf("invalid metric name: %s", m.name))
+	}
+
+	for _, label := range m.labels {
+		if !labelRE.MatchString(label) || label == "le" ||
+			strings.HasPrefix(label, "__") {
+			panic(fmt.Sprintf("invalid label name for %s: %s", m.name, label))
+		}
+	}
+
+	// Metrics without labels have one series. Create it so we report 0 rather
+	// than nothing until it's first updated.
+	if len(m.labels) == 0 && m.valueFunc == nil {
+		m.get(nil)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.metrics[m.name]; ok {
+		panic(fmt.Sprintf("metric already registered: %s", m.name))
+	}
+	r.metrics[m.name] = m
+}
+
+// Counter is a value that only goes up, such as the number of requests we
+// received.
+type Counter struct {
+	m *metric
+}
+
+// NewCounter creates and registers a counter. By convention counters' names
+// end with _total.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	m := &metric{
+		name:       name,
+		help:       help,
+		metricType: "counter",
+		labels:     labels,
+		series:     map[string]*series{},
+	}
+	r.register(m)
+	return &Counter{m: m}
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter. v must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.m.name))
+	}
+
+	c.m.mutex.Lock()
+	defer c.m.mutex.Unlock()
+	c.m.get(labelValues).value += v
+}
+
+// Gauge is a value that can go up and down, such as the length of a queue.
+type Gauge struct {
+	m *metric
+}
+
+// NewGauge creates and registers a gauge.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	m := &metric{
+		name:       name,
+		help:       help,
+		metricType: "gauge",
+		labels:     labels,
+		series:     map[string]*series{},
+	}
+	r.register(m)
+	return &Gauge{m: m}
+}
+
+// NewGaugeFunc creates and registers a gauge without labels whose value comes
+// from calling f. We call f each time we write the metrics, so it must be
+// quick and safe to call concurrently.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&metric{
+		name:       name,
+		help:       help,
+		metricType: "gauge",
+		valueFunc:  f,
+	})
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.mutex.Lock()
+	defer g.m.mutex.Unlock()
+	g.m.get(labelValues).value = v
+}
+
+// Add adds v to the gauge. v may be negative.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.m.mutex.Lock()
+	defer g.m.mutex.Unlock()
+	g.m.get(labelValues).value += v
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Histogram counts observations, such as how long requests take, in buckets.
+type Histogram struct {
+	m *metric
+}
+
+// NewHistogram creates and registers a histogram. buckets are the buckets'
+// upper bounds. If buckets is nil, we use DefaultBuckets.
+func (r *Registry) NewHistogram(
+	name,
+	help string,
+	buckets []float64,
+	labels ...string,
+) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	sorted := make([]float64, 0, len(buckets))
+	for _, b := range buckets {
+		if !math.IsInf(b, 1) {
+			sorted = append(sorted, b)
+		}
+	}
+	sort.Float64s(sorted)
+
+	m := &metric{
+		name:       name,
+		help:       help,
+		metricType: "histogram",
+		labels:     labels,
+		buckets:    sorted,
+		series:     map[string]*series{},
+	}
+	r.register(m)
+	return &Histogram{m: m}
+}
+
+// Observe records an observation, such as how many seconds something took.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.mutex.Lock()
+	defer h.m.mutex.Unlock()
+
+	s := h.m.get(labelValues)
+	i := sort.SearchFloat64s(h.m.buckets, v)
+	s.bucketCounts[i]++
+	s.sum += v
+	s.count++
+}
+
+// get returns the series for the label values, creating it if necessary. The
+// caller must hold the lock.
+//
+// Passing the wrong number of label values is a bug, so we panic.
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels but got %d values", m.name,
+			len(m.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, seriesSep)
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+
+	s := &series{
+		labelValues: append([]string(nil), labelValues...),
+	}
+	if m.metricType == "histogram" {
+		s.bucketCounts = make([]uint64, len(m.buckets)+1)
+	}
+	m.series[key] = s
+	return s
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.Write(w)
+}
+
+// Write writes the metrics in the Prometheus text format. We write metrics
+// sorted by name and their series sorted by label values.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]*metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing metrics: %s", err)
+	}
+	return nil
+}
+
+// write writes the metric and its series.
+func (m *metric) write(w *bufio.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.metricType)
+
+	if m.valueFunc != nil {
+		_, _ = fmt.Fprintf(w, "%s %s\n", m.name, formatValue(m.valueFunc()))
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+
+		if m.metricType != "histogram" {
+			_, _ = fmt.Fprintf(w, "%s%s %s\n", m.name,
+				formatLabels(m.labels, s.labelValues, "", ""),
+				formatValue(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, count := range s.bucketCounts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(m.buckets) {
+				le = formatValue(m.buckets[i])
+			}
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+				formatLabels(m.labels, s.labelValues, "le", le), cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", m.name,
+			formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", m.name,
+			formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// formatLabels formats labels as {name="value",...}. If extraName is not
+// blank, we add it and extraValue last. If there are no labels, it's blank.
+func formatLabels(
+	names,
+	values []string,
+	extraName,
+	extraValue string,
+) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name,
+			escapeLabelValue(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName,
+			escapeLabelValue(extraValue)))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value.
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// escapeHelp escapes a metric's help text.
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// escapeLabelValue escapes a label value.
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
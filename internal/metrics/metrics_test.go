@@ -0,0 +1,266 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// output returns what the registry writes.
+func output(t *testing.T, r *Registry) string {
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatalf("error writing metrics: %s", err)
+	}
+	return buf.String()
+}
+
+// checkOutput checks the registry writes exactly the lines.
+func checkOutput(t *testing.T, r *Registry, lines ...string) {
+	want := strings.Join(lines, "\n") + "\n"
+	if got := output(t, r); got != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", got, want)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("app_requests_total", "Requests received",
+		"method", "code")
+	plain := r.NewCounter("app_errors_total", "Errors")
+
+	requests.Inc("POST", "200")
+	requests.Inc("GET", "200")
+	requests.Add(2.5, "GET", "200")
+	requests.Inc("GET", "404")
+	plain.Inc()
+
+	checkOutput(t, r,
+		"# HELP app_errors_total Errors",
+		"# TYPE app_errors_total counter",
+		"app_errors_total 1",
+		"# HELP app_requests_total Requests received",
+		"# TYPE app_requests_total counter",
+		`app_requests_total{method="GET",code="200"} 3.5`,
+		`app_requests_total{method="GET",code="404"} 1`,
+		`app_requests_total{method="POST",code="200"} 1`,
+	)
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	queue := r.NewGauge("app_queue_length", "Queued jobs", "queue")
+	r.NewGaugeFunc("app_up", "Whether we're up", func() float64 { return 1 })
+	r.NewGaugeFunc("app_limit", "No limit", func() float64 {
+		return math.Inf(1)
+	})
+
+	queue.Set(5, "a")
+	queue.Inc("a")
+	queue.Dec("b")
+	queue.Add(-0.5, "b")
+
+	checkOutput(t, r,
+		"# HELP app_limit No limit",
+		"# TYPE app_limit gauge",
+		"app_limit +Inf",
+		"# HELP app_queue_length Queued jobs",
+		"# TYPE app_queue_length gauge",
+		`app_queue_length{queue="a"} 6`,
+		`app_queue_length{queue="b"} -1.5`,
+		"# HELP app_up Whether we're up",
+		"# TYPE app_up gauge",
+		"app_up 1",
+	)
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	// Out of order and with +Inf, which we add ourselves.
+	h := r.NewHistogram("app_duration_seconds", "How long things took",
+		[]float64{1, math.Inf(1), 0.1}, "method")
+
+	// A value on a bucket's bound is in that bucket.
+	for _, v := range []float64{0.05, 0.1, 0.5, 2, 3} {
+		h.Observe(v, "GET")
+	}
+	h.Observe(0.5, "POST")
+
+	checkOutput(t, r,
+		"# HELP app_duration_seconds How long things took",
+		"# TYPE app_duration_seconds histogram",
+		`app_duration_seconds_bucket{method="GET",le="0.1"} 2`,
+		`app_duration_seconds_bucket{method="GET",le="1"} 3`,
+		`app_duration_seconds_bucket{method="GET",le="+Inf"} 5`,
+		`app_duration_seconds_sum{method="GET"} 5.65`,
+		`app_duration_seconds_count{method="GET"} 5`,
+		`app_duration_seconds_bucket{method="POST",le="0.1"} 0`,
+		`app_duration_seconds_bucket{method="POST",le="1"} 1`,
+		`app_duration_seconds_bucket{method="POST",le="+Inf"} 1`,
+		`app_duration_seconds_sum{method="POST"} 0.5`,
+		`app_duration_seconds_count{method="POST"} 1`,
+	)
+}
+
+func TestHistogramDefaultBuckets(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("app_seconds", "Timing", nil)
+	h.Observe(20)
+
+	out := output(t, r)
+	for _, line := range []string{
+		`app_seconds_bucket{le="0.005"} 0`,
+		`app_seconds_bucket{le="10"} 0`,
+		`app_seconds_bucket{le="+Inf"} 1`,
+		"app_seconds_sum 20",
+		"app_seconds_count 1",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("output doesn't have %q:\n%s", line, out)
+		}
+	}
+	n := strings.Count(out, "app_seconds_bucket")
+	if n != len(DefaultBuckets)+1 {
+		t.Errorf("got %d buckets, wanted %d", n, len(DefaultBuckets)+1)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("app_total", "Help with \\ and\nnewline", "value")
+	c.Inc(`say "hi"`)
+	c.Inc(`back\slash`)
+	c.Inc("two\nlines")
+
+	checkOutput(t, r,
+		`# HELP app_total Help with \\ and\nnewline`,
+		"# TYPE app_total counter",
+		`app_total{value="back\\slash"} 1`,
+		`app_total{value="say \"hi\""} 1`,
+		`app_total{value="two\nlines"} 1`,
+	)
+}
+
+func TestPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func(r *Registry)
+	}{
+		{"too few label values", func(r *Registry) {
+			r.NewCounter("a_total", "", "method").Inc()
+		}},
+		{"too many label values", func(r *Registry) {
+			r.NewGauge("a", "").Set(1, "extra")
+		}},
+		{"histogram label values", func(r *Registry) {
+			r.NewHistogram("a", "", nil, "x", "y").Observe(1, "x")
+		}},
+		{"negative counter", func(r *Registry) {
+			r.NewCounter("a_total", "").Add(-1)
+		}},
+		{"invalid name", func(r *Registry) {
+			r.NewCounter("a-total", "")
+		}},
+		{"invalid label", func(r *Registry) {
+			r.NewCounter("a_total", "", "a-b")
+		}},
+		{"reserved label le", func(r *Registry) {
+			r.NewHistogram("a", "", nil, "le")
+		}},
+		{"reserved label prefix", func(r *Registry) {
+			r.NewGauge("a", "", "__name")
+		}},
+		{"duplicate", func(r *Registry) {
+			r.NewCounter("a_total", "")
+			r.NewGauge("a_total", "")
+		}},
+	}
+
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: didn't panic", test.name)
+				}
+			}()
+			test.f(NewRegistry())
+		}()
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("app_total", "Things").Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, wanted 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+		"text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %s, wanted the text format", ct)
+	}
+	if !strings.Contains(w.Body.String(), "app_total 1\n") {
+		t.Errorf("body = %s, wanted the counter", w.Body.String())
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("app_total", "Things", "worker")
+	h := r.NewHistogram("app_seconds", "Timing", []float64{1})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc(fmt.Sprintf("%d", i%2))
+				h.Observe(0.5)
+			}
+			_ = output(t, r)
+		}(i)
+	}
+	wg.Wait()
+
+	out := output(t, r)
+	for _, line := range []string{
+		`app_total{worker="0"} 500`,
+		`app_total{worker="1"} 500`,
+		`app_seconds_bucket{le="1"} 1000`,
+		"app_seconds_count 1000",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("output doesn't have %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestUnlabelledStartAtZero(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("app_total", "Things")
+	r.NewHistogram("app_seconds", "Timing", []float64{1})
+	r.NewGauge("app_queue_length", "Queued jobs", "queue")
+
+	checkOutput(t, r,
+		"# HELP app_queue_length Queued jobs",
+		"# TYPE app_queue_length gauge",
+		"# HELP app_seconds Timing",
+		"# TYPE app_seconds histogram",
+		`app_seconds_bucket{le="1"} 0`,
+		`app_seconds_bucket{le="+Inf"} 0`,
+		"app_seconds_sum 0",
+		"app_seconds_count 0",
+		"# HELP app_total Things",
+		"# TYPE app_total counter",
+		"app_total 0",
+	)
+}
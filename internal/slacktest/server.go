@@ -0,0 +1,492 @@
+// Package slacktest provides a mock of Slack's Web API to use in tests. It
+// runs in the test's process, so tests of Web API clients need no network
+// and no Slack workspace.
+//
+// The server records every call. Tests can script its responses, including
+// errors and rate limiting, and check which methods were called in which
+// order.
+package slacktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a mock Slack Web API.
+//
+// Without scripting, methods succeed. auth.test and chat.postMessage respond
+// like Slack does. Other methods respond with {"ok": true}.
+type Server struct {
+	server *httptest.Server
+
+	mutex sync.Mutex
+
+	// Tokens we accept. If there are none, we accept any token.
+	tokens map[string]struct{}
+
+	// Every call, in order. This includes calls we rejected because of their
+	// token.
+	calls []Call
+
+	// Closed and replaced whenever there is a call. Waiters use it to find out
+	// there is something new.
+	callsChan chan struct{}
+
+	// Responses to send once, in order, keyed by method.
+	queued map[string][]Response
+
+	// Handlers for methods, keyed by method. We use them when there is no
+	// queued response.
+	handlers map[string]HandlerFunc
+
+	// Used to create message timestamps.
+	tsCounter int
+}
+
+// Call is a request the server received.
+type Call struct {
+	// The method, such as chat.postMessage.
+	Method string
+
+	// The token from the Authorization header or the token argument.
+	Token string
+
+	// The arguments from the JSON body, form, or query string. Values from
+	// forms and query strings are strings.
+	Args map[string]interface{}
+
+	// The request's body.
+	Body []byte
+
+	Time time.Time
+}
+
+// Arg returns the argument as a string. It's blank if there is no such
+// argument.
+func (c Call) Arg(name string) string {
+	v, ok := c.Args[name]
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(buf)
+}
+
+// Response is a scripted response.
+type Response struct {
+	// HTTP status. Zero means 200.
+	Status int
+
+	// Extra headers, such as Retry-After.
+	Header http.Header
+
+	// We send this as JSON. If it's a string or []byte, we send it as is.
+	Body interface{}
+}
+
+// HandlerFunc decides how to respond to a call.
+type HandlerFunc func(call Call) Response
+
+// OK creates a successful response. fields are added to {"ok": true} and may
+// be nil.
+func OK(fields map[string]interface{}) Response {
+	body := map[string]interface{}{"ok": true}
+	for k, v := range fields {
+		body[k] = v
+	}
+	return Response{Body: body}
+}
+
+// Error creates a response with an error such as channel_not_found.
+func Error(code string) Response {
+	return Response{
+		Body: map[string]interface{}{"ok": false, "error": code},
+	}
+}
+
+// RateLimited creates a response telling the client to wait before trying
+// again. This is what Slack does when a client calls a method too often.
+func RateLimited(retryAfter time.Duration) Response {
+	return Response{
+		Status: http.StatusTooManyRequests,
+		Header: http.Header{
+			"Retry-After": []string{
+				strconv.Itoa(int(retryAfter / time.Second)),
+			},
+		},
+		Body: map[string]interface{}{"ok": false, "error": "ratelimited"},
+	}
+}
+
+// NewServer starts a server. Close it when you are done with it.
+func NewServer() *Server {
+	s := &Server{
+		tokens:    map[string]struct{}{},
+		callsChan: make(chan struct{}),
+		queued:    map[string][]Response{},
+		handlers:  map[string]HandlerFunc{},
+	}
+
+	s.handlers["auth.test"] = s.authTest
+	s.handlers["chat.postMessage"] = s.chatPostMessage
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.handler))
+	return s
+}
+
+// URL returns the base URL of the API, such as http://127.0.0.1:1234/api.
+// Methods are at URL/method.
+func (s *Server) URL() string {
+	return s.server.URL + "/api"
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// SetTokens sets the tokens we accept. Calls without a token get a
+// not_authed error and calls with another token get invalid_auth. By default
+// we accept any token.
+func (s *Server) SetTokens(tokens ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tokens = map[string]struct{}{}
+	for _, token := range tokens {
+		s.tokens[token] = struct{}{}
+	}
+}
+
+// Handle sets how to respond to calls to a method.
+func (s *Server) Handle(method string, handler HandlerFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers[method] = handler
+}
+
+// Respond sets the response to all calls to a method.
+func (s *Server) Respond(method string, resp Response) {
+	s.Handle(method, func(Call) Response { return resp })
+}
+
+// Queue adds responses to send to the next calls to a method, one per call.
+// After they are used up we go back to the method's handler.
+//
+// For example, to have the next call be rate limited and the one after
+// succeed:
+//
+//	s.Queue("chat.postMessage", slacktest.RateLimited(time.Second),
+//		slacktest.OK(nil))
+func (s *Server) Queue(method string, resps ...Response) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queued[method] = append(s.queued[method], resps...)
+}
+
+// Calls returns every call, in order.
+func (s *Server) Calls() []Call {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// CallsTo returns the calls to a method, in order.
+func (s *Server) CallsTo(method string) []Call {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var calls []Call
+	for _, c := range s.calls {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the calls so far.
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls = nil
+}
+
+// WaitForCall waits for a call to a method. It counts calls made before it
+// was called too. n is which call to wait for: 1 for the first, 2 for the
+// second, and so on.
+func (s *Server) WaitForCall(
+	method string,
+	n int,
+	timeout time.Duration,
+) (Call, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mutex.Lock()
+		seen := 0
+		for _, c := range s.calls {
+			if c.Method != method {
+				continue
+			}
+			seen++
+			if seen == n {
+				s.mutex.Unlock()
+				return c, nil
+			}
+		}
+		ch := s.callsChan
+		s.mutex.Unlock()
+
+		select {
+		case <-ch:
+		case <-deadline:
+			return Call{}, fmt.Errorf("timed out waiting for call %d to %s",
+				n, method)
+		}
+	}
+}
+
+// CheckCalls checks the methods called, in order, are exactly these. It
+// returns an error describing the difference if not.
+func (s *Server) CheckCalls(methods ...string) error {
+	calls := s.Calls()
+
+	var got []string
+	for _, c := range calls {
+		got = append(got, c.Method)
+	}
+
+	if len(got) != len(methods) {
+		return fmt.Errorf("got calls %v, wanted %v", got, methods)
+	}
+	for i := range got {
+		if got[i] != methods[i] {
+			return fmt.Errorf("got calls %v, wanted %v", got, methods)
+		}
+	}
+	return nil
+}
+
+// CheckCallOrder checks these methods were called in this order. Other calls
+// may come before, after, or between them.
+func (s *Server) CheckCallOrder(methods ...string) error {
+	calls := s.Calls()
+
+	i := 0
+	for _, c := range calls {
+		if i < len(methods) && c.Method == methods[i] {
+			i++
+		}
+	}
+	if i == len(methods) {
+		return nil
+	}
+
+	var got []string
+	for _, c := range calls {
+		got = append(got, c.Method)
+	}
+	return fmt.Errorf("did not see %s after %v in calls %v", methods[i],
+		methods[:i], got)
+}
+
+// handler handles requests to /api/{method}.
+func (s *Server) handler(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	call, err := parseCall(r)
+	if err != nil {
+		writeResponse(w, Error("invalid_form_data"))
+		return
+	}
+
+	s.mutex.Lock()
+	s.calls = append(s.calls, call)
+	close(s.callsChan)
+	s.callsChan = make(chan struct{})
+
+	resp, ok := s.authenticate(call)
+	if !ok {
+		s.mutex.Unlock()
+		writeResponse(w, resp)
+		return
+	}
+
+	if queued := s.queued[call.Method]; len(queued) > 0 {
+		resp = queued[0]
+		s.queued[call.Method] = queued[1:]
+		s.mutex.Unlock()
+		writeResponse(w, resp)
+		return
+	}
+
+	handler, ok := s.handlers[call.Method]
+	s.mutex.Unlock()
+
+	// Call the handler without the lock so it can use the server.
+	if ok {
+		writeResponse(w, handler(call))
+		return
+	}
+	writeResponse(w, OK(nil))
+}
+
+// authenticate checks the call's token. If it's not one we accept, we return
+// the error response to send. The caller must hold the lock.
+func (s *Server) authenticate(call Call) (Response, bool) {
+	if len(s.tokens) == 0 {
+		return Response{}, true
+	}
+	if call.Token == "" {
+		return Error("not_authed"), false
+	}
+	if _, ok := s.tokens[call.Token]; !ok {
+		return Error("invalid_auth"), false
+	}
+	return Response{}, true
+}
+
+// parseCall reads the method and its arguments from a request. Like Slack, we
+// accept a JSON body, a form, or a query string.
+func parseCall(r *http.Request) (Call, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Call{}, fmt.Errorf("error reading body: %s", err)
+	}
+
+	call := Call{
+		Method: strings.TrimPrefix(r.URL.Path, "/api/"),
+		Args:   map[string]interface{}{},
+		Body:   body,
+		Time:   time.Now(),
+	}
+
+	for k := range r.URL.Query() {
+		call.Args[k] = r.URL.Query().Get(k)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/json" && len(body) > 0:
+		var args map[string]interface{}
+		if err := json.Unmarshal(body, &args); err != nil {
+			return Call{}, fmt.Errorf("invalid JSON: %s", err)
+		}
+		for k, v := range args {
+			call.Args[k] = v
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return Call{}, fmt.Errorf("invalid form: %s", err)
+		}
+		for k := range form {
+			call.Args[k] = form.Get(k)
+		}
+	}
+
+	// A blank bearer token arrives as just "Bearer" since trailing space in
+	// header values is dropped.
+	call.Token = strings.TrimSpace(strings.TrimPrefix(
+		r.Header.Get("Authorization"), "Bearer"))
+	if call.Token == "" {
+		call.Token = call.Arg("token")
+	}
+	delete(call.Args, "token")
+
+	return call, nil
+}
+
+// writeResponse writes a response.
+func writeResponse(w http.ResponseWriter, resp Response) {
+	var buf []byte
+	switch body := resp.Body.(type) {
+	case []byte:
+		buf = body
+	case string:
+		buf = []byte(body)
+	default:
+		var err error
+		buf, err = json.Marshal(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(buf)
+}
+
+// authTest responds to auth.test.
+func (s *Server) authTest(call Call) Response {
+	return OK(map[string]interface{}{
+		"url":     "https://test.slack.com/",
+		"team":    "test",
+		"user":    "bot",
+		"team_id": "TTEST",
+		"user_id": "UTEST",
+		"bot_id":  "BTEST",
+	})
+}
+
+// chatPostMessage responds to chat.postMessage. Like Slack, we respond with
+// the message and its timestamp.
+func (s *Server) chatPostMessage(call Call) Response {
+	if call.Arg("channel") == "" {
+		return Error("channel_not_found")
+	}
+	if call.Arg("text") == "" && call.Args["blocks"] == nil {
+		return Error("no_text")
+	}
+
+	s.mutex.Lock()
+	s.tsCounter++
+	ts := fmt.Sprintf("1500000000.%06d", s.tsCounter)
+	s.mutex.Unlock()
+
+	message := map[string]interface{}{
+		"type":    "message",
+		"text":    call.Arg("text"),
+		"user":    "UTEST",
+		"bot_id":  "BTEST",
+		"ts":      ts,
+		"blocks":  call.Args["blocks"],
+		"subtype": "bot_message",
+	}
+
+	return OK(map[string]interface{}{
+		"channel": call.Arg("channel"),
+		"ts":      ts,
+		"message": message,
+	})
+}
@@ -0,0 +1,357 @@
+package slacktest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTimeout is how long we wait for something to happen.
+const testTimeout = 5 * time.Second
+
+// testResponse is what the server sent.
+type testResponse struct {
+	status int
+	header http.Header
+	body   map[string]interface{}
+}
+
+// call calls a method with a JSON body and the token, if it's not blank.
+func call(
+	t *testing.T,
+	s *Server,
+	method,
+	token string,
+	args map[string]interface{},
+) testResponse {
+	buf, err := json.Marshal(args)
+	if err != nil {
+		t.Fatalf("error encoding args: %s", err)
+	}
+
+	req, err := http.NewRequest("POST", s.URL()+"/"+method,
+		strings.NewReader(string(buf)))
+	if err != nil {
+		t.Fatalf("error creating request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return do(t, req)
+}
+
+// do sends a request and decodes the response.
+func do(t *testing.T, req *http.Request) testResponse {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error calling %s: %s", req.URL, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	r := testResponse{status: resp.StatusCode, header: resp.Header}
+	if err := json.NewDecoder(resp.Body).Decode(&r.body); err != nil {
+		t.Fatalf("error decoding response: %s", err)
+	}
+	return r
+}
+
+// checkOK checks a response succeeded.
+func checkOK(t *testing.T, name string, r testResponse) {
+	if r.status != http.StatusOK || r.body["ok"] != true {
+		t.Errorf("%s: got %d %v, wanted success", name, r.status, r.body)
+	}
+}
+
+// checkError checks a response has the error.
+func checkError(t *testing.T, name string, r testResponse, code string) {
+	if r.body["ok"] != false || r.body["error"] != code {
+		t.Errorf("%s: got %v, wanted error %s", name, r.body, code)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	r := call(t, s, "auth.test", "xoxb-any", nil)
+	checkOK(t, "auth.test", r)
+	if r.body["user_id"] != "UTEST" || r.body["bot_id"] != "BTEST" ||
+		r.body["team_id"] != "TTEST" {
+		t.Errorf("auth.test = %v, wanted our IDs", r.body)
+	}
+
+	r = call(t, s, "chat.postMessage", "xoxb-any",
+		map[string]interface{}{"channel": "C1", "text": "hi"})
+	checkOK(t, "chat.postMessage", r)
+	ts, _ := r.body["ts"].(string)
+	message, _ := r.body["message"].(map[string]interface{})
+	if r.body["channel"] != "C1" || ts == "" || message["ts"] != ts ||
+		message["text"] != "hi" {
+		t.Errorf("chat.postMessage = %v, wanted the message and its ts", r.body)
+	}
+
+	r = call(t, s, "chat.postMessage", "xoxb-any",
+		map[string]interface{}{"channel": "C1", "text": "again"})
+	if r.body["ts"] == ts {
+		t.Errorf("two messages got the same ts %s", ts)
+	}
+
+	checkError(t, "no channel", call(t, s, "chat.postMessage", "xoxb-any",
+		map[string]interface{}{"text": "hi"}), "channel_not_found")
+	checkError(t, "no text", call(t, s, "chat.postMessage", "xoxb-any",
+		map[string]interface{}{"channel": "C1"}), "no_text")
+
+	checkOK(t, "other method", call(t, s, "reactions.add", "xoxb-any", nil))
+}
+
+func TestTokens(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.SetTokens("xoxb-good")
+
+	checkOK(t, "good token", call(t, s, "auth.test", "xoxb-good", nil))
+	checkError(t, "bad token", call(t, s, "auth.test", "xoxb-bad", nil),
+		"invalid_auth")
+	checkError(t, "no token", call(t, s, "auth.test", "", nil), "not_authed")
+
+	// Like Slack, we take the token from the arguments too.
+	req, err := http.NewRequest("POST", s.URL()+"/auth.test",
+		strings.NewReader(url.Values{"token": {"xoxb-good"}}.Encode()))
+	if err != nil {
+		t.Fatalf("error creating request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	checkOK(t, "token in form", do(t, req))
+
+	// We record rejected calls too.
+	calls := s.Calls()
+	if len(calls) != 4 {
+		t.Fatalf("got %d calls, wanted 4", len(calls))
+	}
+	for i, want := range []string{"xoxb-good", "xoxb-bad", "", "xoxb-good"} {
+		if calls[i].Token != want {
+			t.Errorf("call %d token = %q, wanted %q", i, calls[i].Token, want)
+		}
+		if _, ok := calls[i].Args["token"]; ok {
+			t.Errorf("call %d has the token in its args", i)
+		}
+	}
+}
+
+func TestArgs(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	call(t, s, "chat.postMessage", "", map[string]interface{}{
+		"channel": "C1",
+		"text":    "json",
+		"blocks":  []map[string]string{{"type": "section"}},
+		"limit":   5,
+	})
+
+	req, err := http.NewRequest("POST",
+		s.URL()+"/conversations.history?channel=C2",
+		strings.NewReader(url.Values{"limit": {"10"}}.Encode()))
+	if err != nil {
+		t.Fatalf("error creating request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	do(t, req)
+
+	tests := []struct {
+		call  int
+		arg   string
+		value string
+	}{
+		{0, "channel", "C1"},
+		{0, "text", "json"},
+		{0, "blocks", `[{"type":"section"}]`},
+		{0, "limit", "5"},
+		{0, "missing", ""},
+		{1, "channel", "C2"},
+		{1, "limit", "10"},
+	}
+
+	calls := s.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("got %d calls, wanted 2", len(calls))
+	}
+	for _, test := range tests {
+		if got := calls[test.call].Arg(test.arg); got != test.value {
+			t.Errorf("call %d Arg(%s) = %q, wanted %q", test.call, test.arg,
+				got, test.value)
+		}
+	}
+}
+
+func TestScripting(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	// Respond replaces the default for every call.
+	s.Respond("chat.postMessage", Error("is_archived"))
+	for i := 0; i < 2; i++ {
+		checkError(t, "Respond", call(t, s, "chat.postMessage", "",
+			map[string]interface{}{"channel": "C1", "text": "hi"}),
+			"is_archived")
+	}
+
+	// Handle sees the call.
+	s.Handle("conversations.info", func(c Call) Response {
+		return OK(map[string]interface{}{
+			"channel": map[string]string{"id": c.Arg("channel")},
+		})
+	})
+	r := call(t, s, "conversations.info", "",
+		map[string]interface{}{"channel": "C9"})
+	channel, _ := r.body["channel"].(map[string]interface{})
+	if channel["id"] != "C9" {
+		t.Errorf("Handle: got %v, wanted channel C9", r.body)
+	}
+
+	// Queued responses go out once each, in order, before the handler.
+	s.Queue("conversations.info", Error("first"), Error("second"))
+	checkError(t, "first queued", call(t, s, "conversations.info", "", nil),
+		"first")
+	checkError(t, "second queued", call(t, s, "conversations.info", "", nil),
+		"second")
+	r = call(t, s, "conversations.info", "",
+		map[string]interface{}{"channel": "C8"})
+	channel, _ = r.body["channel"].(map[string]interface{})
+	if channel["id"] != "C8" {
+		t.Errorf("after queue: got %v, wanted the handler's response", r.body)
+	}
+
+	// Queued responses are per method.
+	s.Queue("reactions.add", Error("queued"))
+	checkOK(t, "other method", call(t, s, "reactions.remove", "", nil))
+	checkError(t, "queued method", call(t, s, "reactions.add", "", nil),
+		"queued")
+
+	// Bodies may be sent as is.
+	s.Respond("auth.test", Response{
+		Status: http.StatusOK,
+		Body:   `{"ok":true,"user":"raw"}`,
+	})
+	if r := call(t, s, "auth.test", "", nil); r.body["user"] != "raw" {
+		t.Errorf("raw body: got %v, wanted user raw", r.body)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.Queue("chat.postMessage", RateLimited(30*time.Second), OK(nil))
+
+	r := call(t, s, "chat.postMessage", "",
+		map[string]interface{}{"channel": "C1", "text": "hi"})
+	if r.status != http.StatusTooManyRequests {
+		t.Errorf("status = %d, wanted 429", r.status)
+	}
+	if got := r.header.Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, wanted 30", got)
+	}
+	checkError(t, "rate limited", r, "ratelimited")
+
+	checkOK(t, "after rate limit", call(t, s, "chat.postMessage", "",
+		map[string]interface{}{"channel": "C1", "text": "hi"}))
+}
+
+func TestCheckCalls(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	for _, method := range []string{"auth.test", "conversations.join",
+		"chat.postMessage", "conversations.leave"} {
+		call(t, s, method, "", map[string]interface{}{
+			"channel": "C1",
+			"text":    "hi",
+		})
+	}
+
+	tests := []struct {
+		name    string
+		check   func(...string) error
+		methods []string
+		ok      bool
+	}{
+		{"CheckCalls exact", s.CheckCalls, []string{"auth.test",
+			"conversations.join", "chat.postMessage", "conversations.leave"},
+			true},
+		{"CheckCalls missing one", s.CheckCalls, []string{"auth.test",
+			"chat.postMessage", "conversations.leave"}, false},
+		{"CheckCalls wrong order", s.CheckCalls, []string{"auth.test",
+			"chat.postMessage", "conversations.join", "conversations.leave"},
+			false},
+		{"CheckCallOrder with gaps", s.CheckCallOrder, []string{"auth.test",
+			"conversations.leave"}, true},
+		{"CheckCallOrder none", s.CheckCallOrder, nil, true},
+		{"CheckCallOrder wrong order", s.CheckCallOrder, []string{
+			"chat.postMessage", "conversations.join"}, false},
+		{"CheckCallOrder not called", s.CheckCallOrder, []string{
+			"auth.test", "reactions.add"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.check(test.methods...)
+		if test.ok && err != nil {
+			t.Errorf("%s: error: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: succeeded, wanted an error", test.name)
+		}
+	}
+
+	if n := len(s.CallsTo("chat.postMessage")); n != 1 {
+		t.Errorf("CallsTo(chat.postMessage) has %d calls, wanted 1", n)
+	}
+
+	s.Reset()
+	if err := s.CheckCalls(); err != nil {
+		t.Errorf("CheckCalls() after Reset(): %s", err)
+	}
+}
+
+func TestWaitForCall(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	call(t, s, "chat.postMessage", "",
+		map[string]interface{}{"channel": "C1", "text": "one"})
+
+	// Calls before we wait count.
+	c, err := s.WaitForCall("chat.postMessage", 1, testTimeout)
+	if err != nil {
+		t.Fatalf("WaitForCall() error: %s", err)
+	}
+	if c.Arg("text") != "one" {
+		t.Errorf("got call %+v, wanted the first", c)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		call(t, s, "auth.test", "", nil)
+		call(t, s, "chat.postMessage", "",
+			map[string]interface{}{"channel": "C1", "text": "two"})
+	}()
+
+	c, err = s.WaitForCall("chat.postMessage", 2, testTimeout)
+	if err != nil {
+		t.Fatalf("WaitForCall() error: %s", err)
+	}
+	if c.Arg("text") != "two" {
+		t.Errorf("got call %+v, wanted the second", c)
+	}
+
+	if _, err := s.WaitForCall("chat.postMessage", 3,
+		10*time.Millisecond); err == nil {
+		t.Errorf("WaitForCall() of a call that never happens succeeded")
+	}
+}
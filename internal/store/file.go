@@ -0,0 +1,224 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File is a Store that saves to a file so it remembers across restarts.
+//
+// It keeps everything in memory too. Each change rewrites the whole file: we
+// write a new file, sync it to disk, and rename it over the old one. A crash
+// leaves either the old file or the new one, never a partial one. This suits
+// the small amounts of data bots keep. Changes are on disk when they return.
+//
+// The file is JSON: an object keyed by namespace, each an object of keys and
+// values.
+type File struct {
+	mutex  sync.Mutex
+	path   string
+	data   data
+	closed bool
+}
+
+// OpenFile opens a File saving to path. If the file exists, we load what's
+// in it. If not, we start empty and create it on the first change.
+func OpenFile(path string) (*File, error) {
+	f := &File{
+		path: path,
+		data: data{},
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, fmt.Errorf("error reading store: %s", err)
+	}
+
+	if err := json.Unmarshal(buf, &f.data); err != nil {
+		return nil, fmt.Errorf("error decoding store %s: %s", path, err)
+	}
+	if f.data == nil {
+		f.data = data{}
+	}
+
+	return f, nil
+}
+
+// Get returns the value of a key. It returns false if there is no such key.
+func (f *File) Get(namespace, key string) (string, bool, error) {
+	if err := checkKey(namespace, key); err != nil {
+		return "", false, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return "", false, fmt.Errorf("store is closed")
+	}
+
+	value, ok := f.data.get(namespace, key)
+	return value, ok, nil
+}
+
+// Put sets the value of a key.
+func (f *File) Put(namespace, key, value string) error {
+	if err := checkKey(namespace, key); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.update(namespace, key, value, true)
+}
+
+// Delete removes a key.
+func (f *File) Delete(namespace, key string) error {
+	if err := checkKey(namespace, key); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, ok := f.data.get(namespace, key); !ok {
+		return nil
+	}
+	return f.update(namespace, key, "", false)
+}
+
+// List returns the keys in a namespace that start with prefix, sorted.
+func (f *File) List(namespace, prefix string) ([]string, error) {
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return nil, fmt.Errorf("store is closed")
+	}
+
+	return f.data.list(namespace, prefix), nil
+}
+
+// Increment adds delta to the integer value of a key and returns the new
+// value.
+func (f *File) Increment(
+	namespace,
+	key string,
+	delta int64,
+) (int64, error) {
+	if err := checkKey(namespace, key); err != nil {
+		return 0, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	value, n, err := f.data.increment(namespace, key, delta)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.update(namespace, key, value, true); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Close stops the File from being used. Changes are saved already, so there
+// is nothing to flush.
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	return nil
+}
+
+// update changes a key and saves. If ok is false, it removes the key. If we
+// can't save, we undo the change so memory matches the file. The caller must
+// hold the lock.
+func (f *File) update(namespace, key, value string, ok bool) error {
+	if f.closed {
+		return fmt.Errorf("store is closed")
+	}
+
+	oldValue, oldOK := f.data.get(namespace, key)
+	f.data.set(namespace, key, value, ok)
+
+	if err := f.save(); err != nil {
+		f.data.set(namespace, key, oldValue, oldOK)
+		return err
+	}
+
+	// The new file is in place, so we keep the change even if this fails. It
+	// may not survive a crash though.
+	return syncDir(filepath.Dir(f.path))
+}
+
+// save writes the data to a new file and renames it over the old one. The
+// caller must hold the lock.
+func (f *File) save() error {
+	buf, err := json.MarshalIndent(f.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding store: %s", err)
+	}
+
+	dir := filepath.Dir(f.path)
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %s", err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(buf); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("error writing store: %s", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("error syncing store: %s", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("error closing store: %s", err)
+	}
+
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("error replacing store: %s", err)
+	}
+
+	return nil
+}
+
+// syncDir syncs a directory so that renames in it are on disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening store directory: %s", err)
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return fmt.Errorf("error syncing store directory: %s", err)
+	}
+	if err := d.Close(); err != nil {
+		return fmt.Errorf("error closing store directory: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"sync"
+)
+
+// Memory is a Store that keeps everything in memory. It forgets everything
+// when the process exits.
+type Memory struct {
+	mutex sync.Mutex
+	data  data
+}
+
+// NewMemory creates an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{
+		data: data{},
+	}
+}
+
+// Get returns the value of a key. It returns false if there is no such key.
+func (m *Memory) Get(namespace, key string) (string, bool, error) {
+	if err := checkKey(namespace, key); err != nil {
+		return "", false, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	value, ok := m.data.get(namespace, key)
+	return value, ok, nil
+}
+
+// Put sets the value of a key.
+func (m *Memory) Put(namespace, key, value string) error {
+	if err := checkKey(namespace, key); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.data.set(namespace, key, value, true)
+	return nil
+}
+
+// Delete removes a key.
+func (m *Memory) Delete(namespace, key string) error {
+	if err := checkKey(namespace, key); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.data.set(namespace, key, "", false)
+	return nil
+}
+
+// List returns the keys in a namespace that start with prefix, sorted.
+func (m *Memory) List(namespace, prefix string) ([]string, error) {
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.data.list(namespace, prefix), nil
+}
+
+// Increment adds delta to the integer value of a key and returns the new
+// value.
+func (m *Memory) Increment(
+	namespace,
+	key string,
+	delta int64,
+) (int64, error) {
+	if err := checkKey(namespace, key); err != nil {
+		return 0, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	value, n, err := m.data.increment(namespace, key, delta)
+	if err != nil {
+		return 0, err
+	}
+	m.data.set(namespace, key, value, true)
+	return n, nil
+}
+
+// Close does nothing.
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,122 @@
+// Package store provides key-value storage for bots, such as to remember
+// karma counts or reminders.
+//
+// Keys are grouped into namespaces so that different users of a Store don't
+// clash. By convention a namespace is named after what uses it, such as a
+// plugin's name. Values are strings. Store structured values as JSON.
+//
+// There are two implementations: Memory, which forgets everything when the
+// process exits and is useful in tests, and File, which saves to a file and
+// remembers across restarts.
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Store is namespaced key-value storage. It's safe to use concurrently.
+type Store interface {
+	// Get returns the value of a key. It returns false if there is no such
+	// key.
+	Get(namespace, key string) (string, bool, error)
+
+	// Put sets the value of a key.
+	Put(namespace, key, value string) error
+
+	// Delete removes a key. It's not an error if there is no such key.
+	Delete(namespace, key string) error
+
+	// List returns the keys in a namespace that start with prefix, sorted.
+	// prefix may be blank to list all of them.
+	List(namespace, prefix string) ([]string, error)
+
+	// Increment adds delta to the integer value of a key and returns the new
+	// value. A key that doesn't exist counts as 0. It's atomic: concurrent
+	// increments don't lose updates.
+	Increment(namespace, key string, delta int64) (int64, error)
+
+	// Close releases the Store's resources. Don't use it afterwards.
+	Close() error
+}
+
+// data holds a Store's keys and values, keyed by namespace and then key.
+//
+// It's not safe to use concurrently. Implementations guard it with a lock.
+type data map[string]map[string]string
+
+// get returns the value of a key.
+func (d data) get(namespace, key string) (string, bool) {
+	value, ok := d[namespace][key]
+	return value, ok
+}
+
+// set sets the value of a key. If ok is false, it removes the key instead.
+func (d data) set(namespace, key, value string, ok bool) {
+	if !ok {
+		delete(d[namespace], key)
+		if len(d[namespace]) == 0 {
+			delete(d, namespace)
+		}
+		return
+	}
+
+	if d[namespace] == nil {
+		d[namespace] = map[string]string{}
+	}
+	d[namespace][key] = value
+}
+
+// list returns the keys in a namespace starting with prefix, sorted.
+func (d data) list(namespace, prefix string) []string {
+	keys := []string{}
+	for key := range d[namespace] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// increment returns the value of a key plus delta, as a string and an
+// integer. It doesn't change the key.
+func (d data) increment(
+	namespace,
+	key string,
+	delta int64,
+) (string, int64, error) {
+	var n int64
+	if value, ok := d.get(namespace, key); ok {
+		var err error
+		n, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("value of %s in %s is not an integer: %s",
+				key, namespace, value)
+		}
+	}
+
+	n += delta
+	return strconv.FormatInt(n, 10), n, nil
+}
+
+// checkKey checks a namespace and key are valid. Neither may be blank.
+func checkKey(namespace, key string) error {
+	if err := checkNamespace(namespace); err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("key must not be blank")
+	}
+	return nil
+}
+
+// checkNamespace checks a namespace is valid. It may not be blank.
+func checkNamespace(namespace string) error {
+	if namespace == "" {
+		return fmt.Errorf("namespace must not be blank")
+	}
+	return nil
+}
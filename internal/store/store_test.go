@@ -0,0 +1,286 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testStore is a Store we run the shared tests against.
+type testStore struct {
+	name string
+
+	// open creates an empty Store. Call the cleanup function when done.
+	open func(t *testing.T) (Store, func())
+}
+
+// testStores returns each implementation.
+func testStores() []testStore {
+	return []testStore{
+		{
+			"memory",
+			func(t *testing.T) (Store, func()) {
+				return NewMemory(), func() {}
+			},
+		},
+		{
+			"file",
+			func(t *testing.T) (Store, func()) {
+				dir, err := ioutil.TempDir("", "store")
+				if err != nil {
+					t.Fatalf("error creating directory: %s", err)
+				}
+				f, err := OpenFile(filepath.Join(dir, "store.json"))
+				if err != nil {
+					t.Fatalf("OpenFile() error: %s", err)
+				}
+				return f, func() { _ = os.RemoveAll(dir) }
+			},
+		},
+	}
+}
+
+// mustPut puts a key or fails the test.
+func mustPut(t *testing.T, s Store, namespace, key, value string) {
+	if err := s.Put(namespace, key, value); err != nil {
+		t.Fatalf("Put(%s, %s) error: %s", namespace, key, err)
+	}
+}
+
+// checkGet checks the value of a key. If wantOK is false, checks there's no
+// such key.
+func checkGet(
+	t *testing.T,
+	name string,
+	s Store,
+	namespace,
+	key,
+	want string,
+	wantOK bool,
+) {
+	value, ok, err := s.Get(namespace, key)
+	if err != nil {
+		t.Errorf("%s: Get(%s, %s) error: %s", name, namespace, key, err)
+		return
+	}
+	if ok != wantOK || value != want {
+		t.Errorf("%s: Get(%s, %s) = %q, %v, wanted %q, %v", name, namespace,
+			key, value, ok, want, wantOK)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	for _, ts := range testStores() {
+		s, cleanup := ts.open(t)
+
+		mustPut(t, s, "karma", "coffee", "1")
+		mustPut(t, s, "remind", "coffee", "at 3")
+
+		checkGet(t, ts.name, s, "karma", "coffee", "1", true)
+		checkGet(t, ts.name, s, "remind", "coffee", "at 3", true)
+		checkGet(t, ts.name, s, "other", "coffee", "", false)
+
+		if err := s.Delete("karma", "coffee"); err != nil {
+			t.Errorf("%s: Delete() error: %s", ts.name, err)
+		}
+		checkGet(t, ts.name, s, "karma", "coffee", "", false)
+		checkGet(t, ts.name, s, "remind", "coffee", "at 3", true)
+
+		// Deleting what isn't there is fine.
+		if err := s.Delete("karma", "coffee"); err != nil {
+			t.Errorf("%s: Delete() of missing key error: %s", ts.name, err)
+		}
+
+		if err := s.Put("", "coffee", "1"); err == nil {
+			t.Errorf("%s: Put() with blank namespace succeeded", ts.name)
+		}
+		if err := s.Put("karma", "", "1"); err == nil {
+			t.Errorf("%s: Put() with blank key succeeded", ts.name)
+		}
+
+		_ = s.Close()
+		cleanup()
+	}
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		namespace string
+		prefix    string
+		output    []string
+	}{
+		{"a", "", []string{"bar", "baz", "foo"}},
+		{"a", "ba", []string{"bar", "baz"}},
+		{"a", "baz", []string{"baz"}},
+		{"a", "nope", []string{}},
+		{"b", "", []string{"bat"}},
+		{"c", "", []string{}},
+	}
+
+	for _, ts := range testStores() {
+		s, cleanup := ts.open(t)
+
+		mustPut(t, s, "a", "foo", "1")
+		mustPut(t, s, "a", "baz", "2")
+		mustPut(t, s, "a", "bar", "3")
+		mustPut(t, s, "b", "bat", "4")
+
+		for _, test := range tests {
+			keys, err := s.List(test.namespace, test.prefix)
+			if err != nil {
+				t.Errorf("%s: List(%s, %q) error: %s", ts.name, test.namespace,
+					test.prefix, err)
+				continue
+			}
+			if !reflect.DeepEqual(keys, test.output) {
+				t.Errorf("%s: List(%s, %q) = %q, wanted %q", ts.name,
+					test.namespace, test.prefix, keys, test.output)
+			}
+		}
+
+		_ = s.Close()
+		cleanup()
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	for _, ts := range testStores() {
+		s, cleanup := ts.open(t)
+
+		// A missing key counts as 0.
+		n, err := s.Increment("karma", "coffee", 1)
+		if err != nil || n != 1 {
+			t.Errorf("%s: Increment() of missing key = %d, %v, wanted 1",
+				ts.name, n, err)
+		}
+
+		n, err = s.Increment("karma", "coffee", -3)
+		if err != nil || n != -2 {
+			t.Errorf("%s: Increment() = %d, %v, wanted -2", ts.name, n, err)
+		}
+		checkGet(t, ts.name, s, "karma", "coffee", "-2", true)
+
+		// We can't increment what isn't an integer, and we leave it alone.
+		mustPut(t, s, "karma", "tea", "lots")
+		_, err = s.Increment("karma", "tea", 1)
+		if err == nil || !strings.Contains(err.Error(), "not an integer") {
+			t.Errorf("%s: Increment() of non-integer error = %v, wanted not an "+
+				"integer", ts.name, err)
+		}
+		checkGet(t, ts.name, s, "karma", "tea", "lots", true)
+
+		_ = s.Close()
+		cleanup()
+	}
+}
+
+func TestIncrementConcurrently(t *testing.T) {
+	const goroutines = 10
+	const increments = 20
+
+	for _, ts := range testStores() {
+		s, cleanup := ts.open(t)
+
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < increments; j++ {
+					_, err := s.Increment("karma", "coffee", 1)
+					if err != nil {
+						t.Errorf("%s: Increment() error: %s", ts.name, err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		checkGet(t, ts.name, s, "karma", "coffee", "200", true)
+
+		_ = s.Close()
+		cleanup()
+	}
+}
+
+func TestFilePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "store.json")
+
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile() error: %s", err)
+	}
+
+	// We don't create the file until there's a change.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("store file exists before any change: %v", err)
+	}
+
+	mustPut(t, f, "karma", "coffee", "1")
+	mustPut(t, f, "karma", "tea", "2")
+	mustPut(t, f, "remind", "coffee", "at 3")
+	if err := f.Delete("karma", "tea"); err != nil {
+		t.Fatalf("Delete() error: %s", err)
+	}
+	if _, err := f.Increment("karma", "coffee", 4); err != nil {
+		t.Fatalf("Increment() error: %s", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error: %s", err)
+	}
+	if err := f.Put("karma", "coffee", "0"); err == nil {
+		t.Errorf("Put() after Close() succeeded")
+	}
+
+	f, err = OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile() error reopening: %s", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	checkGet(t, "reopened", f, "karma", "coffee", "5", true)
+	checkGet(t, "reopened", f, "karma", "tea", "", false)
+	checkGet(t, "reopened", f, "remind", "coffee", "at 3", true)
+
+	// We replace the file by renaming, so no temporary files are left.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("error reading directory: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "store.json" {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory has %q, wanted only store.json", names)
+	}
+}
+
+func TestOpenFileInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "store.json")
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatalf("error writing file: %s", err)
+	}
+
+	if _, err := OpenFile(path); err == nil {
+		t.Errorf("OpenFile() of invalid JSON succeeded")
+	}
+}
@@ -0,0 +1,531 @@
+// Package websocket is a small implementation of the WebSocket protocol
+// (RFC 6455). It has what we need for Slack's Socket Mode: Dialing and
+// accepting connections, and sending and receiving text messages.
+//
+// It does not support extensions such as compression.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types (opcodes).
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// Close status codes.
+const (
+	CloseNormal       = 1000
+	CloseGoingAway    = 1001
+	CloseProtocol     = 1002
+	CloseTooBig       = 1009
+	closeNoStatus     = 1005
+	maxControlPayload = 125
+)
+
+// MaxMessageSize is the largest message we read. Larger messages are an
+// error.
+var MaxMessageSize = 16 * 1024 * 1024
+
+// writeTimeout is how long we wait to write a frame. If the peer stops
+// reading, writes fail rather than blocking forever.
+var writeTimeout = time.Minute
+
+// handshakeGUID is what the protocol says to combine with the client's key to
+// create the accept header.
+const handshakeGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrClosed is the error ReadMessage returns when the peer closes the
+// connection normally.
+var ErrClosed = errors.New("websocket closed")
+
+// CloseError is the error ReadMessage returns when the peer closes the
+// connection with a status other than a normal one.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (c CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", c.Code, c.Reason)
+}
+
+// Conn is a WebSocket connection.
+//
+// One goroutine may read at a time. Writing is safe from any goroutine.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// Clients mask the frames they send. Servers don't.
+	client bool
+
+	writeMutex sync.Mutex
+
+	// Whether we sent a close frame.
+	closeSent bool
+
+	// If set, reading fails if we go this long without receiving a frame.
+	idleTimeout time.Duration
+}
+
+// Dial connects to a WebSocket server. The URL's scheme is ws or wss. header
+// holds extra headers to send with the handshake and may be nil.
+func Dial(rawURL string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", err)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host,
+			&tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting: %s", err)
+	}
+
+	c, err := clientHandshake(conn, u, header)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// clientHandshake sends the opening handshake and checks the server's
+// response.
+func clientHandshake(
+	conn net.Conn,
+	u *url.URL,
+	header http.Header,
+) (*Conn, error) {
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return nil, fmt.Errorf("error generating key: %s", err)
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+		return nil, fmt.Errorf("error setting deadline: %s", err)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("error sending handshake: %s", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("error reading handshake response: %s", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("handshake failed: HTTP %d", resp.StatusCode)
+	}
+
+	if !headerContains(resp.Header, "Upgrade", "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") {
+		return nil, fmt.Errorf("handshake failed: server did not upgrade")
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("handshake failed: invalid accept key")
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("error clearing deadline: %s", err)
+	}
+
+	return &Conn{conn: conn, br: br, client: true}, nil
+}
+
+// Upgrade turns an HTTP request into a WebSocket connection. If it fails, it
+// responds to the request with an error.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("invalid request method: %s", r.Method)
+	}
+
+	if !headerContains(r.Header, "Upgrade", "websocket") ||
+		!headerContains(r.Header, "Connection", "upgrade") {
+		http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a websocket handshake")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported version", http.StatusBadRequest)
+		return nil, fmt.Errorf("unsupported websocket version: %s",
+			r.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return nil, fmt.Errorf("missing websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("error hijacking connection: %s", err)
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("error writing handshake response: %s", err)
+	}
+	if err := rw.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("error writing handshake response: %s", err)
+	}
+
+	return &Conn{conn: conn, br: rw.Reader}, nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value for a key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	_, _ = h.Write([]byte(key + handshakeGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains returns whether the header has the token in its
+// comma-separated list of values, ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage reads the next text or binary message.
+//
+// We answer pings with pongs and ignore pongs. If the peer closes the
+// connection, we reply with a close frame and return ErrClosed or a
+// CloseError.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	var message []byte
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case PingMessage:
+			if err := c.writeFrame(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(payload)
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocol, "expected continuation frame")
+			}
+			messageType = opcode
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocol, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocol,
+				fmt.Sprintf("unknown opcode %d", opcode))
+		}
+
+		if len(message)+len(payload) > MaxMessageSize {
+			return 0, nil, c.fail(CloseTooBig, "message too big")
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame.
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	if c.idleTimeout > 0 {
+		if err := c.conn.SetReadDeadline(
+			time.Now().Add(c.idleTimeout)); err != nil {
+			return false, 0, nil, fmt.Errorf("error setting deadline: %s", err)
+		}
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocol, "reserved bits set")
+	}
+	opcode := int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	// Clients must mask frames. Servers must not.
+	if masked == c.client {
+		return false, 0, nil, c.fail(CloseProtocol, "invalid masking")
+	}
+
+	switch length {
+	case 126:
+		var buf [2]byte
+		if _, err := io.ReadFull(c.br, buf[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(buf[:]))
+	case 127:
+		var buf [8]byte
+		if _, err := io.ReadFull(c.br, buf[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(buf[:])
+	}
+
+	isControl := opcode&0x08 != 0
+	if isControl && (length > maxControlPayload || !fin) {
+		return false, 0, nil, c.fail(CloseProtocol, "invalid control frame")
+	}
+
+	if length > uint64(MaxMessageSize) {
+		return false, 0, nil, c.fail(CloseTooBig, "frame too big")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// handleClose responds to a close frame from the peer.
+func (c *Conn) handleClose(payload []byte) error {
+	code := closeNoStatus
+	reason := ""
+	if len(payload) >= 2 {
+		code = int(binary.BigEndian.Uint16(payload[:2]))
+		reason = string(payload[2:])
+	}
+
+	// Echo the close back if we didn't start closing.
+	_ = c.WriteClose(CloseNormal, "")
+
+	if code == CloseNormal || code == closeNoStatus {
+		return ErrClosed
+	}
+	return CloseError{Code: code, Reason: reason}
+}
+
+// fail closes the connection because the peer broke the protocol.
+func (c *Conn) fail(code int, reason string) error {
+	_ = c.WriteClose(code, reason)
+	_ = c.conn.Close()
+	return fmt.Errorf("websocket protocol error: %s", reason)
+}
+
+// WriteMessage sends a text or binary message.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("invalid message type: %d", messageType)
+	}
+	return c.writeFrame(messageType, data)
+}
+
+// WritePing sends a ping.
+func (c *Conn) WritePing(data []byte) error {
+	return c.writeFrame(PingMessage, data)
+}
+
+// WriteClose sends a close frame. The peer should reply with one of its own
+// and close the connection.
+func (c *Conn) WriteClose(code int, reason string) error {
+	c.writeMutex.Lock()
+	sent := c.closeSent
+	c.closeSent = true
+	c.writeMutex.Unlock()
+
+	if sent {
+		return nil
+	}
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+
+	return c.writeFrameLocked(CloseMessage, payload, true)
+}
+
+// writeFrame sends a single frame holding the payload.
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	return c.writeFrameLocked(opcode, payload, false)
+}
+
+// writeFrameLocked sends a frame. Unless force is true, we don't send frames
+// after we sent a close frame.
+func (c *Conn) writeFrameLocked(opcode int, payload []byte, force bool) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closeSent && !force {
+		return fmt.Errorf("websocket is closing")
+	}
+
+	frame := []byte{0x80 | byte(opcode)}
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return fmt.Errorf("error generating mask: %s", err)
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return fmt.Errorf("error setting write deadline: %s", err)
+	}
+
+	if _, err := c.conn.Write(frame); err != nil {
+		return fmt.Errorf("error writing frame: %s", err)
+	}
+
+	return nil
+}
+
+// SetIdleTimeout makes ReadMessage fail if we go this long without receiving
+// any frame, including pings and pongs. Sending pings more often than this
+// keeps a healthy connection open. Zero means no timeout.
+//
+// Call it before reading.
+func (c *Conn) SetIdleTimeout(d time.Duration) {
+	c.idleTimeout = d
+}
+
+// Close closes the connection without a closing handshake. To close cleanly,
+// call WriteClose first and wait for ReadMessage to return.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,564 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestConns creates a connected pair of Conns over TCP. The first is the
+// client.
+func newTestConns(t *testing.T) (*Conn, *Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %s", err)
+	}
+
+	return &Conn{conn: client, br: bufio.NewReader(client), client: true},
+		&Conn{conn: server, br: bufio.NewReader(server)}
+}
+
+// writeRawFrame writes a frame to c's connection as is. Unlike writeFrame, it
+// lets us send fragments and frames that break the protocol.
+func writeRawFrame(
+	t *testing.T,
+	c *Conn,
+	fin bool,
+	opcode int,
+	payload []byte,
+	masked bool,
+) {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+}
+
+// readCloseCode reads a frame and returns the status code if it's a close
+// frame.
+func readCloseCode(t *testing.T, c *Conn) int {
+	_, opcode, payload, err := c.readFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if opcode != CloseMessage || len(payload) < 2 {
+		t.Fatalf("got opcode %d payload %q, wanted a close frame", opcode,
+			payload)
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func TestHandshake(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/socket" || r.URL.RawQuery != "a=1" ||
+				r.Header.Get("Authorization") != "Bearer x" {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+
+			conn, err := Upgrade(w, r)
+			if err != nil {
+				return
+			}
+			defer func() {
+				_ = conn.Close()
+			}()
+
+			// Echo messages until the client closes.
+			for {
+				messageType, message, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := conn.WriteMessage(messageType, message); err != nil {
+					return
+				}
+			}
+		}))
+	defer server.Close()
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/socket?a=1"
+
+	conn, err := Dial(u, http.Header{"Authorization": {"Bearer x"}})
+	if err != nil {
+		t.Fatalf("Dial() = %s", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	for _, messageType := range []int{TextMessage, BinaryMessage} {
+		if err := conn.WriteMessage(messageType, []byte("hi")); err != nil {
+			t.Fatalf("WriteMessage() = %s", err)
+		}
+		gotType, message, err := conn.ReadMessage()
+		if err != nil || gotType != messageType || string(message) != "hi" {
+			t.Errorf("ReadMessage() = %d, %q, %v, wanted %d, hi", gotType,
+				message, err, messageType)
+		}
+	}
+
+	if err := conn.WriteClose(CloseNormal, ""); err != nil {
+		t.Fatalf("WriteClose() = %s", err)
+	}
+	if _, _, err := conn.ReadMessage(); err != ErrClosed {
+		t.Errorf("ReadMessage() = %v, wanted %s", err, ErrClosed)
+	}
+
+	// The server wants the headers we gave.
+	if _, err := Dial(u, nil); err == nil {
+		t.Errorf("Dial() succeeded without headers, wanted an error")
+	}
+
+	// A server that doesn't speak WebSocket.
+	plain := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	if _, err := Dial("ws"+strings.TrimPrefix(plain.URL, "http"),
+		nil); err == nil {
+		t.Errorf("Dial() to a plain HTTP server succeeded, wanted an error")
+	}
+
+	if _, err := Dial("http"+strings.TrimPrefix(server.URL, "http"),
+		nil); err == nil {
+		t.Errorf("Dial() with an http URL succeeded, wanted an error")
+	}
+}
+
+func TestUpgradeErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if conn, err := Upgrade(w, r); err == nil {
+				_ = conn.Close()
+			}
+		}))
+	defer server.Close()
+
+	valid := http.Header{
+		"Upgrade":               {"websocket"},
+		"Connection":            {"keep-alive, Upgrade"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+		"Sec-Websocket-Version": {"13"},
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		value  string
+		status int
+	}{
+		{"valid", "GET", "", "", http.StatusSwitchingProtocols},
+		{"POST", "POST", "", "", http.StatusMethodNotAllowed},
+		{"no upgrade", "GET", "Upgrade", "", http.StatusBadRequest},
+		{"no connection upgrade", "GET", "Connection", "keep-alive",
+			http.StatusBadRequest},
+		{"old version", "GET", "Sec-Websocket-Version", "8",
+			http.StatusBadRequest},
+		{"no key", "GET", "Sec-Websocket-Key", "", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL, nil)
+		if err != nil {
+			t.Fatalf("error creating request: %s", err)
+		}
+		for k, v := range valid {
+			req.Header[k] = v
+		}
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: error sending request: %s", test.name, err)
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got %d, wanted %d", test.name, resp.StatusCode,
+				test.status)
+		}
+
+		if test.status == http.StatusSwitchingProtocols &&
+			resp.Header.Get("Sec-WebSocket-Accept") !=
+				"s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Errorf("%s: got accept key %s", test.name,
+				resp.Header.Get("Sec-WebSocket-Accept"))
+		}
+	}
+}
+
+// Frames from clients are masked. Frames from servers aren't. Each uses the
+// smallest length encoding that fits.
+func TestWriteFrame(t *testing.T) {
+	client, server := newTestConns(t)
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	tests := []struct {
+		length       int
+		lengthHeader int
+	}{
+		{0, 0},
+		{125, 0},
+		{126, 2},
+		{0xffff, 2},
+		{0x10000, 8},
+	}
+
+	for _, c := range []*Conn{client, server} {
+		peer := server
+		if c == server {
+			peer = client
+		}
+
+		for _, test := range tests {
+			payload := bytes.Repeat([]byte("x"), test.length)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- c.WriteMessage(TextMessage, payload)
+			}()
+
+			// Look at the header and leave the frame for the peer to read.
+			header, err := peer.br.Peek(2)
+			if err != nil {
+				t.Fatalf("error reading frame: %s", err)
+			}
+
+			if header[0] != 0x80|TextMessage {
+				t.Errorf("client %t length %d: first byte %#x, wanted %#x",
+					c.client, test.length, header[0], 0x80|TextMessage)
+			}
+			if masked := header[1]&0x80 != 0; masked != c.client {
+				t.Errorf("client %t length %d: masked %t", c.client,
+					test.length, masked)
+			}
+
+			lengthHeader := 0
+			switch header[1] & 0x7f {
+			case 126:
+				lengthHeader = 2
+			case 127:
+				lengthHeader = 8
+			}
+			if lengthHeader != test.lengthHeader {
+				t.Errorf("client %t length %d: got %d length bytes, wanted %d",
+					c.client, test.length, lengthHeader, test.lengthHeader)
+			}
+
+			_, message, err := peer.ReadMessage()
+			if err != nil || !bytes.Equal(message, payload) {
+				t.Errorf("client %t length %d: ReadMessage() = %d bytes, %v",
+					c.client, test.length, len(message), err)
+			}
+
+			if err := <-done; err != nil {
+				t.Errorf("WriteMessage() = %s", err)
+			}
+		}
+	}
+}
+
+// A message may arrive in fragments with control frames between them. We
+// answer pings and ignore pongs along the way.
+func TestReadFragmented(t *testing.T) {
+	client, server := newTestConns(t)
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	writeRawFrame(t, client, false, TextMessage, []byte("Hel"), true)
+	writeRawFrame(t, client, true, PingMessage, []byte("are you there"), true)
+	writeRawFrame(t, client, false, continuationFrame, []byte("lo, "), true)
+	writeRawFrame(t, client, true, PongMessage, []byte("ignored"), true)
+	writeRawFrame(t, client, true, continuationFrame, []byte("world"), true)
+	writeRawFrame(t, client, true, BinaryMessage, []byte{0, 1}, true)
+
+	messageType, message, err := server.ReadMessage()
+	if err != nil || messageType != TextMessage ||
+		string(message) != "Hello, world" {
+		t.Errorf("ReadMessage() = %d, %q, %v, wanted text Hello, world",
+			messageType, message, err)
+	}
+
+	messageType, message, err = server.ReadMessage()
+	if err != nil || messageType != BinaryMessage ||
+		!bytes.Equal(message, []byte{0, 1}) {
+		t.Errorf("ReadMessage() = %d, %q, %v, wanted binary 0 1", messageType,
+			message, err)
+	}
+
+	fin, opcode, payload, err := client.readFrame()
+	if err != nil || !fin || opcode != PongMessage ||
+		string(payload) != "are you there" {
+		t.Errorf("got %t %d %q %v, wanted a pong", fin, opcode, payload, err)
+	}
+}
+
+// When the peer breaks the protocol we send a close frame with a status
+// saying why and close the connection.
+func TestReadProtocolErrors(t *testing.T) {
+	type frame struct {
+		fin     bool
+		opcode  int
+		payload []byte
+		masked  bool
+	}
+
+	oldMax := MaxMessageSize
+	MaxMessageSize = 1024
+	defer func() {
+		MaxMessageSize = oldMax
+	}()
+
+	big := bytes.Repeat([]byte("x"), 600)
+
+	tests := []struct {
+		name   string
+		frames []frame
+		code   int
+	}{
+		{"unmasked", []frame{{true, TextMessage, []byte("hi"), false}},
+			CloseProtocol},
+		{"reserved bits", []frame{{true, TextMessage | 0x40, []byte("hi"),
+			true}}, CloseProtocol},
+		{"unknown opcode", []frame{{true, 3, []byte("hi"), true}},
+			CloseProtocol},
+		{"continuation first", []frame{{true, continuationFrame,
+			[]byte("hi"), true}}, CloseProtocol},
+		{"new message mid-fragment", []frame{
+			{false, TextMessage, []byte("a"), true},
+			{true, TextMessage, []byte("b"), true},
+		}, CloseProtocol},
+		{"fragmented ping", []frame{{false, PingMessage, []byte("hi"), true}},
+			CloseProtocol},
+		{"long ping", []frame{{true, PingMessage,
+			bytes.Repeat([]byte("x"), maxControlPayload+1), true}},
+			CloseProtocol},
+		{"frame too big", []frame{{true, BinaryMessage,
+			bytes.Repeat([]byte("x"), 1025), true}}, CloseTooBig},
+		{"message too big", []frame{
+			{false, TextMessage, big, true},
+			{true, continuationFrame, big, true},
+		}, CloseTooBig},
+	}
+
+	for _, test := range tests {
+		client, server := newTestConns(t)
+
+		for _, f := range test.frames {
+			writeRawFrame(t, client, f.fin, f.opcode, f.payload, f.masked)
+		}
+
+		if _, _, err := server.ReadMessage(); err == nil {
+			t.Errorf("%s: ReadMessage() succeeded, wanted an error", test.name)
+		}
+
+		if code := readCloseCode(t, client); code != test.code {
+			t.Errorf("%s: got close status %d, wanted %d", test.name, code,
+				test.code)
+		}
+
+		// The server closed the connection.
+		if _, _, _, err := client.readFrame(); err == nil {
+			t.Errorf("%s: connection still open", test.name)
+		}
+
+		_ = client.Close()
+	}
+
+	// Servers must not mask.
+	client, server := newTestConns(t)
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	writeRawFrame(t, server, true, TextMessage, []byte("hi"), true)
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage() of a masked frame succeeded, wanted an error")
+	}
+}
+
+func TestClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		err     error
+	}{
+		{"normal", []byte{0x03, 0xe8}, ErrClosed},
+		{"no status", nil, ErrClosed},
+		{"going away", append([]byte{0x03, 0xe9}, "bye"...),
+			CloseError{Code: CloseGoingAway, Reason: "bye"}},
+	}
+
+	for _, test := range tests {
+		client, server := newTestConns(t)
+
+		writeRawFrame(t, client, true, CloseMessage, test.payload, true)
+
+		if _, _, err := server.ReadMessage(); err != test.err {
+			t.Errorf("%s: ReadMessage() = %v, wanted %v", test.name, err,
+				test.err)
+		}
+
+		// The server echoes the close and then sends nothing more.
+		if code := readCloseCode(t, client); code != CloseNormal {
+			t.Errorf("%s: got close status %d, wanted %d", test.name, code,
+				CloseNormal)
+		}
+
+		if err := server.WriteMessage(TextMessage, []byte("hi")); err == nil {
+			t.Errorf("%s: WriteMessage() after close succeeded", test.name)
+		}
+
+		_ = client.Close()
+		_ = server.Close()
+	}
+
+	// When we start closing, we send one close frame and wait for the peer's.
+	client, server := newTestConns(t)
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	if err := client.WriteClose(CloseGoingAway, "bye"); err != nil {
+		t.Fatalf("WriteClose() = %s", err)
+	}
+	if err := client.WriteClose(CloseNormal, ""); err != nil {
+		t.Fatalf("WriteClose() = %s", err)
+	}
+
+	_, _, err := server.ReadMessage()
+	if err != (CloseError{Code: CloseGoingAway, Reason: "bye"}) {
+		t.Errorf("ReadMessage() = %v, wanted going away", err)
+	}
+
+	if _, _, err := client.ReadMessage(); err != ErrClosed {
+		t.Errorf("ReadMessage() = %v, wanted %s", err, ErrClosed)
+	}
+
+	// We sent only the one close frame, so the server sees nothing more.
+	_ = client.Close()
+	if _, _, _, err := server.readFrame(); err == nil {
+		t.Errorf("got a second close frame")
+	}
+}
+
+// A peer that stops reading can't block writes forever.
+func TestWriteTimeout(t *testing.T) {
+	oldTimeout := writeTimeout
+	writeTimeout = 50 * time.Millisecond
+	defer func() {
+		writeTimeout = oldTimeout
+	}()
+
+	ours, theirs := net.Pipe()
+	defer func() {
+		_ = ours.Close()
+		_ = theirs.Close()
+	}()
+
+	c := &Conn{conn: ours, br: bufio.NewReader(ours)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WriteMessage(TextMessage, []byte("hi"))
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("WriteMessage() succeeded, wanted a timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WriteMessage() did not time out")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	client, server := newTestConns(t)
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	server.SetIdleTimeout(200 * time.Millisecond)
+
+	// Any frame counts as activity.
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(50 * time.Millisecond)
+			_ = client.WritePing(nil)
+		}
+		_ = client.WriteMessage(TextMessage, []byte("hi"))
+	}()
+
+	if _, message, err := server.ReadMessage(); err != nil ||
+		string(message) != "hi" {
+		t.Errorf("ReadMessage() = %q, %v, wanted hi", message, err)
+	}
+
+	if _, _, err := server.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage() succeeded, wanted a timeout")
+	}
+}